@@ -9,7 +9,11 @@
 
 package base
 
-const NumberOfVbuckets = 1024
+import (
+	"errors"
+	"time"
+)
+
 const DcpHandlerChanSize = 100000
 const FileNamePrefix = "diffTool"
 const FileNameDelimiter = "_"
@@ -24,6 +28,37 @@ const SourceFileDir = "source"
 const TargetFileDir = "target"
 const CheckpointFileDir = "checkpoint"
 const FileDifferDir = "fileDiff"
+const KeyHashPartitionDir = "keyHashPartitions"
+const KeyHashPartitionBufferCapacity = 16384
+const KeyHashPartitionMinBufferCapacity = 1024
+
+// memory that the buffers of all the key hash partitions share when there is no memory budget
+const KeyHashPartitionMemoryBudget = 64 * 1024 * 1024
+
+// key hash partitions are named like vbuckets, which are uint16
+const MaxNumberOfKeyHashPartitions = 65536
+
+// external sort of the file differ
+const ExternalSortSpillDir = "sortSpill"
+const ExternalSortSpillDirPrefix = "sort"
+const ExternalSortMergedFileName = "merged"
+const ExternalSortIOBufferSize = 65536
+
+// least number of runs that the external sort merges at once, whatever its memory budget
+const ExternalSortMinFanIn = 2
+
+// read buffer of each sorted run being merged by the file differ
+const SortedRunReadBufferSize = 4096
+
+// estimated memory used by a record being sorted, on top of its serialized bytes
+const ExternalSortRecordOverhead = 64
+
+// least memory budget of each file differ worker, below which the sort spills so many runs that merging them takes many passes
+const ExternalSortMinWorkerMemoryBudget = 4 * 1024 * 1024
+
+// diff details of each bin, as the file differ spills them when it sorts on disk
+const DiffDetailsBinDir = "diffDetailsBins"
+const DiffDetailsSpillDirPrefix = "details"
 const MutationDifferDir = "mutationDiff"
 const DiffKeysFileName = "diffKeys"
 const DiffDetailsFileName = "diffDetails"
@@ -32,15 +67,147 @@ const MutationDiffFileName = "mutationDiffDetails"
 const MutationDiffColIdMapping = "mutationDiffColIdMapping"
 const MutationDiffMigrationDetails = "mutationMigrationDetails"
 const DiffErrorKeysFileName = "diffKeysWithError"
+const MutationDiffExplainedFileName = "mutationDiffExplained"
+
+// dir under the mutation differ dir where the differences are kept until the diff details are written
+const MutationDiffStoreDir = "diffStore"
+const MutationDiffStoreBufferSize = 65536
+
+// The results of each kind in the store are deduplicated into a dir of their own, with a file per collection, before
+// they are read, in parts of at most MutationDiffStoreDedupPartSize bytes, so that only the lines of one part are held
+// in memory at a time
+const MutationDiffStoreDedupPartSize = 64 * 1024 * 1024
+const MutationDiffStoreDedupSuffix = ".dedup"
+const MutationDiffStorePartSuffix = ".part"
+
+// dir under the mutation differ dir where the explained diffs are kept, which are not fetched again by retries
+const MutationDiffExplainedStoreDir = "explainedStore"
+
+// dir under the mutation differ dir where what each round of retries observed of the keys is kept
+const MutationDiffHistoryStoreDir = "historyStore"
+
+// progress of the mutation differ that a restart resumes from, and the fetch list of the round it is in
+const MutationDiffCheckpointFileName = "mutationDiffCheckpoint"
+const MutationDiffFetchListFileName = "mutationDiffFetchList"
+const MutationDiffCheckpointVersion = 3
+
+// interval for periodically saving the mutation differ checkpoint, in seconds
+const MutationDiffCheckpointInterval = 30
+const TempFileSuffix = ".tmp"
+
+const MismatchHistogramFileName = "mismatchHistogram"
+
+// fields of a doc that the differs tell apart when its source and target versions are mismatched. The body is
+// compared by its hash by the file differ, which also covers the xattrs that are compared unless xattrs are compared
+// by key. Otherwise, xattrs differ when only one of the versions has any
+const (
+	DiffFieldBody     = "Body"
+	DiffFieldRevId    = "RevId"
+	DiffFieldCas      = "Cas"
+	DiffFieldFlags    = "Flags"
+	DiffFieldExpiry   = "Expiry"
+	DiffFieldDatatype = "Datatype"
+	DiffFieldXattrs   = "Xattrs"
+	DiffFieldHLV      = "HLV"
+)
+
+var DiffFields = []string{DiffFieldBody, DiffFieldRevId, DiffFieldCas, DiffFieldFlags, DiffFieldExpiry, DiffFieldDatatype, DiffFieldXattrs, DiffFieldHLV}
+
+// outcomes of a key in a retry of the mutation differ besides the kinds of differences, and how the keys that were
+// retried are classified by the last of them
+const (
+	RetryOutcomeConverged               = "Converged"
+	RetryOutcomeExplained               = "Explained"
+	RetryClassificationConverged        = "Converged"
+	RetryClassificationActivelyChanging = "ActivelyChanging"
+	RetryClassificationDiverged         = "Diverged"
+)
+
+// settings of a replication, by the names that XDCR exposes them by, that make it skip some of the mutations of the
+// source on purpose, which explains the differences that they cause
+const (
+	ReplicationSettingFilterExpression   = "filterExpression"
+	ReplicationSettingFilterDeletion     = "filterDeletion"
+	ReplicationSettingFilterExpiration   = "filterExpiration"
+	ReplicationSettingFilterBypassExpiry = "filterBypassExpiry"
+	ReplicationSettingFilterBinary       = "filterBinary"
+	ReplicationSettingMobile             = "mobile"
+)
+
+// rules of JSON paths that are not compared are of the form [<scope>.<collection>:]<JSON pointer>, where the
+// wildcard token matches any key or index
+const IgnoredJsonPathNamespaceDelimiter = ":"
+const JsonPathWildcard = "*"
+
+// metadata docs of Sync Gateway, which are not replicated by mobile compatible replications
+const SyncGatewayMetadataKeyPrefix = "_sync:"
+
+// results of the file differ by bin, which an incremental diff reuses for the bins whose files have not changed
+const DiffStateFileName = "diffState"
+const DiffStateVersion = 4
+
+// bytes at the end of each bin file that the diff state keeps a checksum of
+const DiffStateTailChecksumLen = 4096
+
+// continuous verification diffs what has been captured so far every window interval, in seconds, and reports
+// the inconsistencies that have lasted longer than the grace period, in seconds
+const DaemonWindowInterval = 600
+
+// the daemon captures each window into a directory of its own, which is merged into the bin files once the window
+// is sealed. Only the window being captured into and the one being merged exist at any time
+const DaemonCaptureWindowDirPrefix = "window"
+const DaemonCaptureWindowDirs = 2
+const InconsistencyGracePeriod = 1800
+const InconsistencyDir = "inconsistencies"
+const InconsistenciesFileName = "inconsistencies"
+const PersistentInconsistenciesFileName = "persistentInconsistencies"
+
 const StatsReportInterval = 5
 const SourceClusterName = "source"
 const TargetClusterName = "target"
 const SelfReferenceName = "xdcrDifftoolSelfRef"
 const ManifestFileName = "manifest"
 
+// subcommands of the tool. Without one, the tool captures both clusters and diffs them in the same run
+const (
+	SubcommandCapture = "capture"
+	SubcommandDiff    = "diff"
+)
+
+// a capture archive is the directory of bin files captured from one cluster, which also holds the manifest,
+// the checkpoint that the capture ended at, and a descriptor of the capture
+const CaptureArchiveFileName = "archive"
+const CaptureCheckpointFileName = "checkpoint"
+const CaptureArchiveVersion = 2
+
+// stats of a replication are queried by their labels from the stats range REST API of the source cluster
+const StatsRangePath = "/pools/default/stats/range/"
+const XdcrChangesLeftStatName = "xdcr_changes_left_total"
+const XdcrPipelineTypeMain = "Main"
+
+// stats of the replication that the diff summary reports, by the names that XDCR reports them by,
+// mapped to the names that the stats range REST API serves them by
+var XdcrSummaryStats = map[string]string{
+	"changes_left":          XdcrChangesLeftStatName,
+	"docs_filtered":         "xdcr_docs_filtered_total",
+	"docs_failed_cr_source": "xdcr_docs_failed_cr_source_total",
+	"target_docs_skipped":   "xdcr_target_docs_skipped_total",
+	"expiry_filtered":       "xdcr_expiry_filtered_total",
+	"deletion_filtered":     "xdcr_deletion_filtered_total",
+}
+
+const DiffSummaryFileName = "diffSummary"
+
+// before cutting the clusters at the XDCR checkpoints, a consistent cut waits, for up to ConsistentCutTimeout seconds, for the
+// changes left to replicate to drain, polling them every ChangesLeftPollInterval seconds
+const ConsistentCutTimeout uint64 = 600
+const ChangesLeftPollInterval = 2
+
 const NodesKey = "nodes"
 const PoolsDefaultBucketPath = "/pools/default/buckets/"
 const SASLPasswordKey = "saslPassword"
+const VBucketServerMapKey = "vBucketServerMap"
+const VBucketMapKey = "vBucketMap"
 const HttpGet = "GET"
 
 // default values for configurable parameters if not specified by user
@@ -51,11 +218,38 @@ const SendBatchRetryInterval uint64 = 500
 const SendBatchMaxBackoff uint64 = 5
 const GetStatsBackoffFactor = 2
 const SendBatchBackoffFactor = 2
+const MutationRetriesBackoffFactor = 2
+
+// max wait between retries of the mutation differ, in seconds
+const MutationRetriesMaxWaitSecs = 600
+
+// how the mutation differ limits the rate of the ops that it sends to each cluster. An adaptive limit is halved
+// when ops are timing out or failing temporarily, down to a fraction of the limit, and recovers by a fraction of it
+const RateLimiterBurstSecs = 0.1
+const RateLimiterAdjustInterval = time.Second
+const RateLimiterSlowdownFactor = 0.5
+const RateLimiterMinFraction = 0.05
+const RateLimiterRecoveryFraction = 0.05
 const MaxNumOfGetStatsRetry = 10
 const MaxNumOfSendBatchRetry = 10
 const DelayBetweenSourceAndTarget uint64 = 2
 const CheckpointInterval = 600
 
+// retry parameters for reopening a dcp stream after its vbucket has moved or failed over
+const StreamReopenRetryInterval uint64 = 1
+const StreamReopenMaxBackoff uint64 = 30
+const StreamReopenBackoffFactor = 2
+const MaxNumOfStreamReopenRetry = 10
+
+// size of the dcp flow control buffer of a cluster whose capture bytes are limited, as the seconds of bytes that it
+// holds at the limit. It stays within the min and the max, which is the default size that gocbcore uses
+const DcpFlowControlBufferSecs = 2
+const DcpFlowControlMinBufferSize = 1024 * 1024
+const DcpFlowControlMaxBufferSize = 20 * 1024 * 1024
+
+// interval, in seconds, at which the capture limits file is checked for changes
+const CaptureLimitsFileCheckInterval = 5
+
 const ClusterRunMinPortNo uint16 = 9000
 const ClusterRunMaxPortNo uint16 = 9007
 
@@ -74,23 +268,97 @@ const ClusterRunMaxPortNo uint16 = 9007
 // collectionId       - 4 bytes
 // migrationFilterLen - 2 bytes
 // (variable) - each filterID is 2 bytes
+// xattrDigestCnt     - 2 bytes
+// (variable) - each xattr digest is made up of the length of its key in 2 bytes, its key and its digest
 const BodyLength = 120
 const KeyLenVariable = 2
 const MigrationFilterLen = 2
 const xattrSizeLen = 8 // To store the size of the HLV
+const XattrDigestCntLen = 2
+const XattrKeyLenVariable = 2
+
+// xattrs are digested by SHA-256 when the xattrs are compared by key
+const XattrDigestLen = 32
+
+// the mutation differ gets the keys of the xattrs of a doc from the virtual xattr that lists them, and then the xattrs
+// themselves in lookups of at most as many paths as KV allows in one lookup
+const XattrTocPath = "$XTOC"
+const MaxSubdocPathsPerLookup = 16
+
+// bin files start with a header, which consists of
+//
+// magic              - 4 bytes
+// version            - 2 bytes
+// codec              - 2 bytes
+//
+// followed by the serialized mutations, each in a frame of
+//
+// recordLen          - 4 bytes
+// crc32c             - 4 bytes, of the serialized mutation
+// (variable)         - the serialized mutation
+//
+// when the file is compressed, the frames are compressed in blocks of whole frames, each in a frame of
+//
+// blockLen           - 4 bytes
+// crc32c             - 4 bytes, of the compressed block
+// (variable)         - the compressed block
+const BinFileMagic uint32 = 0x78646966 // "xdif"
+const BinFileFormatVersion uint16 = 2
+const BinFileHeaderLen = 8
+const RecordFrameHeaderLen = 8
+const BlockFrameHeaderLen = 8
+
+// a frame longer than this cannot have been written by the tool, which means that its length is corrupt
+const MaxRecordLen = 1 << 26
+
+// codecs that bin files can be compressed with
+const (
+	BinFileCodecNone   uint16 = iota
+	BinFileCodecSnappy uint16 = iota
+)
+
+// names of the codecs, indexed by codec
+var BinFileCodecNames = []string{"none", "snappy"}
+
+// frames are compressed in blocks of about this size, so that sorted runs can be merged
+// without holding whole flushes of each run in memory
+const BinFileBlockSize = 16384
+
+var ErrorIncompatibleBinFile = errors.New("incompatible bin file")
+
+// where the bin files can be kept
+const (
+	StorageTypeLocal = "local"
+	StorageTypeS3    = "s3"
+)
+
+var StorageTypes = []string{StorageTypeLocal, StorageTypeS3}
+
+const S3RequestTimeout = 60 * time.Second
+
+// files in S3 compatible object stores are read ahead by up to this many bytes at a time
+const S3ReadAheadSize = 1 << 20
+
+// appends to a file in an S3 compatible object store are held in a local file until there are this many bytes of them,
+// which are then uploaded as one object
+const S3AppendSegmentSize = 64 * 1024 * 1024
+
+// objects larger than this are uploaded in parts of this size, which S3 needs to be at least 5MB
+const S3UploadPartSize = 8 * 1024 * 1024
 
 const (
 	JsonBody     = "Body"
 	JsonMetadata = "Metadata"
+	JsonXattrs   = "Xattrs"
 	Updated      = "Updated"
 )
 
-// This function is used to calculate the length of the byte array for serializing a mutation
+// This function is used to calculate the length of the byte array for serializing a mutation, except for its xattr digests
 // @param keyLen denotes the length of the document key
 // @param size denoted the length of HLV
 // @param colMigrationFilterMatched denotes the list of Migration Filters matched
 func GetFixedSizeMutationLen(keyLen int, size uint64, colMigrationFilterMatched []uint8) int {
-	return KeyLenVariable + keyLen + xattrSizeLen + int(size) + BodyLength + MigrationFilterLen + len(colMigrationFilterMatched)*2 // (xattrSizeLen - to store the size of HLV)
+	return KeyLenVariable + keyLen + xattrSizeLen + int(size) + BodyLength + MigrationFilterLen + len(colMigrationFilterMatched)*2 + XattrDigestCntLen // (xattrSizeLen - to store the size of HLV)
 
 }
 
@@ -1,5 +1,7 @@
 package dcp
 
+import "github.com/couchbase/gocbcore/v10"
+
 type Checkpoint struct {
 	Vbuuid             uint64
 	Seqno              uint64
@@ -7,6 +9,8 @@ type Checkpoint struct {
 	SnapshotEndSeqno   uint64
 	FilteredCnt        uint64
 	FailedFilterCnt    uint64
+	// failover log of the vb as of the last time a stream was opened, newest entry first
+	FailoverLog []gocbcore.FailoverEntry
 }
 
 // vbucket timestamp required by dcp
@@ -46,6 +46,8 @@ type CheckpointManager struct {
 	completeBySeqno       bool
 	logOnceCount          uint64
 	lastRemainingMap      map[uint16]uint64
+	failoverLogs          map[uint16][]gocbcore.FailoverEntry
+	failoverLogsLock      sync.RWMutex
 
 	kvSSLPortMap    xdcrBase.SSLPortMap
 	kvVbMap         map[string][]uint16
@@ -66,6 +68,7 @@ func NewCheckpointManager(dcpDriver *DcpDriver, checkpointFileDir, oldCheckpoint
 		endSeqnoMap:           make(map[uint16]uint64),
 		filteredCnt:           make(map[uint16]metrics.Counter),
 		failedFilterCnt:       make(map[uint16]metrics.Counter),
+		failoverLogs:          make(map[uint16][]gocbcore.FailoverEntry),
 		bucketOpTimeout:       bucketOpTimeout,
 		maxNumOfGetStatsRetry: maxNumOfGetStatsRetry,
 		getStatsRetryInterval: getStatsRetryInterval,
@@ -78,16 +81,16 @@ func NewCheckpointManager(dcpDriver *DcpDriver, checkpointFileDir, oldCheckpoint
 
 	if checkpointFileDir != "" {
 		if oldCheckpointFileName != "" {
-			cm.oldCheckpointFileName = checkpointFileDir + base.FileDirDelimiter + clusterName + base.FileNameDelimiter + oldCheckpointFileName
+			cm.oldCheckpointFileName = utils.GetCheckpointFileName(checkpointFileDir, clusterName, oldCheckpointFileName)
 		}
 
 		if newCheckpointFileName != "" {
-			cm.newCheckpointFileName = checkpointFileDir + base.FileDirDelimiter + clusterName + base.FileNameDelimiter + newCheckpointFileName
+			cm.newCheckpointFileName = utils.GetCheckpointFileName(checkpointFileDir, clusterName, newCheckpointFileName)
 		}
 	}
 
 	var vbno uint16
-	for vbno = 0; vbno < base.NumberOfVbuckets; vbno++ {
+	for vbno = 0; vbno < uint16(cm.dcpDriver.numberOfVbuckets); vbno++ {
 		cm.seqnoMap[vbno] = &SeqnoWithLock{}
 		cm.snapshots[vbno] = &Snapshot{}
 		cm.filteredCnt[vbno] = metrics.NewCounter()
@@ -221,7 +224,7 @@ func (cm *CheckpointManager) reportStatusOnce(prevSum uint64) uint64 {
 	var filtered int64
 	var failedFilter int64
 	cm.logOnceCount++
-	for vbno = 0; vbno < base.NumberOfVbuckets; vbno++ {
+	for vbno = 0; vbno < uint16(cm.dcpDriver.numberOfVbuckets); vbno++ {
 		sum += cm.seqnoMap[vbno].getSeqno()
 		filtered += cm.filteredCnt[vbno].Count()
 		failedFilter += cm.failedFilterCnt[vbno].Count()
@@ -305,7 +308,7 @@ func (cm *CheckpointManager) getVbuuidsAndHighSeqnos() error {
 
 	vbuuidMap := make(map[uint16]uint64)
 	endSeqnoMap := make(map[uint16]uint64)
-	err = utils.ParseHighSeqnoStat(statsMap, endSeqnoMap, vbuuidMap, true)
+	err = utils.ParseHighSeqnoStat(statsMap, endSeqnoMap, vbuuidMap, true, cm.dcpDriver.numberOfVbuckets)
 	if err != nil {
 		return err
 	}
@@ -319,6 +322,12 @@ func (cm *CheckpointManager) getVbuuidsAndHighSeqnos() error {
 	cm.vbuuidMap = vbuuidMap
 
 	if cm.dcpDriver.completeBySeqno {
+		if cm.dcpDriver.endSeqnoCut != nil {
+			endSeqnoMap, err = cm.dcpDriver.endSeqnoCut(vbuuidMap, endSeqnoMap)
+			if err != nil {
+				return err
+			}
+		}
 		cm.endSeqnoMap = endSeqnoMap
 		// For end Seqno 0's, mark them as completed
 		for vb, seqno := range endSeqnoMap {
@@ -330,7 +339,7 @@ func (cm *CheckpointManager) getVbuuidsAndHighSeqnos() error {
 		cm.endSeqnoMap = make(map[uint16]uint64)
 		// set endSeqno to maxInt
 		var vbno uint16
-		for vbno = 0; vbno < base.NumberOfVbuckets; vbno++ {
+		for vbno = 0; vbno < uint16(cm.dcpDriver.numberOfVbuckets); vbno++ {
 			cm.endSeqnoMap[vbno] = math.MaxUint64
 		}
 	}
@@ -374,7 +383,7 @@ func (cm *CheckpointManager) getStatsWithRetry() (map[string]map[string]string,
 				// Make sure we get all the vbuuid and seqno
 				vbuuidMap := make(map[uint16]uint64)
 				endSeqnoMap := make(map[uint16]uint64)
-				err = utils.ParseHighSeqnoStat(statsMap, endSeqnoMap, vbuuidMap, true)
+				err = utils.ParseHighSeqnoStat(statsMap, endSeqnoMap, vbuuidMap, true, cm.dcpDriver.numberOfVbuckets)
 				if err != nil {
 					for server, singleServerStats := range result.Servers {
 						cm.logger.Warnf("server %v received stats %v", server, singleServerStats.Stats)
@@ -432,6 +441,7 @@ func (cm *CheckpointManager) setStartVBTS() error {
 
 			// update start Seqno as that in checkpoint doc
 			cm.seqnoMap[vbno].setSeqno(checkpoint.Seqno)
+			cm.updateFailoverLog(vbno, checkpoint.FailoverLog)
 			sum += checkpoint.Seqno
 			totalFiltered += checkpoint.FilteredCnt
 			totalFailedFilter += checkpoint.FailedFilterCnt
@@ -442,7 +452,7 @@ func (cm *CheckpointManager) setStartVBTS() error {
 		}
 	} else {
 		var vbno uint16
-		for vbno = 0; vbno < base.NumberOfVbuckets; vbno++ {
+		for vbno = 0; vbno < uint16(cm.dcpDriver.numberOfVbuckets); vbno++ {
 			// if we are not loading checkpoints, it is ok to leave all fields in Checkpoint with default values, 0
 			cm.startVBTS[vbno] = &VBTS{
 				Checkpoint: &Checkpoint{},
@@ -476,8 +486,9 @@ func (cm *CheckpointManager) loadCheckpoints() (*CheckpointDoc, error) {
 		return nil, err
 	}
 
-	if len(checkpointDoc.Checkpoints) < base.NumberOfVbuckets {
-		return nil, fmt.Errorf("checkpoint file %v has less than 1024 vbuckets.", cm.oldCheckpointFileName)
+	if len(checkpointDoc.Checkpoints) != cm.dcpDriver.numberOfVbuckets {
+		return nil, fmt.Errorf("checkpoint file %v has %v vbuckets while bucket has %v vbuckets.", cm.oldCheckpointFileName,
+			len(checkpointDoc.Checkpoints), cm.dcpDriver.numberOfVbuckets)
 	}
 
 	return checkpointDoc, nil
@@ -507,33 +518,12 @@ func (cm *CheckpointManager) saveCheckpoint(checkpointFileName string) error {
 	var total uint64
 	var totalFiltered uint64
 	var totalFailedFilter uint64
-	for vbno = 0; vbno < base.NumberOfVbuckets; vbno++ {
-		vbuuid := cm.vbuuidMap[vbno]
-		seqno := cm.seqnoMap[vbno].getSeqno()
-		total += seqno
-		var snapshotStartSeqno uint64
-		var snapshotEndSeqno uint64
-		filteredCnt := uint64(cm.filteredCnt[vbno].Count())
-		totalFiltered += filteredCnt
-		failedFilterCnt := uint64(cm.failedFilterCnt[vbno].Count())
-		totalFailedFilter += failedFilterCnt
-
-		curStartVBTS := cm.startVBTS[vbno].Checkpoint
-		if seqno != curStartVBTS.Seqno {
-			snapshotStartSeqno, snapshotEndSeqno = cm.getSnapshot(vbno)
-		} else {
-			// if we have not made any progress since start VBTS, use the same snapshotSeqnos as those in start VBTS
-			snapshotStartSeqno = curStartVBTS.SnapshotStartSeqno
-			snapshotEndSeqno = curStartVBTS.SnapshotEndSeqno
-		}
-		checkpointDoc.Checkpoints[vbno] = &Checkpoint{
-			Vbuuid:             vbuuid,
-			Seqno:              seqno,
-			SnapshotStartSeqno: snapshotStartSeqno,
-			SnapshotEndSeqno:   snapshotEndSeqno,
-			FilteredCnt:        filteredCnt,
-			FailedFilterCnt:    failedFilterCnt,
-		}
+	for vbno = 0; vbno < uint16(cm.dcpDriver.numberOfVbuckets); vbno++ {
+		checkpoint := cm.getCurrentCheckpoint(vbno)
+		total += checkpoint.Seqno
+		totalFiltered += checkpoint.FilteredCnt
+		totalFailedFilter += checkpoint.FailedFilterCnt
+		checkpointDoc.Checkpoints[vbno] = checkpoint
 	}
 
 	value, err := json.Marshal(checkpointDoc)
@@ -562,6 +552,103 @@ func (cm *CheckpointManager) saveCheckpoint(checkpointFileName string) error {
 	return nil
 }
 
+func (cm *CheckpointManager) getCurrentCheckpoint(vbno uint16) *Checkpoint {
+	seqno := cm.seqnoMap[vbno].getSeqno()
+	var snapshotStartSeqno uint64
+	var snapshotEndSeqno uint64
+
+	curStartVBTS := cm.startVBTS[vbno].Checkpoint
+	if seqno != curStartVBTS.Seqno {
+		snapshotStartSeqno, snapshotEndSeqno = cm.getSnapshot(vbno)
+	} else {
+		// if we have not made any progress since start VBTS, use the same snapshotSeqnos as those in start VBTS
+		snapshotStartSeqno = curStartVBTS.SnapshotStartSeqno
+		snapshotEndSeqno = curStartVBTS.SnapshotEndSeqno
+	}
+
+	failoverLog := cm.getFailoverLog(vbno)
+	vbuuid, found := getVbuuidFromFailoverLog(failoverLog, seqno)
+	if !found {
+		vbuuid = cm.vbuuidMap[vbno]
+	}
+
+	return &Checkpoint{
+		Vbuuid:             vbuuid,
+		Seqno:              seqno,
+		SnapshotStartSeqno: snapshotStartSeqno,
+		SnapshotEndSeqno:   snapshotEndSeqno,
+		FilteredCnt:        uint64(cm.filteredCnt[vbno].Count()),
+		FailedFilterCnt:    uint64(cm.failedFilterCnt[vbno].Count()),
+		FailoverLog:        failoverLog,
+	}
+}
+
+// The failover log is ordered from the newest entry to the oldest. A seqno belongs to the branch
+// of the newest entry that starts at or before it
+func getVbuuidFromFailoverLog(failoverLog []gocbcore.FailoverEntry, seqno uint64) (uint64, bool) {
+	for _, entry := range failoverLog {
+		if uint64(entry.SeqNo) <= seqno {
+			return uint64(entry.VbUUID), true
+		}
+	}
+	return 0, false
+}
+
+func (cm *CheckpointManager) updateFailoverLog(vbno uint16, failoverLog []gocbcore.FailoverEntry) {
+	if len(failoverLog) == 0 {
+		return
+	}
+	cm.failoverLogsLock.Lock()
+	defer cm.failoverLogsLock.Unlock()
+	cm.failoverLogs[vbno] = failoverLog
+}
+
+func (cm *CheckpointManager) getFailoverLog(vbno uint16) []gocbcore.FailoverEntry {
+	cm.failoverLogsLock.RLock()
+	defer cm.failoverLogsLock.RUnlock()
+	failoverLog := cm.failoverLogs[vbno]
+	if failoverLog == nil {
+		return nil
+	}
+	clonedLog := make([]gocbcore.FailoverEntry, len(failoverLog))
+	copy(clonedLog, failoverLog)
+	return clonedLog
+}
+
+// Returns the VBTS to reopen a stream from, after the stream of the vb has been interrupted mid-way
+func (cm *CheckpointManager) getResumeVBTS(vbno uint16) *VBTS {
+	checkpoint := cm.getCurrentCheckpoint(vbno)
+	// Snapshot markers are recorded as they are received, whereas seqnos are recorded as the mutations are processed.
+	// Only use the snapshot if the resume seqno falls in it, otherwise the producer will reject the stream request
+	if checkpoint.SnapshotStartSeqno > checkpoint.Seqno || checkpoint.SnapshotEndSeqno < checkpoint.Seqno {
+		checkpoint.SnapshotStartSeqno = checkpoint.Seqno
+		checkpoint.SnapshotEndSeqno = checkpoint.Seqno
+	}
+	return &VBTS{
+		Checkpoint: checkpoint,
+		EndSeqno:   cm.endSeqnoMap[vbno],
+	}
+}
+
+// Called when the producer asks us to roll back the vb to rollbackSeqno before it can stream to us again
+// The records past rollbackSeqno need to have been discarded from the bin files before this is called
+func (cm *CheckpointManager) handleRollback(vbno uint16, rollbackSeqno uint64) {
+	cm.logger.Warnf("%v vb %v rolling back from seqno %v to %v\n", cm.clusterName, vbno, cm.seqnoMap[vbno].getSeqno(), rollbackSeqno)
+	cm.seqnoMap[vbno].setSeqno(rollbackSeqno)
+	cm.updateSnapshot(vbno, rollbackSeqno, rollbackSeqno)
+
+	// branches that start past the rollback seqno no longer exist
+	cm.failoverLogsLock.Lock()
+	defer cm.failoverLogsLock.Unlock()
+	var trimmedLog []gocbcore.FailoverEntry
+	for _, entry := range cm.failoverLogs[vbno] {
+		if uint64(entry.SeqNo) <= rollbackSeqno {
+			trimmedLog = append(trimmedLog, entry)
+		}
+	}
+	cm.failoverLogs[vbno] = trimmedLog
+}
+
 // Returns false if mutation is filtered (should not be recorded into bucket)
 func (cm *CheckpointManager) RecordFilterEvent(vbno uint16, filterResult base.FilterResultType) bool {
 	switch filterResult {
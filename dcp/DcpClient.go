@@ -54,6 +54,7 @@ type DcpClient struct {
 
 	kvSSLPortMap xdcrBase.SSLPortMap
 	kvVbMap      map[string][]uint16
+	kvVbMapLock  sync.RWMutex
 }
 
 func NewDcpClient(dcpDriver *DcpDriver, i int, vbList []uint16, waitGroup *sync.WaitGroup, startVbtsDoneChan chan bool, capabilities metadata.Capability, collectionIds []uint32, colMigrationFilters []string, utils xdcrUtils.UtilsIface, bufferCap int, migrationMapping metadata.CollectionNamespaceMapping) *DcpClient {
@@ -260,7 +261,7 @@ func (c *DcpClient) initializeBucket() (err error) {
 		return err
 	}
 
-	c.gocbcoreDcpFeed, err = NewGocbcoreDCPFeed(c.Name, []string{bucketConnStr}, c.dcpDriver.bucketName, auth, c.capabilities.HasCollectionSupport(), c.dcpDriver.ref)
+	c.gocbcoreDcpFeed, err = NewGocbcoreDCPFeed(c.Name, []string{bucketConnStr}, c.dcpDriver.bucketName, auth, c.capabilities.HasCollectionSupport(), c.dcpDriver.ref, c.dcpDriver.flowControlBufferSize)
 	return
 }
 
@@ -384,7 +385,7 @@ func (c *DcpClient) openDcpStreams() error {
 
 		_, err := c.dcpAgent.OpenStream(vbno, 0, gocbcore.VbUUID(vbts.Checkpoint.Vbuuid), gocbcore.SeqNo(vbts.Checkpoint.Seqno),
 			gocbcore.SeqNo(math.MaxUint64 /*vbts.EndSeqno*/), gocbcore.SeqNo(snapshotStartSeqno), gocbcore.SeqNo(snapshotEndSeqno), c.vbHandlerMap[vbno],
-			c.getOpenStreamOptions(), c.openStreamFunc)
+			c.getOpenStreamOptions(), c.getOpenStreamFunc(vbno))
 
 		if err != nil {
 			c.logger.Errorf("err opening dcp stream for vb %v. err=%v\n", vbno, err)
@@ -406,15 +407,145 @@ func (c *DcpClient) closeStream(vbno uint16) error {
 	return err
 }
 
-func (c *DcpClient) openStreamFunc(f []gocbcore.FailoverEntry, err error) {
-	if err != nil {
-		wrappedErr := fmt.Errorf("%v openStreamCallback reported err: %v", c.Name, err)
-		c.reportError(wrappedErr)
-	} else {
+func (c *DcpClient) getOpenStreamFunc(vbno uint16) gocbcore.OpenStreamCallback {
+	return func(f []gocbcore.FailoverEntry, err error) {
+		if err != nil {
+			if _, isRollback := rollbackStreamError(err); isRollback || reopenableStreamError(err) {
+				// vb may have been moved or failed over between the time we got the cluster map and the stream request
+				go c.reopenStream(vbno, err)
+				return
+			}
+			wrappedErr := fmt.Errorf("%v openStreamCallback reported err: %v", c.Name, err)
+			c.reportError(wrappedErr)
+		} else {
+			c.dcpDriver.checkpointManager.updateFailoverLog(vbno, f)
+			atomic.AddUint32(&c.activeStreams, 1)
+		}
+	}
+}
+
+// Called when the stream of a vb ended while the vb has not yet completed
+func (c *DcpClient) handleStreamInterruption(vbno uint16, err error) {
+	if c.isStopping() {
+		return
+	}
+
+	if c.dcpDriver.getVbState(vbno) != VBStateNormal {
+		// vb has already reached its end seqno, there is nothing left to stream
+		c.dcpDriver.handleVbucketCompletion(vbno, nil, "dcp stream ended after completion")
+		return
+	}
+
+	// (-1)
+	atomic.AddUint32(&c.activeStreams, ^uint32(0))
+	go c.reopenStream(vbno, err)
+}
+
+// Reopens the stream of a vb from where the previous stream left off, on whichever node owns the vb now
+func (c *DcpClient) reopenStream(vbno uint16, reason error) {
+	c.logger.Warnf("%v stream for vb %v was interrupted with err=%v. Reopening stream\n", c.Name, vbno, reason)
+
+	reopenStreamFunc := func() error {
+		if c.isStopping() {
+			return nil
+		}
+
+		err := c.refreshKVVBMap()
+		if err != nil {
+			return err
+		}
+
+		vbts := c.dcpDriver.checkpointManager.getResumeVBTS(vbno)
+		c.logger.Infof("%v reopening stream for vb %v on %v from seqno %v vbuuid %v snapshot [%v, %v]\n", c.Name, vbno,
+			c.getVbOwner(vbno), vbts.Checkpoint.Seqno, vbts.Checkpoint.Vbuuid, vbts.Checkpoint.SnapshotStartSeqno,
+			vbts.Checkpoint.SnapshotEndSeqno)
+
+		var openErr error
+		var failoverLog []gocbcore.FailoverEntry
+		var waitGroup sync.WaitGroup
+		waitGroup.Add(1)
+		_, err = c.dcpAgent.OpenStream(vbno, 0, gocbcore.VbUUID(vbts.Checkpoint.Vbuuid), gocbcore.SeqNo(vbts.Checkpoint.Seqno),
+			gocbcore.SeqNo(math.MaxUint64), gocbcore.SeqNo(vbts.Checkpoint.SnapshotStartSeqno),
+			gocbcore.SeqNo(vbts.Checkpoint.SnapshotEndSeqno), c.vbHandlerMap[vbno], c.getOpenStreamOptions(),
+			func(f []gocbcore.FailoverEntry, cbErr error) {
+				defer waitGroup.Done()
+				failoverLog = f
+				openErr = cbErr
+			})
+		if err != nil {
+			return err
+		}
+		waitGroup.Wait()
+
+		if openErr != nil {
+			if rollbackSeqno, isRollback := rollbackStreamError(openErr); isRollback {
+				// the next attempt will start from the seqno that the producer asked for
+				rollbackErr := c.rollbackVb(vbno, rollbackSeqno)
+				if rollbackErr != nil {
+					return rollbackErr
+				}
+			}
+			return openErr
+		}
+
+		c.dcpDriver.checkpointManager.updateFailoverLog(vbno, failoverLog)
 		atomic.AddUint32(&c.activeStreams, 1)
+		c.logger.Infof("%v reopened stream for vb %v\n", c.Name, vbno)
+		return nil
+	}
+
+	err := utils.ExponentialBackoffExecutor(fmt.Sprintf("%v reopenStream for vb %v", c.Name, vbno),
+		time.Duration(base.StreamReopenRetryInterval)*time.Second, base.MaxNumOfStreamReopenRetry,
+		base.StreamReopenBackoffFactor, time.Duration(base.StreamReopenMaxBackoff)*time.Second, reopenStreamFunc)
+	if err != nil {
+		c.reportError(fmt.Errorf("%v unable to reopen dcp stream for vb %v after it ended with %v: %v", c.Name, vbno, reason, err))
+	}
+}
+
+// Discards what has been captured for the vb past rollbackSeqno, so that the vb can be streamed again from there
+func (c *DcpClient) rollbackVb(vbno uint16, rollbackSeqno uint64) error {
+	err := c.vbHandlerMap[vbno].rollback(vbno, rollbackSeqno)
+	if err != nil {
+		return err
+	}
+	c.dcpDriver.checkpointManager.handleRollback(vbno, rollbackSeqno)
+	return nil
+}
+
+func (c *DcpClient) isStopping() bool {
+	select {
+	case <-c.finChan:
+		return true
+	default:
+		return false
 	}
 }
 
+func (c *DcpClient) refreshKVVBMap() error {
+	kvVbMap, err := initializeKVVBMap(c.dcpDriver)
+	if err != nil {
+		return err
+	}
+
+	c.kvVbMapLock.Lock()
+	defer c.kvVbMapLock.Unlock()
+	c.kvVbMap = kvVbMap
+	return nil
+}
+
+func (c *DcpClient) getVbOwner(vbno uint16) string {
+	c.kvVbMapLock.RLock()
+	defer c.kvVbMapLock.RUnlock()
+	for kvAddr, vbList := range c.kvVbMap {
+		for _, vb := range vbList {
+			if vb == vbno {
+				return kvAddr
+			}
+		}
+	}
+	return "unknown"
+}
+
 func (c *DcpClient) reportError(err error) {
 	select {
 	case c.dcpDriver.errChan <- err:
@@ -469,6 +600,9 @@ func initializeKVVBMap(dcpDriver *DcpDriver) (map[string][]uint16, error) {
 		dcpDriver.ref.Password(), dcpDriver.ref.HttpAuthMech(), dcpDriver.ref.Certificates(),
 		dcpDriver.ref.SANInCertificate(), dcpDriver.ref.ClientCertificate(), dcpDriver.ref.ClientKey(),
 		dcpDriver.logger)
+	if err != nil {
+		return nil, err
+	}
 
 	return kvVbMap, nil
 }
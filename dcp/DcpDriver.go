@@ -10,12 +10,14 @@
 package dcp
 
 import (
+	"errors"
 	"fmt"
 	"sync"
 	"sync/atomic"
 	"time"
 	"xdcrDiffer/base"
 	fdp "xdcrDiffer/fileDescriptorPool"
+	"xdcrDiffer/storage"
 	"xdcrDiffer/utils"
 
 	gocbcore "github.com/couchbase/gocbcore/v10"
@@ -39,6 +41,7 @@ type DcpDriver struct {
 	numberOfClients    int
 	numberOfWorkers    int
 	numberOfBins       int
+	numberOfVbuckets   int
 	dcpHandlerChanSize int
 	completeBySeqno    bool
 	checkpointManager  *CheckpointManager
@@ -61,16 +64,38 @@ type DcpDriver struct {
 	dataPool            xdcrBase.DataPool
 	utils               xdcrUtils.UtilsIface
 	bufferCapacity      int
+	binFileCodec        uint16
+	storage             storage.Storage
 	migrationMapping    metadata.CollectionNamespaceMapping
 	mobileCompatible    int
 	expDelMode          xdcrBase.FilterExpDelType
+	// the rollbacks since they were last taken, which the bin files of the capture windows that are no longer
+	// being captured into need to be rolled back by too
+	rollbacks     []*CaptureWindowRollback
+	rollbacksLock sync.Mutex
 
 	// various counters
 	totalNumReceivedFromDCP                uint64
 	totalSysOrUnsubbedEventReceivedFromDCP uint64
 	xattrKeysForNoCompare                  map[string]bool
+	// whether to capture digests of the xattrs that are compared, by key
+	compareXattrs bool
+	// whether to canonicalize JSON bodies before hashing them
+	semanticJsonCompare bool
+	// JSON paths that are removed from bodies before hashing them, by the collections of this cluster
+	ignoredJsonPaths *utils.IgnoredJsonPaths
+	// paces the capture to the bytes and mutations per second limits, which can be changed while capturing
+	captureThrottle *captureThrottle
+	// size of the dcp flow control buffer of each connection, which is fixed by the limits that the driver starts with
+	flowControlBufferSize int
+	// when set, turns the vbuuids and high seqnos taken into the seqnos that the streams end at
+	endSeqnoCut EndSeqnoCut
 }
 
+// Derives the seqnos that the streams of a driver that completes by seqno end at from the vbuuids and high seqnos
+// of its vbuckets
+type EndSeqnoCut func(vbuuids, highSeqnos map[uint16]uint64) (map[uint16]uint64, error)
+
 type VBStateWithLock struct {
 	vbState VBState
 	lock    sync.RWMutex
@@ -92,7 +117,7 @@ const (
 	DriverStateStopped DriverState = iota
 )
 
-func NewDcpDriver(logger *xdcrLog.CommonLogger, name, url, bucketName string, ref *metadata.RemoteClusterReference, fileDir, checkpointFileDir, oldCheckpointFileName, newCheckpointFileName string, numberOfClients, numberOfWorkers, numberOfBins, dcpHandlerChanSize int, bucketOpTimeout time.Duration, maxNumOfGetStatsRetry int, getStatsRetryInterval, getStatsMaxBackoff time.Duration, checkpointInterval int, errChan chan error, waitGroup *sync.WaitGroup, completeBySeqno bool, fdPool fdp.FdPoolIface, filter xdcrParts.Filter, capabilities metadata.Capability, collectionIds []uint32, colMigrationFilters []string, utils xdcrUtils.UtilsIface, bufferCap int, migrationMapping metadata.CollectionNamespaceMapping, mobileCompat int, expDelMode xdcrBase.FilterExpDelType, xattrKeysForNoCompare map[string]bool) *DcpDriver {
+func NewDcpDriver(logger *xdcrLog.CommonLogger, name, url, bucketName string, ref *metadata.RemoteClusterReference, fileDir, checkpointFileDir, oldCheckpointFileName, newCheckpointFileName string, numberOfClients, numberOfWorkers, numberOfBins, numberOfVbuckets, dcpHandlerChanSize int, bucketOpTimeout time.Duration, maxNumOfGetStatsRetry int, getStatsRetryInterval, getStatsMaxBackoff time.Duration, checkpointInterval int, errChan chan error, waitGroup *sync.WaitGroup, completeBySeqno bool, fdPool fdp.FdPoolIface, filter xdcrParts.Filter, capabilities metadata.Capability, collectionIds []uint32, colMigrationFilters []string, utils xdcrUtils.UtilsIface, bufferCap int, binFileCodec uint16, storage storage.Storage, migrationMapping metadata.CollectionNamespaceMapping, mobileCompat int, expDelMode xdcrBase.FilterExpDelType, xattrKeysForNoCompare map[string]bool, compareXattrs bool, semanticJsonCompare bool, ignoredJsonPaths *utils.IgnoredJsonPaths, captureLimits CaptureLimits) *DcpDriver {
 	dcpDriver := &DcpDriver{
 		Name:                  name,
 		url:                   url,
@@ -102,6 +127,7 @@ func NewDcpDriver(logger *xdcrLog.CommonLogger, name, url, bucketName string, re
 		numberOfClients:       numberOfClients,
 		numberOfWorkers:       numberOfWorkers,
 		numberOfBins:          numberOfBins,
+		numberOfVbuckets:      numberOfVbuckets,
 		dcpHandlerChanSize:    dcpHandlerChanSize,
 		completeBySeqno:       completeBySeqno,
 		errChan:               errChan,
@@ -120,14 +146,21 @@ func NewDcpDriver(logger *xdcrLog.CommonLogger, name, url, bucketName string, re
 		colMigrationFilters:   colMigrationFilters,
 		utils:                 utils,
 		bufferCapacity:        bufferCap,
+		binFileCodec:          binFileCodec,
+		storage:               storage,
 		migrationMapping:      migrationMapping,
 		mobileCompatible:      mobileCompat,
 		expDelMode:            expDelMode,
 		xattrKeysForNoCompare: xattrKeysForNoCompare,
+		compareXattrs:         compareXattrs,
+		semanticJsonCompare:   semanticJsonCompare,
+		ignoredJsonPaths:      ignoredJsonPaths,
+		captureThrottle:       newCaptureThrottle(captureLimits),
+		flowControlBufferSize: captureLimits.flowControlBufferSize(),
 	}
 
 	var vbno uint16
-	for vbno = 0; vbno < base.NumberOfVbuckets; vbno++ {
+	for vbno = 0; vbno < uint16(numberOfVbuckets); vbno++ {
 		dcpDriver.vbStateMap[vbno] = &VBStateWithLock{
 			vbState: VBStateNormal,
 		}
@@ -184,13 +217,13 @@ func (d *DcpDriver) checkForCompletion() {
 		case <-ticker.C:
 			var numOfCompletedVb int
 			var vbno uint16
-			for vbno = 0; vbno < base.NumberOfVbuckets; vbno++ {
+			for vbno = 0; vbno < uint16(d.numberOfVbuckets); vbno++ {
 				vbState := d.getVbState(vbno)
 				if vbState != VBStateNormal {
 					numOfCompletedVb++
 				}
 			}
-			if numOfCompletedVb == base.NumberOfVbuckets {
+			if numOfCompletedVb == d.numberOfVbuckets {
 				d.logger.Infof("%v all vbuckets have completed for dcp driver\n", d.Name)
 				d.Stop()
 				return
@@ -222,6 +255,7 @@ func (d *DcpDriver) Stop() error {
 	defer d.waitGroup.Done()
 
 	close(d.finChan)
+	d.captureThrottle.stop()
 
 	for i, dcpClient := range d.clients {
 		if dcpClient != nil {
@@ -244,10 +278,110 @@ func (d *DcpDriver) Stop() error {
 	return nil
 }
 
+// A rollback of a vb, and the capture window that was being captured into when it happened
+type CaptureWindowRollback struct {
+	Window int
+	Vbno   uint16
+	Seqno  uint64
+}
+
+// Seals the capture window being captured into, by flushing what has been received so far to its bin files, and
+// captures what is received after into new bin files in fileDir. The streams are not held back, so the bin files
+// of the sealed window can be read while the capture of the next one goes on
+func (d *DcpDriver) RotateCaptureWindow(window int, fileDir string) error {
+	if d.getState() != DriverStateStarted {
+		return fmt.Errorf("%v dcp driver is not capturing", d.Name)
+	}
+	err := d.storage.MkdirAll(fileDir)
+	if err != nil {
+		return err
+	}
+
+	var handlers []*DcpHandler
+	for _, dcpClient := range d.getDcpClients() {
+		for _, dcpHandler := range dcpClient.dcpHandlers {
+			if dcpHandler != nil {
+				handlers = append(handlers, dcpHandler)
+			}
+		}
+	}
+
+	errChan := make(chan error, len(handlers))
+	waitGroup := &sync.WaitGroup{}
+	for _, dcpHandler := range handlers {
+		waitGroup.Add(1)
+		go func(dcpHandler *DcpHandler) {
+			defer waitGroup.Done()
+			err := dcpHandler.rotate(window, fileDir)
+			if err != nil {
+				utils.AddToErrorChan(errChan, err)
+			}
+		}(dcpHandler)
+	}
+	waitGroup.Wait()
+
+	select {
+	case err := <-errChan:
+		return err
+	default:
+	}
+	d.logger.Infof("%v rotated to capture window %v after receiving %v mutations\n", d.Name, window, atomic.LoadUint64(&d.totalNumReceivedFromDCP))
+	return nil
+}
+
+func (d *DcpDriver) recordRollback(window int, vbno uint16, rollbackSeqno uint64) {
+	d.rollbacksLock.Lock()
+	defer d.rollbacksLock.Unlock()
+	d.rollbacks = append(d.rollbacks, &CaptureWindowRollback{
+		Window: window,
+		Vbno:   vbno,
+		Seqno:  rollbackSeqno,
+	})
+}
+
+// returns the rollbacks since they were last taken, in the order that they happened
+func (d *DcpDriver) TakeRollbacks() []*CaptureWindowRollback {
+	d.rollbacksLock.Lock()
+	defer d.rollbacksLock.Unlock()
+	rollbacks := d.rollbacks
+	d.rollbacks = nil
+	return rollbacks
+}
+
+// Changes the limits of the capture while it is running. The flow control buffer keeps the size that it was given
+// by the limits that the driver started with
+func (d *DcpDriver) SetCaptureLimits(limits CaptureLimits) {
+	if d.getState() == DriverStateStopped || d.captureThrottle.getLimits() == limits {
+		return
+	}
+	d.captureThrottle.setLimits(limits)
+	d.logger.Infof("%v capture limits changed to %v bytes/sec and %v mutations/sec\n", d.Name, limits.BytesPerSec, limits.MutationsPerSec)
+}
+
+func (d *DcpDriver) CaptureLimits() CaptureLimits {
+	return d.captureThrottle.getLimits()
+}
+
+// Has the streams end at the seqnos that cut derives instead of at the high seqnos. Needs to be called before Start,
+// and only applies when completing by seqno
+func (d *DcpDriver) SetEndSeqnoCut(cut EndSeqnoCut) {
+	d.endSeqnoCut = cut
+}
+
+// closed once the driver has taken the seqnos that its streams start from and end at
+func (d *DcpDriver) EndSeqnosTaken() <-chan bool {
+	return d.startVbtsDoneChan
+}
+
+// the checkpoint file that the driver saves to when it stops, which is empty when it does not save checkpoints
+func (d *DcpDriver) CheckpointFileName() string {
+	return d.checkpointManager.newCheckpointFileName
+}
+
 func (d *DcpDriver) FilteredCount() int64 {
 	var vbno uint16
 	var filtered int64
-	for vbno = 0; vbno < base.NumberOfVbuckets; vbno++ {
+	for vbno = 0; vbno < uint16(d.numberOfVbuckets); vbno++ {
 		filtered += d.checkpointManager.filteredCnt[vbno].Count()
 	}
 	return filtered
@@ -257,7 +391,7 @@ func (d *DcpDriver) initializeDcpClients() {
 	d.stateLock.Lock()
 	defer d.stateLock.Unlock()
 
-	loadDistribution := utils.BalanceLoad(d.numberOfClients, base.NumberOfVbuckets)
+	loadDistribution := utils.BalanceLoad(d.numberOfClients, d.numberOfVbuckets)
 	for i := 0; i < d.numberOfClients; i++ {
 		lowIndex := loadDistribution[i][0]
 		highIndex := loadDistribution[i][1]
@@ -324,6 +458,29 @@ func allowedCompletionError(err error) bool {
 	}
 }
 
+// Stream end reasons that mean the vbucket is still being served, just not by the producer we were streaming from,
+// e.g. the vbucket has been moved by rebalance, or its node has been failed over and a replica promoted
+func reopenableStreamError(err error) bool {
+	switch {
+	case errors.Is(err, gocbcore.ErrDCPStreamStateChanged),
+		errors.Is(err, gocbcore.ErrDCPStreamDisconnected),
+		errors.Is(err, gocbcore.ErrDCPStreamTooSlow),
+		errors.Is(err, gocbcore.ErrNotMyVBucket),
+		errors.Is(err, gocbcore.ErrSocketClosed):
+		return true
+	default:
+		return false
+	}
+}
+
+func rollbackStreamError(err error) (uint64, bool) {
+	var rollbackErr gocbcore.DCPRollbackError
+	if errors.As(err, &rollbackErr) {
+		return uint64(rollbackErr.SeqNo), true
+	}
+	return 0, false
+}
+
 func (d *DcpDriver) handleVbucketCompletion(vbno uint16, err error, reason string) {
 	if err != nil && !allowedCompletionError(err) {
 		wrappedErr := fmt.Errorf("%v Vbno %v vbucket completed with err %v - %v", d.Name, vbno, err, reason)
@@ -10,15 +10,19 @@
 package dcp
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
 	"sort"
 	"strings"
 	"sync"
 	"xdcrDiffer/base"
 	fdp "xdcrDiffer/fileDescriptorPool"
+	"xdcrDiffer/storage"
 	"xdcrDiffer/utils"
 
 	"github.com/couchbase/gocbcore/v10"
@@ -39,7 +43,7 @@ type DcpHandler struct {
 	index                         int
 	vbList                        []uint16
 	numberOfBins                  int
-	dataChan                      chan *Mutation
+	dataChan                      chan interface{} // *Mutation, *rollbackEvent or *rotateEvent, kept in order so that they follow the mutations before them
 	waitGrp                       sync.WaitGroup
 	finChan                       chan bool
 	bucketMap                     map[uint16]map[int]*Bucket
@@ -54,10 +58,14 @@ type DcpHandler struct {
 	isSource                      bool
 	utils                         xdcrUtils.UtilsIface
 	bufferCap                     int
+	binFileCodec                  uint16
+	storage                       storage.Storage
 	migrationMapping              metadata.CollectionNamespaceMapping
 	mobileCompatible              int
 	expDelMode                    xdcrBase.FilterExpDelType
 	xattrIterator                 *xdcrBase.XattrIterator
+	// the capture window that the bin files in fileDir are of, which the daemon rotates
+	window int
 }
 
 func NewDcpHandler(dcpClient *DcpClient, fileDir string, index int, vbList []uint16, numberOfBins, dataChanSize int, fdPool fdp.FdPoolIface, incReceivedCounter, incSysOrUnsubbedEvtReceived func(), colMigrationFilters []string, utils xdcrUtils.UtilsIface, bufferCap int, migrationMapping metadata.CollectionNamespaceMapping) (*DcpHandler, error) {
@@ -70,7 +78,7 @@ func NewDcpHandler(dcpClient *DcpClient, fileDir string, index int, vbList []uin
 		index:                         index,
 		vbList:                        vbList,
 		numberOfBins:                  numberOfBins,
-		dataChan:                      make(chan *Mutation, dataChanSize),
+		dataChan:                      make(chan interface{}, dataChanSize),
 		finChan:                       make(chan bool),
 		bucketMap:                     make(map[uint16]map[int]*Bucket),
 		fdPool:                        fdPool,
@@ -83,6 +91,8 @@ func NewDcpHandler(dcpClient *DcpClient, fileDir string, index int, vbList []uin
 		utils:                         utils,
 		isSource:                      strings.Contains(dcpClient.Name, base.SourceClusterName),
 		bufferCap:                     bufferCap,
+		binFileCodec:                  dcpClient.dcpDriver.binFileCodec,
+		storage:                       dcpClient.dcpDriver.storage,
 		migrationMapping:              migrationMapping,
 		mobileCompatible:              dcpClient.dcpDriver.mobileCompatible,
 		expDelMode:                    dcpClient.dcpDriver.expDelMode,
@@ -126,21 +136,29 @@ func (d *DcpHandler) compileMigrCollectionFiltersIfNeeded() error {
 }
 
 func (dh *DcpHandler) initialize() error {
+	err := dh.initializeBuckets()
+	if err != nil {
+		return err
+	}
+
+	if err := dh.compileMigrCollectionFiltersIfNeeded(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (dh *DcpHandler) initializeBuckets() error {
 	for _, vbno := range dh.vbList {
 		innerMap := make(map[int]*Bucket)
 		dh.bucketMap[vbno] = innerMap
 		for i := 0; i < dh.numberOfBins; i++ {
-			bucket, err := NewBucket(dh.fileDir, vbno, i, dh.fdPool, dh.logger, dh.bufferCap)
+			bucket, err := NewBucket(dh.fileDir, vbno, i, dh.fdPool, dh.logger, dh.bufferCap, dh.binFileCodec, dh.storage)
 			if err != nil {
 				return err
 			}
 			innerMap[i] = bucket
 		}
 	}
-
-	if err := dh.compileMigrCollectionFiltersIfNeeded(); err != nil {
-		return err
-	}
 	return nil
 }
 
@@ -172,8 +190,16 @@ func (dh *DcpHandler) processData() {
 		select {
 		case <-dh.finChan:
 			goto done
-		case mut := <-dh.dataChan:
-			dh.processMutation(mut)
+		case item := <-dh.dataChan:
+			switch event := item.(type) {
+			case *Mutation:
+				dh.throttle(event)
+				dh.processMutation(event)
+			case *rollbackEvent:
+				dh.processRollback(event)
+			case *rotateEvent:
+				dh.processRotate(event)
+			}
 		}
 	}
 done:
@@ -256,33 +282,160 @@ func (dh *DcpHandler) writeToDataChan(mut *Mutation) {
 	}
 }
 
+type rollbackEvent struct {
+	vbno          uint16
+	rollbackSeqno uint64
+	doneCh        chan error
+}
+
+// discards the records of vbno with seqno past rollbackSeqno from all of its bins
+// blocks until the mutations of the vb already queued have been written out and the discard is done
+func (dh *DcpHandler) rollback(vbno uint16, rollbackSeqno uint64) error {
+	event := &rollbackEvent{
+		vbno:          vbno,
+		rollbackSeqno: rollbackSeqno,
+		doneCh:        make(chan error, 1),
+	}
+
+	select {
+	case dh.dataChan <- event:
+	case <-dh.finChan:
+		return fmt.Errorf("%v DcpHandler %v stopped before rollback of vb %v", dh.dcpClient.Name, dh.index, vbno)
+	}
+
+	select {
+	case err := <-event.doneCh:
+		return err
+	case <-dh.finChan:
+		return fmt.Errorf("%v DcpHandler %v stopped before rollback of vb %v", dh.dcpClient.Name, dh.index, vbno)
+	}
+}
+
+func (dh *DcpHandler) processRollback(event *rollbackEvent) {
+	innerMap := dh.bucketMap[event.vbno]
+	if innerMap == nil {
+		event.doneCh <- fmt.Errorf("cannot find bucketMap for Vbno %v", event.vbno)
+		return
+	}
+
+	var discardedCnt int
+	for i := 0; i < dh.numberOfBins; i++ {
+		cnt, err := innerMap[i].rollback(event.rollbackSeqno)
+		if err != nil {
+			event.doneCh <- fmt.Errorf("error rolling back %v to seqno %v. err=%v", innerMap[i].fileName, event.rollbackSeqno, err)
+			return
+		}
+		discardedCnt += cnt
+	}
+
+	dh.logger.Infof("%v DcpHandler %v discarded %v records past seqno %v for vb %v\n", dh.dcpClient.Name, dh.index, discardedCnt, event.rollbackSeqno, event.vbno)
+	dh.dcpClient.dcpDriver.recordRollback(dh.window, event.vbno, event.rollbackSeqno)
+	event.doneCh <- nil
+}
+
+type rotateEvent struct {
+	window  int
+	fileDir string
+	doneCh  chan error
+}
+
+// flushes the mutations queued so far to the bin files of the current window, and writes the mutations after them
+// to new bin files in fileDir. Blocks until the files of the current window have been closed
+func (dh *DcpHandler) rotate(window int, fileDir string) error {
+	event := &rotateEvent{
+		window:  window,
+		fileDir: fileDir,
+		doneCh:  make(chan error, 1),
+	}
+
+	select {
+	case dh.dataChan <- event:
+	case <-dh.finChan:
+		return fmt.Errorf("%v DcpHandler %v stopped before rotating to window %v", dh.dcpClient.Name, dh.index, window)
+	}
+
+	select {
+	case err := <-event.doneCh:
+		return err
+	case <-dh.finChan:
+		return fmt.Errorf("%v DcpHandler %v stopped before rotating to window %v", dh.dcpClient.Name, dh.index, window)
+	}
+}
+
+func (dh *DcpHandler) processRotate(event *rotateEvent) {
+	err := dh.flushBuckets()
+	if err != nil {
+		event.doneCh <- err
+		return
+	}
+	for _, vbno := range dh.vbList {
+		for i := 0; i < dh.numberOfBins; i++ {
+			dh.bucketMap[vbno][i].closeFile()
+		}
+	}
+
+	dh.fileDir = event.fileDir
+	dh.window = event.window
+	event.doneCh <- dh.initializeBuckets()
+}
+
+func (dh *DcpHandler) flushBuckets() error {
+	for _, vbno := range dh.vbList {
+		for i := 0; i < dh.numberOfBins; i++ {
+			bucket := dh.bucketMap[vbno][i]
+			// an empty flush would leave the file as it is anyway
+			if bucket.index == 0 {
+				continue
+			}
+			err := bucket.flushToFile()
+			if err != nil {
+				return fmt.Errorf("error flushing to file %v. err=%v", bucket.fileName, err)
+			}
+		}
+	}
+	return nil
+}
+
 func (dh *DcpHandler) SnapshotMarker(snapshot gocbcore.DcpSnapshotMarker) {
 	dh.dcpClient.dcpDriver.checkpointManager.updateSnapshot(snapshot.VbID, snapshot.StartSeqNo, snapshot.EndSeqNo)
 }
 
 func (dh *DcpHandler) Mutation(mutation gocbcore.DcpMutation) {
-	dh.writeToDataChan(CreateMutation(mutation.VbID, mutation.Key, mutation.SeqNo, mutation.RevNo, mutation.Cas, mutation.Flags, mutation.Expiry, gomemcached.UPR_MUTATION, mutation.Value, mutation.Datatype, mutation.CollectionID, dh.xattrIterator, dh.dcpClient.dcpDriver.xattrKeysForNoCompare))
+	dh.writeToDataChan(CreateMutation(mutation.VbID, mutation.Key, mutation.SeqNo, mutation.RevNo, mutation.Cas, mutation.Flags, mutation.Expiry, gomemcached.UPR_MUTATION, mutation.Value, mutation.Datatype, mutation.CollectionID, dh.xattrIterator, dh.dcpClient.dcpDriver.xattrKeysForNoCompare, dh.dcpClient.dcpDriver.compareXattrs, dh.dcpClient.dcpDriver.semanticJsonCompare, dh.dcpClient.dcpDriver.ignoredJsonPaths.ForCollection(mutation.CollectionID)))
 }
 
 func (dh *DcpHandler) Deletion(deletion gocbcore.DcpDeletion) {
-	dh.writeToDataChan(CreateMutation(deletion.VbID, deletion.Key, deletion.SeqNo, deletion.RevNo, deletion.Cas, 0, 0, gomemcached.UPR_DELETION, deletion.Value, deletion.Datatype, deletion.CollectionID, dh.xattrIterator, dh.dcpClient.dcpDriver.xattrKeysForNoCompare))
+	dh.writeToDataChan(CreateMutation(deletion.VbID, deletion.Key, deletion.SeqNo, deletion.RevNo, deletion.Cas, 0, 0, gomemcached.UPR_DELETION, deletion.Value, deletion.Datatype, deletion.CollectionID, dh.xattrIterator, dh.dcpClient.dcpDriver.xattrKeysForNoCompare, dh.dcpClient.dcpDriver.compareXattrs, dh.dcpClient.dcpDriver.semanticJsonCompare, dh.dcpClient.dcpDriver.ignoredJsonPaths.ForCollection(deletion.CollectionID)))
 }
 
 func (dh *DcpHandler) Expiration(expiration gocbcore.DcpExpiration) {
-	dh.writeToDataChan(CreateMutation(expiration.VbID, expiration.Key, expiration.SeqNo, expiration.RevNo, expiration.Cas, 0, 0, gomemcached.UPR_EXPIRATION, nil, 0, expiration.CollectionID, dh.xattrIterator, dh.dcpClient.dcpDriver.xattrKeysForNoCompare))
+	dh.writeToDataChan(CreateMutation(expiration.VbID, expiration.Key, expiration.SeqNo, expiration.RevNo, expiration.Cas, 0, 0, gomemcached.UPR_EXPIRATION, nil, 0, expiration.CollectionID, dh.xattrIterator, dh.dcpClient.dcpDriver.xattrKeysForNoCompare, dh.dcpClient.dcpDriver.compareXattrs, dh.dcpClient.dcpDriver.semanticJsonCompare, dh.dcpClient.dcpDriver.ignoredJsonPaths.ForCollection(expiration.CollectionID)))
+}
+
+// Holds back the handler until the capture limits of the cluster allow for the doc. This is done once the doc has been
+// handed off by its callback, so that the callbacks of the connection are only held back once the data channel is full
+func (dh *DcpHandler) throttle(mut *Mutation) {
+	if !mut.IsMutation() && !mut.IsDeletion() && !mut.IsExpiration() {
+		return
+	}
+	dh.dcpClient.dcpDriver.captureThrottle.wait(len(mut.Key) + len(mut.Value))
 }
 
 func (dh *DcpHandler) End(streamEnd gocbcore.DcpStreamEnd, err error) {
+	if reopenableStreamError(err) {
+		dh.dcpClient.handleStreamInterruption(streamEnd.VbID, err)
+		return
+	}
 	dh.dcpClient.dcpDriver.handleVbucketCompletion(streamEnd.VbID, err, "dcp stream ended")
 }
 
 // want CreateCollection("github.com/couchbase/gocbcore/v10".DcpCollectionCreation)
 func (dh *DcpHandler) CreateCollection(creation gocbcore.DcpCollectionCreation) {
-	dh.writeToDataChan(CreateMutation(creation.VbID, creation.Key, creation.SeqNo, 0, 0, 0, 0, gomemcached.DCP_SYSTEM_EVENT, nil, 0, creation.CollectionID, nil, nil))
+	dh.writeToDataChan(CreateMutation(creation.VbID, creation.Key, creation.SeqNo, 0, 0, 0, 0, gomemcached.DCP_SYSTEM_EVENT, nil, 0, creation.CollectionID, nil, nil, false, false, nil))
 }
 
 func (dh *DcpHandler) DeleteCollection(deletion gocbcore.DcpCollectionDeletion) {
-	dh.writeToDataChan(CreateMutation(deletion.VbID, nil, deletion.SeqNo, 0, 0, 0, 0, gomemcached.DCP_SYSTEM_EVENT, nil, 0, deletion.CollectionID, nil, nil))
+	dh.writeToDataChan(CreateMutation(deletion.VbID, nil, deletion.SeqNo, 0, 0, 0, 0, gomemcached.DCP_SYSTEM_EVENT, nil, 0, deletion.CollectionID, nil, nil, false, false, nil))
 }
 
 func (dh *DcpHandler) FlushCollection(flush gocbcore.DcpCollectionFlush) {
@@ -291,17 +444,17 @@ func (dh *DcpHandler) FlushCollection(flush gocbcore.DcpCollectionFlush) {
 
 func (dh *DcpHandler) CreateScope(creation gocbcore.DcpScopeCreation) {
 	// Overloading collectionID field for scopeID because differ doesn't care
-	dh.writeToDataChan(CreateMutation(creation.VbID, nil, creation.SeqNo, 0, 0, 0, 0, gomemcached.DCP_SYSTEM_EVENT, nil, 0, creation.ScopeID, nil, nil))
+	dh.writeToDataChan(CreateMutation(creation.VbID, nil, creation.SeqNo, 0, 0, 0, 0, gomemcached.DCP_SYSTEM_EVENT, nil, 0, creation.ScopeID, nil, nil, false, false, nil))
 }
 
 func (dh *DcpHandler) DeleteScope(deletion gocbcore.DcpScopeDeletion) {
 	// Overloading collectionID field for scopeID because differ doesn't care
-	dh.writeToDataChan(CreateMutation(deletion.VbID, nil, deletion.SeqNo, 0, 0, 0, 0, gomemcached.DCP_SYSTEM_EVENT, nil, 0, deletion.ScopeID, nil, nil))
+	dh.writeToDataChan(CreateMutation(deletion.VbID, nil, deletion.SeqNo, 0, 0, 0, 0, gomemcached.DCP_SYSTEM_EVENT, nil, 0, deletion.ScopeID, nil, nil, false, false, nil))
 }
 
 func (dh *DcpHandler) ModifyCollection(modify gocbcore.DcpCollectionModification) {
 	// Overloading collectionID field for scopeID because differ doesn't care
-	dh.writeToDataChan(CreateMutation(modify.VbID, nil, modify.SeqNo, 0, 0, 0, 0, gomemcached.DCP_SYSTEM_EVENT, nil, 0, modify.CollectionID, nil, nil))
+	dh.writeToDataChan(CreateMutation(modify.VbID, nil, modify.SeqNo, 0, 0, 0, 0, gomemcached.DCP_SYSTEM_EVENT, nil, 0, modify.CollectionID, nil, nil, false, false, nil))
 }
 
 func (dh *DcpHandler) OSOSnapshot(oso gocbcore.DcpOSOSnapshot) {
@@ -313,7 +466,7 @@ func (dh *DcpHandler) SeqNoAdvanced(seqnoAdv gocbcore.DcpSeqNoAdvanced) {
 	// Eventhough such mutations/events are not streamed by the producer
 	// bySeqno stores the value of the current high seqno of the vbucket
 	// collectionId parameter of CreateMutation() is insignificant
-	dh.writeToDataChan(CreateMutation(seqnoAdv.VbID, nil, seqnoAdv.SeqNo, 0, 0, 0, 0, gomemcached.DCP_SEQNO_ADV, nil, 0, base.Uint32MaxVal, nil, nil))
+	dh.writeToDataChan(CreateMutation(seqnoAdv.VbID, nil, seqnoAdv.SeqNo, 0, 0, 0, 0, gomemcached.DCP_SEQNO_ADV, nil, 0, base.Uint32MaxVal, nil, nil, false, false, nil))
 }
 
 func (dh *DcpHandler) checkColMigrationFilters(mut *Mutation) []uint8 {
@@ -351,7 +504,7 @@ type Bucket struct {
 	data []byte
 	// current index in data for next write
 	index    int
-	file     *os.File
+	file     io.WriteCloser
 	fileName string
 
 	fdPoolCb fdp.FileOp
@@ -360,17 +513,20 @@ type Bucket struct {
 	logger *xdcrLog.CommonLogger
 
 	bufferCap int
+	// codec that the file is compressed with
+	codec   uint16
+	storage storage.Storage
 }
 
-func NewBucket(fileDir string, vbno uint16, bucketIndex int, fdPool fdp.FdPoolIface, logger *xdcrLog.CommonLogger, bufferCap int) (*Bucket, error) {
+func NewBucket(fileDir string, vbno uint16, bucketIndex int, fdPool fdp.FdPoolIface, logger *xdcrLog.CommonLogger, bufferCap int, codec uint16, storage storage.Storage) (*Bucket, error) {
 	fileName := utils.GetFileName(fileDir, vbno, bucketIndex)
 	var cb fdp.FileOp
 	var closeOp func() error
 	var err error
-	var file *os.File
+	var file io.WriteCloser
 
 	if fdPool == nil {
-		file, err = os.OpenFile(fileName, os.O_APPEND|os.O_WRONLY|os.O_CREATE, base.FileModeReadWrite)
+		file, err = storage.OpenForAppend(fileName)
 		if err != nil {
 			return nil, err
 		}
@@ -383,7 +539,7 @@ func NewBucket(fileDir string, vbno uint16, bucketIndex int, fdPool fdp.FdPoolIf
 			return fdPool.DeRegisterFileHandle(fileName)
 		}
 	}
-	return &Bucket{
+	bucket := &Bucket{
 		data:      make([]byte, bufferCap),
 		index:     0,
 		file:      file,
@@ -392,7 +548,37 @@ func NewBucket(fileDir string, vbno uint16, bucketIndex int, fdPool fdp.FdPoolIf
 		closeOp:   closeOp,
 		logger:    logger,
 		bufferCap: bufferCap,
-	}, nil
+		codec:     codec,
+		storage:   storage,
+	}
+	err = bucket.initFile()
+	if err != nil {
+		bucket.closeFile()
+		return nil, err
+	}
+	return bucket, nil
+}
+
+// a new file starts with the bin file header, whereas an existing file, e.g. one that is being appended to
+// after resuming from checkpoints, needs to have been written in the same format, and keeps its codec
+func (b *Bucket) initFile() error {
+	file, err := b.storage.Open(b.fileName)
+	if os.IsNotExist(err) {
+		return b.writeToFile(utils.AppendBinFileHeader(nil, b.codec))
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if file.Size() == 0 {
+		return b.writeToFile(utils.AppendBinFileHeader(nil, b.codec))
+	}
+	reader, err := utils.NewBinFileReader(b.fileName, file.Read, b.logger)
+	if err != nil {
+		return err
+	}
+	b.codec = reader.Codec()
+	return nil
 }
 
 func (b *Bucket) write(item []byte) error {
@@ -408,30 +594,172 @@ func (b *Bucket) write(item []byte) error {
 	return nil
 }
 
+// each flush writes a run of records sorted by key, with only the newest record of each key,
+// so that the file differ can merge the runs instead of sorting the whole file
 func (b *Bucket) flushToFile() error {
+	sortedData, err := utils.SortDedupAndFrameRecords(b.data[:b.index])
+	if err != nil {
+		return err
+	}
+	sortedData, err = utils.AppendFramesToBinFile(nil, sortedData, b.codec)
+	if err != nil {
+		return err
+	}
+
+	err = b.writeToFile(sortedData)
+	if err != nil {
+		return err
+	}
+	b.index = 0
+	return nil
+}
+
+func (b *Bucket) writeToFile(data []byte) error {
 	var numOfBytes int
 	var err error
 
 	if b.fdPoolCb != nil {
-		numOfBytes, err = b.fdPoolCb(b.data[:b.index])
+		numOfBytes, err = b.fdPoolCb(data)
 	} else {
-		numOfBytes, err = b.file.Write(b.data[:b.index])
+		numOfBytes, err = b.file.Write(data)
 	}
 	if err != nil {
 		return err
 	}
-	if numOfBytes != b.index {
-		return fmt.Errorf("Incomplete write. expected=%v, actual=%v", b.index, numOfBytes)
+	if numOfBytes != len(data) {
+		return fmt.Errorf("Incomplete write. expected=%v, actual=%v", len(data), numOfBytes)
 	}
-	b.index = 0
 	return nil
 }
 
+// discards the records with seqno past rollbackSeqno, both from the buffer and from the file
+// returns the number of records discarded
+func (b *Bucket) rollback(rollbackSeqno uint64) (int, error) {
+	keptLen, discardedCnt, err := discardRecordsPastSeqno(b.data[:b.index], rollbackSeqno)
+	if err != nil {
+		return 0, err
+	}
+	b.index = keptLen
+
+	fileData, err := b.storage.ReadFile(b.fileName)
+	if os.IsNotExist(err) {
+		// nothing has been flushed yet
+		return discardedCnt, nil
+	} else if err != nil {
+		return discardedCnt, err
+	}
+
+	keptFileData, fileDiscardedCnt, err := discardFramesPastSeqno(b.fileName, fileData, rollbackSeqno, b.logger)
+	if err != nil {
+		return discardedCnt, err
+	}
+	if fileDiscardedCnt == 0 {
+		return discardedCnt, nil
+	}
+
+	// the file is rewritten in place, since the handles opened for append need to keep appending to it
+	err = b.storage.WriteFile(b.fileName, keptFileData)
+	if err != nil {
+		return discardedCnt, err
+	}
+	return discardedCnt + fileDiscardedCnt, nil
+}
+
+// Discards the records of vbno with seqno past rollbackSeqno from its bin files in fileDir, which are no longer being captured into
+// returns the number of records discarded
+func RollbackBinFiles(fileDir string, vbno uint16, numberOfBins int, rollbackSeqno uint64, storage storage.Storage, logger *xdcrLog.CommonLogger) (int, error) {
+	var discardedCnt int
+	for i := 0; i < numberOfBins; i++ {
+		fileName := utils.GetFileName(fileDir, vbno, i)
+		fileData, err := storage.ReadFile(fileName)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return discardedCnt, err
+		}
+
+		keptFileData, fileDiscardedCnt, err := discardFramesPastSeqno(fileName, fileData, rollbackSeqno, logger)
+		if err != nil {
+			return discardedCnt, err
+		}
+		if fileDiscardedCnt == 0 {
+			continue
+		}
+		err = storage.WriteFile(fileName, keptFileData)
+		if err != nil {
+			return discardedCnt, err
+		}
+		discardedCnt += fileDiscardedCnt
+	}
+	return discardedCnt, nil
+}
+
+// compacts the serialized records in data in place, keeping only those with seqno not past rollbackSeqno
+// returns the length of the kept records and the number of records discarded
+func discardRecordsPastSeqno(data []byte, rollbackSeqno uint64) (int, int, error) {
+	var keptLen, discardedCnt int
+	for pos := 0; pos < len(data); {
+		recordLen, _, seqno, _, err := utils.ParseSerializedMutation(data[pos:])
+		if err != nil {
+			return 0, 0, err
+		}
+		if seqno <= rollbackSeqno {
+			copy(data[keptLen:], data[pos:pos+recordLen])
+			keptLen += recordLen
+		} else {
+			discardedCnt++
+		}
+		pos += recordLen
+	}
+	return keptLen, discardedCnt, nil
+}
+
+// reads the records framed in the bin file data, keeping only those with seqno not past rollbackSeqno
+// returns the bin file data of the kept records and the number of records discarded
+// corrupt records are dropped along with the discarded ones
+func discardFramesPastSeqno(fileName string, data []byte, rollbackSeqno uint64, logger *xdcrLog.CommonLogger) ([]byte, int, error) {
+	reader, err := utils.NewBinFileReader(fileName, bytes.NewReader(data).Read, logger)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var keptFrames []byte
+	var discardedCnt int
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, 0, err
+		}
+		_, _, seqno, _, err := utils.ParseSerializedMutation(record)
+		if err != nil {
+			return nil, 0, err
+		}
+		if seqno <= rollbackSeqno {
+			keptFrames = utils.AppendRecordFrame(keptFrames, record)
+		} else {
+			discardedCnt++
+		}
+	}
+
+	keptData, err := utils.AppendFramesToBinFile(utils.AppendBinFileHeader(nil, reader.Codec()), keptFrames, reader.Codec())
+	if err != nil {
+		return nil, 0, err
+	}
+	return keptData, discardedCnt, nil
+}
+
 func (b *Bucket) close() {
 	err := b.flushToFile()
 	if err != nil {
 		b.logger.Errorf("Error flushing to file %v at bucket close err=%v\n", b.fileName, err)
 	}
+	b.closeFile()
+}
+
+func (b *Bucket) closeFile() {
+	var err error
 	if b.fdPoolCb != nil {
 		err = b.closeOp()
 		if err != nil {
@@ -460,9 +788,15 @@ type Mutation struct {
 	ColFiltersMatched     []uint8 // Given a ordered list of filters, this list contains indexes of the ordered list of filter that matched
 	XattrIterator         *xdcrBase.XattrIterator
 	XattrKeysForNoCompare map[string]bool
+	// whether to digest each of the xattrs that are compared, instead of hashing them along with the body
+	CompareXattrs bool
+	// whether to canonicalize the body before hashing it, when it is JSON
+	SemanticJsonCompare bool
+	// JSON paths that are removed from the body before hashing it, when it is JSON
+	IgnoredJsonPaths [][]string
 }
 
-func CreateMutation(vbno uint16, key []byte, seqno, revId, cas uint64, flags, expiry uint32, opCode gomemcached.CommandCode, value []byte, datatype uint8, collectionId uint32, xattrIterator *xdcrBase.XattrIterator, xattrKeysForNoCompare map[string]bool) *Mutation {
+func CreateMutation(vbno uint16, key []byte, seqno, revId, cas uint64, flags, expiry uint32, opCode gomemcached.CommandCode, value []byte, datatype uint8, collectionId uint32, xattrIterator *xdcrBase.XattrIterator, xattrKeysForNoCompare map[string]bool, compareXattrs bool, semanticJsonCompare bool, ignoredJsonPaths [][]string) *Mutation {
 	return &Mutation{
 		Vbno:                  vbno,
 		Key:                   key,
@@ -477,6 +811,9 @@ func CreateMutation(vbno uint16, key []byte, seqno, revId, cas uint64, flags, ex
 		ColId:                 collectionId,
 		XattrIterator:         xattrIterator,
 		XattrKeysForNoCompare: xattrKeysForNoCompare,
+		CompareXattrs:         compareXattrs,
+		SemanticJsonCompare:   semanticJsonCompare,
+		IgnoredJsonPaths:      ignoredJsonPaths,
 	}
 }
 
@@ -536,6 +873,8 @@ func (m *Mutation) ToUprEvent() *xdcrBase.WrappedUprEvent {
 //	collectionId - 4 bytes
 //	colFiltersLen - 2 byte (number of collection migration filters)
 //	(per col filter) - 2 byte
+//	xattrDigestCnt - 2 byte (number of xattrs digested, which are only digested when comparing xattrs)
+//	(per xattr digest) - keyLen of 2 bytes, key, and digest of base.XattrDigestLen bytes
 
 // Darshan:TODO accomodate SGW xattr change from "import" to "_mou" when MB-60897 is checked-in
 func (mut *Mutation) Serialize() ([]byte, error) {
@@ -543,17 +882,20 @@ func (mut *Mutation) Serialize() ([]byte, error) {
 	var xattrSize uint32
 	var xattr []byte
 	var bodyWithoutXattr, trimmedXattrPlusBody, hlv []byte
+	var xattrDigests map[string][]byte
 	var importCas, pRev uint64
 	var err error
 	if mut.Datatype&xdcrBase.XattrDataType > 0 {
-		var KVsToBeExcluded map[string][]byte
+		var KVsToBeIncluded, KVsToBeExcluded map[string][]byte
 		bodyWithoutXattr, err = xdcrBase.StripXattrAndGetBody(mut.Value)
 		if err != nil {
 			return nil, err
 		}
 		xattrSize, _ = xdcrBase.GetXattrSize(mut.Value)
 		xattr = mut.Value[4 : xattrSize+4]
-		trimmedXattrPlusBody, KVsToBeExcluded, err = removeKVSubsetFromXattr(xattr, len(mut.Value), xattrSize, mut.XattrIterator, mut.XattrKeysForNoCompare, bodyWithoutXattr)
+		bodyLen := len(bodyWithoutXattr)
+		bodyWithoutXattr = mut.comparableBody(bodyWithoutXattr)
+		trimmedXattrPlusBody, KVsToBeIncluded, KVsToBeExcluded, err = removeKVSubsetFromXattr(xattr, len(mut.Value)-bodyLen+len(bodyWithoutXattr), xattrSize, mut.XattrIterator, mut.XattrKeysForNoCompare, bodyWithoutXattr)
 		if err != nil {
 			return nil, err
 		}
@@ -565,14 +907,27 @@ func (mut *Mutation) Serialize() ([]byte, error) {
 				return nil, err
 			}
 		}
-		bodyHash = sha512.Sum512(trimmedXattrPlusBody)
+		if mut.CompareXattrs {
+			// the xattrs are compared by their digests instead
+			xattrDigests = digestXattrs(KVsToBeIncluded)
+			bodyHash = sha512.Sum512(bodyWithoutXattr)
+		} else {
+			bodyHash = sha512.Sum512(trimmedXattrPlusBody)
+		}
 	} else {
-		bodyHash = sha512.Sum512(mut.Value)
+		bodyHash = sha512.Sum512(mut.comparableBody(mut.Value))
 	}
 
 	hlvLen := uint64(len(hlv))
 	keyLen := len(mut.Key)
-	ret := make([]byte, base.GetFixedSizeMutationLen(keyLen, hlvLen, mut.ColFiltersMatched))
+	xattrDigestKeys := make([]string, 0, len(xattrDigests))
+	xattrDigestsLen := 0
+	for xattrKey := range xattrDigests {
+		xattrDigestKeys = append(xattrDigestKeys, xattrKey)
+		xattrDigestsLen += base.XattrKeyLenVariable + len(xattrKey) + base.XattrDigestLen
+	}
+	sort.Strings(xattrDigestKeys)
+	ret := make([]byte, base.GetFixedSizeMutationLen(keyLen, hlvLen, mut.ColFiltersMatched)+xattrDigestsLen)
 
 	pos := 0
 	binary.BigEndian.PutUint16(ret[pos:pos+2], uint16(keyLen))
@@ -611,9 +966,42 @@ func (mut *Mutation) Serialize() ([]byte, error) {
 		binary.BigEndian.PutUint16(ret[pos:pos+2], uint16(colFilterId))
 		pos += 2
 	}
+	binary.BigEndian.PutUint16(ret[pos:pos+2], uint16(len(xattrDigestKeys)))
+	pos += 2
+	for _, xattrKey := range xattrDigestKeys {
+		binary.BigEndian.PutUint16(ret[pos:pos+2], uint16(len(xattrKey)))
+		pos += 2
+		copy(ret[pos:pos+len(xattrKey)], xattrKey)
+		pos += len(xattrKey)
+		copy(ret[pos:pos+base.XattrDigestLen], xattrDigests[xattrKey])
+		pos += base.XattrDigestLen
+	}
 	return ret, nil
 }
 
+// the body as it is hashed, without the JSON paths that are ignored, and canonicalized when JSON bodies are
+// compared semantically. Bodies that are not JSON are hashed as they are
+func (mut *Mutation) comparableBody(body []byte) []byte {
+	if (!mut.SemanticJsonCompare && len(mut.IgnoredJsonPaths) == 0) || mut.Datatype&base.JSONDataType == 0 {
+		return body
+	}
+	comparableBody, err := utils.ComparableJsonBody(body, mut.IgnoredJsonPaths, mut.SemanticJsonCompare)
+	if err != nil {
+		return body
+	}
+	return comparableBody
+}
+
+// digests each of the xattrs, by key
+func digestXattrs(xattrs map[string][]byte) map[string][]byte {
+	digests := make(map[string][]byte, len(xattrs))
+	for key, value := range xattrs {
+		digest := sha256.Sum256(value)
+		digests[key] = digest[:]
+	}
+	return digests
+}
+
 // This is function is used to remove specified KVs from the xattr and create a new one excluding them
 // @param xattr - denotes the original xattr
 // @param size - denotes the max size of the new xattr+docBody
@@ -621,13 +1009,13 @@ func (mut *Mutation) Serialize() ([]byte, error) {
 // @param xattrIterator - is a pointer to the xattrIterator object
 // @param keysToExclude - is map containing the keys to excluded from the xattr
 // @param bodyWithoutXatt - denotes the document body alone
-// Returns - trimmedXattr, KV pairs of the excluded Xattrs, error
-func removeKVSubsetFromXattr(xattr []byte, size int, xattrSize uint32, xattrIterator *xdcrBase.XattrIterator, keysToExclude map[string]bool, bodyWithoutXattr []byte) ([]byte, map[string][]byte, error) {
+// Returns - trimmedXattr, KV pairs of the included Xattrs, KV pairs of the excluded Xattrs, error
+func removeKVSubsetFromXattr(xattr []byte, size int, xattrSize uint32, xattrIterator *xdcrBase.XattrIterator, keysToExclude map[string]bool, bodyWithoutXattr []byte) ([]byte, map[string][]byte, map[string][]byte, error) {
 	var err error
 	var trimmedXattrPlusBody []byte = make([]byte, size)
 	err = xattrIterator.ResetXattrIterator(xattr, xattrSize)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	var key, value []byte
 	var KVsToBeIncluded map[string][]byte = make(map[string][]byte)
@@ -636,7 +1024,7 @@ func removeKVSubsetFromXattr(xattr []byte, size int, xattrSize uint32, xattrIter
 	for xattrIterator.HasNext() {
 		key, value, err = xattrIterator.Next()
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
 		keyStr := string(key)
 		_, exists := keysToExclude[keyStr]
@@ -654,9 +1042,9 @@ func removeKVSubsetFromXattr(xattr []byte, size int, xattrSize uint32, xattrIter
 	for _, key := range keys {
 		err = xattrComposer.WriteKV([]byte(key), KVsToBeIncluded[key])
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
 	}
 	trimmedXattrPlusBody, _ = xattrComposer.FinishAndAppendDocValue(bodyWithoutXattr, nil, nil)
-	return trimmedXattrPlusBody, KVsToBeExcluded, nil
+	return trimmedXattrPlusBody, KVsToBeIncluded, KVsToBeExcluded, nil
 }
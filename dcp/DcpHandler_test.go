@@ -0,0 +1,165 @@
+package dcp
+
+import (
+	"fmt"
+	"io"
+	"testing"
+
+	"xdcrDiffer/base"
+	"xdcrDiffer/storage"
+	"xdcrDiffer/utils"
+
+	"github.com/couchbase/gomemcached"
+	xdcrLog "github.com/couchbase/goxdcr/log"
+	"github.com/stretchr/testify/assert"
+)
+
+var logger = xdcrLog.NewLogger("dcp_test", xdcrLog.DefaultLoggerContext)
+
+func genSerializedMutation(t *testing.T, key string, seqno uint64) []byte {
+	mut := &Mutation{
+		Key:    []byte(key),
+		Seqno:  seqno,
+		Cas:    seqno,
+		OpCode: gomemcached.UPR_MUTATION,
+		Value:  []byte(key),
+	}
+	data, err := mut.Serialize()
+	assert.Nil(t, err)
+	return data
+}
+
+// the seqnos of the records in the bin file, in order
+func readBinFileSeqnos(t *testing.T, storage storage.Storage, fileName string) []uint64 {
+	file, err := storage.Open(fileName)
+	assert.Nil(t, err)
+	defer file.Close()
+	reader, err := utils.NewBinFileReader(fileName, file.Read, logger)
+	assert.Nil(t, err)
+	var seqnos []uint64
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return seqnos
+		}
+		assert.Nil(t, err)
+		_, _, seqno, _, err := utils.ParseSerializedMutation(record)
+		assert.Nil(t, err)
+		seqnos = append(seqnos, seqno)
+	}
+}
+
+func TestDiscardRecordsPastSeqno(t *testing.T) {
+	assert := assert.New(t)
+	var data []byte
+	for seqno := uint64(1); seqno <= 10; seqno++ {
+		data = append(data, genSerializedMutation(t, fmt.Sprintf("key_%v", seqno%3), seqno)...)
+	}
+
+	keptLen, discardedCnt, err := discardRecordsPastSeqno(data, 6)
+	assert.Nil(err)
+	assert.Equal(4, discardedCnt)
+	var seqnos []uint64
+	for pos := 0; pos < keptLen; {
+		recordLen, _, seqno, _, err := utils.ParseSerializedMutation(data[pos:keptLen])
+		assert.Nil(err)
+		seqnos = append(seqnos, seqno)
+		pos += recordLen
+	}
+	assert.Equal([]uint64{1, 2, 3, 4, 5, 6}, seqnos)
+
+	_, _, err = discardRecordsPastSeqno(data[:keptLen-1], 6)
+	assert.NotNil(err)
+}
+
+func TestBucketRollback(t *testing.T) {
+	for _, codec := range []uint16{base.BinFileCodecNone, base.BinFileCodecSnappy} {
+		t.Run(base.BinFileCodecNames[codec], func(t *testing.T) {
+			assert := assert.New(t)
+			storage := storage.NewMemoryStorage()
+			assert.Nil(storage.MkdirAll("/vb"))
+			recordLen := len(genSerializedMutation(t, "key_00", 1))
+			// a flush every 4 records
+			bucket, err := NewBucket("/vb", 0, 0, nil, logger, recordLen*4, codec, storage)
+			assert.Nil(err)
+
+			for seqno := uint64(1); seqno <= 10; seqno++ {
+				assert.Nil(bucket.write(genSerializedMutation(t, fmt.Sprintf("key_%02d", 20-seqno), seqno)))
+			}
+			// 8 records were flushed, in two sorted runs, and 2 are still in the buffer
+			assert.Equal([]uint64{4, 3, 2, 1, 8, 7, 6, 5}, readBinFileSeqnos(t, storage, bucket.fileName))
+
+			discardedCnt, err := bucket.rollback(6)
+			assert.Nil(err)
+			assert.Equal(4, discardedCnt)
+			assert.Equal([]uint64{4, 3, 2, 1, 6, 5}, readBinFileSeqnos(t, storage, bucket.fileName))
+			assert.Equal(0, bucket.index)
+
+			// mutations streamed after the rollback are appended to the truncated file
+			assert.Nil(bucket.write(genSerializedMutation(t, "key_99", 7)))
+			bucket.close()
+			assert.Equal([]uint64{4, 3, 2, 1, 6, 5, 7}, readBinFileSeqnos(t, storage, bucket.fileName))
+
+			// nothing past the rollback seqno leaves the file as it is
+			sizeBefore, err := storage.Size(bucket.fileName)
+			assert.Nil(err)
+			bucket, err = NewBucket("/vb", 0, 0, nil, logger, recordLen*4, codec, storage)
+			assert.Nil(err)
+			discardedCnt, err = bucket.rollback(100)
+			assert.Nil(err)
+			assert.Equal(0, discardedCnt)
+			sizeAfter, err := storage.Size(bucket.fileName)
+			assert.Nil(err)
+			assert.Equal(sizeBefore, sizeAfter)
+			bucket.close()
+		})
+	}
+}
+
+func TestDiscardFramesPastSeqnoDropsCorruptRecords(t *testing.T) {
+	assert := assert.New(t)
+	var frames []byte
+	for seqno := uint64(1); seqno <= 5; seqno++ {
+		frames = utils.AppendRecordFrame(frames, genSerializedMutation(t, fmt.Sprintf("key_%v", seqno), seqno))
+	}
+	data, err := utils.AppendFramesToBinFile(utils.AppendBinFileHeader(nil, base.BinFileCodecNone), frames, base.BinFileCodecNone)
+	assert.Nil(err)
+	// corrupt the checksum of the second record
+	data[base.BinFileHeaderLen+len(frames)/5+4] ^= 0xff
+
+	kept, discardedCnt, err := discardFramesPastSeqno("test", data, 3, logger)
+	assert.Nil(err)
+	assert.Equal(2, discardedCnt)
+	storage := storage.NewMemoryStorage()
+	assert.Nil(storage.WriteFile("/test", kept))
+	assert.Equal([]uint64{1, 3}, readBinFileSeqnos(t, storage, "/test"))
+}
+
+func TestRollbackBinFiles(t *testing.T) {
+	assert := assert.New(t)
+	storage := storage.NewMemoryStorage()
+	assert.Nil(storage.MkdirAll("/window"))
+	// vb 0 has both bins, while vb 1 has only its first
+	for _, vbBin := range [][2]int{{0, 0}, {0, 1}, {1, 0}} {
+		bucket, err := NewBucket("/window", uint16(vbBin[0]), vbBin[1], nil, logger, 1024, base.BinFileCodecNone, storage)
+		assert.Nil(err)
+		for seqno := uint64(1); seqno <= 4; seqno++ {
+			assert.Nil(bucket.write(genSerializedMutation(t, fmt.Sprintf("key_%v_%v", vbBin[1], seqno), seqno)))
+		}
+		bucket.close()
+	}
+
+	discardedCnt, err := RollbackBinFiles("/window", 0, 2, 2, storage, logger)
+	assert.Nil(err)
+	assert.Equal(4, discardedCnt)
+	assert.Equal([]uint64{1, 2}, readBinFileSeqnos(t, storage, utils.GetFileName("/window", 0, 0)))
+	assert.Equal([]uint64{1, 2}, readBinFileSeqnos(t, storage, utils.GetFileName("/window", 0, 1)))
+	// other vbs are left as they are
+	assert.Equal([]uint64{1, 2, 3, 4}, readBinFileSeqnos(t, storage, utils.GetFileName("/window", 1, 0)))
+
+	// a bin file that does not exist has nothing to roll back
+	discardedCnt, err = RollbackBinFiles("/window", 1, 2, 0, storage, logger)
+	assert.Nil(err)
+	assert.Equal(4, discardedCnt)
+	assert.Len(readBinFileSeqnos(t, storage, utils.GetFileName("/window", 1, 0)), 0)
+}
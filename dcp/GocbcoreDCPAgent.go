@@ -16,6 +16,8 @@ import (
 type GocbcoreDCPFeed struct {
 	base.GocbcoreAgentCommon
 	dcpAgent *gocbcore.DCPAgent
+	// 0 for the default size of gocbcore
+	flowControlBufferSize int
 }
 
 func (f *GocbcoreDCPFeed) setupDCPAgent(auth interface{}, collections bool, ref *metadata.RemoteClusterReference) error {
@@ -89,6 +91,7 @@ func (f *GocbcoreDCPFeed) setupDCPAgentConfig(authMech interface{}, collections
 		CompressionConfig: gocbcore.CompressionConfig{Enabled: true},
 		IoConfig:          gocbcore.IoConfig{UseCollections: collections},
 		HTTPConfig:        gocbcore.HTTPConfig{ConnectTimeout: f.SetupTimeout},
+		DCPConfig:         gocbcore.DCPConfig{BufferSize: f.flowControlBufferSize},
 	}, useTLS, nil
 }
 
@@ -163,7 +166,7 @@ func (f *GocbcoreDCPFeed) setupGocbcoreDCPAgent(config *gocbcore.DCPAgentConfig,
 	return
 }
 
-func NewGocbcoreDCPFeed(id string, servers []string, bucketName string, auth interface{}, collections bool, ref *metadata.RemoteClusterReference) (*GocbcoreDCPFeed, error) {
+func NewGocbcoreDCPFeed(id string, servers []string, bucketName string, auth interface{}, collections bool, ref *metadata.RemoteClusterReference, flowControlBufferSize int) (*GocbcoreDCPFeed, error) {
 	gocbcoreDcpFeed := &GocbcoreDCPFeed{
 		GocbcoreAgentCommon: base.GocbcoreAgentCommon{
 			Name:         id,
@@ -171,7 +174,8 @@ func NewGocbcoreDCPFeed(id string, servers []string, bucketName string, auth int
 			BucketName:   bucketName,
 			SetupTimeout: time.Duration(base.SetupTimeoutSeconds) * time.Second,
 		},
-		dcpAgent: nil,
+		dcpAgent:              nil,
+		flowControlBufferSize: flowControlBufferSize,
 	}
 
 	if auth == nil {
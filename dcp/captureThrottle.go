@@ -0,0 +1,124 @@
+package dcp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"xdcrDiffer/base"
+	"xdcrDiffer/utils"
+)
+
+// The bytes and mutations per second that the dcp streams of a cluster are captured at, where 0 means no limit
+type CaptureLimits struct {
+	BytesPerSec     uint64 `json:"bytesPerSec"`
+	MutationsPerSec uint64 `json:"mutationsPerSec"`
+}
+
+// The size of the dcp flow control buffer for the limits, or 0 for the default size when bytes are not limited.
+// A smaller buffer keeps the producer from sending far ahead of what the throttle lets through
+func (l CaptureLimits) flowControlBufferSize() int {
+	if l.BytesPerSec == 0 {
+		return 0
+	}
+	size := l.BytesPerSec * base.DcpFlowControlBufferSecs
+	if size < base.DcpFlowControlMinBufferSize {
+		return base.DcpFlowControlMinBufferSize
+	}
+	if size > base.DcpFlowControlMaxBufferSize {
+		return base.DcpFlowControlMaxBufferSize
+	}
+	return int(size)
+}
+
+// Paces the handlers of a cluster to its capture limits as they take the docs off their data channels. The dcp
+// callbacks are only held back once the data channel of their handler is full, which holds back the flow control acks
+// of the connection too, so that the producer stops sending once the buffer is full
+type captureThrottle struct {
+	limits           CaptureLimits
+	bytesLimiter     *utils.RateLimiter
+	mutationsLimiter *utils.RateLimiter
+	// closed when the limits change or the throttle stops, to let the callbacks waiting on the old limits through
+	changedCh chan bool
+	stopped   bool
+	mtx       sync.RWMutex
+}
+
+func newCaptureThrottle(limits CaptureLimits) *captureThrottle {
+	t := &captureThrottle{}
+	t.setLimits(limits)
+	return t
+}
+
+func (t *captureThrottle) setLimits(limits CaptureLimits) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.stopped {
+		return
+	}
+	if t.changedCh != nil {
+		close(t.changedCh)
+	}
+	t.limits = limits
+	// the docs that the old limits have let through ahead of time are paid off under the new ones
+	bytesLimiter := utils.NewRateLimiter(limits.BytesPerSec, false)
+	bytesLimiter.CarryOver(t.bytesLimiter)
+	mutationsLimiter := utils.NewRateLimiter(limits.MutationsPerSec, false)
+	mutationsLimiter.CarryOver(t.mutationsLimiter)
+	t.bytesLimiter = bytesLimiter
+	t.mutationsLimiter = mutationsLimiter
+	t.changedCh = make(chan bool)
+}
+
+func (t *captureThrottle) getLimits() CaptureLimits {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.limits
+}
+
+// blocks until a mutation of the given size can be captured
+func (t *captureThrottle) wait(size int) {
+	t.mtx.RLock()
+	bytesLimiter, mutationsLimiter, changedCh := t.bytesLimiter, t.mutationsLimiter, t.changedCh
+	t.mtx.RUnlock()
+
+	mutationsLimiter.WaitN(1, changedCh)
+	bytesLimiter.WaitN(uint64(size), changedCh)
+}
+
+// lets the callbacks that are waiting through, and every callback after them
+func (t *captureThrottle) stop() {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.stopped {
+		return
+	}
+	t.stopped = true
+	close(t.changedCh)
+	t.limits = CaptureLimits{}
+	t.bytesLimiter = nil
+	t.mutationsLimiter = nil
+}
+
+// Loads the capture limits by cluster name from a capture limits file. Clusters that are left out of the file keep
+// their limits
+func LoadCaptureLimits(fileName string) (map[string]*CaptureLimits, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	limitsByCluster := make(map[string]*CaptureLimits)
+	err = json.Unmarshal(data, &limitsByCluster)
+	if err != nil {
+		return nil, err
+	}
+	for name, limits := range limitsByCluster {
+		if name != base.SourceClusterName && name != base.TargetClusterName {
+			return nil, fmt.Errorf("unknown cluster %v, which needs to be either %v or %v", name, base.SourceClusterName, base.TargetClusterName)
+		}
+		if limits == nil {
+			return nil, fmt.Errorf("no limits for cluster %v", name)
+		}
+	}
+	return limitsByCluster, nil
+}
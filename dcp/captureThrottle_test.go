@@ -0,0 +1,95 @@
+package dcp
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"xdcrDiffer/base"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlowControlBufferSize(t *testing.T) {
+	assert := assert.New(t)
+	// the default size when bytes are not limited
+	assert.Equal(0, CaptureLimits{MutationsPerSec: 100}.flowControlBufferSize())
+	// a few seconds of the bytes limit, within the bounds
+	assert.Equal(base.DcpFlowControlMinBufferSize, CaptureLimits{BytesPerSec: 1}.flowControlBufferSize())
+	assert.Equal(4*1024*1024, CaptureLimits{BytesPerSec: 2 * 1024 * 1024}.flowControlBufferSize())
+	assert.Equal(base.DcpFlowControlMaxBufferSize, CaptureLimits{BytesPerSec: 1024 * 1024 * 1024}.flowControlBufferSize())
+}
+
+func TestLoadCaptureLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "captureLimitsTest")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	fileName := dir + base.FileDirDelimiter + "captureLimits.json"
+
+	tests := []struct {
+		name     string
+		contents string
+		limits   map[string]*CaptureLimits
+		hasErr   bool
+	}{
+		{"both clusters", `{"source": {"bytesPerSec": 1024, "mutationsPerSec": 10}, "target": {"bytesPerSec": 0}}`,
+			map[string]*CaptureLimits{base.SourceClusterName: {BytesPerSec: 1024, MutationsPerSec: 10}, base.TargetClusterName: {}}, false},
+		// the clusters left out keep their limits
+		{"one cluster", `{"target": {"mutationsPerSec": 10}}`, map[string]*CaptureLimits{base.TargetClusterName: {MutationsPerSec: 10}}, false},
+		{"no clusters", `{}`, map[string]*CaptureLimits{}, false},
+		{"unknown cluster", `{"other": {"bytesPerSec": 1024}}`, nil, true},
+		{"no limits", `{"source": null}`, nil, true},
+		{"not json", `{"source":`, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Nil(t, ioutil.WriteFile(fileName, []byte(test.contents), base.FileModeReadWrite))
+			limits, err := LoadCaptureLimits(fileName)
+			assert.Equal(t, test.hasErr, err != nil, err)
+			assert.Equal(t, test.limits, limits)
+		})
+	}
+
+	_, err = LoadCaptureLimits(dir + base.FileDirDelimiter + "missing.json")
+	assert.NotNil(t, err)
+}
+
+func TestCaptureThrottle(t *testing.T) {
+	assert := assert.New(t)
+	throttle := newCaptureThrottle(CaptureLimits{MutationsPerSec: 1})
+	// the burst of a limit of 1 per second is a single mutation
+	throttle.wait(10)
+	waitInBackground := func() chan bool {
+		doneCh := make(chan bool)
+		go func() {
+			throttle.wait(10)
+			close(doneCh)
+		}()
+		return doneCh
+	}
+
+	// a change of limits lets the waits on the old limits through, and the new limits pay off the old ones' deficit
+	doneCh := waitInBackground()
+	time.Sleep(10 * time.Millisecond)
+	throttle.setLimits(CaptureLimits{MutationsPerSec: 2})
+	select {
+	case <-doneCh:
+	case <-time.After(5 * time.Second):
+		assert.Fail("the wait was not let through by the change of limits")
+	}
+	assert.Equal(CaptureLimits{MutationsPerSec: 2}, throttle.getLimits())
+	doneCh = waitInBackground()
+	select {
+	case <-doneCh:
+		assert.Fail("the change of limits started over with a full burst")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// stopping lets the waits through, and every wait after them
+	throttle.stop()
+	<-doneCh
+	throttle.wait(1000)
+	throttle.setLimits(CaptureLimits{MutationsPerSec: 1})
+	assert.Equal(CaptureLimits{}, throttle.getLimits())
+}
@@ -2,10 +2,13 @@ package differ
 
 import (
 	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"reflect"
 	"time"
 	"xdcrDiffer/base"
+	"xdcrDiffer/utils"
 
 	"github.com/couchbase/gocbcore/v10"
 	"github.com/couchbase/gocbcore/v10/memd"
@@ -16,6 +19,8 @@ import (
 type GocbcoreAgent struct {
 	base.GocbcoreAgentCommon
 	agent *gocbcore.Agent
+	// limits the ops sent to the bucket across all the calls of the agent, and is nil when they are not limited
+	rateLimiter *utils.RateLimiter
 }
 
 func (a *GocbcoreAgent) setupAgent(auth interface{}, batchSize int, capability metadata.Capability, reference *metadata.RemoteClusterReference) error {
@@ -118,13 +123,30 @@ func (a *GocbcoreAgent) setupGocbcoreAgent(config *gocbcore.AgentConfig) (err er
 	return
 }
 
+func (a *GocbcoreAgent) Close() error {
+	// the agent is not created when its config is invalid
+	if a.agent == nil {
+		return nil
+	}
+	return a.agent.Close()
+}
+
+// whether an op failed because the server could not keep up with the ops sent to it
+func isOverloadedError(err error) bool {
+	return errors.Is(err, gocbcore.ErrTimeout) || errors.Is(err, gocbcore.ErrTemporaryFailure) || errors.Is(err, gocbcore.ErrBusy)
+}
+
 func (a *GocbcoreAgent) Get(key string, callbackFunc func(result *gocbcore.GetResult, err error), colId uint32) error {
 	opts := gocbcore.GetOptions{
 		Key:           []byte(key),
 		RetryStrategy: nil,
 		CollectionID:  colId,
 	}
-	_, err := a.agent.Get(opts, callbackFunc)
+	a.rateLimiter.Wait()
+	_, err := a.agent.Get(opts, func(result *gocbcore.GetResult, err error) {
+		a.rateLimiter.Observe(isOverloadedError(err))
+		callbackFunc(result, err)
+	})
 	return err
 }
 
@@ -134,7 +156,11 @@ func (a *GocbcoreAgent) GetMeta(key string, callbackFunc func(result *gocbcore.G
 		RetryStrategy: nil,
 		CollectionID:  colId,
 	}
-	_, err := a.agent.GetMeta(opts, callbackFunc)
+	a.rateLimiter.Wait()
+	_, err := a.agent.GetMeta(opts, func(result *gocbcore.GetMetaResult, err error) {
+		a.rateLimiter.Observe(isOverloadedError(err))
+		callbackFunc(result, err)
+	})
 	return err
 }
 
@@ -165,11 +191,103 @@ func (a *GocbcoreAgent) GetHlv(key string, callbackFunc func(result *gocbcore.Lo
 		RetryStrategy: nil,
 		CollectionID:  colId,
 	}
-	_, err := a.agent.LookupIn(opts, callbackFunc)
+	a.rateLimiter.Wait()
+	_, err := a.agent.LookupIn(opts, func(result *gocbcore.LookupInResult, err error) {
+		a.rateLimiter.Observe(isOverloadedError(err))
+		callbackFunc(result, err)
+	})
+	return err
+}
+
+// Gets all the xattrs of a doc, by key. The keys of the xattrs are listed first, and the xattrs are then looked up
+// one lookup after another, since each lookup can only get so many of them
+func (a *GocbcoreAgent) GetXattrs(key string, callbackFunc func(xattrs map[string][]byte, err error), colId uint32) error {
+	tocCallbackFunc := func(result *gocbcore.LookupInResult, err error) {
+		a.rateLimiter.Observe(isOverloadedError(err))
+		if err == nil && result.Ops[0].Err != nil {
+			err = result.Ops[0].Err
+		}
+		if err != nil {
+			callbackFunc(nil, err)
+			return
+		}
+		var xattrKeys []string
+		err = json.Unmarshal(result.Ops[0].Value, &xattrKeys)
+		if err != nil {
+			callbackFunc(nil, fmt.Errorf("unable to parse the keys of the xattrs of %v: %v", key, err))
+			return
+		}
+		a.lookupXattrsAsync(key, xattrKeys, make(map[string][]byte, len(xattrKeys)), colId, callbackFunc)
+	}
+	a.rateLimiter.Wait()
+	_, err := a.agent.LookupIn(xattrsLookupInOptions(key, []string{base.XattrTocPath}, colId), tocCallbackFunc)
 	return err
 }
 
-func NewGocbcoreAgent(id string, servers []string, bucketName string, auth interface{}, batchSize int, capability metadata.Capability, reference *metadata.RemoteClusterReference) (*GocbcoreAgent, error) {
+// looks up the first of xattrKeys into xattrs, and then the rest, calling callbackFunc once all have been looked up
+func (a *GocbcoreAgent) lookupXattrs(key string, xattrKeys []string, xattrs map[string][]byte, colId uint32, callbackFunc func(xattrs map[string][]byte, err error)) {
+	if len(xattrKeys) == 0 {
+		callbackFunc(xattrs, nil)
+		return
+	}
+	lookupKeys := xattrKeys
+	if len(lookupKeys) > base.MaxSubdocPathsPerLookup {
+		lookupKeys = lookupKeys[:base.MaxSubdocPathsPerLookup]
+	}
+	a.rateLimiter.Wait()
+	_, err := a.agent.LookupIn(xattrsLookupInOptions(key, lookupKeys, colId), func(result *gocbcore.LookupInResult, err error) {
+		a.rateLimiter.Observe(isOverloadedError(err))
+		if err != nil {
+			callbackFunc(nil, err)
+			return
+		}
+		for i, op := range result.Ops {
+			if errors.Is(op.Err, gocbcore.ErrPathNotFound) {
+				// removed since its key was listed
+				continue
+			} else if op.Err != nil {
+				callbackFunc(nil, op.Err)
+				return
+			}
+			xattrs[lookupKeys[i]] = op.Value
+		}
+		a.lookupXattrsAsync(key, xattrKeys[len(lookupKeys):], xattrs, colId, callbackFunc)
+	})
+	if err != nil {
+		callbackFunc(nil, err)
+	}
+}
+
+// The lookups that follow one another are sent from the callbacks of the ones before. When ops are rate limited,
+// they are sent from a goroutine of their own instead, so that waiting for the limit does not hold up the callbacks
+// of the other ops
+func (a *GocbcoreAgent) lookupXattrsAsync(key string, xattrKeys []string, xattrs map[string][]byte, colId uint32, callbackFunc func(xattrs map[string][]byte, err error)) {
+	if a.rateLimiter == nil || len(xattrKeys) == 0 {
+		a.lookupXattrs(key, xattrKeys, xattrs, colId, callbackFunc)
+		return
+	}
+	go a.lookupXattrs(key, xattrKeys, xattrs, colId, callbackFunc)
+}
+
+func xattrsLookupInOptions(key string, paths []string, colId uint32) gocbcore.LookupInOptions {
+	opts := gocbcore.LookupInOptions{
+		Key:           []byte(key),
+		Flags:         memd.SubdocDocFlagAccessDeleted,
+		RetryStrategy: nil,
+		CollectionID:  colId,
+	}
+	for _, path := range paths {
+		opts.Ops = append(opts.Ops, gocbcore.SubDocOp{
+			Op:    memd.SubDocOpType(memd.CmdSubDocGet),
+			Flags: memd.SubdocFlag(xdcrBase.SUBDOC_FLAG_XATTR),
+			Path:  path,
+			Value: nil,
+		})
+	}
+	return opts
+}
+
+func NewGocbcoreAgent(id string, servers []string, bucketName string, auth interface{}, batchSize int, capability metadata.Capability, reference *metadata.RemoteClusterReference, rateLimiter *utils.RateLimiter) (*GocbcoreAgent, error) {
 	gocbcoreAgent := &GocbcoreAgent{
 		GocbcoreAgentCommon: base.GocbcoreAgentCommon{
 			Name:         id,
@@ -177,7 +295,8 @@ func NewGocbcoreAgent(id string, servers []string, bucketName string, auth inter
 			BucketName:   bucketName,
 			SetupTimeout: time.Duration(base.SetupTimeoutSeconds) * time.Second,
 		},
-		agent: nil,
+		agent:       nil,
+		rateLimiter: rateLimiter,
 	}
 
 	err := gocbcoreAgent.setupAgent(auth, batchSize, capability, reference)
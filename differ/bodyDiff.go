@@ -0,0 +1,121 @@
+package differ
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A value of a JSON body that differs between the source and target versions of a doc, at Path, which is a JSON
+// Pointer (RFC 6901) into the body. The side that the value is missing from is left out
+type BodyChange struct {
+	Path   string
+	Source json.RawMessage `json:",omitempty"`
+	Target json.RawMessage `json:",omitempty"`
+}
+
+// diffs the JSON bodies of the source and target versions of a doc, value by value. Objects are diffed by key and
+// arrays by index. Returns nil if either body is not JSON, since binary bodies can only be told apart as a whole
+func diffJsonBodies(source, target []byte) []*BodyChange {
+	sourceValue, err := decodeJsonBody(source)
+	if err != nil {
+		return nil
+	}
+	targetValue, err := decodeJsonBody(target)
+	if err != nil {
+		return nil
+	}
+	var changes []*BodyChange
+	diffJsonValues("", sourceValue, targetValue, &changes)
+	return changes
+}
+
+// numbers are kept as they are written, so that they are neither rounded nor told apart by how they are decoded.
+// A body with anything but whitespace after its first JSON value is not JSON
+func decodeJsonBody(body []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value interface{}
+	err := decoder.Decode(&value)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("body has data after its JSON value")
+	}
+	return value, nil
+}
+
+func diffJsonValues(path string, source, target interface{}, changes *[]*BodyChange) {
+	switch sourceValue := source.(type) {
+	case map[string]interface{}:
+		if targetValue, ok := target.(map[string]interface{}); ok {
+			diffJsonObjects(path, sourceValue, targetValue, changes)
+			return
+		}
+	case []interface{}:
+		if targetValue, ok := target.([]interface{}); ok {
+			diffJsonArrays(path, sourceValue, targetValue, changes)
+			return
+		}
+	default:
+		if source == target {
+			return
+		}
+	}
+	*changes = append(*changes, &BodyChange{Path: path, Source: encodeJsonValue(source), Target: encodeJsonValue(target)})
+}
+
+func diffJsonObjects(path string, source, target map[string]interface{}, changes *[]*BodyChange) {
+	keys := make([]string, 0, len(source)+len(target))
+	for key := range source {
+		keys = append(keys, key)
+	}
+	for key := range target {
+		if _, exists := source[key]; !exists {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		keyPath := path + "/" + escapeJsonPointerToken(key)
+		sourceValue, sourceExists := source[key]
+		targetValue, targetExists := target[key]
+		if !sourceExists {
+			*changes = append(*changes, &BodyChange{Path: keyPath, Target: encodeJsonValue(targetValue)})
+		} else if !targetExists {
+			*changes = append(*changes, &BodyChange{Path: keyPath, Source: encodeJsonValue(sourceValue)})
+		} else {
+			diffJsonValues(keyPath, sourceValue, targetValue, changes)
+		}
+	}
+}
+
+func diffJsonArrays(path string, source, target []interface{}, changes *[]*BodyChange) {
+	for i := 0; i < len(source) || i < len(target); i++ {
+		indexPath := path + "/" + strconv.Itoa(i)
+		if i >= len(source) {
+			*changes = append(*changes, &BodyChange{Path: indexPath, Target: encodeJsonValue(target[i])})
+		} else if i >= len(target) {
+			*changes = append(*changes, &BodyChange{Path: indexPath, Source: encodeJsonValue(source[i])})
+		} else {
+			diffJsonValues(indexPath, source[i], target[i], changes)
+		}
+	}
+}
+
+func encodeJsonValue(value interface{}) json.RawMessage {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil
+	}
+	return encoded
+}
+
+func escapeJsonPointerToken(token string) string {
+	return strings.Replace(strings.Replace(token, "~", "~0", -1), "/", "~1", -1)
+}
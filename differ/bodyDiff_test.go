@@ -0,0 +1,67 @@
+package differ
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffJsonBodies(t *testing.T) {
+	fmt.Println("============== Test case start: TestDiffJsonBodies =================")
+	tests := []struct {
+		name    string
+		source  string
+		target  string
+		changes []*BodyChange
+	}{
+		{"same", `{"a":1,"b":[1,2]}`, `{ "b": [1, 2], "a": 1 }`, nil},
+		{"changed value", `{"a":1,"b":"x"}`, `{"a":2,"b":"x"}`, []*BodyChange{{Path: "/a", Source: json.RawMessage(`1`), Target: json.RawMessage(`2`)}}},
+		{"numbers as written", `{"a":1.0}`, `{"a":1}`, []*BodyChange{{Path: "/a", Source: json.RawMessage(`1.0`), Target: json.RawMessage(`1`)}}},
+		{"big numbers", `{"a":12345678901234567890}`, `{"a":12345678901234567891}`,
+			[]*BodyChange{{Path: "/a", Source: json.RawMessage(`12345678901234567890`), Target: json.RawMessage(`12345678901234567891`)}}},
+		{"missing keys", `{"a":1,"c":{"d":true}}`, `{"b":2,"c":{}}`, []*BodyChange{
+			{Path: "/a", Source: json.RawMessage(`1`)},
+			{Path: "/b", Target: json.RawMessage(`2`)},
+			{Path: "/c/d", Source: json.RawMessage(`true`)},
+		}},
+		{"arrays by index", `[1,[2,3],4]`, `[1,[2,5]]`, []*BodyChange{
+			{Path: "/1/1", Source: json.RawMessage(`3`), Target: json.RawMessage(`5`)},
+			{Path: "/2", Source: json.RawMessage(`4`)},
+		}},
+		{"changed type", `{"a":{"b":1}}`, `{"a":[1]}`, []*BodyChange{{Path: "/a", Source: json.RawMessage(`{"b":1}`), Target: json.RawMessage(`[1]`)}}},
+		{"whole body", `1`, `"1"`, []*BodyChange{{Path: "", Source: json.RawMessage(`1`), Target: json.RawMessage(`"1"`)}}},
+		{"escaped keys", `{"a/b":1,"c~d":1}`, `{"a/b":2,"c~d":2}`, []*BodyChange{
+			{Path: "/a~1b", Source: json.RawMessage(`1`), Target: json.RawMessage(`2`)},
+			{Path: "/c~0d", Source: json.RawMessage(`1`), Target: json.RawMessage(`2`)},
+		}},
+		{"trailing whitespace", "{\"a\":1}\n ", `{"a":1}`, nil},
+		{"binary source", "\x00\x01", `{"a":1}`, nil},
+		{"empty target", `{"a":1}`, ``, nil},
+		// a body that only starts with a JSON value is not JSON
+		{"trailing value", `{"a":1}{"a":2}`, `{"a":2}`, nil},
+		{"trailing garbage", `{"a":1}`, `{"a":2} xyz`, nil},
+		{"trailing delimiter", `[1]]`, `[2]`, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.changes, diffJsonBodies([]byte(test.source), []byte(test.target)))
+		})
+	}
+}
+
+func TestDecodeJsonBody(t *testing.T) {
+	fmt.Println("============== Test case start: TestDecodeJsonBody =================")
+	assert := assert.New(t)
+	value, err := decodeJsonBody([]byte(`{"a":12345678901234567890}`))
+	assert.Nil(err)
+	assert.Equal(json.Number("12345678901234567890"), value.(map[string]interface{})["a"])
+
+	_, err = decodeJsonBody([]byte(`{"a":1} {"a":2}`))
+	assert.NotNil(err)
+	_, err = decodeJsonBody([]byte(`"a" 1`))
+	assert.NotNil(err)
+	_, err = decodeJsonBody([]byte(`{"a":`))
+	assert.NotNil(err)
+}
@@ -0,0 +1,146 @@
+package differ
+
+import (
+	"bufio"
+	"container/heap"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"xdcrDiffer/base"
+	"xdcrDiffer/storage"
+	"xdcrDiffer/utils"
+
+	xdcrLog "github.com/couchbase/goxdcr/log"
+)
+
+// Merges the bin files of a capture window that is no longer being captured into, which are in windowDir,
+// into the bin files in fileDir, and removes windowDir. Each bin file that has changed is rewritten as
+// a single sorted run with only the newest record of each key, so that the files grow with the number of keys
+// rather than with the number of mutations captured
+// returns the number of bin files that have changed
+func MergeCaptureWindow(windowDir, fileDir string, numberOfVbuckets, numberOfBins int, storage storage.Storage, logger *xdcrLog.CommonLogger) (int, error) {
+	var mergedCnt int
+	for vbno := 0; vbno < numberOfVbuckets; vbno++ {
+		for bucketIndex := 0; bucketIndex < numberOfBins; bucketIndex++ {
+			merged, err := mergeWindowBinFile(utils.GetFileName(windowDir, uint16(vbno), bucketIndex),
+				utils.GetFileName(fileDir, uint16(vbno), bucketIndex), storage, logger)
+			if err != nil {
+				return mergedCnt, err
+			}
+			if merged {
+				mergedCnt++
+			}
+		}
+	}
+	return mergedCnt, storage.RemoveAll(windowDir)
+}
+
+// Merges the sorted runs of the window file and of the file into a single sorted run, which is streamed into
+// a local temporary file, so that neither file is held in memory, and then copied over the file.
+// returns whether the window file had any records to merge
+func mergeWindowBinFile(windowFileName, fileName string, storage storage.Storage, logger *xdcrLog.CommonLogger) (bool, error) {
+	windowRuns, windowCodec, err := scanSortedRuns(windowFileName, storage, logger)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if len(windowRuns) == 0 {
+		return false, nil
+	}
+
+	// the file keeps its codec
+	codec := windowCodec
+	fileRuns, fileCodec, err := scanSortedRuns(fileName, storage, logger)
+	if err == nil {
+		codec = fileCodec
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+
+	mergedFile, err := ioutil.TempFile("", "xdcrDiffer_window_")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(mergedFile.Name())
+	defer mergedFile.Close()
+
+	it := &runMergeIterator{}
+	defer it.close()
+	for _, binFile := range []struct {
+		name      string
+		codec     uint16
+		colIdRuns map[uint32][]*runRange
+	}{{fileName, fileCodec, fileRuns}, {windowFileName, windowCodec, windowRuns}} {
+		if len(binFile.colIdRuns) == 0 {
+			continue
+		}
+		file, err := storage.Open(binFile.name)
+		if err != nil {
+			return false, err
+		}
+		it.files = append(it.files, file)
+		for _, runs := range binFile.colIdRuns {
+			it.mergeHeap, err = appendSortedRunCursors(it.mergeHeap, file, binFile.name, binFile.codec, runs, logger)
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+	heap.Init(&it.mergeHeap)
+
+	err = writeMergedRecords(mergedFile, it, codec)
+	if err != nil {
+		return false, err
+	}
+
+	// the file is rewritten in place, as a rollback of it is
+	err = storage.WriteFile(fileName, nil)
+	if err != nil {
+		return false, err
+	}
+	_, err = mergedFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return false, err
+	}
+	appender, err := storage.OpenForAppend(fileName)
+	if err != nil {
+		return false, err
+	}
+	_, err = io.Copy(appender, bufio.NewReaderSize(mergedFile, base.ExternalSortIOBufferSize))
+	closeErr := appender.Close()
+	if err != nil {
+		return false, err
+	}
+	return true, closeErr
+}
+
+// writes the records of the iterator to file as a bin file of codec, a buffer of frames at a time
+func writeMergedRecords(file io.Writer, it *runMergeIterator, codec uint16) error {
+	_, err := file.Write(utils.AppendBinFileHeader(nil, codec))
+	if err != nil {
+		return err
+	}
+	var frames []byte
+	for {
+		record := it.nextRecord()
+		if record != nil {
+			frames = utils.AppendRecordFrame(frames, record.Data)
+		}
+		if len(frames) > 0 && (record == nil || len(frames) >= base.ExternalSortIOBufferSize) {
+			data, err := utils.AppendFramesToBinFile(nil, frames, codec)
+			if err != nil {
+				return err
+			}
+			_, err = file.Write(data)
+			if err != nil {
+				return err
+			}
+			frames = frames[:0]
+		}
+		if record == nil {
+			return it.err()
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package differ
+
+import (
+	"fmt"
+	"testing"
+
+	"xdcrDiffer/base"
+	"xdcrDiffer/storage"
+	"xdcrDiffer/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeCaptureWindow(t *testing.T) {
+	fmt.Println("============== Test case start: TestMergeCaptureWindow =================")
+	for _, codec := range []uint16{base.BinFileCodecNone, base.BinFileCodecSnappy} {
+		t.Run(base.BinFileCodecNames[codec], func(t *testing.T) {
+			assert := assert.New(t)
+			storage := storage.NewMemoryStorage()
+			assert.Nil(storage.MkdirAll("/bins"))
+			assert.Nil(storage.MkdirAll("/bins/window_0"))
+			writeBinFile := func(fileName string, records ...[]byte) {
+				var frames []byte
+				for _, record := range records {
+					frames = utils.AppendRecordFrame(frames, record)
+				}
+				data, err := utils.AppendFramesToBinFile(utils.AppendBinFileHeader(nil, codec), frames, codec)
+				assert.Nil(err)
+				assert.Nil(storage.WriteFile(fileName, data))
+			}
+
+			// bin 0 has been merged before, and the window has two runs of it, with a newer version of key_1 in each
+			writeBinFile(utils.GetFileName("/bins", 0, 0), genRecord("key_1", 1, 0), genRecord("key_2", 2, 0))
+			writeBinFile(utils.GetFileName("/bins/window_0", 0, 0), genRecord("key_1", 3, 0), genRecord("key_3", 4, 0),
+				genRecord("key_0", 6, 0), genRecord("key_1", 5, 0))
+			// bin 1 has not been captured into before
+			writeBinFile(utils.GetFileName("/bins/window_0", 0, 1), genRecord("key_4", 7, 8))
+			// nothing was captured into bin 2 during the window
+			writeBinFile(utils.GetFileName("/bins", 0, 2), genRecord("key_5", 8, 0))
+			writeBinFile(utils.GetFileName("/bins/window_0", 0, 2))
+			bin2Size, err := storage.Size(utils.GetFileName("/bins", 0, 2))
+			assert.Nil(err)
+
+			mergedCnt, err := MergeCaptureWindow("/bins/window_0", "/bins", 1, 4, storage, logger)
+			assert.Nil(err)
+			assert.Equal(2, mergedCnt)
+
+			// a single sorted run with the newest version of each key
+			var keySeqnos []string
+			for _, record := range readBinFileRecords(t, storage, utils.GetFileName("/bins", 0, 0)) {
+				keySeqnos = append(keySeqnos, fmt.Sprintf("%s@%v", record.Key, record.Seqno))
+			}
+			assert.Equal([]string{"key_0@6", "key_1@5", "key_2@2", "key_3@4"}, keySeqnos)
+			records := readBinFileRecords(t, storage, utils.GetFileName("/bins", 0, 1))
+			assert.Len(records, 1)
+			assert.Equal(uint32(8), records[0].ColId)
+			size, err := storage.Size(utils.GetFileName("/bins", 0, 2))
+			assert.Nil(err)
+			assert.Equal(bin2Size, size)
+			_, err = storage.Size(utils.GetFileName("/bins", 0, 3))
+			assert.NotNil(err)
+
+			// the window is removed once it has been merged
+			_, err = storage.Size(utils.GetFileName("/bins/window_0", 0, 0))
+			assert.NotNil(err)
+		})
+	}
+}
+
+func TestMergeCaptureWindowOfLargeBins(t *testing.T) {
+	fmt.Println("============== Test case start: TestMergeCaptureWindowOfLargeBins =================")
+	assert := assert.New(t)
+	storage := storage.NewMemoryStorage()
+	fileName := utils.GetFileName("/bins", 0, 0)
+	windowFileName := utils.GetFileName("/bins/window_0", 0, 0)
+
+	// the file is snappy compressed, and the window is not, with a newer version of every other key in two runs
+	var records []byte
+	for i := 0; i < 2000; i++ {
+		records = append(records, genRecord(fmt.Sprintf("key_%04d", i), uint64(i+1), uint32(i%2))...)
+	}
+	sortedFrames, err := utils.SortDedupAndFrameRecords(records)
+	assert.Nil(err)
+	data, err := utils.AppendFramesToBinFile(utils.AppendBinFileHeader(nil, base.BinFileCodecSnappy), sortedFrames, base.BinFileCodecSnappy)
+	assert.Nil(err)
+	assert.Nil(storage.WriteFile(fileName, data))
+	var windowRecords [][]byte
+	for _, run := range [][]int{{0, 1000}, {1000, 2000}} {
+		for i := run[0]; i < run[1]; i += 2 {
+			windowRecords = append(windowRecords, genRecord(fmt.Sprintf("key_%04d", i), uint64(i+3000), 0))
+		}
+	}
+	assert.Nil(storage.WriteFile(windowFileName, genBinFile(windowRecords...)))
+
+	mergedCnt, err := MergeCaptureWindow("/bins/window_0", "/bins", 1, 1, storage, logger)
+	assert.Nil(err)
+	assert.Equal(1, mergedCnt)
+
+	// written a buffer of frames at a time, the file is still a single sorted run of each collection
+	colIdRuns, codec, err := scanSortedRuns(fileName, storage, logger)
+	assert.Nil(err)
+	assert.Equal(base.BinFileCodecSnappy, codec)
+	assert.Len(colIdRuns, 2)
+	for _, runs := range colIdRuns {
+		assert.Len(runs, 1)
+	}
+	mergedRecords := readBinFileRecords(t, storage, fileName)
+	assert.Len(mergedRecords, 2000)
+	for _, record := range mergedRecords {
+		var i int
+		fmt.Sscanf(string(record.Key), "key_%d", &i)
+		if i%2 == 0 {
+			assert.Equal(uint64(i+3000), record.Seqno)
+		} else {
+			assert.Equal(uint64(i+1), record.Seqno)
+		}
+	}
+}
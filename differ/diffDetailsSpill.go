@@ -0,0 +1,150 @@
+package differ
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"xdcrDiffer/base"
+)
+
+const (
+	diffDetailsMismatch          = "Mismatch"
+	diffDetailsMismatchHistogram = "MismatchHistogram"
+	diffDetailsMismatchedFields  = "MismatchedFields"
+	diffDetailsMismatchedXattrs  = "MismatchedXattrs"
+	diffDetailsMissingFromSource = "MissingFromSource"
+	diffDetailsMissingFromTarget = "MissingFromTarget"
+)
+
+// keys of the diff details, in the order that json.Marshal writes the map of diffToJson
+var diffDetailsKeys = []string{diffDetailsMismatch, diffDetailsMismatchHistogram, diffDetailsMismatchedFields,
+	diffDetailsMismatchedXattrs, diffDetailsMissingFromSource, diffDetailsMissingFromTarget}
+
+// Spills the lists of the diff details of a files differ to a file each as the files are diffed,
+// so that the details do not need to be held in memory. They are put together in the same format as diffToJson at the end
+type diffDetailsSpill struct {
+	dir   string
+	lists map[string]*diffDetailsSpillList
+}
+
+type diffDetailsSpillList struct {
+	file   *os.File
+	writer *bufio.Writer
+	count  int
+}
+
+func newDiffDetailsSpill(parentDir string) (*diffDetailsSpill, error) {
+	dir, err := ioutil.TempDir(parentDir, base.DiffDetailsSpillDirPrefix)
+	if err != nil {
+		return nil, err
+	}
+	return &diffDetailsSpill{
+		dir:   dir,
+		lists: make(map[string]*diffDetailsSpillList),
+	}, nil
+}
+
+// appends value to the list of key
+func (s *diffDetailsSpill) add(key string, value interface{}) error {
+	list, exists := s.lists[key]
+	if !exists {
+		file, err := os.Create(s.dir + base.FileDirDelimiter + key)
+		if err != nil {
+			return err
+		}
+		list = &diffDetailsSpillList{
+			file:   file,
+			writer: bufio.NewWriterSize(file, base.ExternalSortIOBufferSize),
+		}
+		s.lists[key] = list
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if list.count > 0 {
+		err = list.writer.WriteByte(',')
+		if err != nil {
+			return err
+		}
+	}
+	_, err = list.writer.Write(data)
+	if err != nil {
+		return err
+	}
+	list.count++
+	return nil
+}
+
+// writes the diff details to fileName, with the lists that were spilled and the histogram
+func (s *diffDetailsSpill) writeTo(fileName string, histogram MismatchHistogram) error {
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, base.FileModeReadWrite)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriterSize(file, base.ExternalSortIOBufferSize)
+	err = s.write(writer, histogram)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (s *diffDetailsSpill) write(writer *bufio.Writer, histogram MismatchHistogram) error {
+	writer.WriteByte('{')
+	for i, key := range diffDetailsKeys {
+		if i > 0 {
+			writer.WriteByte(',')
+		}
+		keyData, _ := json.Marshal(key)
+		writer.Write(keyData)
+		writer.WriteByte(':')
+
+		if key == diffDetailsMismatchHistogram {
+			data, err := json.Marshal(histogram)
+			if err != nil {
+				return err
+			}
+			writer.Write(data)
+			continue
+		}
+
+		list, exists := s.lists[key]
+		if !exists {
+			// as json.Marshal writes a nil slice
+			writer.WriteString("null")
+			continue
+		}
+		err := list.writer.Flush()
+		if err != nil {
+			return err
+		}
+		_, err = list.file.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		writer.WriteByte('[')
+		_, err = io.Copy(writer, list.file)
+		if err != nil {
+			return err
+		}
+		writer.WriteByte(']')
+	}
+	_, err := writer.Write([]byte{'}'})
+	return err
+}
+
+func (s *diffDetailsSpill) cleanup() {
+	for _, list := range s.lists {
+		list.file.Close()
+	}
+	os.RemoveAll(s.dir)
+}
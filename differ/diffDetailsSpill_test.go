@@ -0,0 +1,101 @@
+package differ
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writes a pair of bin files where the source is missing some keys, the target is missing others,
+// and others are in both but differ
+func genDivergedFiles(t *testing.T, dir string) (string, string) {
+	var sourceRecords, targetRecords [][]byte
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key_%03d", i)
+		switch i % 4 {
+		case 0:
+			sourceRecords = append(sourceRecords, genRecord(key, uint64(i+1), 0))
+		case 1:
+			targetRecords = append(targetRecords, genRecord(key, uint64(i+1), 0))
+		case 2:
+			sourceRecords = append(sourceRecords, genRecord(key, uint64(i+1), 0))
+			targetRecords = append(targetRecords, genRecord(key, uint64(i+1000), 0))
+		default:
+			sourceRecords = append(sourceRecords, genRecord(key, uint64(i+1), 0))
+			targetRecords = append(targetRecords, genRecord(key, uint64(i+1), 0))
+		}
+	}
+	sourceFileName := dir + "/source.bin"
+	targetFileName := dir + "/target.bin"
+	assert.Nil(t, ioutil.WriteFile(sourceFileName, genBinFile(sourceRecords...), 0644))
+	assert.Nil(t, ioutil.WriteFile(targetFileName, genBinFile(targetRecords...), 0644))
+	return sourceFileName, targetFileName
+}
+
+func TestDiffDetailsSpill(t *testing.T) {
+	fmt.Println("============== Test case start: TestDiffDetailsSpill =================")
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "diffDetailsSpillTest")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	sourceFileName, targetFileName := genDivergedFiles(t, dir)
+	collectionMapping := map[uint32][]uint32{0: {0}}
+
+	inMemoryDiffer := NewFilesDiffer(sourceFileName, targetFileName, collectionMapping, nil, nil, logger)
+	srcDiffMap, tgtDiffMap, _, diffBytes, err := inMemoryDiffer.Diff()
+	assert.Nil(err)
+	assert.Equal(25, len(inMemoryDiffer.BothExistButMismatch))
+	assert.Equal(25, len(inMemoryDiffer.MissingFromFile1))
+	assert.Equal(25, len(inMemoryDiffer.MissingFromFile2))
+
+	detailsFileName := dir + "/details"
+	spillDiffer := NewFilesDiffer(sourceFileName, targetFileName, collectionMapping, nil, nil, logger)
+	spillDiffer.setExternalSort(1024*1024, dir)
+	spillDiffer.setDiffDetailsSpill(dir, detailsFileName)
+	spilledSrcDiffMap, spilledTgtDiffMap, _, spilledDiffBytes, err := spillDiffer.Diff()
+	assert.Nil(err)
+	assert.Nil(spilledDiffBytes)
+	assert.Equal(srcDiffMap, spilledSrcDiffMap)
+	assert.Equal(tgtDiffMap, spilledTgtDiffMap)
+	// nothing is held in memory
+	assert.Equal(0, len(spillDiffer.BothExistButMismatch))
+	assert.Equal(0, len(spillDiffer.MissingFromFile1))
+	assert.Equal(0, len(spillDiffer.MissingFromFile2))
+
+	// the spilled details are the same as the details that were held in memory
+	spilledDetails, err := ioutil.ReadFile(detailsFileName)
+	assert.Nil(err)
+	var expected, actual map[string]interface{}
+	assert.Nil(json.Unmarshal(diffBytes, &expected))
+	assert.Nil(json.Unmarshal(spilledDetails, &actual))
+	assert.Equal(expected, actual)
+
+	// and the spill dir of the differ is removed
+	fileInfos, err := ioutil.ReadDir(dir)
+	assert.Nil(err)
+	assert.Equal(3, len(fileInfos))
+	fmt.Println("============== Test case end: TestDiffDetailsSpill =================")
+}
+
+func TestDiffDetailsSpillNoDiff(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "diffDetailsSpillTest")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	spill, err := newDiffDetailsSpill(dir)
+	assert.Nil(err)
+	defer spill.cleanup()
+	assert.Nil(spill.writeTo(dir+"/details", MismatchHistogram{}))
+
+	// lists that nothing was spilled to are written like nil slices
+	expected, err := (&FilesDiffer{MismatchHistogram: MismatchHistogram{}}).diffToJson()
+	assert.Nil(err)
+	actual, err := ioutil.ReadFile(dir + "/details")
+	assert.Nil(err)
+	assert.Equal(string(expected), string(actual))
+}
@@ -0,0 +1,232 @@
+package differ
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"xdcrDiffer/base"
+
+	"github.com/couchbase/gomemcached"
+	mcc "github.com/couchbase/gomemcached/client"
+	xdcrBase "github.com/couchbase/goxdcr/base"
+	xdcrParts "github.com/couchbase/goxdcr/base/filter"
+)
+
+// A difference found by the mutation differ that is expected given the settings of the replication
+type ExplainedDiff struct {
+	// the settings of the replication that would explain the difference
+	ExplainedBy []string
+	Results     []*GetResult
+}
+
+// explained differences by the kind that they would otherwise be reported as, then by collection ID and key
+type ExplainedDiffs map[string]map[uint32]map[string]*ExplainedDiff
+
+func (e ExplainedDiffs) add(kind string, colId uint32, key string, explainedBy []string, results ...*GetResult) {
+	if _, exists := e[kind]; !exists {
+		e[kind] = make(map[uint32]map[string]*ExplainedDiff)
+	}
+	if _, exists := e[kind][colId]; !exists {
+		e[kind][colId] = make(map[string]*ExplainedDiff)
+	}
+	e[kind][colId][key] = &ExplainedDiff{ExplainedBy: explainedBy, Results: results}
+}
+
+func (e ExplainedDiffs) GetTotalCount() int {
+	var count int
+	for _, diffsPerKind := range e {
+		for _, diffsPerCol := range diffsPerKind {
+			count += len(diffsPerCol)
+		}
+	}
+	return count
+}
+
+// Tells which of the settings of the replication, which make XDCR skip some of the mutations of the source on purpose,
+// would explain a difference. A nil DiffExplainer explains nothing
+type DiffExplainer struct {
+	// the filter of the replication, which is nil when the replication has no filter expression
+	filter       xdcrParts.Filter
+	expDelMode   xdcrBase.FilterExpDelType
+	mobileCompat int
+}
+
+func NewDiffExplainer(filter xdcrParts.Filter, expDelMode xdcrBase.FilterExpDelType, mobileCompat int) *DiffExplainer {
+	return &DiffExplainer{
+		filter:       filter,
+		expDelMode:   expDelMode,
+		mobileCompat: mobileCompat,
+	}
+}
+
+// whether the body of the source doc needs to be fetched for the filter to be evaluated against it
+func (e *DiffExplainer) needsSourceBody() bool {
+	return e != nil && e.filter != nil
+}
+
+// whether all the xattrs of the docs need to be fetched, for the filter or to tell the docs that Sync Gateway manages
+func (e *DiffExplainer) needsDocXattrs() bool {
+	return e != nil && (e.filter != nil || e.isMobileActive())
+}
+
+// the settings that would explain a doc of the source that is missing from the target
+func (e *DiffExplainer) explainMissingFromTarget(key string, sourceResult *GetResult) []string {
+	if e == nil {
+		return nil
+	}
+	if isDeleted(sourceResult.GetMetaResult) {
+		return e.explainDeletion()
+	}
+	explainedBy := e.explainSkippedMutation(key, sourceResult)
+	if e.expDelMode.IsSkipBinarySet() && isBinary(sourceResult) {
+		explainedBy = append(explainedBy, base.ReplicationSettingFilterBinary)
+	}
+	return explainedBy
+}
+
+// the settings that would explain a doc that is deleted from the source but not from the target
+func (e *DiffExplainer) explainDeletedFromSource(key string, targetResult *GetResult) []string {
+	if e == nil {
+		return nil
+	}
+	explainedBy := e.explainDeletion()
+	if e.isMobileDoc(key, targetResult) {
+		explainedBy = append(explainedBy, base.ReplicationSettingMobile)
+	}
+	return explainedBy
+}
+
+// the settings that would explain a doc of the target that is missing from the source, or that the target has deleted
+// while the source has not. The docs that the Sync Gateway of the target manages are written by it
+func (e *DiffExplainer) explainTargetOnly(key string, targetResult *GetResult) []string {
+	if e == nil || !e.isMobileDoc(key, targetResult) {
+		return nil
+	}
+	return []string{base.ReplicationSettingMobile}
+}
+
+// the settings that would explain a doc whose source and target versions differ
+func (e *DiffExplainer) explainMismatch(key string, sourceResult, targetResult *GetResult) []string {
+	if e == nil {
+		return nil
+	}
+	var explainedBy []string
+	if e.isFilteredOut(key, sourceResult) {
+		explainedBy = append(explainedBy, base.ReplicationSettingFilterExpression)
+	}
+	if e.isMobileDoc(key, targetResult) {
+		// the Sync Gateway of the target rewrites the docs that it imports
+		explainedBy = append(explainedBy, base.ReplicationSettingMobile)
+	}
+	if e.expDelMode.IsStripExpirationSet() && sourceResult.GetMetaResult != nil && targetResult.GetMetaResult != nil &&
+		sourceResult.Expiry != 0 && targetResult.Expiry == 0 {
+		explainedBy = append(explainedBy, base.ReplicationSettingFilterBypassExpiry)
+	}
+	return explainedBy
+}
+
+// a deletion on the source can be told apart from an expiration only by its mutation, which is gone by the time
+// the mutation differ gets the tombstone
+func (e *DiffExplainer) explainDeletion() []string {
+	var explainedBy []string
+	if e.expDelMode.IsSkipDeletesSet() {
+		explainedBy = append(explainedBy, base.ReplicationSettingFilterDeletion)
+	}
+	if e.expDelMode.IsSkipExpirationSet() {
+		explainedBy = append(explainedBy, base.ReplicationSettingFilterExpiration)
+	}
+	return explainedBy
+}
+
+// the settings that would have XDCR skip the latest mutation of a doc of the source
+func (e *DiffExplainer) explainSkippedMutation(key string, sourceResult *GetResult) []string {
+	var explainedBy []string
+	if e.isFilteredOut(key, sourceResult) {
+		explainedBy = append(explainedBy, base.ReplicationSettingFilterExpression)
+	}
+	if e.isMobileActive() && strings.HasPrefix(key, base.SyncGatewayMetadataKeyPrefix) {
+		// the metadata docs of Sync Gateway are not replicated
+		explainedBy = append(explainedBy, base.ReplicationSettingMobile)
+	}
+	return explainedBy
+}
+
+// whether the filter of the replication does not match the doc. A doc whose body or xattrs have not been fetched
+// cannot be evaluated, and is not taken to be filtered out
+func (e *DiffExplainer) isFilteredOut(key string, result *GetResult) bool {
+	if e.filter == nil || result.cas == 0 || result.docXattrs == nil {
+		return false
+	}
+	uprEvent, err := newUprEvent(key, result)
+	if err != nil {
+		return false
+	}
+	matched, err, _, _, _ := e.filter.FilterUprEvent(uprEvent)
+	return err == nil && !matched
+}
+
+func (e *DiffExplainer) isMobileActive() bool {
+	return e.mobileCompat == xdcrBase.MobileCompatibilityActive
+}
+
+// whether the doc is managed by Sync Gateway, which is told by the key of its metadata docs and the xattr of the others
+func (e *DiffExplainer) isMobileDoc(key string, result *GetResult) bool {
+	return e.isMobileActive() && (strings.HasPrefix(key, base.SyncGatewayMetadataKeyPrefix) || hasMobileXattr(result))
+}
+
+func hasMobileXattr(result *GetResult) bool {
+	_, exists := result.docXattrs[xdcrBase.XATTR_MOBILE]
+	return exists
+}
+
+// the doc as the filter sees it in the mutation that XDCR would replicate, with its xattrs ahead of its body
+func newUprEvent(key string, result *GetResult) (*xdcrBase.WrappedUprEvent, error) {
+	value := result.value
+	var datatype uint8
+	if json.Valid(value) {
+		datatype |= base.JSONDataType
+	}
+	if len(result.docXattrs) > 0 {
+		xattrKeys := make([]string, 0, len(result.docXattrs))
+		size := 4 + len(value)
+		for xattrKey, xattrValue := range result.docXattrs {
+			xattrKeys = append(xattrKeys, xattrKey)
+			size += 4 + len(xattrKey) + 1 + len(xattrValue) + 1
+		}
+		sort.Strings(xattrKeys)
+		xattrComposer := xdcrBase.NewXattrComposer(make([]byte, size))
+		for _, xattrKey := range xattrKeys {
+			if err := xattrComposer.WriteKV([]byte(xattrKey), result.docXattrs[xattrKey]); err != nil {
+				return nil, err
+			}
+		}
+		value, _ = xattrComposer.FinishAndAppendDocValue(value, nil, nil)
+		datatype |= xdcrBase.XattrDataType
+	}
+
+	uprEvent := &mcc.UprEvent{
+		Opcode:   gomemcached.UPR_MUTATION,
+		DataType: datatype,
+		Key:      []byte(key),
+		Value:    value,
+		Cas:      result.cas,
+	}
+	if result.GetMetaResult != nil {
+		uprEvent.Flags = result.Flags
+		uprEvent.Expiry = result.Expiry
+	}
+	return &xdcrBase.WrappedUprEvent{
+		UprEvent: uprEvent,
+		ByteSliceGetter: func(size uint64) ([]byte, error) {
+			return make([]byte, int(size)), nil
+		},
+	}, nil
+}
+
+func isBinary(result *GetResult) bool {
+	if result.GetMetaResult != nil {
+		return result.Datatype&base.JSONDataType == 0
+	}
+	return result.value != nil && !json.Valid(result.value)
+}
@@ -0,0 +1,139 @@
+package differ
+
+import (
+	"fmt"
+	"testing"
+
+	"xdcrDiffer/base"
+
+	"github.com/couchbase/gocbcore/v10"
+	xdcrBase "github.com/couchbase/goxdcr/base"
+	"github.com/stretchr/testify/assert"
+)
+
+// a filter that matches every doc but the ones with the given keys
+type keyFilter struct {
+	rejectedKeys map[string]bool
+	err          error
+	lastEvent    *xdcrBase.WrappedUprEvent
+}
+
+func (f *keyFilter) FilterUprEvent(wrappedUprEvent *xdcrBase.WrappedUprEvent) (bool, error, string, int64, xdcrBase.FilteringStatusType) {
+	f.lastEvent = wrappedUprEvent
+	if f.err != nil {
+		return false, f.err, f.err.Error(), 0, 0
+	}
+	return !f.rejectedKeys[string(wrappedUprEvent.UprEvent.Key)], nil, "", 0, 0
+}
+
+func (f *keyFilter) SetShouldSkipUncommittedTxn(bool) {}
+
+func (f *keyFilter) SetShouldSkipBinaryDocs(bool) {}
+
+func (f *keyFilter) SetMobileCompatibility(uint32) {}
+
+// a doc whose body and xattrs have been fetched
+func genFetchedResult(key string, value []byte, xattrs map[string][]byte) *GetResult {
+	return &GetResult{key: key, value: value, cas: 1, docXattrs: xattrs}
+}
+
+func TestDiffExplainerFilter(t *testing.T) {
+	fmt.Println("============== Test case start: TestDiffExplainerFilter =================")
+	assert := assert.New(t)
+	filter := &keyFilter{rejectedKeys: map[string]bool{"rejected": true}}
+	explainer := NewDiffExplainer(filter, 0, xdcrBase.MobileCompatibilityOff)
+	assert.True(explainer.needsSourceBody())
+	assert.True(explainer.needsDocXattrs())
+
+	tests := []struct {
+		name         string
+		key          string
+		sourceResult *GetResult
+		explainedBy  []string
+	}{
+		{"rejected by the filter", "rejected", genFetchedResult("rejected", []byte(`{"a":1}`), map[string][]byte{}),
+			[]string{base.ReplicationSettingFilterExpression}},
+		{"matched by the filter", "matched", genFetchedResult("matched", []byte(`{"a":1}`), map[string][]byte{}), nil},
+		{"body not fetched", "rejected", &GetResult{key: "rejected", docXattrs: map[string][]byte{}}, nil},
+		{"xattrs not fetched", "rejected", &GetResult{key: "rejected", value: []byte(`{"a":1}`), cas: 1}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(test.explainedBy, explainer.explainMissingFromTarget(test.key, test.sourceResult))
+			assert.Equal(test.explainedBy, explainer.explainMismatch(test.key, test.sourceResult, &GetResult{key: test.key}))
+		})
+	}
+
+	// the filter sees the body of the doc as a JSON mutation
+	sourceResult := genFetchedResult("rejected", []byte(`{"a":1}`), map[string][]byte{})
+	sourceResult.GetMetaResult = &gocbcore.GetMetaResult{Expiry: 10}
+	explainer.explainMissingFromTarget("rejected", sourceResult)
+	assert.Equal([]byte(`{"a":1}`), filter.lastEvent.UprEvent.Value)
+	assert.Equal(uint8(base.JSONDataType), filter.lastEvent.UprEvent.DataType)
+	assert.Equal(uint32(10), filter.lastEvent.UprEvent.Expiry)
+
+	// a doc that the filter cannot be evaluated against is not explained
+	filter.err = fmt.Errorf("unable to evaluate")
+	assert.Nil(explainer.explainMissingFromTarget("rejected", genFetchedResult("rejected", []byte(`{"a":1}`), map[string][]byte{})))
+
+	// without a filter expression nothing is filtered out, and nothing needs fetching for it
+	explainer = NewDiffExplainer(nil, 0, xdcrBase.MobileCompatibilityOff)
+	assert.False(explainer.needsSourceBody())
+	assert.False(explainer.needsDocXattrs())
+	assert.Nil(explainer.explainMissingFromTarget("rejected", genFetchedResult("rejected", []byte(`{"a":1}`), map[string][]byte{})))
+
+	var nilExplainer *DiffExplainer
+	assert.False(nilExplainer.needsSourceBody())
+	assert.False(nilExplainer.needsDocXattrs())
+	assert.Nil(nilExplainer.explainMissingFromTarget("rejected", genFetchedResult("rejected", []byte(`{"a":1}`), map[string][]byte{})))
+}
+
+func TestDiffExplainerMobile(t *testing.T) {
+	fmt.Println("============== Test case start: TestDiffExplainerMobile =================")
+	assert := assert.New(t)
+	metadataKey := base.SyncGatewayMetadataKeyPrefix + "seq"
+	mobileXattrs := map[string][]byte{xdcrBase.XATTR_MOBILE: []byte(`{"rev":"1-a"}`)}
+	mobile := []string{base.ReplicationSettingMobile}
+
+	explainer := NewDiffExplainer(nil, 0, xdcrBase.MobileCompatibilityOff)
+	assert.Nil(explainer.explainMissingFromTarget(metadataKey, genFetchedResult(metadataKey, nil, nil)))
+	assert.Nil(explainer.explainTargetOnly("doc", genFetchedResult("doc", nil, mobileXattrs)))
+
+	explainer = NewDiffExplainer(nil, 0, xdcrBase.MobileCompatibilityActive)
+	assert.True(explainer.needsDocXattrs())
+	assert.False(explainer.needsSourceBody())
+
+	// the metadata docs of Sync Gateway are told by their keys
+	assert.Equal(mobile, explainer.explainMissingFromTarget(metadataKey, genFetchedResult(metadataKey, nil, nil)))
+	assert.Equal(mobile, explainer.explainTargetOnly(metadataKey, genFetchedResult(metadataKey, nil, nil)))
+	assert.Nil(explainer.explainMissingFromTarget("doc", genFetchedResult("doc", nil, mobileXattrs)))
+
+	// the docs that the Sync Gateway of the target manages are told by their xattr
+	assert.Equal(mobile, explainer.explainTargetOnly("doc", genFetchedResult("doc", nil, mobileXattrs)))
+	assert.Nil(explainer.explainTargetOnly("doc", genFetchedResult("doc", nil, map[string][]byte{"_other": []byte(`{}`)})))
+	assert.Equal(mobile, explainer.explainMismatch("doc", genFetchedResult("doc", nil, nil), genFetchedResult("doc", nil, mobileXattrs)))
+	assert.Nil(explainer.explainMismatch("doc", genFetchedResult("doc", nil, mobileXattrs), genFetchedResult("doc", nil, nil)))
+	assert.Equal(mobile, explainer.explainDeletedFromSource("doc", genFetchedResult("doc", nil, mobileXattrs)))
+	assert.Nil(explainer.explainDeletedFromSource("doc", genFetchedResult("doc", nil, nil)))
+}
+
+func TestDiffExplainerExpDelMode(t *testing.T) {
+	fmt.Println("============== Test case start: TestDiffExplainerExpDelMode =================")
+	assert := assert.New(t)
+	// skip deletes, skip expirations, strip expirations and skip binary docs
+	explainer := NewDiffExplainer(nil, 1|2|4|16, xdcrBase.MobileCompatibilityOff)
+
+	deleted := &GetResult{key: "doc", GetMetaResult: &gocbcore.GetMetaResult{Deleted: 1}}
+	assert.Equal([]string{base.ReplicationSettingFilterDeletion, base.ReplicationSettingFilterExpiration},
+		explainer.explainMissingFromTarget("doc", deleted))
+	assert.Equal([]string{base.ReplicationSettingFilterDeletion, base.ReplicationSettingFilterExpiration},
+		explainer.explainDeletedFromSource("doc", &GetResult{key: "doc"}))
+
+	binary := &GetResult{key: "doc", GetMetaResult: &gocbcore.GetMetaResult{}}
+	assert.Equal([]string{base.ReplicationSettingFilterBinary}, explainer.explainMissingFromTarget("doc", binary))
+
+	expiring := &GetResult{key: "doc", GetMetaResult: &gocbcore.GetMetaResult{Expiry: 10, Datatype: base.JSONDataType}}
+	stripped := &GetResult{key: "doc", GetMetaResult: &gocbcore.GetMetaResult{Datatype: base.JSONDataType}}
+	assert.Equal([]string{base.ReplicationSettingFilterBypassExpiry}, explainer.explainMismatch("doc", expiring, stripped))
+	assert.Nil(explainer.explainMismatch("doc", stripped, expiring))
+}
@@ -10,17 +10,20 @@
 package differ
 
 import (
+	"bytes"
 	"crypto/sha512"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"sort"
-	"strings"
 	"sync"
+	"xdcrDiffer/base"
 	fdp "xdcrDiffer/fileDescriptorPool"
+	"xdcrDiffer/storage"
 	"xdcrDiffer/utils"
 
 	"github.com/couchbase/gomemcached"
@@ -46,6 +49,18 @@ type FilesDiffer struct {
 	MissingFromFile1     []*oneEntry
 	MissingFromFile2     []*oneEntry
 	BothExistButMismatch []*entryPair
+	// the fields that differ between the entries of each of BothExistButMismatch
+	MismatchedFields  [][]string
+	MismatchHistogram MismatchHistogram
+	// the xattrs that differ between the entries of each of BothExistButMismatch, when xattrs are compared by key
+	MismatchedXattrs []*XattrDiff
+
+	// when set, the results above are spilled to detailsSpill instead of being held in memory,
+	// and the diff details are written to detailsFileName instead of being returned
+	detailsSpillDir string
+	detailsFileName string
+	detailsSpill    *diffDetailsSpill
+	detailsSpillErr error
 
 	fdPool *fdp.FdPool
 
@@ -100,6 +115,23 @@ type FileAttributes struct {
 	sortedEntries map[uint32][]*oneEntry
 	readOp        fdp.FileOp
 	closeOp       func() error
+	logger        *xdcrLog.CommonLogger
+	storage       storage.Storage
+
+	// when non-zero, entries are sorted on disk instead of in memory
+	memoryBudget    int
+	spillParentDir  string
+	fdPool          *fdp.FdPool
+	spillDir        string
+	sortedFileName  string
+	colIdRanges     map[uint32]*fileRange
+	sortedItemCount int
+
+	// when set, the file is made up of sorted runs that are merged as entries are iterated
+	sortedRuns      bool
+	binFileCodec    uint16
+	colIdRuns       map[uint32][]*runRange
+	colIdItemCounts map[uint32]int
 }
 
 func NewFileAttribute(fileName string) *FileAttributes {
@@ -107,6 +139,7 @@ func NewFileAttribute(fileName string) *FileAttributes {
 		name:          fileName,
 		entries:       make(map[uint32]map[string]*oneEntry),
 		sortedEntries: make(map[uint32][]*oneEntry),
+		storage:       storage.NewLocalStorage(),
 	}
 	return attr
 }
@@ -122,6 +155,8 @@ type oneEntry struct {
 	ColId             uint32
 	ColMigrFilterLen  uint8
 	ColFiltersMatched []uint8
+	// digests of the xattrs that are compared by key, which are only captured when comparing xattrs
+	XattrDigests map[string][]byte `json:",omitempty"`
 }
 
 func (oneEntry *oneEntry) String() string {
@@ -181,6 +216,9 @@ func (entry oneEntry) Diff(other oneEntry) (int, bool) {
 			panic(fmt.Sprintf("Programming error - found one of HLVs to be nil. SourceHlv: %v, TargetHlv: %v", entry.CrMeta.GetHLV(), other.CrMeta.GetHLV()))
 		}
 	}
+	if match && diffXattrDigests(entry.XattrDigests, other.XattrDigests) != nil {
+		match = false
+	}
 	return 0, match
 }
 
@@ -209,6 +247,18 @@ func SetHlv(crMeta1, crMeta2 *crMeta.CRMetadata, bucketUUID1, bucketUUID2 hlv.Do
 	return nil
 }
 
+// the fields that differ between two versions of a doc that Diff has found mismatched, which also
+// have their HLVs set by then
+func (entry *oneEntry) diffFields(other *oneEntry) []string {
+	var fields []string
+	if !shaCompare(entry.BodyHash, other.BodyHash) {
+		fields = append(fields, base.DiffFieldBody)
+	}
+	fields = append(fields, diffMetaFields(entry.CrMeta.GetDocumentMetadata(), other.CrMeta.GetDocumentMetadata(),
+		entry.CrMeta.GetHLV(), other.CrMeta.GetHLV(), diffXattrDigests(entry.XattrDigests, other.XattrDigests) != nil)...)
+	return withHLVIfNoFields(fields)
+}
+
 func (entry *oneEntry) IsMutation() bool {
 	return entry.CrMeta.GetDocumentMetadata().Opcode == gomemcached.UPR_MUTATION
 }
@@ -238,9 +288,12 @@ func NewFilesDiffer(file1, file2 string, collectionMapping map[uint32][]uint32,
 		collectionIdMapping: collectionMapping,
 		colFilterStrings:    colFilterStrings,
 		colFilterTgtIds:     colFilterTgtIds,
+		MismatchHistogram:   make(MismatchHistogram),
 		duplicatedHintMap:   map[string][]uint8{},
 		logger:              logger,
 	}
+	differ.file1.logger = logger
+	differ.file2.logger = logger
 	if len(collectionMapping) == 0 {
 		// This means this is legacy mode - no collection support
 		differ.collectionIdMapping = make(map[uint32][]uint32)
@@ -418,6 +471,34 @@ func getOneEntry(readOp fdp.FileOp, actorId hlv.DocumentSourceId) (*oneEntry, er
 		colFilterIds = append(colFilterIds, uint8(binary.BigEndian.Uint16(idByte)))
 	}
 	entry.ColFiltersMatched = colFilterIds
+
+	xattrDigestCntBytes := make([]byte, base.XattrDigestCntLen)
+	bytesRead, err = readOp(xattrDigestCntBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read xattrDigestCntBytes, bytes read: %v, err: %v", bytesRead, err)
+	}
+	xattrDigestCnt := binary.BigEndian.Uint16(xattrDigestCntBytes)
+	if xattrDigestCnt > 0 {
+		entry.XattrDigests = make(map[string][]byte, xattrDigestCnt)
+	}
+	for i := uint16(0); i < xattrDigestCnt; i++ {
+		xattrKeyLenBytes := make([]byte, base.XattrKeyLenVariable)
+		bytesRead, err = readOp(xattrKeyLenBytes)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read xattrKeyLen for index %v, err: %v", i, err)
+		}
+		xattrKeyBytes := make([]byte, binary.BigEndian.Uint16(xattrKeyLenBytes))
+		bytesRead, err = readOp(xattrKeyBytes)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read xattrKey for index %v, err: %v", i, err)
+		}
+		digest := make([]byte, base.XattrDigestLen)
+		bytesRead, err = readOp(digest)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read xattr digest for index %v, err: %v", i, err)
+		}
+		entry.XattrDigests[string(xattrKeyBytes)] = digest
+	}
 	return entry, nil
 }
 
@@ -426,10 +507,18 @@ func (a ByKeyName) Swap(i, j int)      { *a[i], *a[j] = *a[j], *a[i] }
 func (a ByKeyName) Less(i, j int) bool { return a[i].Key < a[j].Key }
 
 func (attr *FileAttributes) fillAndDedupEntries() error {
-	var err error
-	var entry *oneEntry
+	reader, err := utils.NewBinFileReader(attr.name, attr.readOp, attr.logger)
+	if err != nil {
+		return err
+	}
 	for {
-		entry, err = getOneEntry(attr.readOp, attr.actorId)
+		var record []byte
+		record, err = reader.Next()
+		if err != nil {
+			break
+		}
+		var entry *oneEntry
+		entry, err = getOneEntry(readFullOp(bytes.NewReader(record)), attr.actorId)
 		if err != nil {
 			break
 		}
@@ -447,7 +536,7 @@ func (attr *FileAttributes) fillAndDedupEntries() error {
 		}
 	}
 
-	if strings.Contains(err.Error(), io.EOF.Error()) {
+	if err == io.EOF {
 		err = nil
 	}
 
@@ -467,14 +556,20 @@ func (attr *FileAttributes) LoadFileIntoBuffer() error {
 	if len(attr.name) == 0 {
 		return fmt.Errorf("No file specified")
 	}
+	if attr.memoryBudget > 0 {
+		return attr.loadWithExternalSort()
+	}
+	if attr.sortedRuns {
+		return attr.loadSortedRuns()
+	}
 	if attr.readOp != nil && attr.closeOp != nil {
 		defer attr.closeOp()
 	} else {
-		file, err := os.Open(attr.name)
-		defer file.Close()
+		file, err := attr.storage.Open(attr.name)
 		if err != nil {
 			return err
 		}
+		defer file.Close()
 		attr.readOp = file.Read
 	}
 	err := attr.fillAndDedupEntries()
@@ -485,6 +580,65 @@ func (attr *FileAttributes) LoadFileIntoBuffer() error {
 	return nil
 }
 
+func (attr *FileAttributes) newEntryIterator(colId uint32) entryIterator {
+	if attr.memoryBudget > 0 {
+		return newFileEntryIterator(attr.sortedFileName, attr.colIdRanges[colId], attr.actorId)
+	}
+	if attr.sortedRuns {
+		return attr.newRunMergeIterator(colId)
+	}
+	return &sliceEntryIterator{entries: attr.sortedEntries[colId]}
+}
+
+func (attr *FileAttributes) getItemCount() int {
+	if attr.memoryBudget > 0 {
+		return attr.sortedItemCount
+	}
+	if attr.sortedRuns {
+		return attr.getSortedRunsItemCount()
+	}
+	var itemCount int
+	for _, entryMap := range attr.entries {
+		itemCount += len(entryMap)
+	}
+	return itemCount
+}
+
+func (attr *FileAttributes) cleanup() {
+	if attr.spillDir != "" {
+		os.RemoveAll(attr.spillDir)
+	}
+}
+
+// Sorts the files on disk within spillDir, using up to memoryBudget bytes for the two files together
+func (differ *FilesDiffer) setExternalSort(memoryBudget int, spillDir string) {
+	differ.file1.memoryBudget = memoryBudget / 2
+	differ.file1.spillParentDir = spillDir
+	differ.file1.fdPool = differ.fdPool
+	differ.file2.memoryBudget = memoryBudget / 2
+	differ.file2.spillParentDir = spillDir
+	differ.file2.fdPool = differ.fdPool
+}
+
+// Reads the files from the storage that they were captured to, rather than from the local file system.
+// This needs to be the storage of the fd pool, if there is one
+func (differ *FilesDiffer) setStorage(storage storage.Storage) {
+	differ.file1.storage = storage
+	differ.file2.storage = storage
+}
+
+// Spills the results to disk within spillDir as the files are diffed, and writes the diff details to detailsFileName
+func (differ *FilesDiffer) setDiffDetailsSpill(spillDir, detailsFileName string) {
+	differ.detailsSpillDir = spillDir
+	differ.detailsFileName = detailsFileName
+}
+
+// Merges the sorted runs that the files are made up of, instead of loading the files into memory
+func (differ *FilesDiffer) setSortedRuns() {
+	differ.file1.sortedRuns = true
+	differ.file2.sortedRuns = true
+}
+
 func (differ *FilesDiffer) asyncLoad(attr *FileAttributes, err *error) {
 	defer differ.dataLoadWg.Done()
 	*err = attr.LoadFileIntoBuffer()
@@ -510,71 +664,59 @@ func (differ *FilesDiffer) diffSorted() (map[uint32][]string, map[uint32][]strin
 		srcDedupMap := make(map[string]bool)
 		for _, tgtColId := range tgtColIds {
 			diffKeys := make([]string, 0)
-			file1Len := len(differ.file1.sortedEntries[srcColId])
-			file2Len := len(differ.file2.sortedEntries[tgtColId])
-
-			if file1Len == 0 && file2Len == 0 && !colMigrationMode {
-				//return srcDiffKeys
-				continue
-			}
+			iter1 := differ.file1.newEntryIterator(srcColId)
+			iter2 := differ.file2.newEntryIterator(tgtColId)
+			item1 := iter1.next()
+			item2 := iter2.next()
 
-			var i int
-			var j int
-
-			for i < file1Len && j < file2Len {
-				item1 := differ.file1.sortedEntries[srcColId][i]
-				item2 := differ.file2.sortedEntries[tgtColId][j]
+			for item1 != nil && item2 != nil {
 				differ.addMigrationHintIfNeeded(colMigrationMode, item1, migrationHintMap)
 
 				keyCompare, match := item1.Diff(*item2)
 				validComparison := !colMigrationMode || item1.MapsToTargetCol(item2.ColId, differ.colFilterTgtIds, tgtColId) && item1.IsMutation() && item2.IsMutation()
 				if match {
 					// Both items are the same
-					i++
-					j++
+					item1 = iter1.next()
+					item2 = iter2.next()
 				} else {
 					if keyCompare == 0 {
 						// Both document are the same, but others mismatched
 						if validComparison {
-							var onePair entryPair
-							onePair[0] = item1
-							onePair[1] = item2
-							differ.BothExistButMismatch = append(differ.BothExistButMismatch, &onePair)
+							differ.addMismatch(item1, item2)
 							diffKeys = append(diffKeys, item1.Key)
 							addToSrcDiffMapIfNotAdded(srcDedupMap, item1.Key, srcDiffMap, srcColId)
 							tgtDiffMap[tgtColId] = append(tgtDiffMap[tgtColId], item1.Key)
 						}
-						i++
-						j++
+						item1 = iter1.next()
+						item2 = iter2.next()
 					} else if keyCompare < 0 {
 						// Like "a" < "b", where a is 1 and b is 2
 						if validComparison {
-							differ.MissingFromFile2 = append(differ.MissingFromFile2, item1)
+							differ.addMissing(item1, false)
 							diffKeys = append(diffKeys, item1.Key)
 							addToSrcDiffMapIfNotAdded(srcDedupMap, item1.Key, srcDiffMap, srcColId)
 							tgtDiffMap[tgtColId] = append(tgtDiffMap[tgtColId], item1.Key)
 						}
-						i++
+						item1 = iter1.next()
 					} else {
 						// "b" > "a", leading to keyCompare > 0
 						if validComparison {
-							differ.MissingFromFile1 = append(differ.MissingFromFile1, item2)
+							differ.addMissing(item2, true)
 							diffKeys = append(diffKeys, item2.Key)
 							addToSrcDiffMapIfNotAdded(srcDedupMap, item2.Key, srcDiffMap, srcColId)
 							tgtDiffMap[tgtColId] = append(tgtDiffMap[tgtColId], item2.Key)
 						}
-						j++
+						item2 = iter2.next()
 					}
 				}
 			}
 
-			for ; i < file1Len; i++ {
+			for ; item1 != nil; item1 = iter1.next() {
 				// This means that all the rest of the entries in file1 are missing from file2
-				item1 := differ.file1.sortedEntries[srcColId][i]
 				differ.addMigrationHintIfNeeded(colMigrationMode, item1, migrationHintMap)
 				validComparison := !colMigrationMode || item1.MapsToTargetCol(tgtColId, differ.colFilterTgtIds, tgtColId) && item1.IsMutation()
 				if validComparison {
-					differ.MissingFromFile2 = append(differ.MissingFromFile2, item1)
+					differ.addMissing(item1, false)
 					addToSrcDiffMapIfNotAdded(srcDedupMap, item1.Key, srcDiffMap, srcColId)
 				}
 			}
@@ -583,17 +725,66 @@ func (differ *FilesDiffer) diffSorted() (map[uint32][]string, map[uint32][]strin
 			// do migration with a set of rules, and then do another set of migration with another set of rules, etc
 			// Do not check the rest if it is migration mode
 			if !colMigrationMode {
-				for ; j < file2Len; j++ {
+				for ; item2 != nil; item2 = iter2.next() {
 					// This means that all the rest of the entries in file2 are missing from file1
-					differ.MissingFromFile1 = append(differ.MissingFromFile1, differ.file2.sortedEntries[tgtColId][j])
-					tgtDiffMap[tgtColId] = append(tgtDiffMap[tgtColId], differ.file2.sortedEntries[tgtColId][j].Key)
+					differ.addMissing(item2, true)
+					tgtDiffMap[tgtColId] = append(tgtDiffMap[tgtColId], item2.Key)
 				}
 			}
+
+			if err := iter1.err(); err != nil {
+				differ.logger.Errorf("Error when reading sorted entries of %v: %v\n", differ.file1.name, err)
+			}
+			if err := iter2.err(); err != nil {
+				differ.logger.Errorf("Error when reading sorted entries of %v: %v\n", differ.file2.name, err)
+			}
+			iter1.close()
+			iter2.close()
 		}
 	}
 	return srcDiffMap, tgtDiffMap, migrationHintMap
 }
 
+func (differ *FilesDiffer) addMismatch(item1, item2 *oneEntry) {
+	fields := item1.diffFields(item2)
+	differ.MismatchHistogram.add(fields)
+	xattrDiff := diffXattrDigests(item1.XattrDigests, item2.XattrDigests)
+	if differ.detailsSpill != nil {
+		differ.spill(diffDetailsMismatch, &entryPair{item1, item2})
+		differ.spill(diffDetailsMismatchedFields, fields)
+		differ.spill(diffDetailsMismatchedXattrs, xattrDiff)
+		return
+	}
+	differ.BothExistButMismatch = append(differ.BothExistButMismatch, &entryPair{item1, item2})
+	differ.MismatchedFields = append(differ.MismatchedFields, fields)
+	differ.MismatchedXattrs = append(differ.MismatchedXattrs, xattrDiff)
+}
+
+// adds the entry of one file that is missing from the other, which is file1 when missingFromFile1 is set
+func (differ *FilesDiffer) addMissing(item *oneEntry, missingFromFile1 bool) {
+	if differ.detailsSpill != nil {
+		if missingFromFile1 {
+			differ.spill(diffDetailsMissingFromSource, item)
+		} else {
+			differ.spill(diffDetailsMissingFromTarget, item)
+		}
+		return
+	}
+	if missingFromFile1 {
+		differ.MissingFromFile1 = append(differ.MissingFromFile1, item)
+	} else {
+		differ.MissingFromFile2 = append(differ.MissingFromFile2, item)
+	}
+}
+
+// keeps the first error of spilling, which fails the diff
+func (differ *FilesDiffer) spill(key string, value interface{}) {
+	if differ.detailsSpillErr != nil {
+		return
+	}
+	differ.detailsSpillErr = differ.detailsSpill.add(key, value)
+}
+
 func addToSrcDiffMapIfNotAdded(srcDedupMap map[string]bool, key string, srcDiffMap map[uint32][]string, srcColId uint32) {
 	if _, exists := srcDedupMap[key]; !exists {
 		srcDiffMap[srcColId] = append(srcDiffMap[srcColId], key)
@@ -621,26 +812,46 @@ func (differ *FilesDiffer) Diff() (srcDiffMap, tgtDiffMap map[uint32][]string, m
 		differ.logger.Errorf("Error when loading file %v contents: %v\n", differ.file2.name, differ.err2)
 	}
 
-	srcDiffMap, tgtDiffMap, migrationHintMap = differ.diffSorted()
-	diffBytes, err = differ.diffToJson()
+	defer differ.file1.cleanup()
+	defer differ.file2.cleanup()
 
-	// Count source items
-	for _, entryMap := range differ.file1.entries {
-		differ.file1ItemCount += len(entryMap)
+	// files that could not be loaded are diffed as if they were empty, unless they are bins of another format
+	for _, loadErr := range []error{differ.err1, differ.err2} {
+		if errors.Is(loadErr, base.ErrorIncompatibleBinFile) {
+			return nil, nil, nil, nil, loadErr
+		}
 	}
-	// Count target Items
-	for _, entryMap := range differ.file2.entries {
-		differ.file2ItemCount += len(entryMap)
+
+	if differ.detailsSpillDir != "" {
+		differ.detailsSpill, err = newDiffDetailsSpill(differ.detailsSpillDir)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		defer differ.detailsSpill.cleanup()
 	}
+
+	srcDiffMap, tgtDiffMap, migrationHintMap = differ.diffSorted()
+	if differ.detailsSpill != nil {
+		err = differ.detailsSpillErr
+		if err == nil {
+			err = differ.detailsSpill.writeTo(differ.detailsFileName, differ.MismatchHistogram)
+		}
+	} else {
+		diffBytes, err = differ.diffToJson()
+	}
+
+	differ.file1ItemCount = differ.file1.getItemCount()
+	differ.file2ItemCount = differ.file2.getItemCount()
 	return srcDiffMap, tgtDiffMap, migrationHintMap, diffBytes, err
 }
 
+// prints the results that are held in memory, which are none when they are spilled
 func (differ *FilesDiffer) PrettyPrintResult() {
 	mismatchCnt := len(differ.BothExistButMismatch)
 	missing1Cnt := len(differ.MissingFromFile1)
 	missing2Cnt := len(differ.MissingFromFile2)
 
-	if len(differ.file1.entries) == 0 && len(differ.file2.entries) == 0 {
+	if differ.file1ItemCount == 0 && differ.file2ItemCount == 0 {
 		fmt.Printf("Diff tool has not been run yet\n")
 	} else if mismatchCnt == 0 && missing1Cnt == 0 && missing2Cnt == 0 {
 		fmt.Printf("Both sides match\n")
@@ -676,9 +887,12 @@ func (differ *FilesDiffer) PrettyPrintResult() {
 
 func (differ *FilesDiffer) diffToJson() ([]byte, error) {
 	outputMap := map[string]interface{}{
-		"Mismatch":          differ.BothExistButMismatch,
-		"MissingFromSource": differ.MissingFromFile1,
-		"MissingFromTarget": differ.MissingFromFile2,
+		diffDetailsMismatch:          differ.BothExistButMismatch,
+		diffDetailsMismatchedFields:  differ.MismatchedFields,
+		diffDetailsMismatchHistogram: differ.MismatchHistogram,
+		diffDetailsMismatchedXattrs:  differ.MismatchedXattrs,
+		diffDetailsMissingFromSource: differ.MissingFromFile1,
+		diffDetailsMissingFromTarget: differ.MissingFromFile2,
 	}
 
 	ret, err := json.Marshal(outputMap)
@@ -12,6 +12,7 @@ package differ
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"sort"
@@ -20,6 +21,7 @@ import (
 	"time"
 	"xdcrDiffer/base"
 	fdp "xdcrDiffer/fileDescriptorPool"
+	"xdcrDiffer/storage"
 	"xdcrDiffer/utils"
 
 	"github.com/couchbase/goxdcr/hlv"
@@ -43,13 +45,29 @@ var sourcePruningWindow *pruningWindow = &pruningWindow{isSource: true}
 var targetPruningWindow *pruningWindow = &pruningWindow{}
 
 func (p *pruningWindow) set(svc service_def.BucketTopologySvc, spec *metadata.ReplicationSpecification) error {
+	duration, err := GetVersionPruningWindow(svc, spec, p.isSource)
+	if err != nil {
+		return err
+	}
+	p.setDuration(duration)
+	return nil
+}
+
+func (p *pruningWindow) setDuration(duration time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.duration = duration
+}
+
+// fetches the version pruning window of the source or the target bucket of the replication
+func GetVersionPruningWindow(svc service_def.BucketTopologySvc, spec *metadata.ReplicationSpecification, isSource bool) (time.Duration, error) {
 	subscriberId := "DiffTool"
 	var pruningWindow int
-	if p.isSource {
+	if isSource {
 		notificationCh, err := svc.SubscribeToLocalBucketFeed(spec, subscriberId)
 		if err != nil {
 			fmt.Printf("Failed to fetch LocalBucketFeed. err=%v\n", err)
-			return err
+			return 0, err
 		}
 		defer svc.UnSubscribeLocalBucketFeed(spec, subscriberId)
 		latestNotification := <-notificationCh
@@ -59,17 +77,14 @@ func (p *pruningWindow) set(svc service_def.BucketTopologySvc, spec *metadata.Re
 		notificationCh, err := svc.SubscribeToRemoteBucketFeed(spec, subscriberId)
 		if err != nil {
 			fmt.Printf("Failed to fetch RemoteBucketFeed. err=%v\n", err)
-			return err
+			return 0, err
 		}
 		defer svc.UnSubscribeRemoteBucketFeed(spec, subscriberId)
 		latestNotification := <-notificationCh
 		defer latestNotification.Recycle()
 		pruningWindow = latestNotification.GetVersionPruningWindowHrs()
 	}
-	p.lock.Lock()
-	defer p.lock.Unlock()
-	p.duration = time.Duration(uint32(pruningWindow)) * time.Hour
-	return nil
+	return time.Duration(uint32(pruningWindow)) * time.Hour, nil
 }
 
 func (p *pruningWindow) get() time.Duration {
@@ -226,6 +241,7 @@ type DifferDriver struct {
 	waitGroup         *sync.WaitGroup
 	srcDiffKeys       DiffKeysMap
 	tgtDiffKeys       DiffKeysMap
+	mismatchHistogram MismatchHistogram
 	stateLock         *sync.RWMutex
 	fileDescPool      *fdp.FdPool
 	vbCompleted       uint32
@@ -244,12 +260,35 @@ type DifferDriver struct {
 	bucketTopologySvc service_def.BucketTopologySvc
 	specifiedSpec     *metadata.ReplicationSpecification
 	logger            *xdcrLog.CommonLogger
+
+	srcNumberOfVbuckets int
+	tgtNumberOfVbuckets int
+	// when non-zero, files are diffed by key hash partition instead of by vbucket
+	numberOfKeyHashPartitions int
+	// when non-zero, the file differ workers sort on disk using up to this many bytes of memory between them,
+	// and spill the diff details of each bin to disk too
+	memoryBudget int
+	// when set, the results of the previous diff are reused for the bins whose files have not changed since
+	incremental   bool
+	prevDiffState *diffState
+	diffState     *diffState
+	binsReused    uint32
+	// codec that the key hash partitions are compressed with
+	binFileCodec uint16
+	// where the captured files are, which is also where the key hash partitions are written to
+	storage storage.Storage
+	// version pruning windows of the buckets, which are used when there is no bucketTopologySvc to fetch them from
+	srcPruningWindow time.Duration
+	tgtPruningWindow time.Duration
+	// how the docs are compared, which the results of an incremental diff are only reused for if they are the same
+	compareType     string
+	captureSettings *utils.CaptureSettings
 }
 
-func NewDifferDriver(sourceFileDir, targetFileDir, diffFileDir, diffKeysFileName string, numberOfWorkers, numberOfBins, numberOfFds int, collectionMapping map[uint32][]uint32, colFilterStrings []string, colFilterTgtIds []uint32, sourceClusterUUID, targetClusterUUID, sourceBucketUUID, targetBucketUUID string, bucketTopologySvc service_def.BucketTopologySvc, specifiedSpec *metadata.ReplicationSpecification, logger *xdcrLog.CommonLogger) *DifferDriver {
+func NewDifferDriver(sourceFileDir, targetFileDir, diffFileDir, diffKeysFileName string, numberOfWorkers, numberOfBins, srcNumberOfVbuckets, tgtNumberOfVbuckets, numberOfKeyHashPartitions, numberOfFds, memoryBudget int, incremental bool, binFileCodec uint16, storage storage.Storage, collectionMapping map[uint32][]uint32, colFilterStrings []string, colFilterTgtIds []uint32, sourceClusterUUID, targetClusterUUID, sourceBucketUUID, targetBucketUUID string, bucketTopologySvc service_def.BucketTopologySvc, specifiedSpec *metadata.ReplicationSpecification, logger *xdcrLog.CommonLogger) *DifferDriver {
 	var fdPool *fdp.FdPool
 	if numberOfFds > 0 {
-		fdPool = fdp.NewFileDescriptorPool(numberOfFds)
+		fdPool = fdp.NewFileDescriptorPoolWithStorage(numberOfFds, storage)
 	}
 
 	return &DifferDriver{
@@ -266,6 +305,7 @@ func NewDifferDriver(sourceFileDir, targetFileDir, diffFileDir, diffKeysFileName
 		collectionMapping: collectionMapping,
 		srcDiffKeys:       make(DiffKeysMap),
 		tgtDiffKeys:       make(DiffKeysMap),
+		mismatchHistogram: make(MismatchHistogram),
 		colFilterStrings:  colFilterStrings,
 		colFilterTgtIds:   colFilterTgtIds,
 		srcMigrationHint:  MigrationHintMap{},
@@ -280,18 +320,80 @@ func NewDifferDriver(sourceFileDir, targetFileDir, diffFileDir, diffKeysFileName
 		bucketTopologySvc: bucketTopologySvc,
 		specifiedSpec:     specifiedSpec,
 		logger:            logger,
+
+		srcNumberOfVbuckets:       srcNumberOfVbuckets,
+		tgtNumberOfVbuckets:       tgtNumberOfVbuckets,
+		numberOfKeyHashPartitions: numberOfKeyHashPartitions,
+		memoryBudget:              memoryBudget,
+		incremental:               incremental,
+		binFileCodec:              binFileCodec,
+		storage:                   storage,
 	}
 }
 
+// sets the version pruning windows of the buckets for when the driver has no bucketTopologySvc,
+// e.g. when diffing capture archives
+func (dr *DifferDriver) SetPruningWindows(srcPruningWindow, tgtPruningWindow time.Duration) {
+	dr.srcPruningWindow = srcPruningWindow
+	dr.tgtPruningWindow = tgtPruningWindow
+}
+
+// sets how the docs are compared, along with the settings that the files were captured with
+func (dr *DifferDriver) SetCompareSettings(compareType string, captureSettings *utils.CaptureSettings) {
+	dr.compareType = compareType
+	dr.captureSettings = captureSettings
+}
+
 func (dr *DifferDriver) Run() error {
-	loadDistribution := utils.BalanceLoad(dr.numberOfWorkers, base.NumberOfVbuckets)
-	err := sourcePruningWindow.set(dr.bucketTopologySvc, dr.specifiedSpec)
-	if err != nil {
-		return err
+	sourceFileDir, targetFileDir, numberOfBins := dr.sourceFileDir, dr.targetFileDir, dr.numberOfBins
+	if dr.numberOfKeyHashPartitions > 0 {
+		var err error
+		sourceFileDir, targetFileDir, err = dr.partitionByKeyHash()
+		if err != nil {
+			return err
+		}
+		defer dr.storage.RemoveAll(dr.getKeyHashPartitionDir())
+		numberOfBins = 1
+	} else if dr.srcNumberOfVbuckets != dr.tgtNumberOfVbuckets {
+		return fmt.Errorf("source bucket has %v vbuckets while target bucket has %v vbuckets. Files need to be diffed by key hash partition",
+			dr.srcNumberOfVbuckets, dr.tgtNumberOfVbuckets)
 	}
-	err1 := targetPruningWindow.set(dr.bucketTopologySvc, dr.specifiedSpec)
-	if err1 != nil {
-		return err1
+
+	if dr.memoryBudget > 0 {
+		err := os.MkdirAll(dr.getSpillDir(), 0777)
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dr.getSpillDir())
+		err = os.MkdirAll(dr.getDiffDetailsBinDir(), 0777)
+		if err != nil {
+			return err
+		}
+		if dr.memoryBudget/dr.numberOfWorkers < base.ExternalSortMinWorkerMemoryBudget {
+			dr.logger.Warnf("Memory budget of %v bytes is less than %v bytes for each of %v workers. Each worker uses %v bytes\n",
+				dr.memoryBudget, base.ExternalSortMinWorkerMemoryBudget, dr.numberOfWorkers, dr.getWorkerMemoryBudget())
+		}
+	}
+
+	loadDistribution := utils.BalanceLoad(dr.numberOfWorkers, dr.numberOfDiffUnits())
+	if dr.bucketTopologySvc != nil {
+		err := sourcePruningWindow.set(dr.bucketTopologySvc, dr.specifiedSpec)
+		if err != nil {
+			return err
+		}
+		err1 := targetPruningWindow.set(dr.bucketTopologySvc, dr.specifiedSpec)
+		if err1 != nil {
+			return err1
+		}
+	} else {
+		sourcePruningWindow.setDuration(dr.srcPruningWindow)
+		targetPruningWindow.setDuration(dr.tgtPruningWindow)
+	}
+	if dr.incremental {
+		err := dr.initializeDiffState()
+		if err != nil {
+			return err
+		}
 	}
 	go dr.reportStatus()
 
@@ -306,7 +408,7 @@ func (dr *DifferDriver) Run() error {
 		}
 
 		dr.waitGroup.Add(1)
-		differHandler := NewDifferHandler(dr, i, dr.sourceFileDir, dr.targetFileDir, vbList, dr.numberOfBins, dr.waitGroup, dr.fileDescPool, dr.collectionMapping, dr.colFilterStrings, dr.colFilterTgtIds)
+		differHandler := NewDifferHandler(dr, i, sourceFileDir, targetFileDir, vbList, numberOfBins, dr.waitGroup, dr.fileDescPool, dr.collectionMapping, dr.colFilterStrings, dr.colFilterTgtIds)
 		differHandlers = append(differHandlers, differHandler)
 		go differHandler.run()
 	}
@@ -321,9 +423,72 @@ func (dr *DifferDriver) Run() error {
 
 	dr.Stop()
 
+	// a bin that could not be diffed would leave its keys out of the results, so the run fails
+	for _, handler := range differHandlers {
+		if handler.err != nil {
+			return handler.err
+		}
+	}
 	return nil
 }
 
+// number of vbuckets, or of key hash partitions, that the files are diffed by
+func (dr *DifferDriver) numberOfDiffUnits() int {
+	if dr.numberOfKeyHashPartitions > 0 {
+		return dr.numberOfKeyHashPartitions
+	}
+	return dr.srcNumberOfVbuckets
+}
+
+func (dr *DifferDriver) getSpillDir() string {
+	return dr.diffFileDir + base.FileDirDelimiter + base.ExternalSortSpillDir
+}
+
+// the share of the memory budget of each worker, since they all sort at the same time
+func (dr *DifferDriver) getWorkerMemoryBudget() int {
+	budget := dr.memoryBudget / dr.numberOfWorkers
+	if budget < base.ExternalSortMinWorkerMemoryBudget {
+		return base.ExternalSortMinWorkerMemoryBudget
+	}
+	return budget
+}
+
+// kept with the diff state, so that the diff details of bins that are reused are still there for the next diff
+func (dr *DifferDriver) getDiffDetailsBinDir() string {
+	return dr.diffFileDir + base.FileDirDelimiter + base.DiffDetailsBinDir
+}
+
+func (dr *DifferDriver) getDiffDetailsBinFileName(vbno uint16, bucketIndex int) string {
+	return fmt.Sprintf("%v%v%v%v%v", dr.getDiffDetailsBinDir(), base.FileDirDelimiter, vbno, base.FileNameDelimiter, bucketIndex)
+}
+
+func (dr *DifferDriver) getKeyHashPartitionDir() string {
+	return dr.diffFileDir + base.FileDirDelimiter + base.KeyHashPartitionDir
+}
+
+// re-partitions the source and target files by key hash, and returns the directories holding the partitions
+func (dr *DifferDriver) partitionByKeyHash() (string, string, error) {
+	if dr.numberOfKeyHashPartitions > base.MaxNumberOfKeyHashPartitions {
+		return "", "", fmt.Errorf("number of key hash partitions %v exceeds the max of %v", dr.numberOfKeyHashPartitions, base.MaxNumberOfKeyHashPartitions)
+	}
+
+	sourcePartitionDir := dr.getKeyHashPartitionDir() + base.FileDirDelimiter + base.SourceFileDir
+	targetPartitionDir := dr.getKeyHashPartitionDir() + base.FileDirDelimiter + base.TargetFileDir
+
+	dr.logger.Infof("Partitioning source files of %v vbuckets into %v key hash partitions\n", dr.srcNumberOfVbuckets, dr.numberOfKeyHashPartitions)
+	err := newKeyHashPartitioner(dr.sourceFileDir, sourcePartitionDir, dr.srcNumberOfVbuckets, dr.numberOfBins, dr.numberOfKeyHashPartitions, dr.numberOfWorkers, dr.memoryBudget, dr.binFileCodec, dr.storage, dr.logger).run()
+	if err != nil {
+		return "", "", fmt.Errorf("error partitioning source files. err=%v", err)
+	}
+
+	dr.logger.Infof("Partitioning target files of %v vbuckets into %v key hash partitions\n", dr.tgtNumberOfVbuckets, dr.numberOfKeyHashPartitions)
+	err = newKeyHashPartitioner(dr.targetFileDir, targetPartitionDir, dr.tgtNumberOfVbuckets, dr.numberOfBins, dr.numberOfKeyHashPartitions, dr.numberOfWorkers, dr.memoryBudget, dr.binFileCodec, dr.storage, dr.logger).run()
+	if err != nil {
+		return "", "", fmt.Errorf("error partitioning target files. err=%v", err)
+	}
+	return sourcePartitionDir, targetPartitionDir, nil
+}
+
 func (dr *DifferDriver) Stop() {
 	dr.stopOnce.Do(func() { dr.cleanup() })
 }
@@ -334,6 +499,54 @@ func (dr *DifferDriver) cleanup() {
 	if err != nil {
 		fmt.Printf("Error writing srcDiff fetchList. err=%v\n", err)
 	}
+	err = dr.writeMismatchHistogram()
+	if err != nil {
+		dr.logger.Errorf("Error writing mismatch histogram. err=%v\n", err)
+	}
+	if dr.diffState != nil {
+		dr.logger.Infof("Reused the results of the previous diff for %v of %v bins\n", atomic.LoadUint32(&dr.binsReused), dr.numberOfDiffUnits()*dr.numberOfBins)
+		err = dr.diffState.save(dr.diffFileDir)
+		if err != nil {
+			dr.logger.Errorf("Error saving diff state. err=%v\n", err)
+		}
+	}
+}
+
+// Loads the results of the previous diff, which are reused for the bins whose files have not changed since
+func (dr *DifferDriver) initializeDiffState() error {
+	if dr.numberOfKeyHashPartitions > 0 {
+		// partitions are rebuilt from all files on every diff
+		dr.logger.Warnf("Incremental diff is not supported when diffing by key hash partition. All partitions are diffed\n")
+		return nil
+	}
+	params := &diffStateParams{
+		SourceFileDir:       dr.sourceFileDir,
+		TargetFileDir:       dr.targetFileDir,
+		SrcNumberOfVbuckets: dr.srcNumberOfVbuckets,
+		NumberOfBins:        dr.numberOfBins,
+		SourceClusterUUID:   dr.sourceClusterUUID,
+		TargetClusterUUID:   dr.targetClusterUUID,
+		SourceBucketUUID:    dr.sourceBucketUUID,
+		TargetBucketUUID:    dr.targetBucketUUID,
+		CollectionMapping:   dr.collectionMapping,
+		ColFilterStrings:    dr.colFilterStrings,
+		ColFilterTgtIds:     dr.colFilterTgtIds,
+		SrcPruningWindow:    sourcePruningWindow.get(),
+		TgtPruningWindow:    targetPruningWindow.get(),
+		CompareType:         dr.compareType,
+		CaptureSettings:     dr.captureSettings,
+	}
+	var err error
+	dr.prevDiffState, err = loadDiffState(dr.diffFileDir, params)
+	if err != nil {
+		return err
+	}
+	if dr.prevDiffState == nil {
+		dr.logger.Infof("There are no results of a previous diff of the same files and replication to reuse. All bins are diffed\n")
+	}
+	dr.diffState = newDiffState(params)
+	// where the diff details of the bins are kept for the next diff
+	return os.MkdirAll(dr.getDiffDetailsBinDir(), 0777)
 }
 
 func (dr *DifferDriver) reportStatus() {
@@ -345,7 +558,7 @@ func (dr *DifferDriver) reportStatus() {
 		case <-ticker.C:
 			vbCompleted := atomic.LoadUint32(&dr.vbCompleted)
 			fmt.Printf("%v File differ processed %v vbuckets\n", time.Now(), vbCompleted)
-			if vbCompleted == base.NumberOfVbuckets {
+			if vbCompleted == uint32(dr.numberOfDiffUnits()) {
 				return
 			}
 		case <-dr.finChan:
@@ -367,6 +580,36 @@ func (dr *DifferDriver) addSrcDiffKeys(diffKeys map[uint32][]string, migrationHi
 	}
 }
 
+// the number of keys found different, from the point of view of the source and of the target
+func (dr *DifferDriver) DiffKeyCounts() (int, int) {
+	dr.stateLock.RLock()
+	defer dr.stateLock.RUnlock()
+	return dr.srcDiffKeys.GetTotalCount(), dr.tgtDiffKeys.GetTotalCount()
+}
+
+func (dr *DifferDriver) addMismatchHistogram(histogram MismatchHistogram) {
+	dr.stateLock.Lock()
+	defer dr.stateLock.Unlock()
+	dr.mismatchHistogram.Merge(histogram)
+}
+
+// the number of docs found mismatched by each of the fields that differ between their source and target versions
+func (dr *DifferDriver) MismatchHistogram() MismatchHistogram {
+	dr.stateLock.RLock()
+	defer dr.stateLock.RUnlock()
+	histogram := make(MismatchHistogram)
+	histogram.Merge(dr.mismatchHistogram)
+	return histogram
+}
+
+func (dr *DifferDriver) writeMismatchHistogram() error {
+	histogram := dr.MismatchHistogram()
+	if len(histogram) > 0 {
+		dr.logger.Infof("Mismatched docs by the fields that differ: %v\n", histogram)
+	}
+	return writeJsonFile(dr.diffFileDir+base.FileDirDelimiter+base.MismatchHistogramFileName, histogram)
+}
+
 func (dr *DifferDriver) addTgtDiffKeys(diffKeys map[uint32][]string) {
 	dr.stateLock.Lock()
 	defer dr.stateLock.Unlock()
@@ -450,6 +693,8 @@ type DifferHandler struct {
 	colFilterTgtIds   []uint32
 
 	duplicatedHintMap DuplicatedHintMap
+	// what stopped the handler before it diffed all of its bins
+	err error
 }
 
 func NewDifferHandler(driver *DifferDriver, index int, sourceFileDir, targetFileDir string, vbList []uint16, numberOfBins int, waitGroup *sync.WaitGroup, fdPool *fdp.FdPool, collectionMapping map[uint32][]uint32, colFilterStrings []string, colFilterTgtIds []uint32) *DifferHandler {
@@ -469,59 +714,47 @@ func NewDifferHandler(driver *DifferDriver, index int, sourceFileDir, targetFile
 	}
 }
 
-func (dh *DifferHandler) run() error {
+func (dh *DifferHandler) run() (err error) {
 	//fmt.Printf("DiffHandler %v starting\n", dh.index)
 	//defer fmt.Printf("DiffHandler %v stopping\n", dh.index)
 	defer dh.waitGroup.Done()
+	defer func() {
+		dh.err = err
+	}()
 
-	err := dh.initialize()
+	err = dh.initialize()
 	if err != nil {
 		fmt.Printf("%v srcDiff handler failed to initialize. err=%v\n", dh.index, err)
 		return err
 	}
+	defer dh.cleanup()
 	var vbno uint16
 	for _, vbno = range dh.vbList {
 		srcVbItemCnt := 0
 		tgtVbItemCnt := 0
 		for bucketIndex := 0; bucketIndex < dh.numberOfBins; bucketIndex++ {
-			sourceFileName := utils.GetFileName(dh.sourceFileDir, vbno, bucketIndex)
-			targetFileName := utils.GetFileName(dh.targetFileDir, vbno, bucketIndex)
-
-			filesDiffer, err := NewFilesDifferWithFDPool(sourceFileName, targetFileName, dh.fileDescPool, dh.collectionMapping, dh.colFilterStrings, dh.colFilterTgtIds, dh.driver.logger)
-			filesDiffer.file1.actorId, err = hlv.UUIDstoDocumentSource(dh.driver.sourceBucketUUID, dh.driver.sourceClusterUUID)
+			result, err := dh.diffBin(vbno, bucketIndex)
 			if err != nil {
-				dh.driver.logger.Errorf("error occured while constructing the actorID from bucketUUID %v and clusterUUID %v. err %v", dh.driver.sourceBucketUUID, dh.driver.sourceClusterUUID, err)
 				return err
 			}
-			filesDiffer.file2.actorId, err = hlv.UUIDstoDocumentSource(dh.driver.targetBucketUUID, dh.driver.targetClusterUUID)
-			if err != nil {
-				dh.driver.logger.Errorf("error occured while constructing the actorID from bucketUUID %v and clusterUUID %v. err %v", dh.driver.targetBucketUUID, dh.driver.targetClusterUUID, err)
-				return err
-			}
-			if err != nil {
-				// Most likely FD overrun, program should exit. Print a msg just in case
-				dh.driver.logger.Errorf("Creating file differ for files %v and %v resulted in error: %v\n",
-					sourceFileName, targetFileName, err)
-				return err
-			}
-			srcDiffMap, tgtDiffMap, migrationHints, diffBytes, err := filesDiffer.Diff()
-			if err != nil {
-				fmt.Printf("error getting srcDiff from file differ. err=%v\n", err)
-				continue
-			}
-			if len(srcDiffMap) > 0 || len(tgtDiffMap) > 0 {
-				if len(srcDiffMap) > 0 {
-					dh.driver.addSrcDiffKeys(srcDiffMap, migrationHints)
+			if len(result.SrcDiffKeys) > 0 || len(result.TgtDiffKeys) > 0 {
+				if len(result.SrcDiffKeys) > 0 {
+					dh.driver.addSrcDiffKeys(result.SrcDiffKeys, result.MigrationHints)
 				}
-				if len(tgtDiffMap) > 0 {
-					dh.driver.addTgtDiffKeys(tgtDiffMap)
+				if len(result.TgtDiffKeys) > 0 {
+					dh.driver.addTgtDiffKeys(result.TgtDiffKeys)
+				}
+				if result.DiffDetailsFileName != "" {
+					dh.copyDiffDetails(result.DiffDetailsFileName)
+				} else {
+					dh.writeDiffBytes(result.diffBytes)
 				}
-				dh.writeDiffBytes(diffBytes)
 			}
-			srcVbItemCnt += filesDiffer.file1ItemCount
-			tgtVbItemCnt += filesDiffer.file2ItemCount
+			dh.driver.addMismatchHistogram(result.MismatchHistogram)
+			srcVbItemCnt += result.SrcItemCount
+			tgtVbItemCnt += result.TgtItemCount
 
-			dh.duplicatedHintMap.Merge(filesDiffer.duplicatedHintMap)
+			dh.duplicatedHintMap.Merge(result.DuplicatedHint)
 		}
 		atomic.AddInt64(&dh.driver.SourceItemCount, int64(srcVbItemCnt))
 		atomic.AddInt64(&dh.driver.TargetItemCount, int64(tgtVbItemCnt))
@@ -533,11 +766,99 @@ func (dh *DifferHandler) run() error {
 		atomic.AddUint32(&dh.driver.vbCompleted, 1)
 	}
 
-	dh.cleanup()
-
 	return nil
 }
 
+// Diffs the source and target files of the bin, or reuses the result of the previous diff when neither file
+// has changed since
+func (dh *DifferHandler) diffBin(vbno uint16, bucketIndex int) (*binDiffResult, error) {
+	sourceFileName := utils.GetFileName(dh.sourceFileDir, vbno, bucketIndex)
+	targetFileName := utils.GetFileName(dh.targetFileDir, vbno, bucketIndex)
+
+	var sourceFileSize, targetFileSize int64
+	var sourceFileTailChecksum, targetFileTailChecksum uint32
+	if dh.driver.diffState != nil {
+		var err error
+		sourceFileSize, sourceFileTailChecksum, err = getBinFileVersion(dh.driver.storage, sourceFileName)
+		if err != nil {
+			return nil, err
+		}
+		targetFileSize, targetFileTailChecksum, err = getBinFileVersion(dh.driver.storage, targetFileName)
+		if err != nil {
+			return nil, err
+		}
+		if dh.driver.prevDiffState != nil {
+			prevResult := dh.driver.prevDiffState.get(vbno, bucketIndex)
+			if prevResult != nil && prevResult.SourceFileSize == sourceFileSize && prevResult.TargetFileSize == targetFileSize &&
+				prevResult.SourceFileTailChecksum == sourceFileTailChecksum && prevResult.TargetFileTailChecksum == targetFileTailChecksum {
+				dh.driver.diffState.set(vbno, bucketIndex, prevResult)
+				atomic.AddUint32(&dh.driver.binsReused, 1)
+				return prevResult, nil
+			}
+		}
+	}
+
+	filesDiffer, err := NewFilesDifferWithFDPool(sourceFileName, targetFileName, dh.fileDescPool, dh.collectionMapping, dh.colFilterStrings, dh.colFilterTgtIds, dh.driver.logger)
+	filesDiffer.setStorage(dh.driver.storage)
+	var diffDetailsFileName string
+	if dh.driver.memoryBudget > 0 {
+		filesDiffer.setExternalSort(dh.driver.getWorkerMemoryBudget(), dh.driver.getSpillDir())
+		diffDetailsFileName = dh.driver.getDiffDetailsBinFileName(vbno, bucketIndex)
+		filesDiffer.setDiffDetailsSpill(dh.driver.getSpillDir(), diffDetailsFileName)
+	} else {
+		filesDiffer.setSortedRuns()
+	}
+	filesDiffer.file1.actorId, err = hlv.UUIDstoDocumentSource(dh.driver.sourceBucketUUID, dh.driver.sourceClusterUUID)
+	if err != nil {
+		dh.driver.logger.Errorf("error occured while constructing the actorID from bucketUUID %v and clusterUUID %v. err %v", dh.driver.sourceBucketUUID, dh.driver.sourceClusterUUID, err)
+		return nil, err
+	}
+	filesDiffer.file2.actorId, err = hlv.UUIDstoDocumentSource(dh.driver.targetBucketUUID, dh.driver.targetClusterUUID)
+	if err != nil {
+		dh.driver.logger.Errorf("error occured while constructing the actorID from bucketUUID %v and clusterUUID %v. err %v", dh.driver.targetBucketUUID, dh.driver.targetClusterUUID, err)
+		return nil, err
+	}
+	if err != nil {
+		// Most likely FD overrun, program should exit. Print a msg just in case
+		dh.driver.logger.Errorf("Creating file differ for files %v and %v resulted in error: %v\n",
+			sourceFileName, targetFileName, err)
+		return nil, err
+	}
+	srcDiffMap, tgtDiffMap, migrationHints, diffBytes, err := filesDiffer.Diff()
+	if err != nil {
+		dh.driver.logger.Errorf("Error diffing files %v and %v. err=%v\n", sourceFileName, targetFileName, err)
+		return nil, err
+	}
+
+	result := &binDiffResult{
+		SourceFileSize:         sourceFileSize,
+		TargetFileSize:         targetFileSize,
+		SourceFileTailChecksum: sourceFileTailChecksum,
+		TargetFileTailChecksum: targetFileTailChecksum,
+		SrcDiffKeys:            srcDiffMap,
+		TgtDiffKeys:            tgtDiffMap,
+		MigrationHints:         migrationHints,
+		DiffDetailsFileName:    diffDetailsFileName,
+		SrcItemCount:           filesDiffer.file1ItemCount,
+		TgtItemCount:           filesDiffer.file2ItemCount,
+		DuplicatedHint:         filesDiffer.duplicatedHintMap,
+		MismatchHistogram:      filesDiffer.MismatchHistogram,
+		diffBytes:              diffBytes,
+	}
+	if dh.driver.diffState != nil {
+		if diffDetailsFileName == "" && len(diffBytes) > 0 {
+			// the details are kept in a file of their own for the next diff, rather than in the state
+			result.DiffDetailsFileName = dh.driver.getDiffDetailsBinFileName(vbno, bucketIndex)
+			err = ioutil.WriteFile(result.DiffDetailsFileName, diffBytes, base.FileModeReadWrite)
+			if err != nil {
+				return nil, err
+			}
+		}
+		dh.driver.diffState.set(vbno, bucketIndex, result)
+	}
+	return result, nil
+}
+
 func (dh *DifferHandler) initialize() error {
 	diffDetailsFileName := dh.driver.diffFileDir + base.FileDirDelimiter + base.DiffDetailsFileName + base.FileNameDelimiter + fmt.Sprintf("%v", dh.index)
 	diffDetailsFile, err := os.OpenFile(diffDetailsFileName, os.O_RDWR|os.O_CREATE, base.FileModeReadWrite)
@@ -556,6 +877,18 @@ func (dh *DifferHandler) writeDiffBytes(diffBytes []byte) error {
 	return err
 }
 
+func (dh *DifferHandler) copyDiffDetails(fileName string) error {
+	file, err := os.Open(fileName)
+	if err == nil {
+		_, err = io.Copy(dh.diffDetailsFile, file)
+		file.Close()
+	}
+	if err != nil {
+		fmt.Printf("Diff handler %v error writing srcDiff details. err=%v\n", dh.index, err)
+	}
+	return err
+}
+
 func (dh *DifferHandler) cleanup() {
 	dh.diffDetailsFile.Close()
 }
@@ -10,18 +10,26 @@
 package differ
 
 import (
+	"bytes"
 	"crypto/sha512"
+	"errors"
 	"fmt"
 	"github.com/couchbase/gomemcached"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"sync"
 	"testing"
 	"time"
+	"xdcrDiffer/base"
 	"xdcrDiffer/dcp"
 	fdp "xdcrDiffer/fileDescriptorPool"
+	"xdcrDiffer/storage"
+	"xdcrDiffer/utils"
+
+	xdcrLog "github.com/couchbase/goxdcr/log"
 )
 
 const MaxUint64 = ^uint64(0)
@@ -29,6 +37,8 @@ const MinUint = 0
 
 var randomOnce sync.Once
 
+var logger = xdcrLog.NewLogger("differ_test", xdcrLog.DefaultLoggerContext)
+
 func randomString(l int) string {
 	bytes := make([]byte, l)
 	for i := 0; i < l; i++ {
@@ -94,24 +104,76 @@ func genTestData(regularMutation, colFilters bool) (key string, seqno, revId, ca
 		ColId:             0,
 		ColFiltersMatched: filterIds,
 	}
-	dataSlice := mutationToSerialize.Serialize()
+	dataSlice, _ := mutationToSerialize.Serialize()
 
 	return key, seqno, revId, cas, flags, expiry, opCode, hash, dataSlice, colId, filterIds
 }
 
+// serializes a mutation of key whose value is the key itself
+func genRecord(key string, seqno uint64, colId uint32) []byte {
+	mutation := dcp.Mutation{
+		Key:    []byte(key),
+		Seqno:  seqno,
+		RevId:  1,
+		Cas:    seqno,
+		OpCode: gomemcached.UPR_MUTATION,
+		Value:  []byte(key),
+		ColId:  colId,
+	}
+	record, _ := mutation.Serialize()
+	return record
+}
+
+// reads every record of the bin file, in order
+func readBinFileRecords(t *testing.T, storage storage.Storage, fileName string) []*utils.SortableRecord {
+	data, err := storage.ReadFile(fileName)
+	if err != nil {
+		t.Fatalf("cannot read %v: %v", fileName, err)
+	}
+	reader, err := utils.NewBinFileReader(fileName, bytes.NewReader(data).Read, logger)
+	if err != nil {
+		t.Fatalf("cannot read %v: %v", fileName, err)
+	}
+	var records []*utils.SortableRecord
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return records
+		} else if err != nil {
+			t.Fatalf("cannot read %v: %v", fileName, err)
+		}
+		sortable, err := utils.NewSortableRecord(record)
+		if err != nil {
+			t.Fatalf("cannot parse record of %v: %v", fileName, err)
+		}
+		records = append(records, sortable)
+	}
+}
+
+// returns the records framed the way that they are written to an uncompressed bin file
 func genMultipleRecords(numOfRecords int) []byte {
 	var retSlice []byte
 
 	for i := 0; i < numOfRecords; i++ {
 		_, _, _, _, _, _, _, _, record, _, _ := genTestData(true, false)
-		retSlice = append(retSlice, record...)
+		retSlice = utils.AppendRecordFrame(retSlice, record)
 	}
 
 	return retSlice
 }
 
+// returns an uncompressed bin file of the serialized records
+func genBinFile(records ...[]byte) []byte {
+	data := utils.AppendBinFileHeader(nil, base.BinFileCodecNone)
+	for _, record := range records {
+		data = utils.AppendRecordFrame(data, record)
+	}
+	return data
+}
+
 func genSameFiles(numOfRecords int, fileName1, fileName2 string) error {
-	data := genMultipleRecords(numOfRecords)
+	data := utils.AppendBinFileHeader(nil, base.BinFileCodecNone)
+	data = append(data, genMultipleRecords(numOfRecords)...)
 
 	err := ioutil.WriteFile(fileName1, data, 0644)
 	if err != nil {
@@ -128,7 +190,8 @@ func genSameFiles(numOfRecords int, fileName1, fileName2 string) error {
 
 func genMismatchedFiles(numOfRecords, mismatchCnt int, fileName1, fileName2 string) ([]string, error) {
 	var mismatchedKeyNames []string
-	data := genMultipleRecords(numOfRecords - mismatchCnt)
+	data := utils.AppendBinFileHeader(nil, base.BinFileCodecNone)
+	data = append(data, genMultipleRecords(numOfRecords-mismatchCnt)...)
 
 	err := ioutil.WriteFile(fileName1, data, 0644)
 	if err != nil {
@@ -169,14 +232,17 @@ func genMismatchedFiles(numOfRecords, mismatchCnt int, fileName1, fileName2 stri
 			ColId:             colId,
 			ColFiltersMatched: nil,
 		}
-		mismatchedData := mismatchedDataMut.Serialize()
+		mismatchedData, err := mismatchedDataMut.Serialize()
+		if err != nil {
+			return mismatchedKeyNames, err
+		}
 
-		_, err = f1.Write(oneData)
+		_, err = f1.Write(utils.AppendRecordFrame(nil, oneData))
 		if err != nil {
 			return mismatchedKeyNames, err
 		}
 
-		_, err = f2.Write(mismatchedData)
+		_, err = f2.Write(utils.AppendRecordFrame(nil, mismatchedData))
 		if err != nil {
 			return mismatchedKeyNames, err
 		}
@@ -210,10 +276,10 @@ func TestLoader(t *testing.T) {
 
 	key, seqno, _, _, _, _, _, _, data, _, _ := genTestData(true, false)
 
-	err := ioutil.WriteFile(outputFileTemp, data, 0644)
+	err := ioutil.WriteFile(outputFileTemp, genBinFile(data), 0644)
 	assert.Nil(err)
 
-	differ := NewFilesDiffer(outputFileTemp, "", nil, nil, nil)
+	differ := NewFilesDiffer(outputFileTemp, "", nil, nil, nil, nil)
 	err = differ.file1.LoadFileIntoBuffer()
 	assert.Nil(err)
 
@@ -231,10 +297,10 @@ func TestLoaderWithColFilters(t *testing.T) {
 
 	key, _, _, _, _, _, _, _, data, _, filterIds := genTestData(true, true)
 
-	err := ioutil.WriteFile(outputFileTemp, data, 0644)
+	err := ioutil.WriteFile(outputFileTemp, genBinFile(data), 0644)
 	assert.Nil(err)
 
-	differ := NewFilesDiffer(outputFileTemp, "", nil, nil, nil)
+	differ := NewFilesDiffer(outputFileTemp, "", nil, nil, nil, nil)
 	err = differ.file1.LoadFileIntoBuffer()
 	assert.Nil(err)
 
@@ -259,7 +325,7 @@ func TestLoadSameFile(t *testing.T) {
 	err := genSameFiles(entries, file1, file2)
 	assert.Equal(nil, err)
 
-	differ := NewFilesDiffer(file1, file2, nil, nil, nil)
+	differ := NewFilesDiffer(file1, file2, nil, nil, nil, logger)
 	assert.NotNil(differ)
 
 	srcDiffMap, tgtDiffMap, _, _, _ := differ.Diff()
@@ -287,7 +353,7 @@ func Disabled_TestLoadMismatchedFilesOnly(t *testing.T) {
 	keys, err := genMismatchedFiles(entries, numMismatch, file1, file2)
 	assert.Nil(err)
 
-	differ := NewFilesDiffer(file1, file2, nil, nil, nil)
+	differ := NewFilesDiffer(file1, file2, nil, nil, nil, logger)
 	assert.NotNil(differ)
 
 	srcDiffMap, tgtDiffMap, _, _, _ := differ.Diff()
@@ -331,7 +397,7 @@ func Disabled_TestLoadMismatchedFilesAndUneven(t *testing.T) {
 	assert.Nil(err)
 	f.Close()
 
-	differ := NewFilesDiffer(file1, file2, nil, nil, nil)
+	differ := NewFilesDiffer(file1, file2, nil, nil, nil, logger)
 	assert.NotNil(differ)
 
 	srcDiffMap, tgtDiffMap, _, _, _ := differ.Diff()
@@ -364,7 +430,7 @@ func TestLoadSameFileWPool(t *testing.T) {
 	err := genSameFiles(entries, file1, file2)
 	assert.Equal(nil, err)
 
-	differ, err := NewFilesDifferWithFDPool(file1, file2, fileDescPool, nil, nil, nil)
+	differ, err := NewFilesDifferWithFDPool(file1, file2, fileDescPool, nil, nil, nil, logger)
 	assert.NotNil(differ)
 	assert.Nil(err)
 
@@ -379,8 +445,33 @@ func TestNoFilePool(t *testing.T) {
 	fmt.Println("============== Test case start: TestNoFilePool =================")
 	assert := assert.New(t)
 
-	differDriver := NewDifferDriver("", "", "", "", 2, 2, 0, nil, nil, nil)
+	differDriver := NewDifferDriver("", "", "", "", 2, 2, 1024, 1024, 0, 0, 0, false, base.BinFileCodecNone, storage.NewLocalStorage(), nil, nil, nil, "", "", "", "", nil, nil, logger)
 	assert.NotNil(differDriver)
 	assert.Nil(differDriver.fileDescPool)
 	fmt.Println("============== Test case end: TestNoFilePool =================")
 }
+
+func TestDifferDriverRejectsIncompatibleBins(t *testing.T) {
+	fmt.Println("============== Test case start: TestDifferDriverRejectsIncompatibleBins =================")
+	assert := assert.New(t)
+	diffFileDir, err := ioutil.TempDir("", "incompatibleBinTest")
+	assert.Nil(err)
+	defer os.RemoveAll(diffFileDir)
+	storage := storage.NewMemoryStorage()
+
+	// the source bins of vb 1 were captured before the format was versioned, so their records are not framed
+	for vbno := uint16(0); vbno < 2; vbno++ {
+		sourceData := genBinFile(genRecord("key_1", 1, 0))
+		if vbno == 1 {
+			sourceData = genRecord("key_1", 1, 0)
+		}
+		assert.Nil(storage.WriteFile(utils.GetFileName("/source", vbno, 0), sourceData))
+		assert.Nil(storage.WriteFile(utils.GetFileName("/target", vbno, 0), genBinFile(genRecord("key_1", 1, 0))))
+	}
+
+	dr := NewDifferDriver("/source", "/target", diffFileDir, diffFileDir+base.FileDirDelimiter+base.DiffKeysFileName, 2, 1, 2, 2, 0, 0, 0, false,
+		base.BinFileCodecNone, storage, nil, nil, nil, "", "", "", "", nil, nil, logger)
+	err = dr.Run()
+	assert.True(errors.Is(err, base.ErrorIncompatibleBinFile))
+	fmt.Println("============== Test case end: TestDifferDriverRejectsIncompatibleBins =================")
+}
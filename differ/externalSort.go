@@ -0,0 +1,514 @@
+package differ
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"xdcrDiffer/base"
+	fdp "xdcrDiffer/fileDescriptorPool"
+	"xdcrDiffer/utils"
+
+	hlv "github.com/couchbase/goxdcr/hlv"
+)
+
+// Reads one whole serialized record. Returns io.EOF if there are no more records
+func readRawRecord(readOp fdp.FileOp) ([]byte, error) {
+	data := make([]byte, base.KeyLenVariable)
+	bytesRead, err := readOp(data)
+	if err == io.EOF && bytesRead == 0 {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("Unable to read keyLen, bytes read: %v, err: %v", bytesRead, err)
+	}
+	keyLen := int(binary.BigEndian.Uint16(data))
+
+	// key, seqno, revId, cas, flags, expiry, opCode, datatype, importCas, pRev and hlv size
+	data, err = readMore(readOp, data, keyLen+60)
+	if err != nil {
+		return nil, err
+	}
+	hlvLen := int(binary.BigEndian.Uint64(data[len(data)-8:]))
+
+	// hlv, hash, collectionId and migration filter length
+	data, err = readMore(readOp, data, hlvLen+64+4+base.MigrationFilterLen)
+	if err != nil {
+		return nil, err
+	}
+	filterCnt := int(binary.BigEndian.Uint16(data[len(data)-base.MigrationFilterLen:]))
+
+	// migration filters and xattr digest count
+	data, err = readMore(readOp, data, filterCnt*2+base.XattrDigestCntLen)
+	if err != nil {
+		return nil, err
+	}
+	xattrDigestCnt := int(binary.BigEndian.Uint16(data[len(data)-base.XattrDigestCntLen:]))
+
+	for i := 0; i < xattrDigestCnt; i++ {
+		data, err = readMore(readOp, data, base.XattrKeyLenVariable)
+		if err != nil {
+			return nil, err
+		}
+		xattrKeyLen := int(binary.BigEndian.Uint16(data[len(data)-base.XattrKeyLenVariable:]))
+		data, err = readMore(readOp, data, xattrKeyLen+base.XattrDigestLen)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+func readMore(readOp fdp.FileOp, data []byte, length int) ([]byte, error) {
+	if length == 0 {
+		return data, nil
+	}
+	buf := make([]byte, length)
+	bytesRead, err := readOp(buf)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read record, bytes read: %v, err: %v", bytesRead, err)
+	}
+	if bytesRead != length {
+		return nil, fmt.Errorf("Unable to read record, expected %v bytes, bytes read: %v", length, bytesRead)
+	}
+	return append(data, buf...), nil
+}
+
+// a file op that always fills the given buffer unless it runs into the end of the reader
+func readFullOp(reader io.Reader) fdp.FileOp {
+	return func(p []byte) (int, error) {
+		return io.ReadFull(reader, p)
+	}
+}
+
+type fileRange struct {
+	offset int64
+	length int64
+}
+
+// Writes sorted records into a file, skipping all but the first record of each key
+// and keeping track of where the records of each collection are
+type sortedFileWriter struct {
+	file        *os.File
+	writer      *bufio.Writer
+	offset      int64
+	colIdRanges map[uint32]*fileRange
+	itemCount   int
+	last        *utils.SortableRecord
+}
+
+func newSortedFileWriter(fileName string) (*sortedFileWriter, error) {
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, base.FileModeReadWrite)
+	if err != nil {
+		return nil, err
+	}
+	return &sortedFileWriter{
+		file:        file,
+		writer:      bufio.NewWriterSize(file, base.ExternalSortIOBufferSize),
+		colIdRanges: make(map[uint32]*fileRange),
+	}, nil
+}
+
+func (w *sortedFileWriter) write(record *utils.SortableRecord) error {
+	if w.last != nil && w.last.SameKey(record) {
+		// older version of the same document
+		return nil
+	}
+
+	colIdRange, exists := w.colIdRanges[record.ColId]
+	if !exists {
+		colIdRange = &fileRange{offset: w.offset}
+		w.colIdRanges[record.ColId] = colIdRange
+	}
+
+	_, err := w.writer.Write(record.Data)
+	if err != nil {
+		return err
+	}
+	w.offset += int64(len(record.Data))
+	colIdRange.length += int64(len(record.Data))
+	w.itemCount++
+	w.last = record
+	return nil
+}
+
+func (w *sortedFileWriter) close() error {
+	err := w.writer.Flush()
+	if err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// Sorts the records of a bin file by spilling sorted runs of at most memoryBudget bytes into spillDir,
+// and then merging the runs into a single sorted and deduplicated file.
+// Runs are merged a fan-in at a time, in as many passes as it takes, so that the read buffers of the runs being
+// merged fit within memoryBudget too, and the files that they are read from are taken from fdPool when there is one.
+// The runs and the sorted file are internal to the sort, so their records are not framed
+type externalSorter struct {
+	input        *utils.BinFileReader
+	spillDir     string
+	memoryBudget int
+	fdPool       *fdp.FdPool
+	runFileNames []string
+	// passes that the runs took to merge, which the last one is into the sorted file
+	mergePasses int
+}
+
+func newExternalSorter(input *utils.BinFileReader, spillDir string, memoryBudget int, fdPool *fdp.FdPool) *externalSorter {
+	return &externalSorter{
+		input:        input,
+		spillDir:     spillDir,
+		memoryBudget: memoryBudget,
+		fdPool:       fdPool,
+	}
+}
+
+// the number of runs that are merged at once, each of which is read through a buffer of its own
+func (s *externalSorter) fanIn() int {
+	fanIn := s.memoryBudget / base.ExternalSortIOBufferSize
+	if fanIn < base.ExternalSortMinFanIn {
+		return base.ExternalSortMinFanIn
+	}
+	return fanIn
+}
+
+// Returns the writer of the sorted file, which has been closed
+func (s *externalSorter) sort() (*sortedFileWriter, error) {
+	lastRun, err := s.spillRuns()
+	if err != nil {
+		return nil, err
+	}
+	if len(s.runFileNames) == 1 {
+		// the whole file fit within the budget, so the only run is already the result
+		return lastRun, nil
+	}
+	return s.mergeRuns()
+}
+
+func (s *externalSorter) spillRuns() (*sortedFileWriter, error) {
+	var records []*utils.SortableRecord
+	var usedMemory int
+	var lastRun *sortedFileWriter
+	var err error
+
+	for {
+		var data []byte
+		data, err = s.input.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		var record *utils.SortableRecord
+		record, err = utils.NewSortableRecord(data)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+		usedMemory += len(data) + base.ExternalSortRecordOverhead
+
+		if usedMemory >= s.memoryBudget {
+			lastRun, err = s.spillRun(records)
+			if err != nil {
+				return nil, err
+			}
+			records = nil
+			usedMemory = 0
+		}
+	}
+
+	if len(records) > 0 || len(s.runFileNames) == 0 {
+		lastRun, err = s.spillRun(records)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return lastRun, nil
+}
+
+func (s *externalSorter) spillRun(records []*utils.SortableRecord) (*sortedFileWriter, error) {
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Less(records[j])
+	})
+
+	runFileName := fmt.Sprintf("%v%vrun%v%v", s.spillDir, base.FileDirDelimiter, base.FileNameDelimiter, len(s.runFileNames))
+	writer, err := newSortedFileWriter(runFileName)
+	if err != nil {
+		return nil, err
+	}
+	s.runFileNames = append(s.runFileNames, runFileName)
+
+	for _, record := range records {
+		err = writer.write(record)
+		if err != nil {
+			writer.close()
+			return nil, err
+		}
+	}
+	return writer, writer.close()
+}
+
+type runCursor struct {
+	file    *os.File
+	nextOp  func() ([]byte, error)
+	current *utils.SortableRecord
+}
+
+func newRawRecordCursor(file *os.File, readOp fdp.FileOp) *runCursor {
+	return &runCursor{
+		file: file,
+		nextOp: func() ([]byte, error) {
+			return readRawRecord(readOp)
+		},
+	}
+}
+
+func (c *runCursor) advance() error {
+	data, err := c.nextOp()
+	if err == io.EOF {
+		c.current = nil
+		return nil
+	} else if err != nil {
+		return err
+	}
+	c.current, err = utils.NewSortableRecord(data)
+	return err
+}
+
+// min-heap of the runs, by their current record
+type runCursorHeap []*runCursor
+
+func (h runCursorHeap) Len() int            { return len(h) }
+func (h runCursorHeap) Less(i, j int) bool  { return h[i].current.Less(h[j].current) }
+func (h runCursorHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *runCursorHeap) Push(x interface{}) { *h = append(*h, x.(*runCursor)) }
+func (h *runCursorHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	cursor := old[n-1]
+	*h = old[:n-1]
+	return cursor
+}
+
+func (s *externalSorter) mergeRuns() (*sortedFileWriter, error) {
+	fanIn := s.fanIn()
+	runFileNames := s.runFileNames
+	for len(runFileNames) > fanIn {
+		var mergedFileNames []string
+		for i := 0; i < len(runFileNames); i += fanIn {
+			end := i + fanIn
+			if end > len(runFileNames) {
+				end = len(runFileNames)
+			}
+			if end-i == 1 {
+				mergedFileNames = append(mergedFileNames, runFileNames[i])
+				continue
+			}
+			mergedFileName := fmt.Sprintf("%v%vpass%v%v%v", s.spillDir, base.FileDirDelimiter, s.mergePasses, base.FileNameDelimiter, len(mergedFileNames))
+			_, err := s.mergeRunsInto(runFileNames[i:end], mergedFileName)
+			if err != nil {
+				return nil, err
+			}
+			mergedFileNames = append(mergedFileNames, mergedFileName)
+		}
+		runFileNames = mergedFileNames
+		s.mergePasses++
+	}
+	s.mergePasses++
+	return s.mergeRunsInto(runFileNames, s.spillDir+base.FileDirDelimiter+base.ExternalSortMergedFileName)
+}
+
+// Merges the runs into a single run, and removes them once they have been merged
+func (s *externalSorter) mergeRunsInto(runFileNames []string, mergedFileName string) (*sortedFileWriter, error) {
+	if s.fdPool != nil {
+		// the runs and the merged file
+		defer s.fdPool.ReleaseFds(s.fdPool.AcquireFds(len(runFileNames) + 1))
+	}
+
+	var cursors runCursorHeap
+	defer func() {
+		for _, cursor := range cursors {
+			cursor.file.Close()
+		}
+	}()
+
+	for _, runFileName := range runFileNames {
+		file, err := os.Open(runFileName)
+		if err != nil {
+			return nil, err
+		}
+		cursor := newRawRecordCursor(file, readFullOp(bufio.NewReaderSize(file, base.ExternalSortIOBufferSize)))
+		cursors = append(cursors, cursor)
+		err = cursor.advance()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the heap only holds cursors that have a current record
+	mergeHeap := make(runCursorHeap, 0, len(cursors))
+	for _, cursor := range cursors {
+		if cursor.current != nil {
+			mergeHeap = append(mergeHeap, cursor)
+		}
+	}
+	heap.Init(&mergeHeap)
+
+	writer, err := newSortedFileWriter(mergedFileName)
+	if err != nil {
+		return nil, err
+	}
+
+	for mergeHeap.Len() > 0 {
+		cursor := mergeHeap[0]
+		err = writer.write(cursor.current)
+		if err != nil {
+			writer.close()
+			return nil, err
+		}
+		err = cursor.advance()
+		if err != nil {
+			writer.close()
+			return nil, err
+		}
+		if cursor.current == nil {
+			heap.Pop(&mergeHeap)
+		} else {
+			heap.Fix(&mergeHeap, 0)
+		}
+	}
+	err = writer.close()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, runFileName := range runFileNames {
+		err = os.Remove(runFileName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return writer, nil
+}
+
+// Iterates through the entries of a collection in key order
+type entryIterator interface {
+	// returns nil when there are no more entries
+	next() *oneEntry
+	// the error that stopped the iteration early, if any
+	err() error
+	close()
+}
+
+type sliceEntryIterator struct {
+	entries []*oneEntry
+	index   int
+}
+
+func (it *sliceEntryIterator) next() *oneEntry {
+	if it.index >= len(it.entries) {
+		return nil
+	}
+	entry := it.entries[it.index]
+	it.index++
+	return entry
+}
+
+func (it *sliceEntryIterator) err() error {
+	return nil
+}
+
+func (it *sliceEntryIterator) close() {
+}
+
+type fileEntryIterator struct {
+	file      *os.File
+	reader    *io.LimitedReader
+	readOp    fdp.FileOp
+	actorId   hlv.DocumentSourceId
+	iterErr   error
+	exhausted bool
+}
+
+func newFileEntryIterator(fileName string, colIdRange *fileRange, actorId hlv.DocumentSourceId) *fileEntryIterator {
+	it := &fileEntryIterator{actorId: actorId}
+	if colIdRange == nil {
+		it.exhausted = true
+		return it
+	}
+
+	it.file, it.iterErr = os.Open(fileName)
+	if it.iterErr != nil {
+		it.exhausted = true
+		return it
+	}
+	it.reader = &io.LimitedReader{
+		R: bufio.NewReaderSize(io.NewSectionReader(it.file, colIdRange.offset, colIdRange.length), base.ExternalSortIOBufferSize),
+		N: colIdRange.length,
+	}
+	it.readOp = readFullOp(it.reader)
+	return it
+}
+
+func (it *fileEntryIterator) next() *oneEntry {
+	if it.exhausted || it.reader.N == 0 {
+		it.exhausted = true
+		return nil
+	}
+	entry, err := getOneEntry(it.readOp, it.actorId)
+	if err != nil {
+		it.iterErr = err
+		it.exhausted = true
+		return nil
+	}
+	return entry
+}
+
+func (it *fileEntryIterator) err() error {
+	return it.iterErr
+}
+
+func (it *fileEntryIterator) close() {
+	if it.file != nil {
+		it.file.Close()
+	}
+}
+
+// Loads the file through an external sort instead of into memory
+func (attr *FileAttributes) loadWithExternalSort() error {
+	if attr.readOp != nil && attr.closeOp != nil {
+		defer attr.closeOp()
+	} else {
+		file, err := attr.storage.Open(attr.name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		attr.readOp = file.Read
+	}
+
+	input, err := utils.NewBinFileReader(attr.name, attr.readOp, attr.logger)
+	if err != nil {
+		return err
+	}
+	attr.spillDir, err = ioutil.TempDir(attr.spillParentDir, base.ExternalSortSpillDirPrefix)
+	if err != nil {
+		return err
+	}
+
+	sorted, err := newExternalSorter(input, attr.spillDir, attr.memoryBudget, attr.fdPool).sort()
+	if err != nil {
+		return err
+	}
+	attr.sortedFileName = sorted.file.Name()
+	attr.colIdRanges = sorted.colIdRanges
+	attr.sortedItemCount = sorted.itemCount
+	return nil
+}
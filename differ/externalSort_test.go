@@ -0,0 +1,127 @@
+package differ
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"xdcrDiffer/base"
+	fdp "xdcrDiffer/fileDescriptorPool"
+	"xdcrDiffer/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// returns a bin file of numberOfKeys keys in each of colIds, in random order, where every other key also
+// has an older version. Also returns the newest seqno of each key by collection
+func genUnsortedBinFile(numberOfKeys int, colIds []uint32) ([]byte, map[uint32]map[string]uint64) {
+	var records [][]byte
+	newestSeqnos := make(map[uint32]map[string]uint64)
+	seqno := uint64(0)
+	for _, colId := range colIds {
+		newestSeqnos[colId] = make(map[string]uint64)
+		for i := 0; i < numberOfKeys; i++ {
+			key := fmt.Sprintf("key_%v", i)
+			if i%2 == 0 {
+				seqno++
+				records = append(records, genRecord(key, seqno, colId))
+			}
+			seqno++
+			records = append(records, genRecord(key, seqno, colId))
+			newestSeqnos[colId][key] = seqno
+		}
+	}
+	rand.Shuffle(len(records), func(i, j int) { records[i], records[j] = records[j], records[i] })
+	return genBinFile(records...), newestSeqnos
+}
+
+func TestExternalSort(t *testing.T) {
+	fmt.Println("============== Test case start: TestExternalSort =================")
+	tests := []struct {
+		name           string
+		memoryBudget   int
+		fdPoolSize     int
+		multipleRuns   bool
+		multiplePasses bool
+	}{
+		{"fits within budget", 64 * 1024 * 1024, 0, false, false},
+		{"runs within the fan-in", 128 * 1024, 0, true, false},
+		// the budget only has room for the buffers of the least fan-in
+		{"more runs than the fan-in", 4096, 0, true, true},
+		{"fds of the pool", 4096, base.ExternalSortMinFanIn + 1, true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+			spillDir, err := ioutil.TempDir("", "externalSortTest")
+			assert.Nil(err)
+			defer os.RemoveAll(spillDir)
+
+			colIds := []uint32{0, 8}
+			data, newestSeqnos := genUnsortedBinFile(300, colIds)
+			input, err := utils.NewBinFileReader("test", bytes.NewReader(data).Read, logger)
+			assert.Nil(err)
+
+			var fdPool *fdp.FdPool
+			if test.fdPoolSize > 0 {
+				fdPool = fdp.NewFileDescriptorPool(test.fdPoolSize)
+			}
+			sorter := newExternalSorter(input, spillDir, test.memoryBudget, fdPool)
+			sorted, err := sorter.sort()
+			assert.Nil(err)
+			assert.Equal(test.multipleRuns, len(sorter.runFileNames) > 1)
+			assert.Equal(test.multiplePasses, sorter.mergePasses > 1)
+			assert.Equal(600, sorted.itemCount)
+
+			// the runs are removed once they are merged
+			fileInfos, err := ioutil.ReadDir(spillDir)
+			assert.Nil(err)
+			assert.Len(fileInfos, 1)
+			assert.Equal(sorted.file.Name(), spillDir+base.FileDirDelimiter+fileInfos[0].Name())
+
+			for _, colId := range colIds {
+				it := newFileEntryIterator(sorted.file.Name(), sorted.colIdRanges[colId], "")
+				var lastKey string
+				var count int
+				for entry := it.next(); entry != nil; entry = it.next() {
+					assert.True(entry.Key > lastKey)
+					assert.Equal(colId, entry.ColId)
+					// only the newest version of a key is kept
+					assert.Equal(newestSeqnos[colId][entry.Key], entry.Seqno)
+					lastKey = entry.Key
+					count++
+				}
+				assert.Nil(it.err())
+				it.close()
+				assert.Equal(300, count)
+			}
+
+			// collections that are not in the file have nothing to iterate
+			it := newFileEntryIterator(sorted.file.Name(), sorted.colIdRanges[9], "")
+			assert.Nil(it.next())
+			assert.Nil(it.err())
+		})
+	}
+	fmt.Println("============== Test case end: TestExternalSort =================")
+}
+
+func TestWorkerMemoryBudget(t *testing.T) {
+	assert := assert.New(t)
+	tests := []struct {
+		memoryBudget    int
+		numberOfWorkers int
+		expected        int
+	}{
+		{300 * 1024 * 1024, 30, 10 * 1024 * 1024},
+		{64 * 1024 * 1024, 1, 64 * 1024 * 1024},
+		// each worker gets at least the minimum
+		{30 * 1024 * 1024, 30, base.ExternalSortMinWorkerMemoryBudget},
+	}
+	for _, test := range tests {
+		driver := &DifferDriver{memoryBudget: test.memoryBudget, numberOfWorkers: test.numberOfWorkers}
+		assert.Equal(test.expected, driver.getWorkerMemoryBudget())
+	}
+}
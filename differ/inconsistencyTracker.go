@@ -0,0 +1,175 @@
+package differ
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"xdcrDiffer/base"
+	"xdcrDiffer/utils"
+)
+
+// An inconsistency found by the diffs of a continuous verification, and for how long it has been found
+type Inconsistency struct {
+	Key   string
+	ColId uint32
+	// the cluster from whose point of view the key is different, which ColId is a collection of
+	Cluster   string
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+func (i *Inconsistency) id() string {
+	return fmt.Sprintf("%v%v%v%v%v", i.Cluster, base.FileNameDelimiter, i.ColId, base.FileNameDelimiter, i.Key)
+}
+
+// Keeps a rolling picture of the inconsistencies found by the diffs of a continuous verification, so that
+// those that have lasted longer than the grace period can be told apart from those still being replicated.
+// The picture is saved in fileDir, so that it survives restarts
+type InconsistencyTracker struct {
+	fileDir     string
+	gracePeriod time.Duration
+	// indexed by id
+	inconsistencies map[string]*Inconsistency
+}
+
+func NewInconsistencyTracker(fileDir string, gracePeriod time.Duration) (*InconsistencyTracker, error) {
+	tracker := &InconsistencyTracker{
+		fileDir:         fileDir,
+		gracePeriod:     gracePeriod,
+		inconsistencies: make(map[string]*Inconsistency),
+	}
+
+	err := os.MkdirAll(fileDir, 0777)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(tracker.getFileName(base.InconsistenciesFileName))
+	if os.IsNotExist(err) {
+		return tracker, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var inconsistencies []*Inconsistency
+	err = json.Unmarshal(data, &inconsistencies)
+	if err != nil {
+		return nil, fmt.Errorf("Error unmarshalling inconsistencies %v. err=%v", tracker.getFileName(base.InconsistenciesFileName), err)
+	}
+	for _, inconsistency := range inconsistencies {
+		tracker.inconsistencies[inconsistency.id()] = inconsistency
+	}
+	return tracker, nil
+}
+
+func (t *InconsistencyTracker) getFileName(fileName string) string {
+	return t.fileDir + base.FileDirDelimiter + fileName
+}
+
+// Replaces the picture with the keys found different by the diff at now. The inconsistencies that are still found
+// keep when they were first found, while those that are no longer found are dropped
+// returns the number of inconsistencies that are new, and the number of those that have been resolved
+func (t *InconsistencyTracker) Update(srcDiffKeys, tgtDiffKeys DiffKeysMap, now time.Time) (int, int) {
+	inconsistencies := make(map[string]*Inconsistency)
+	var newCnt int
+	for cluster, diffKeys := range map[string]DiffKeysMap{base.SourceClusterName: srcDiffKeys, base.TargetClusterName: tgtDiffKeys} {
+		for colId, keys := range diffKeys {
+			for _, key := range keys {
+				inconsistency := &Inconsistency{
+					Key:       key,
+					ColId:     colId,
+					Cluster:   cluster,
+					FirstSeen: now,
+				}
+				if prev, exists := t.inconsistencies[inconsistency.id()]; exists {
+					inconsistency.FirstSeen = prev.FirstSeen
+				} else {
+					newCnt++
+				}
+				inconsistency.LastSeen = now
+				inconsistencies[inconsistency.id()] = inconsistency
+			}
+		}
+	}
+
+	var resolvedCnt int
+	for id := range t.inconsistencies {
+		if _, exists := inconsistencies[id]; !exists {
+			resolvedCnt++
+		}
+	}
+	t.inconsistencies = inconsistencies
+	return newCnt, resolvedCnt
+}
+
+func (t *InconsistencyTracker) Len() int {
+	return len(t.inconsistencies)
+}
+
+// the inconsistencies that have lasted longer than the grace period at now, the oldest first
+func (t *InconsistencyTracker) Persistent(now time.Time) []*Inconsistency {
+	persistent := []*Inconsistency{}
+	for _, inconsistency := range t.inconsistencies {
+		if now.Sub(inconsistency.FirstSeen) > t.gracePeriod {
+			persistent = append(persistent, inconsistency)
+		}
+	}
+	sortInconsistencies(persistent)
+	return persistent
+}
+
+// saves the picture, along with a report of the inconsistencies that have lasted longer than the grace period at now
+func (t *InconsistencyTracker) Save(now time.Time) error {
+	inconsistencies := make([]*Inconsistency, 0, len(t.inconsistencies))
+	for _, inconsistency := range t.inconsistencies {
+		inconsistencies = append(inconsistencies, inconsistency)
+	}
+	sortInconsistencies(inconsistencies)
+
+	err := writeJsonFile(t.getFileName(base.InconsistenciesFileName), inconsistencies)
+	if err != nil {
+		return err
+	}
+	return writeJsonFile(t.getFileName(base.PersistentInconsistenciesFileName), t.Persistent(now))
+}
+
+func sortInconsistencies(inconsistencies []*Inconsistency) {
+	sort.Slice(inconsistencies, func(i, j int) bool {
+		if !inconsistencies[i].FirstSeen.Equal(inconsistencies[j].FirstSeen) {
+			return inconsistencies[i].FirstSeen.Before(inconsistencies[j].FirstSeen)
+		}
+		return inconsistencies[i].id() < inconsistencies[j].id()
+	})
+}
+
+func writeJsonFile(fileName string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fileName, data, base.FileModeReadWrite)
+}
+
+// Loads the keys found different by the file differ into diffFileDir, from the point of view of the source and of the target
+func LoadDiffKeys(diffFileDir string) (DiffKeysMap, DiffKeysMap, error) {
+	srcDiffKeys := make(DiffKeysMap)
+	tgtDiffKeys := make(DiffKeysMap)
+	for _, isSource := range []bool{true, false} {
+		diffKeys := srcDiffKeys
+		if !isSource {
+			diffKeys = tgtDiffKeys
+		}
+		fileName := utils.DiffKeysFileName(isSource, diffFileDir, base.DiffKeysFileName)
+		data, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = json.Unmarshal(data, &diffKeys)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error unmarshalling diff keys %v. err=%v", fileName, err)
+		}
+	}
+	return srcDiffKeys, tgtDiffKeys, nil
+}
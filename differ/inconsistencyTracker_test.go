@@ -0,0 +1,97 @@
+package differ
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"xdcrDiffer/base"
+	"xdcrDiffer/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInconsistencyTracker(t *testing.T) {
+	fmt.Println("============== Test case start: TestInconsistencyTracker =================")
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	gracePeriod := 30 * time.Minute
+	// the diffs of consecutive windows, 10 minutes apart
+	windows := []struct {
+		name        string
+		srcDiffKeys DiffKeysMap
+		tgtDiffKeys DiffKeysMap
+		newCnt      int
+		resolvedCnt int
+		// the keys that have lasted longer than the grace period after the window, the oldest first
+		persistent []string
+	}{
+		{"first window", DiffKeysMap{0: {"a", "b"}, 8: {"a"}}, DiffKeysMap{0: {"a"}}, 4, 0, nil},
+		{"b clears", DiffKeysMap{0: {"a"}, 8: {"a"}}, DiffKeysMap{0: {"a"}}, 0, 1, nil},
+		{"b is back", DiffKeysMap{0: {"a", "b"}, 8: {"a"}}, DiffKeysMap{0: {"a"}}, 1, 0, nil},
+		// not past the grace period until it has lasted longer than it
+		{"grace period", DiffKeysMap{0: {"a", "b"}, 8: {"a"}}, DiffKeysMap{0: {"a"}}, 0, 0, nil},
+		{"past the grace period", DiffKeysMap{0: {"a", "b"}, 8: {"a"}}, DiffKeysMap{0: {"a"}, 16: {"c"}}, 1, 0,
+			[]string{"source_0_a", "source_8_a", "target_0_a"}},
+		{"source a clears", DiffKeysMap{0: {"b"}, 8: {"a"}}, DiffKeysMap{0: {"a"}, 16: {"c"}}, 0, 1,
+			[]string{"source_8_a", "target_0_a"}},
+		{"b past the grace period", DiffKeysMap{0: {"b"}, 8: {"a"}}, DiffKeysMap{0: {"a"}, 16: {"c"}}, 0, 0,
+			[]string{"source_8_a", "target_0_a", "source_0_b"}},
+		{"all clear", DiffKeysMap{}, DiffKeysMap{}, 0, 4, nil},
+	}
+
+	assert := assert.New(t)
+	fileDir, err := ioutil.TempDir("", "inconsistencyTrackerTest")
+	assert.Nil(err)
+	defer os.RemoveAll(fileDir)
+
+	tracker, err := NewInconsistencyTracker(fileDir, gracePeriod)
+	assert.Nil(err)
+	for i, window := range windows {
+		now := start.Add(time.Duration(i) * 10 * time.Minute)
+		newCnt, resolvedCnt := tracker.Update(window.srcDiffKeys, window.tgtDiffKeys, now)
+		assert.Equal(window.newCnt, newCnt, window.name)
+		assert.Equal(window.resolvedCnt, resolvedCnt, window.name)
+
+		var persistent []string
+		for _, inconsistency := range tracker.Persistent(now) {
+			assert.Equal(now, inconsistency.LastSeen, window.name)
+			persistent = append(persistent, inconsistency.id())
+		}
+		assert.Equal(window.persistent, persistent, window.name)
+
+		// the picture survives a restart
+		assert.Nil(tracker.Save(now))
+		tracker, err = NewInconsistencyTracker(fileDir, gracePeriod)
+		assert.Nil(err)
+		assert.Equal(len(persistent), len(tracker.Persistent(now)), window.name)
+
+		data, err := ioutil.ReadFile(fileDir + base.FileDirDelimiter + base.PersistentInconsistenciesFileName)
+		assert.Nil(err)
+		var saved []*Inconsistency
+		assert.Nil(json.Unmarshal(data, &saved))
+		assert.Len(saved, len(persistent), window.name)
+	}
+}
+
+func TestLoadDiffKeys(t *testing.T) {
+	fmt.Println("============== Test case start: TestLoadDiffKeys =================")
+	assert := assert.New(t)
+	diffFileDir, err := ioutil.TempDir("", "inconsistencyTrackerTest")
+	assert.Nil(err)
+	defer os.RemoveAll(diffFileDir)
+
+	_, _, err = LoadDiffKeys(diffFileDir)
+	assert.NotNil(err)
+
+	srcDiffKeys := DiffKeysMap{0: {"a", "b"}, 8: {"c"}}
+	tgtDiffKeys := DiffKeysMap{16: {"d"}}
+	assert.Nil(writeJsonFile(utils.DiffKeysFileName(true, diffFileDir, base.DiffKeysFileName), srcDiffKeys))
+	assert.Nil(writeJsonFile(utils.DiffKeysFileName(false, diffFileDir, base.DiffKeysFileName), tgtDiffKeys))
+	loadedSrcDiffKeys, loadedTgtDiffKeys, err := LoadDiffKeys(diffFileDir)
+	assert.Nil(err)
+	assert.Equal(srcDiffKeys, loadedSrcDiffKeys)
+	assert.Equal(tgtDiffKeys, loadedTgtDiffKeys)
+}
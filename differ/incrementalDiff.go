@@ -0,0 +1,156 @@
+package differ
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"xdcrDiffer/base"
+	"xdcrDiffer/storage"
+	"xdcrDiffer/utils"
+)
+
+// The result of diffing the source and target files of a bin, which an incremental diff reuses
+// for as long as neither file has changed
+type binDiffResult struct {
+	// sizes of the files when they were diffed. Since captures only append to files,
+	// or truncate them on rollback, a file that has changed has changed in size,
+	// unless it was rolled back and then captured up to the same size again, which the checksums of its tail tell apart
+	SourceFileSize         int64
+	TargetFileSize         int64
+	SourceFileTailChecksum uint32
+	TargetFileTailChecksum uint32
+	SrcDiffKeys            map[uint32][]string
+	TgtDiffKeys            map[uint32][]string
+	MigrationHints         map[string][]uint32
+	// the file that the diff details of the bin are kept in, which the state only holds the name of
+	DiffDetailsFileName string
+	SrcItemCount        int
+	TgtItemCount        int
+	DuplicatedHint      DuplicatedHintMap
+	MismatchHistogram   MismatchHistogram
+
+	// the diff details, when they are held in memory rather than kept in a file, which are not saved with the state
+	diffBytes []byte
+}
+
+// What the results of a diff depend on besides the files, which need to be the same for them to be reused
+type diffStateParams struct {
+	SourceFileDir       string
+	TargetFileDir       string
+	SrcNumberOfVbuckets int
+	NumberOfBins        int
+	SourceClusterUUID   string
+	TargetClusterUUID   string
+	SourceBucketUUID    string
+	TargetBucketUUID    string
+	CollectionMapping   map[uint32][]uint32
+	ColFilterStrings    []string
+	ColFilterTgtIds     []uint32
+	SrcPruningWindow    time.Duration
+	TgtPruningWindow    time.Duration
+	// how the docs are compared, which decides what was hashed into the files and which diffs are reported
+	CompareType     string
+	CaptureSettings *utils.CaptureSettings
+}
+
+// The results of a diff by vbucket, which are saved in the diff file dir for the next incremental diff to resume from
+type diffState struct {
+	Version int
+	Params  *diffStateParams
+	// indexed by vbno, and then by bin
+	Bins map[uint16][]*binDiffResult
+
+	mtx sync.Mutex
+}
+
+func newDiffState(params *diffStateParams) *diffState {
+	return &diffState{
+		Version: base.DiffStateVersion,
+		Params:  params,
+		Bins:    make(map[uint16][]*binDiffResult),
+	}
+}
+
+func getDiffStateFileName(diffFileDir string) string {
+	return diffFileDir + base.FileDirDelimiter + base.DiffStateFileName
+}
+
+// Loads the state saved by the previous diff. Returns nil when there is no state that can be resumed from,
+// in which case every bin is diffed
+func loadDiffState(diffFileDir string, params *diffStateParams) (*diffState, error) {
+	data, err := ioutil.ReadFile(getDiffStateFileName(diffFileDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	state := &diffState{}
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return nil, fmt.Errorf("Error unmarshalling diff state %v. err=%v", getDiffStateFileName(diffFileDir), err)
+	}
+	if state.Version != base.DiffStateVersion || !reflect.DeepEqual(state.Params, params) {
+		return nil, nil
+	}
+	return state, nil
+}
+
+func (s *diffState) save(diffFileDir string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(getDiffStateFileName(diffFileDir), data, base.FileModeReadWrite)
+}
+
+func (s *diffState) get(vbno uint16, bucketIndex int) *binDiffResult {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	results := s.Bins[vbno]
+	if bucketIndex >= len(results) {
+		return nil
+	}
+	return results[bucketIndex]
+}
+
+func (s *diffState) set(vbno uint16, bucketIndex int, result *binDiffResult) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for len(s.Bins[vbno]) <= bucketIndex {
+		s.Bins[vbno] = append(s.Bins[vbno], nil)
+	}
+	s.Bins[vbno][bucketIndex] = result
+}
+
+// size of the file, or -1 when it does not exist, and the checksum of the last bytes of the file.
+// A file that has been rolled back and captured again ends in records of other seqnos, even when it is of the same size
+func getBinFileVersion(storage storage.Storage, fileName string) (int64, uint32, error) {
+	file, err := storage.Open(fileName)
+	if os.IsNotExist(err) {
+		return -1, 0, nil
+	} else if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	size := file.Size()
+	tailLen := int64(base.DiffStateTailChecksumLen)
+	if tailLen > size {
+		tailLen = size
+	}
+	tail := make([]byte, tailLen)
+	_, err = file.ReadAt(tail, size-tailLen)
+	if err != nil && err != io.EOF {
+		return 0, 0, err
+	}
+	return size, crc32.ChecksumIEEE(tail), nil
+}
@@ -0,0 +1,183 @@
+package differ
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"xdcrDiffer/base"
+	"xdcrDiffer/storage"
+	"xdcrDiffer/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadDiffState(t *testing.T) {
+	fmt.Println("============== Test case start: TestLoadDiffState =================")
+	assert := assert.New(t)
+	diffFileDir, err := ioutil.TempDir("", "incrementalDiffTest")
+	assert.Nil(err)
+	defer os.RemoveAll(diffFileDir)
+
+	genParams := func() *diffStateParams {
+		return &diffStateParams{
+			SourceFileDir:   "/source",
+			TargetFileDir:   "/target",
+			NumberOfBins:    2,
+			CompareType:     base.MutationCompareTypeMetadata,
+			CaptureSettings: utils.NewCaptureSettings(true, false, map[string]bool{"_sync": true}, nil),
+		}
+	}
+
+	// no state saved yet
+	state, err := loadDiffState(diffFileDir, genParams())
+	assert.Nil(err)
+	assert.Nil(state)
+
+	saved := newDiffState(genParams())
+	saved.set(3, 1, &binDiffResult{SourceFileSize: 10, TargetFileSize: 20, SourceFileTailChecksum: 1, TargetFileTailChecksum: 2})
+	assert.Nil(saved.save(diffFileDir))
+
+	state, err = loadDiffState(diffFileDir, genParams())
+	assert.Nil(err)
+	assert.NotNil(state)
+	assert.Nil(state.get(3, 0))
+	assert.Equal(saved.get(3, 1), state.get(3, 1))
+
+	tests := []struct {
+		name   string
+		change func(params *diffStateParams)
+	}{
+		{"compare type", func(params *diffStateParams) { params.CompareType = base.MutationCompareTypeBodyOnly }},
+		{"compare xattrs", func(params *diffStateParams) { params.CaptureSettings.CompareXattrs = false }},
+		{"semantic json compare", func(params *diffStateParams) { params.CaptureSettings.SemanticJsonCompare = true }},
+		{"xattr keys for no compare", func(params *diffStateParams) {
+			params.CaptureSettings = utils.NewCaptureSettings(true, false, map[string]bool{"_sync": true, "_mou": true}, nil)
+		}},
+		{"ignored json paths", func(params *diffStateParams) {
+			params.CaptureSettings.IgnoredJsonPathRules = []*utils.IgnoredJsonPathRule{{Path: []string{"updatedAt"}}}
+		}},
+		{"bins", func(params *diffStateParams) { params.NumberOfBins = 3 }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			params := genParams()
+			test.change(params)
+			state, err := loadDiffState(diffFileDir, params)
+			assert.Nil(err)
+			assert.Nil(state)
+		})
+	}
+
+	// state saved by another version
+	saved.Version = base.DiffStateVersion - 1
+	assert.Nil(saved.save(diffFileDir))
+	state, err = loadDiffState(diffFileDir, genParams())
+	assert.Nil(err)
+	assert.Nil(state)
+}
+
+func TestGetBinFileVersion(t *testing.T) {
+	fmt.Println("============== Test case start: TestGetBinFileVersion =================")
+	assert := assert.New(t)
+	storage := storage.NewMemoryStorage()
+
+	size, _, err := getBinFileVersion(storage, "/missing")
+	assert.Nil(err)
+	assert.Equal(int64(-1), size)
+
+	assert.Nil(storage.WriteFile("/empty", nil))
+	size, _, err = getBinFileVersion(storage, "/empty")
+	assert.Nil(err)
+	assert.Equal(int64(0), size)
+
+	// a file rolled back and captured again up to the same size
+	captured := genBinFile(genRecord("key_1", 1, 0), genRecord("key_2", 2, 0))
+	recaptured := genBinFile(genRecord("key_1", 1, 0), genRecord("key_3", 3, 0))
+	assert.Equal(len(captured), len(recaptured))
+	assert.Nil(storage.WriteFile("/captured", captured))
+	assert.Nil(storage.WriteFile("/recaptured", recaptured))
+	size, capturedChecksum, err := getBinFileVersion(storage, "/captured")
+	assert.Nil(err)
+	assert.Equal(int64(len(captured)), size)
+	size, recapturedChecksum, err := getBinFileVersion(storage, "/recaptured")
+	assert.Nil(err)
+	assert.Equal(int64(len(recaptured)), size)
+	assert.NotEqual(capturedChecksum, recapturedChecksum)
+
+	// only the tail of a large file is checksummed
+	var records [][]byte
+	for i := 0; i < 500; i++ {
+		records = append(records, genRecord(fmt.Sprintf("key_%v", i), uint64(i+1), 0))
+	}
+	large := genBinFile(records...)
+	assert.True(len(large) > base.DiffStateTailChecksumLen)
+	assert.Nil(storage.WriteFile("/large", large))
+	size, largeChecksum, err := getBinFileVersion(storage, "/large")
+	assert.Nil(err)
+	assert.Equal(int64(len(large)), size)
+	changedHead := append([]byte{}, large...)
+	changedHead[len(changedHead)-base.DiffStateTailChecksumLen-1] ^= 0xff
+	assert.Nil(storage.WriteFile("/changedHead", changedHead))
+	_, changedHeadChecksum, err := getBinFileVersion(storage, "/changedHead")
+	assert.Nil(err)
+	assert.Equal(largeChecksum, changedHeadChecksum)
+}
+
+func TestIncrementalDiffReusesUnchangedBins(t *testing.T) {
+	fmt.Println("============== Test case start: TestIncrementalDiffReusesUnchangedBins =================")
+	assert := assert.New(t)
+	diffFileDir, err := ioutil.TempDir("", "incrementalDiffTest")
+	assert.Nil(err)
+	defer os.RemoveAll(diffFileDir)
+	storage := storage.NewMemoryStorage()
+	sourceFileName := utils.GetFileName("/source", 0, 0)
+	targetFileName := utils.GetFileName("/target", 0, 0)
+	assert.Nil(storage.WriteFile(sourceFileName, genBinFile(genRecord("key_1", 1, 0), genRecord("key_2", 2, 0))))
+	assert.Nil(storage.WriteFile(targetFileName, genBinFile(genRecord("key_1", 1, 0), genRecord("key_2", 2, 0))))
+
+	// diffs the bin the way that an incremental diff does, and returns whether the previous result was reused
+	diff := func() (*binDiffResult, bool) {
+		dr := NewDifferDriver("/source", "/target", diffFileDir, "", 1, 1, 1, 1, 0, 0, 0, true, base.BinFileCodecNone, storage, nil, nil, nil, "", "", "", "", nil, nil, logger)
+		dr.SetCompareSettings(base.MutationCompareTypeMetadata, utils.NewCaptureSettings(false, false, nil, nil))
+		assert.Nil(dr.initializeDiffState())
+		dh := NewDifferHandler(dr, 0, "/source", "/target", []uint16{0}, 1, dr.waitGroup, nil, nil, nil, nil)
+		result, err := dh.diffBin(0, 0)
+		assert.Nil(err)
+		assert.NotNil(result)
+		assert.Nil(dr.diffState.save(diffFileDir))
+		return result, atomic.LoadUint32(&dr.binsReused) == 1
+	}
+
+	result, reused := diff()
+	assert.False(reused)
+	assert.Len(result.SrcDiffKeys[0], 0)
+
+	result, reused = diff()
+	assert.True(reused)
+	assert.Len(result.SrcDiffKeys[0], 0)
+
+	// the source is rolled back and captured again up to the same size, with key_2 now at another seqno
+	assert.Nil(storage.WriteFile(sourceFileName, genBinFile(genRecord("key_1", 1, 0), genRecord("key_2", 3, 0))))
+	result, reused = diff()
+	assert.False(reused)
+	assert.Equal([]string{"key_2"}, result.SrcDiffKeys[0])
+
+	// the diff details are kept in a file of their own, which the state only holds the name of
+	assert.NotEqual("", result.DiffDetailsFileName)
+	diffDetails, err := ioutil.ReadFile(result.DiffDetailsFileName)
+	assert.Nil(err)
+	assert.Contains(string(diffDetails), "key_2")
+	stateData, err := ioutil.ReadFile(getDiffStateFileName(diffFileDir))
+	assert.Nil(err)
+	assert.NotContains(string(stateData), string(diffDetails))
+
+	result, reused = diff()
+	assert.True(reused)
+	assert.Equal([]string{"key_2"}, result.SrcDiffKeys[0])
+	reusedDiffDetails, err := ioutil.ReadFile(result.DiffDetailsFileName)
+	assert.Nil(err)
+	assert.Equal(diffDetails, reusedDiffDetails)
+}
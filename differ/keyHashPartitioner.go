@@ -0,0 +1,234 @@
+package differ
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"xdcrDiffer/base"
+	"xdcrDiffer/storage"
+	"xdcrDiffer/utils"
+
+	xdcrLog "github.com/couchbase/goxdcr/log"
+)
+
+// Re-partitions the files captured per vbucket and bin into files per key hash partition, so that
+// buckets with different numbers of vbuckets can be diffed against each other.
+// The output directory is laid out like the capture of a bucket with numberOfPartitions vbuckets and a single bin.
+// The vbuckets are re-partitioned by numberOfWorkers workers at once, which share the buffers of the partitions
+type keyHashPartitioner struct {
+	inputDir           string
+	outputDir          string
+	numberOfVbuckets   int
+	numberOfBins       int
+	numberOfPartitions int
+	numberOfWorkers    int
+	codec              uint16
+	storage            storage.Storage
+	// bytes that each partition buffers before it is flushed, which is its share of the memory budget
+	bufferCapacity int
+	partitions     []*keyHashPartition
+	// set once a worker has failed, so that the others stop too
+	failed uint32
+	logger *xdcrLog.CommonLogger
+}
+
+type keyHashPartition struct {
+	// serialized records, which are sorted as they are flushed
+	buffer []byte
+	mtx    sync.Mutex
+}
+
+func newKeyHashPartitioner(inputDir, outputDir string, numberOfVbuckets, numberOfBins, numberOfPartitions, numberOfWorkers, memoryBudget int, codec uint16, storage storage.Storage, logger *xdcrLog.CommonLogger) *keyHashPartitioner {
+	partitions := make([]*keyHashPartition, numberOfPartitions)
+	for i := range partitions {
+		partitions[i] = &keyHashPartition{}
+	}
+	return &keyHashPartitioner{
+		inputDir:           inputDir,
+		outputDir:          outputDir,
+		numberOfVbuckets:   numberOfVbuckets,
+		numberOfBins:       numberOfBins,
+		numberOfPartitions: numberOfPartitions,
+		numberOfWorkers:    numberOfWorkers,
+		codec:              codec,
+		storage:            storage,
+		bufferCapacity:     getKeyHashPartitionBufferCapacity(memoryBudget, numberOfPartitions),
+		partitions:         partitions,
+		logger:             logger,
+	}
+}
+
+// splits the memory budget between the partitions, within the bounds of the buffer capacity of each
+func getKeyHashPartitionBufferCapacity(memoryBudget, numberOfPartitions int) int {
+	if memoryBudget <= 0 {
+		memoryBudget = base.KeyHashPartitionMemoryBudget
+	}
+	capacity := memoryBudget / numberOfPartitions
+	if capacity < base.KeyHashPartitionMinBufferCapacity {
+		return base.KeyHashPartitionMinBufferCapacity
+	}
+	if capacity > base.KeyHashPartitionBufferCapacity {
+		return base.KeyHashPartitionBufferCapacity
+	}
+	return capacity
+}
+
+func (p *keyHashPartitioner) run() error {
+	err := p.storage.RemoveAll(p.outputDir)
+	if err != nil {
+		return err
+	}
+	err = p.storage.MkdirAll(p.outputDir)
+	if err != nil {
+		return err
+	}
+
+	// the files differ expects every file to exist, even when there is nothing in it
+	for partition := 0; partition < p.numberOfPartitions; partition++ {
+		err = p.storage.WriteFile(p.getPartitionFileName(partition), utils.AppendBinFileHeader(nil, p.codec))
+		if err != nil {
+			return err
+		}
+	}
+
+	loadDistribution := utils.BalanceLoad(p.numberOfWorkers, p.numberOfVbuckets)
+	errs := make([]error, p.numberOfWorkers)
+	waitGroup := &sync.WaitGroup{}
+	for i := 0; i < p.numberOfWorkers; i++ {
+		waitGroup.Add(1)
+		go func(i int) {
+			defer waitGroup.Done()
+			errs[i] = p.partitionVbuckets(loadDistribution[i][0], loadDistribution[i][1])
+		}(i)
+	}
+	waitGroup.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	for partition := 0; partition < p.numberOfPartitions; partition++ {
+		err = p.flush(partition)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// re-partitions the files of the vbuckets from lowVbno up to highVbno
+func (p *keyHashPartitioner) partitionVbuckets(lowVbno, highVbno int) error {
+	for vbno := lowVbno; vbno < highVbno; vbno++ {
+		for bucketIndex := 0; bucketIndex < p.numberOfBins; bucketIndex++ {
+			if atomic.LoadUint32(&p.failed) == 1 {
+				return nil
+			}
+			err := p.partitionFile(utils.GetFileName(p.inputDir, uint16(vbno), bucketIndex))
+			if err != nil {
+				atomic.StoreUint32(&p.failed, 1)
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *keyHashPartitioner) partitionFile(fileName string) error {
+	file, err := p.storage.Open(fileName)
+	if os.IsNotExist(err) {
+		// nothing was captured for this vbucket and bin
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader, err := utils.NewBinFileReader(fileName, bufio.NewReaderSize(file, base.ExternalSortIOBufferSize).Read, p.logger)
+	if err != nil {
+		return err
+	}
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		_, key, _, _, err := utils.ParseSerializedMutation(record)
+		if err != nil {
+			return err
+		}
+		err = p.add(utils.GetBucketIndexFromKey(key, p.numberOfPartitions), record)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buffers the record in its partition, which is flushed first if the record does not fit
+func (p *keyHashPartitioner) add(partition int, record []byte) error {
+	keyHashPartition := p.partitions[partition]
+	keyHashPartition.mtx.Lock()
+	defer keyHashPartition.mtx.Unlock()
+	if len(keyHashPartition.buffer) > 0 && len(keyHashPartition.buffer)+len(record) > p.bufferCapacity {
+		err := p.flushLocked(partition)
+		if err != nil {
+			return err
+		}
+	}
+	if keyHashPartition.buffer == nil {
+		keyHashPartition.buffer = make([]byte, 0, p.bufferCapacity)
+	}
+	keyHashPartition.buffer = append(keyHashPartition.buffer, record...)
+	return nil
+}
+
+// Each flush appends a single sorted and deduplicated run, like a flush of the dcp handlers does, which the files differ merges.
+// Files are opened only for the duration of a flush, since there can be many more partitions than file descriptors
+func (p *keyHashPartitioner) flush(partition int) error {
+	p.partitions[partition].mtx.Lock()
+	defer p.partitions[partition].mtx.Unlock()
+	return p.flushLocked(partition)
+}
+
+func (p *keyHashPartitioner) flushLocked(partition int) error {
+	keyHashPartition := p.partitions[partition]
+	if len(keyHashPartition.buffer) == 0 {
+		return nil
+	}
+
+	sortedFrames, err := utils.SortDedupAndFrameRecords(keyHashPartition.buffer)
+	if err != nil {
+		return err
+	}
+	data, err := utils.AppendFramesToBinFile(nil, sortedFrames, p.codec)
+	if err != nil {
+		return err
+	}
+
+	file, err := p.storage.OpenForAppend(p.getPartitionFileName(partition))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(data)
+	if err != nil {
+		return err
+	}
+	if cap(keyHashPartition.buffer) > p.bufferCapacity {
+		// a record larger than the buffer does not get to keep the memory that it took
+		keyHashPartition.buffer = nil
+	} else {
+		keyHashPartition.buffer = keyHashPartition.buffer[:0]
+	}
+	return nil
+}
+
+func (p *keyHashPartitioner) getPartitionFileName(partition int) string {
+	return utils.GetFileName(p.outputDir, uint16(partition), 0)
+}
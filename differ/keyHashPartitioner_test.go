@@ -0,0 +1,127 @@
+package differ
+
+import (
+	"fmt"
+	"testing"
+
+	"xdcrDiffer/base"
+	"xdcrDiffer/storage"
+	"xdcrDiffer/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// captures numberOfKeys keys into the bins of inputDir, the way that the dcp handlers lay them out.
+// Every fifth key also has an older version in the same file. Returns the newest seqno of each key
+func genCapturedBins(t *testing.T, storage storage.Storage, inputDir string, numberOfKeys, numberOfVbuckets, numberOfBins int, codec uint16) map[string]uint64 {
+	files := make(map[string][]byte)
+	newestSeqnos := make(map[string]uint64)
+	for i := 0; i < numberOfKeys; i++ {
+		key := fmt.Sprintf("key_%v", i)
+		fileName := utils.GetFileName(inputDir, uint16(i%numberOfVbuckets), utils.GetBucketIndexFromKey([]byte(key), numberOfBins))
+		seqno := uint64(i + 1)
+		if i%5 == 0 {
+			files[fileName] = utils.AppendRecordFrame(files[fileName], genRecord(key, seqno, 0))
+			seqno += uint64(numberOfKeys)
+		}
+		files[fileName] = utils.AppendRecordFrame(files[fileName], genRecord(key, seqno, 0))
+		newestSeqnos[key] = seqno
+	}
+	assert.Nil(t, storage.MkdirAll(inputDir))
+	for fileName, frames := range files {
+		data, err := utils.AppendFramesToBinFile(utils.AppendBinFileHeader(nil, codec), frames, codec)
+		assert.Nil(t, err)
+		assert.Nil(t, storage.WriteFile(fileName, data))
+	}
+	return newestSeqnos
+}
+
+func TestKeyHashPartitioner(t *testing.T) {
+	fmt.Println("============== Test case start: TestKeyHashPartitioner =================")
+	tests := []struct {
+		name               string
+		numberOfKeys       int
+		numberOfVbuckets   int
+		numberOfBins       int
+		numberOfPartitions int
+		numberOfWorkers    int
+		memoryBudget       int
+		codec              uint16
+	}{
+		{"fewer partitions than vbuckets", 500, 8, 2, 3, 1, 0, base.BinFileCodecNone},
+		{"more partitions than keys", 3, 2, 1, 16, 4, 0, base.BinFileCodecNone},
+		{"snappy", 500, 4, 3, 5, 2, 0, base.BinFileCodecSnappy},
+		{"many flushes", 5000, 16, 1, 2, 1, 0, base.BinFileCodecNone},
+		// the workers share the buffers, which are flushed more often with a smaller budget
+		{"many workers", 5000, 16, 2, 4, 8, 0, base.BinFileCodecNone},
+		{"more workers than vbuckets", 500, 2, 1, 3, 4, 0, base.BinFileCodecNone},
+		{"small budget", 5000, 16, 1, 2, 4, 4096, base.BinFileCodecNone},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+			storage := storage.NewMemoryStorage()
+			newestSeqnos := genCapturedBins(t, storage, "/in", test.numberOfKeys, test.numberOfVbuckets, test.numberOfBins, test.codec)
+
+			// bytes of all the versions of the keys of each partition
+			capturedLen := make([]int, test.numberOfPartitions)
+			var maxRecordLen int
+			for vbno := 0; vbno < test.numberOfVbuckets; vbno++ {
+				for bucketIndex := 0; bucketIndex < test.numberOfBins; bucketIndex++ {
+					fileName := utils.GetFileName("/in", uint16(vbno), bucketIndex)
+					if _, err := storage.Size(fileName); err != nil {
+						continue
+					}
+					for _, record := range readBinFileRecords(t, storage, fileName) {
+						capturedLen[utils.GetBucketIndexFromKey(record.Key, test.numberOfPartitions)] += len(record.Data)
+						if len(record.Data) > maxRecordLen {
+							maxRecordLen = len(record.Data)
+						}
+					}
+				}
+			}
+
+			partitioner := newKeyHashPartitioner("/in", "/out", test.numberOfVbuckets, test.numberOfBins, test.numberOfPartitions,
+				test.numberOfWorkers, test.memoryBudget, test.codec, storage, logger)
+			assert.Nil(partitioner.run())
+
+			seenKeys := make(map[string]bool)
+			for partition := 0; partition < test.numberOfPartitions; partition++ {
+				// every partition file exists, even when no key hashes to it
+				fileName := partitioner.getPartitionFileName(partition)
+				for _, record := range readBinFileRecords(t, storage, fileName) {
+					assert.Equal(partition, utils.GetBucketIndexFromKey(record.Key, test.numberOfPartitions))
+				}
+
+				// each flush is a single sorted run, and there is a flush for each time the buffer fills up
+				colIdRuns, _, err := scanSortedRuns(fileName, storage, logger)
+				assert.Nil(err)
+				assert.True(len(colIdRuns[0]) <= capturedLen[partition]/(partitioner.bufferCapacity-maxRecordLen)+1)
+
+				it := newRunMergeIterator(fileName, storage, test.codec, colIdRuns[0], "", logger, nil)
+				for record := it.nextRecord(); record != nil; record = it.nextRecord() {
+					assert.False(seenKeys[string(record.Key)])
+					assert.Equal(newestSeqnos[string(record.Key)], record.Seqno)
+					seenKeys[string(record.Key)] = true
+				}
+				assert.Nil(it.err())
+				it.close()
+			}
+			assert.Equal(test.numberOfKeys, len(seenKeys))
+		})
+	}
+	fmt.Println("============== Test case end: TestKeyHashPartitioner =================")
+}
+
+func TestKeyHashPartitionBufferCapacity(t *testing.T) {
+	fmt.Println("============== Test case start: TestKeyHashPartitionBufferCapacity =================")
+	assert := assert.New(t)
+	// the default budget is split between the partitions
+	assert.Equal(base.KeyHashPartitionBufferCapacity, getKeyHashPartitionBufferCapacity(0, 16))
+	assert.Equal(base.KeyHashPartitionMemoryBudget/8192, getKeyHashPartitionBufferCapacity(0, 8192))
+	// the buffers of the most partitions there can be stay within the default budget
+	assert.True(getKeyHashPartitionBufferCapacity(0, base.MaxNumberOfKeyHashPartitions)*base.MaxNumberOfKeyHashPartitions <= base.KeyHashPartitionMemoryBudget)
+	// the budget of the file differ is split instead when there is one
+	assert.Equal(2048, getKeyHashPartitionBufferCapacity(2048*1024, 1024))
+	assert.Equal(base.KeyHashPartitionMinBufferCapacity, getKeyHashPartitionBufferCapacity(1024, 1024))
+}
@@ -0,0 +1,71 @@
+package differ
+
+import (
+	"reflect"
+
+	"xdcrDiffer/base"
+
+	xdcrBase "github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/hlv"
+)
+
+// The number of docs found mismatched by each of the fields that differ between their source and target versions.
+// A doc whose versions differ by several fields is counted for each of them
+type MismatchHistogram map[string]int
+
+func (h MismatchHistogram) add(fields []string) {
+	for _, field := range fields {
+		h[field]++
+	}
+}
+
+func (h MismatchHistogram) Merge(other MismatchHistogram) {
+	for field, count := range other {
+		h[field] += count
+	}
+}
+
+// the fields of the metadata that differ between two versions of a doc, in the order of base.DiffFields.
+// xattrsDiffer tells whether the xattrs have been found different by key
+func diffMetaFields(docMeta1, docMeta2 *xdcrBase.DocumentMetadata, hlv1, hlv2 *hlv.HLV, xattrsDiffer bool) []string {
+	var fields []string
+	if docMeta1.RevSeq != docMeta2.RevSeq {
+		fields = append(fields, base.DiffFieldRevId)
+	}
+	if docMeta1.Cas != docMeta2.Cas {
+		fields = append(fields, base.DiffFieldCas)
+	}
+	if docMeta1.Flags != docMeta2.Flags {
+		fields = append(fields, base.DiffFieldFlags)
+	}
+	if docMeta1.Expiry != docMeta2.Expiry {
+		fields = append(fields, base.DiffFieldExpiry)
+	}
+	if docMeta1.DataType != docMeta2.DataType {
+		fields = append(fields, base.DiffFieldDatatype)
+	}
+	if xattrsDiffer || docMeta1.DataType&xdcrBase.XattrDataType != docMeta2.DataType&xdcrBase.XattrDataType {
+		fields = append(fields, base.DiffFieldXattrs)
+	}
+	if hlvsDiffer(hlv1, hlv2) {
+		fields = append(fields, base.DiffFieldHLV)
+	}
+	return fields
+}
+
+// the previous versions of an HLV are left out, since they are pruned independently on each side
+func hlvsDiffer(hlv1, hlv2 *hlv.HLV) bool {
+	if hlv1 == nil || hlv2 == nil {
+		return hlv1 != hlv2
+	}
+	return hlv1.GetCvSrc() != hlv2.GetCvSrc() || hlv1.GetCvVer() != hlv2.GetCvVer() || !reflect.DeepEqual(hlv1.GetMV(), hlv2.GetMV())
+}
+
+// the versions of a doc that conflict resolution finds different, but whose fields are all the same, differ by
+// what their HLVs are derived from, such as the import CAS of the docs imported by Sync Gateway
+func withHLVIfNoFields(fields []string) []string {
+	if len(fields) == 0 {
+		return []string{base.DiffFieldHLV}
+	}
+	return fields
+}
@@ -0,0 +1,113 @@
+package differ
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"xdcrDiffer/base"
+	"xdcrDiffer/dcp"
+
+	"github.com/couchbase/gomemcached"
+	xdcrBase "github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/hlv"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffMetaFields(t *testing.T) {
+	fmt.Println("============== Test case start: TestDiffMetaFields =================")
+	genDocMeta := func() *xdcrBase.DocumentMetadata {
+		return &xdcrBase.DocumentMetadata{RevSeq: 1, Cas: 100, Flags: 2, Expiry: 0, DataType: base.JSONDataType}
+	}
+	tests := []struct {
+		name         string
+		change       func(docMeta *xdcrBase.DocumentMetadata)
+		hlv1, hlv2   *hlv.HLV
+		xattrsDiffer bool
+		fields       []string
+	}{
+		{"same", func(docMeta *xdcrBase.DocumentMetadata) {}, nil, nil, false, nil},
+		{"revId and cas", func(docMeta *xdcrBase.DocumentMetadata) { docMeta.RevSeq, docMeta.Cas = 2, 200 }, nil, nil, false,
+			[]string{base.DiffFieldRevId, base.DiffFieldCas}},
+		{"flags", func(docMeta *xdcrBase.DocumentMetadata) { docMeta.Flags = 3 }, nil, nil, false, []string{base.DiffFieldFlags}},
+		{"expiry", func(docMeta *xdcrBase.DocumentMetadata) { docMeta.Expiry = 10 }, nil, nil, false, []string{base.DiffFieldExpiry}},
+		{"xattrs by datatype", func(docMeta *xdcrBase.DocumentMetadata) { docMeta.DataType |= xdcrBase.XattrDataType }, nil, nil, false,
+			[]string{base.DiffFieldDatatype, base.DiffFieldXattrs}},
+		{"xattrs by key", func(docMeta *xdcrBase.DocumentMetadata) {}, nil, nil, true, []string{base.DiffFieldXattrs}},
+		{"HLV on one side only", func(docMeta *xdcrBase.DocumentMetadata) {}, &hlv.HLV{}, nil, false, []string{base.DiffFieldHLV}},
+		{"same HLV", func(docMeta *xdcrBase.DocumentMetadata) {}, &hlv.HLV{}, &hlv.HLV{}, false, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			docMeta2 := genDocMeta()
+			test.change(docMeta2)
+			assert.Equal(t, test.fields, diffMetaFields(genDocMeta(), docMeta2, test.hlv1, test.hlv2, test.xattrsDiffer))
+		})
+	}
+
+	// versions that differ by none of the fields differ by what their HLVs are derived from
+	assert.Equal(t, []string{base.DiffFieldHLV}, withHLVIfNoFields(nil))
+	assert.Equal(t, []string{base.DiffFieldCas}, withHLVIfNoFields([]string{base.DiffFieldCas}))
+}
+
+func TestMismatchHistogram(t *testing.T) {
+	fmt.Println("============== Test case start: TestMismatchHistogram =================")
+	assert := assert.New(t)
+	histogram := make(MismatchHistogram)
+	histogram.add([]string{base.DiffFieldBody, base.DiffFieldCas})
+	histogram.add([]string{base.DiffFieldCas})
+	histogram.add(nil)
+	assert.Equal(MismatchHistogram{base.DiffFieldBody: 1, base.DiffFieldCas: 2}, histogram)
+
+	histogram.Merge(MismatchHistogram{base.DiffFieldCas: 1, base.DiffFieldHLV: 3})
+	assert.Equal(MismatchHistogram{base.DiffFieldBody: 1, base.DiffFieldCas: 3, base.DiffFieldHLV: 3}, histogram)
+
+	// the driver adds up the histograms of the file differs, and writes them out
+	diffFileDir, err := ioutil.TempDir("", "mismatchHistogramTest")
+	assert.Nil(err)
+	defer os.RemoveAll(diffFileDir)
+	dr := NewDifferDriver("/source", "/target", diffFileDir, "", 1, 1, 1, 1, 0, 0, 0, false, base.BinFileCodecNone, nil, nil, nil, nil, "", "", "", "", nil, nil, logger)
+	dr.addMismatchHistogram(histogram)
+	dr.addMismatchHistogram(MismatchHistogram{base.DiffFieldBody: 1})
+	merged := dr.MismatchHistogram()
+	assert.Equal(MismatchHistogram{base.DiffFieldBody: 2, base.DiffFieldCas: 3, base.DiffFieldHLV: 3}, merged)
+	// a copy is handed out
+	merged[base.DiffFieldBody] = 10
+	assert.Equal(2, dr.MismatchHistogram()[base.DiffFieldBody])
+
+	assert.Nil(dr.writeMismatchHistogram())
+	data, err := ioutil.ReadFile(diffFileDir + base.FileDirDelimiter + base.MismatchHistogramFileName)
+	assert.Nil(err)
+	var written MismatchHistogram
+	assert.Nil(json.Unmarshal(data, &written))
+	assert.Equal(dr.MismatchHistogram(), written)
+}
+
+func TestFilesDifferMismatchHistogram(t *testing.T) {
+	fmt.Println("============== Test case start: TestFilesDifferMismatchHistogram =================")
+	assert := assert.New(t)
+	fileDir, err := ioutil.TempDir("", "mismatchHistogramTest")
+	assert.Nil(err)
+	defer os.RemoveAll(fileDir)
+
+	genMutation := func(key string, cas uint64, flags uint32, value string) []byte {
+		mutation := dcp.Mutation{Key: []byte(key), Seqno: 1, RevId: 1, Cas: cas, Flags: flags, OpCode: gomemcached.UPR_MUTATION, Value: []byte(value)}
+		record, _ := mutation.Serialize()
+		return record
+	}
+	file1 := fileDir + "/source.bin"
+	file2 := fileDir + "/target.bin"
+	assert.Nil(ioutil.WriteFile(file1, genBinFile(genMutation("key_1", 1, 0, "a"), genMutation("key_2", 1, 0, "a"),
+		genMutation("key_3", 1, 0, "a")), 0644))
+	// key_1 is the same, key_2 differs by its cas and body, key_3 by its cas and flags
+	assert.Nil(ioutil.WriteFile(file2, genBinFile(genMutation("key_1", 1, 0, "a"), genMutation("key_2", 2, 0, "b"),
+		genMutation("key_3", 2, 5, "a")), 0644))
+
+	differ := NewFilesDiffer(file1, file2, nil, nil, nil, logger)
+	_, _, _, _, err = differ.Diff()
+	assert.Nil(err)
+	assert.Len(differ.BothExistButMismatch, 2)
+	assert.Equal(MismatchHistogram{base.DiffFieldBody: 1, base.DiffFieldCas: 2, base.DiffFieldFlags: 1}, differ.MismatchHistogram)
+}
@@ -0,0 +1,206 @@
+package differ
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+
+	"xdcrDiffer/base"
+	"xdcrDiffer/utils"
+)
+
+// A range of the fetch list of the mutation differ, from Start up to but not including End
+type fetchRange struct {
+	Start int
+	End   int
+}
+
+// sorts the ranges and merges the ones that are next to each other
+func mergeFetchRanges(ranges []fetchRange) []fetchRange {
+	sorted := make([]fetchRange, len(ranges))
+	copy(sorted, ranges)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start < sorted[j].Start })
+
+	var merged []fetchRange
+	for _, r := range sorted {
+		if len(merged) > 0 && merged[len(merged)-1].End >= r.Start {
+			if r.End > merged[len(merged)-1].End {
+				merged[len(merged)-1].End = r.End
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// splits the parts of a fetch list of length that are not done into batches of at most batchSize
+func pendingFetchBatches(length int, done []fetchRange, batchSize int) []fetchRange {
+	var batches []fetchRange
+	index := 0
+	for _, doneRange := range append(mergeFetchRanges(done), fetchRange{Start: length, End: length}) {
+		for index < doneRange.Start {
+			end := index + batchSize
+			if end > doneRange.Start {
+				end = doneRange.Start
+			}
+			batches = append(batches, fetchRange{Start: index, End: end})
+			index = end
+		}
+		if doneRange.End > index {
+			index = doneRange.End
+		}
+	}
+	return batches
+}
+
+// What the results of the mutation differ depend on, which need to be the same for a checkpoint to be resumed from
+type mutationDiffCheckpointParams struct {
+	// fingerprint of the diff keys and migration hints given by the file differ
+	DiffKeysFingerprint string
+	CompareType         string
+	CollectionMapping   map[uint32][]uint32
+	CompareXattrs       bool
+	SemanticJsonCompare bool
+	// the rules of the JSON paths that are not compared, as resolved on the source
+	IgnoredJsonPathRules []*utils.IgnoredJsonPathRule
+}
+
+// The progress of the mutation differ, which is saved periodically in the mutation differ dir so that a restart
+// continues from it rather than fetching every key again
+type mutationDiffCheckpoint struct {
+	Version int
+	Params  *mutationDiffCheckpointParams
+	// the round of retries that the fetch list is for, where 0 is the first fetch
+	Round int
+	// length of the fetch list of the round, which is saved in a file of its own
+	FetchListLen int
+	// the ranges of the fetch list whose results are in the diff store
+	DoneRanges []fetchRange
+	// sizes of the files of the diff store, of the store of explained diffs and of the store of retry observations
+	// when the ranges were done
+	DiffStoreSizes      map[string]int64
+	ExplainedStoreSizes map[string]int64
+	HistoryStoreSizes   map[string]int64
+	KeysWithError       MutationDiffFetchList
+	RoundDiffCounts     []int
+}
+
+func getMutationDiffCheckpointFileName(mutationDifferFileDir string) string {
+	return mutationDifferFileDir + base.FileDirDelimiter + base.MutationDiffCheckpointFileName
+}
+
+func getMutationDiffFetchListFileName(mutationDifferFileDir string) string {
+	return mutationDifferFileDir + base.FileDirDelimiter + base.MutationDiffFetchListFileName
+}
+
+// Loads the checkpoint saved by a previous run along with the fetch list of its round. Returns nil when there is
+// no checkpoint that can be resumed from, in which case every key is fetched
+func loadMutationDiffCheckpoint(mutationDifferFileDir string, params *mutationDiffCheckpointParams) (*mutationDiffCheckpoint, MutationDiffFetchList, error) {
+	data, err := ioutil.ReadFile(getMutationDiffCheckpointFileName(mutationDifferFileDir))
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	checkpoint := &mutationDiffCheckpoint{}
+	err = json.Unmarshal(data, checkpoint)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error unmarshalling mutation diff checkpoint %v. err=%v", getMutationDiffCheckpointFileName(mutationDifferFileDir), err)
+	}
+	if checkpoint.Version != base.MutationDiffCheckpointVersion || !reflect.DeepEqual(checkpoint.Params, params) {
+		return nil, nil, nil
+	}
+
+	data, err = ioutil.ReadFile(getMutationDiffFetchListFileName(mutationDifferFileDir))
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	var fetchList MutationDiffFetchList
+	err = json.Unmarshal(data, &fetchList)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error unmarshalling mutation diff fetch list %v. err=%v", getMutationDiffFetchListFileName(mutationDifferFileDir), err)
+	}
+	if len(fetchList) != checkpoint.FetchListLen {
+		return nil, nil, nil
+	}
+	return checkpoint, fetchList, nil
+}
+
+// the checkpoint is written to a temp file first, so that a crash while saving it leaves the previous one in place
+func (c *mutationDiffCheckpoint) save(mutationDifferFileDir string) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(getMutationDiffCheckpointFileName(mutationDifferFileDir), data)
+}
+
+func saveMutationDiffFetchList(mutationDifferFileDir string, fetchList MutationDiffFetchList) error {
+	data, err := json.Marshal(fetchList)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(getMutationDiffFetchListFileName(mutationDifferFileDir), data)
+}
+
+func writeFileAtomically(fileName string, data []byte) error {
+	tempFileName := fileName + base.TempFileSuffix
+	err := ioutil.WriteFile(tempFileName, data, base.FileModeReadWrite)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempFileName, fileName)
+}
+
+func removeMutationDiffCheckpoint(mutationDifferFileDir string) error {
+	for _, fileName := range []string{getMutationDiffCheckpointFileName(mutationDifferFileDir), getMutationDiffFetchListFileName(mutationDifferFileDir)} {
+		err := os.Remove(fileName)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Whether the mutation differ dir holds a checkpoint of a run that did not complete, which the mutation differ
+// resumes from if it is for the same diff keys
+func MutationDiffCheckpointExists(mutationDifferFileDir string) bool {
+	_, err := os.Stat(getMutationDiffCheckpointFileName(mutationDifferFileDir))
+	return err == nil
+}
+
+// The keys are sorted before they are hashed, since the order that the file differ writes them in is not fixed
+func fingerprintDiffKeys(srcDiffKeys, tgtDiffKeys DiffKeysMap, migrationHintMap MigrationHintMap) string {
+	hash := sha256.New()
+	for _, diffKeys := range []DiffKeysMap{srcDiffKeys, tgtDiffKeys} {
+		var colIds []uint32
+		for colId := range diffKeys {
+			colIds = append(colIds, colId)
+		}
+		sort.Slice(colIds, func(i, j int) bool { return colIds[i] < colIds[j] })
+		for _, colId := range colIds {
+			keys := make([]string, len(diffKeys[colId]))
+			copy(keys, diffKeys[colId])
+			sort.Strings(keys)
+			fmt.Fprintf(hash, "%v:%q\n", colId, keys)
+		}
+		fmt.Fprintf(hash, "\n")
+	}
+	var hintedKeys []string
+	for key := range migrationHintMap {
+		hintedKeys = append(hintedKeys, key)
+	}
+	sort.Strings(hintedKeys)
+	for _, key := range hintedKeys {
+		fmt.Fprintf(hash, "%q:%v\n", key, migrationHintMap[key])
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,225 @@
+package differ
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"xdcrDiffer/base"
+	"xdcrDiffer/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPendingFetchBatches(t *testing.T) {
+	fmt.Println("============== Test case start: TestPendingFetchBatches =================")
+	assert := assert.New(t)
+	assert.Equal([]fetchRange{{0, 4}, {8, 12}}, mergeFetchRanges([]fetchRange{{8, 10}, {0, 2}, {2, 4}, {9, 12}}))
+	assert.Nil(mergeFetchRanges(nil))
+
+	assert.Equal([]fetchRange{{0, 3}, {3, 6}, {6, 7}}, pendingFetchBatches(7, nil, 3))
+	assert.Equal([]fetchRange{{2, 5}, {5, 6}, {9, 10}}, pendingFetchBatches(10, []fetchRange{{6, 9}, {0, 2}}, 3))
+	assert.Nil(pendingFetchBatches(10, []fetchRange{{0, 10}}, 3))
+	assert.Nil(pendingFetchBatches(0, nil, 3))
+}
+
+func TestFingerprintDiffKeys(t *testing.T) {
+	fmt.Println("============== Test case start: TestFingerprintDiffKeys =================")
+	assert := assert.New(t)
+	fingerprint := fingerprintDiffKeys(DiffKeysMap{0: {"a", "b"}, 8: {"c"}}, DiffKeysMap{0: {"d"}}, nil)
+	// the order that the keys are written in does not matter
+	assert.Equal(fingerprint, fingerprintDiffKeys(DiffKeysMap{8: {"c"}, 0: {"b", "a"}}, DiffKeysMap{0: {"d"}}, MigrationHintMap{}))
+	// which side a key is on does
+	assert.NotEqual(fingerprint, fingerprintDiffKeys(DiffKeysMap{0: {"a", "b"}, 8: {"c"}, 16: {"d"}}, DiffKeysMap{}, nil))
+	assert.NotEqual(fingerprint, fingerprintDiffKeys(DiffKeysMap{0: {"a", "b"}, 8: {"c"}}, DiffKeysMap{0: {"d"}},
+		MigrationHintMap{"a": []uint32{8}}))
+}
+
+func TestLoadMutationDiffCheckpoint(t *testing.T) {
+	fmt.Println("============== Test case start: TestLoadMutationDiffCheckpoint =================")
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "mutationDiffCheckpointTest")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	params := &mutationDiffCheckpointParams{DiffKeysFingerprint: "fingerprint", CompareType: base.MutationCompareTypeMetadata,
+		CollectionMapping: map[uint32][]uint32{0: {0}}, IgnoredJsonPathRules: []*utils.IgnoredJsonPathRule{{Path: []string{"ts"}}}}
+	fetchList := MutationDiffFetchList{{Key: "a"}, {Key: "b"}}
+
+	// there is nothing to resume from before a checkpoint is saved
+	checkpoint, _, err := loadMutationDiffCheckpoint(dir, params)
+	assert.Nil(err)
+	assert.Nil(checkpoint)
+	assert.False(MutationDiffCheckpointExists(dir))
+
+	assert.Nil(saveMutationDiffFetchList(dir, fetchList))
+	saved := &mutationDiffCheckpoint{Version: base.MutationDiffCheckpointVersion, Params: params, Round: 1,
+		FetchListLen: len(fetchList), DoneRanges: []fetchRange{{0, 1}}, DiffStoreSizes: map[string]int64{diffKindMismatch: 10},
+		RoundDiffCounts: []int{5}}
+	assert.Nil(saved.save(dir))
+	assert.True(MutationDiffCheckpointExists(dir))
+
+	checkpoint, loadedFetchList, err := loadMutationDiffCheckpoint(dir, params)
+	assert.Nil(err)
+	assert.Equal(saved, checkpoint)
+	assert.Equal(fetchList, loadedFetchList)
+
+	// a checkpoint of other params is not resumed from, including other rules of the JSON paths that are ignored
+	otherRules := *params
+	otherRules.IgnoredJsonPathRules = []*utils.IgnoredJsonPathRule{{Path: []string{"other"}}}
+	otherCompareType := *params
+	otherCompareType.CompareType = base.MutationCompareTypeBodyOnly
+	for _, otherParams := range []*mutationDiffCheckpointParams{&otherRules, &otherCompareType} {
+		checkpoint, _, err = loadMutationDiffCheckpoint(dir, otherParams)
+		assert.Nil(err)
+		assert.Nil(checkpoint)
+	}
+
+	// nor is one whose fetch list is not the one it was saved with
+	assert.Nil(saveMutationDiffFetchList(dir, fetchList[:1]))
+	checkpoint, _, err = loadMutationDiffCheckpoint(dir, params)
+	assert.Nil(err)
+	assert.Nil(checkpoint)
+
+	// nor one of another version
+	assert.Nil(saveMutationDiffFetchList(dir, fetchList))
+	saved.Version = base.MutationDiffCheckpointVersion - 1
+	assert.Nil(saved.save(dir))
+	checkpoint, _, err = loadMutationDiffCheckpoint(dir, params)
+	assert.Nil(err)
+	assert.Nil(checkpoint)
+
+	assert.Nil(ioutil.WriteFile(getMutationDiffCheckpointFileName(dir), []byte("{"), base.FileModeReadWrite))
+	_, _, err = loadMutationDiffCheckpoint(dir, params)
+	assert.NotNil(err)
+
+	assert.Nil(removeMutationDiffCheckpoint(dir))
+	assert.False(MutationDiffCheckpointExists(dir))
+	assert.Nil(removeMutationDiffCheckpoint(dir))
+}
+
+func TestMutationDiffStoreLoad(t *testing.T) {
+	fmt.Println("============== Test case start: TestMutationDiffStoreLoad =================")
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "mutationDiffCheckpointTest")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	store := newMutationDiffStore(dir)
+	assert.Nil(store.add(diffKindMismatch, 0, "key_1", []string{"a"}))
+	assert.Nil(store.add(diffKindMissingFromSource, 0, "key_2", nil))
+	assert.Nil(store.flush())
+	sizes := store.fileSizes()
+	// read once, so that there are dedup files
+	_, err = store.totalCount()
+	assert.Nil(err)
+
+	// results flushed and not flushed after the sizes were taken, and of a kind that the sizes do not have
+	assert.Nil(store.add(diffKindMismatch, 0, "key_3", []string{"b"}))
+	assert.Nil(store.add(diffKindMissingFromSource, 8, "key_4", nil))
+	assert.Nil(store.flush())
+	assert.Nil(store.add(diffKindMismatch, 0, "key_5", []string{"c"}))
+	assert.Nil(store.add(diffKindDeletedFromSource, 0, "key_6", nil))
+	assert.Nil(store.flush())
+	assert.Nil(store.add(diffKindMismatch, 0, "key_7", []string{"d"}))
+	store.close()
+
+	// whatever was added after the sizes is truncated on load, and the files that the sizes do not have are removed
+	loaded := newMutationDiffStore(dir)
+	defer loaded.close()
+	assert.Nil(loaded.load(sizes))
+	fileInfos, err := ioutil.ReadDir(dir)
+	assert.Nil(err)
+	var fileNames []string
+	for _, fileInfo := range fileInfos {
+		fileNames = append(fileNames, fileInfo.Name())
+		assert.Equal(sizes[fileInfo.Name()], fileInfo.Size())
+	}
+	assert.ElementsMatch([]string{diffKindMismatch, diffKindMissingFromSource}, fileNames)
+	assert.Equal(sizes, loaded.fileSizes())
+
+	diffKeys, err := loaded.diffKeys(diffKindMismatch)
+	assert.Nil(err)
+	assert.Equal(DiffKeysMap{0: {"key_1"}}, diffKeys)
+	diffKeys, err = loaded.diffKeys(diffKindMissingFromSource)
+	assert.Nil(err)
+	assert.Equal(DiffKeysMap{0: {"key_2"}}, diffKeys)
+
+	// the results added after the load follow the ones loaded
+	assert.Nil(loaded.add(diffKindMismatch, 0, "key_3", []string{"b"}))
+	assert.Nil(loaded.add(diffKindMismatch, 0, "key_1", []string{"e"}))
+	assert.Nil(loaded.flush())
+	diffKeys, err = loaded.diffKeys(diffKindMismatch)
+	assert.Nil(err)
+	assert.Equal(DiffKeysMap{0: {"key_1", "key_3"}}, diffKeys)
+
+	// a file that is missing cannot be loaded
+	assert.NotNil(newMutationDiffStore(dir).load(map[string]int64{diffKindBodyDiffs: 10}))
+}
+
+// a mutation differ with only what checkpointing needs
+func newCheckpointedMutationDiffer(dir string, params *mutationDiffCheckpointParams) *MutationDiffer {
+	return &MutationDiffer{
+		mutationDifferFileDir: dir,
+		diffStore:             newMutationDiffStore(dir + base.FileDirDelimiter + base.MutationDiffStoreDir),
+		explainedStore:        newMutationDiffStore(dir + base.FileDirDelimiter + base.MutationDiffExplainedStoreDir),
+		historyStore:          newMutationDiffStore(dir + base.FileDirDelimiter + base.MutationDiffHistoryStoreDir),
+		keysWithError:         MutationDiffFetchList{},
+		stateLock:             &sync.RWMutex{},
+		checkpointLock:        &sync.Mutex{},
+		checkpointParams:      params,
+		logger:                logger,
+	}
+}
+
+func TestMutationDifferResumeFromCheckpoint(t *testing.T) {
+	fmt.Println("============== Test case start: TestMutationDifferResumeFromCheckpoint =================")
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "mutationDiffCheckpointTest")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	params := &mutationDiffCheckpointParams{DiffKeysFingerprint: "fingerprint"}
+	fetchList := MutationDiffFetchList{{Key: "key_1"}, {Key: "key_2"}, {Key: "key_3"}, {Key: "key_4"}}
+
+	d := newCheckpointedMutationDiffer(dir, params)
+	assert.Nil(d.explainedStore.reset())
+	assert.Nil(d.startRound(0, fetchList))
+	d.addDocDiff(nil, nil, map[uint32]map[string][]*GetResult{0: {"key_1": nil}}, nil, nil, nil,
+		map[uint32]map[string][]string{0: {"key_1": {base.DiffFieldCas}}}, nil, nil,
+		ExplainedDiffs{diffKindMissingFromTarget: {0: {"key_2": &ExplainedDiff{ExplainedBy: []string{base.ReplicationSettingMobile}}}}}, nil, fetchRange{0, 2}, nil)
+	d.addKeysWithError(MutationDiffFetchList{{Key: "key_3"}}, fetchRange{2, 3})
+	assert.Nil(d.saveCheckpoint())
+
+	// the batch of key_4 is diffed after the checkpoint, and the process dies before the next one
+	d.addDocDiff(nil, nil, map[uint32]map[string][]*GetResult{0: {"key_4": nil}}, nil, nil, nil, nil, nil, nil, nil, nil,
+		fetchRange{3, 4}, nil)
+	d.Close()
+
+	// a restart is resumed with the results as of the checkpoint, and fetches only key_4 again
+	d = newCheckpointedMutationDiffer(dir, params)
+	defer d.Close()
+	resumed, err := d.resumeFromCheckpoint()
+	assert.Nil(err)
+	assert.True(resumed)
+	assert.Equal(fetchList, d.fetchList)
+	assert.Equal([]fetchRange{{3, 4}}, pendingFetchBatches(len(d.fetchList), d.doneRanges, 10))
+	assert.Equal([]*MutationDifferFetchEntry{{Key: "key_3"}}, d.keysWithError)
+	srcDiffKeys, err := d.getDiffKeysFromSourceGocbResult()
+	assert.Nil(err)
+	assert.Equal(DiffKeysMap{0: {"key_1"}}, srcDiffKeys)
+	histogram, err := d.mismatchHistogram()
+	assert.Nil(err)
+	assert.Equal(MismatchHistogram{base.DiffFieldCas: 1}, histogram)
+	explainedCount, err := d.explainedStore.totalCount()
+	assert.Nil(err)
+	assert.Equal(1, explainedCount)
+
+	// a checkpoint of other params is not resumed from
+	d = newCheckpointedMutationDiffer(dir, &mutationDiffCheckpointParams{DiffKeysFingerprint: "other"})
+	defer d.Close()
+	resumed, err = d.resumeFromCheckpoint()
+	assert.Nil(err)
+	assert.False(resumed)
+}
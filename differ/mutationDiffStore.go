@@ -0,0 +1,641 @@
+package differ
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+
+	"xdcrDiffer/base"
+)
+
+// kinds of results that the mutation differ keeps in its store, by the names that the diff details report them as.
+// The mismatches from the point of view of the target are not reported, and so are added without their results
+const (
+	diffKindMismatch          = "Mismatch"
+	diffKindTargetMismatch    = "TargetMismatch"
+	diffKindMissingFromSource = "MissingFromSource"
+	diffKindMissingFromTarget = "MissingFromTarget"
+	diffKindDeletedFromSource = "DeletedFromSource"
+	diffKindDeletedFromTarget = "DeletedFromTarget"
+	diffKindMismatchedFields  = "MismatchedFields"
+	diffKindMismatchedXattrs  = "MismatchedXattrs"
+	diffKindBodyDiffs         = "BodyDiffs"
+	// the histories of the keys, which are classified from their observations at the end of the retries. The
+	// observations are kept in a store of their own, which is not cleared by retries
+	diffKindRetryHistory     = "RetryHistory"
+	diffKindRetryObservation = "RetryObservation"
+	// the histogram is derived from the mismatched fields, and is reported alongside the kinds in the store
+	diffKindMismatchHistogram = "MismatchHistogram"
+)
+
+// Keeps the results of the mutation differ on disk as they are found, so that millions of differences do not need
+// to be held in memory. The results of each kind are appended to a file of their own, one per line. A key that is
+// added more than once keeps its first result, which is sorted out when the results of the kind are next read, by
+// deduplicating its file a part at a time into a dir of files of each collection. Only the number of keys of each
+// kind and the collections that they are in are kept in memory
+type mutationDiffStore struct {
+	dir     string
+	lock    *sync.Mutex
+	files   map[string]*os.File
+	writers map[string]*bufio.Writer
+	// bytes written to the file of each kind, and the bytes of them that have been flushed, which a checkpoint
+	// records to load the store from
+	sizes        map[string]int64
+	flushedSizes map[string]int64
+	// the number of keys of each kind and the collections that they are in, as of when the kind was deduplicated
+	counts map[string]int
+	colIds map[string][]uint32
+	// the kinds that have been added to since they were last deduplicated
+	dirty map[string]bool
+	// the size of the parts that the files are deduplicated in
+	dedupPartSize int64
+}
+
+func newMutationDiffStore(dir string) *mutationDiffStore {
+	s := &mutationDiffStore{
+		dir:     dir,
+		lock:    &sync.Mutex{},
+		files:   make(map[string]*os.File),
+		writers: make(map[string]*bufio.Writer),
+		// the size of the parts is only changed by tests
+		dedupPartSize: base.MutationDiffStoreDedupPartSize,
+	}
+	s.clear()
+	return s
+}
+
+func (s *mutationDiffStore) clear() {
+	s.closeFiles()
+	s.sizes = make(map[string]int64)
+	s.flushedSizes = make(map[string]int64)
+	s.counts = make(map[string]int)
+	s.colIds = make(map[string][]uint32)
+	s.dirty = make(map[string]bool)
+}
+
+// removes all the results, so that the store can be filled again
+func (s *mutationDiffStore) reset() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.clear()
+	err := os.RemoveAll(s.dir)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(s.dir, 0755)
+}
+
+// Loads the results that were in the store when it had the sizes, which are given by a checkpoint. Whatever was
+// added to the files after the checkpoint is truncated, and the other files in the store are removed
+func (s *mutationDiffStore) load(sizes map[string]int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.clear()
+	err := os.MkdirAll(s.dir, 0755)
+	if err != nil {
+		return err
+	}
+	fileInfos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, fileInfo := range fileInfos {
+		if _, exists := sizes[fileInfo.Name()]; !exists {
+			err = os.RemoveAll(s.fileName(fileInfo.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for kind, size := range sizes {
+		err = s.loadKind(kind, size)
+		if err != nil {
+			return fmt.Errorf("error loading %v of the mutation diff store. err=%v", kind, err)
+		}
+	}
+	return nil
+}
+
+func (s *mutationDiffStore) loadKind(kind string, size int64) error {
+	file, err := os.OpenFile(s.fileName(kind), os.O_RDWR, base.FileModeReadWrite)
+	if err != nil {
+		return err
+	}
+	err = file.Truncate(size)
+	if err == nil {
+		_, err = file.Seek(size, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.files[kind] = file
+	s.writers[kind] = bufio.NewWriterSize(file, base.MutationDiffStoreBufferSize)
+	s.sizes[kind] = size
+	s.flushedSizes[kind] = size
+	s.dirty[kind] = true
+	return nil
+}
+
+// the end of the key of a line of the file of a kind, which is a JSON string that follows the collection ID
+func storedLineKeyEnd(line []byte) int {
+	sepIdx := bytes.IndexByte(line, ' ')
+	if sepIdx < 0 || sepIdx+1 >= len(line) || line[sepIdx+1] != '"' {
+		return -1
+	}
+	// the key ends at the first quote that is not escaped
+	for i := sepIdx + 2; i < len(line); i++ {
+		if line[i] == '\\' {
+			i++
+		} else if line[i] == '"' {
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// the collection ID, the key and the result of a line of the file of a kind
+func parseStoredLine(line []byte) (uint32, string, []byte, error) {
+	keyEnd := storedLineKeyEnd(line)
+	if keyEnd < 0 || keyEnd >= len(line) || line[keyEnd] != ':' {
+		return 0, "", nil, fmt.Errorf("invalid line %q", line)
+	}
+	sepIdx := bytes.IndexByte(line, ' ')
+	colId, err := strconv.ParseUint(string(line[:sepIdx]), 10, 32)
+	if err != nil {
+		return 0, "", nil, err
+	}
+	var key string
+	err = json.Unmarshal(line[sepIdx+1:keyEnd], &key)
+	if err != nil {
+		return 0, "", nil, err
+	}
+	return uint32(colId), key, bytes.TrimSuffix(line[keyEnd+1:], []byte("\n")), nil
+}
+
+// removes the store from disk once the reports have been produced from it
+func (s *mutationDiffStore) remove() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.closeFiles()
+	return os.RemoveAll(s.dir)
+}
+
+func (s *mutationDiffStore) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closeFiles()
+}
+
+func (s *mutationDiffStore) closeFiles() {
+	for kind, file := range s.files {
+		file.Close()
+		delete(s.files, kind)
+		delete(s.writers, kind)
+	}
+}
+
+func (s *mutationDiffStore) add(kind string, colId uint32, key string, result interface{}) error {
+	keyBytes, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	resultBytes, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	writer, err := s.writer(kind)
+	if err != nil {
+		return err
+	}
+	// each line is the collection ID followed by the key and the result as a member of a JSON object
+	n, err := fmt.Fprintf(writer, "%v %s:%s\n", colId, keyBytes, resultBytes)
+	s.sizes[kind] += int64(n)
+	s.dirty[kind] = true
+	return err
+}
+
+func (s *mutationDiffStore) writer(kind string) (*bufio.Writer, error) {
+	if writer, exists := s.writers[kind]; exists {
+		return writer, nil
+	}
+	file, err := os.OpenFile(s.fileName(kind), os.O_RDWR|os.O_CREATE|os.O_TRUNC, base.FileModeReadWrite)
+	if err != nil {
+		return nil, err
+	}
+	s.files[kind] = file
+	s.writers[kind] = bufio.NewWriterSize(file, base.MutationDiffStoreBufferSize)
+	return s.writers[kind], nil
+}
+
+func (s *mutationDiffStore) fileName(kind string) string {
+	return s.dir + base.FileDirDelimiter + kind
+}
+
+// the dir of the deduplicated results of the kind, which has a file of the results of each collection
+func (s *mutationDiffStore) dedupDirName(kind string) string {
+	return s.fileName(kind) + base.MutationDiffStoreDedupSuffix
+}
+
+func (s *mutationDiffStore) dedupFileName(kind string, colId uint32) string {
+	return s.dedupDirName(kind) + base.FileDirDelimiter + strconv.FormatUint(uint64(colId), 10)
+}
+
+func (s *mutationDiffStore) flush() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for kind, writer := range s.writers {
+		err := writer.Flush()
+		if err != nil {
+			return err
+		}
+		s.flushedSizes[kind] = s.sizes[kind]
+	}
+	return nil
+}
+
+// the sizes of the files of the kinds as of the last flush, which end with whole lines
+func (s *mutationDiffStore) fileSizes() map[string]int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sizes := make(map[string]int64, len(s.flushedSizes))
+	for kind, size := range s.flushedSizes {
+		sizes[kind] = size
+	}
+	return sizes
+}
+
+// Writes the first line of each key of the file of the kind to the dedup file of its collection, one part of the
+// file at a time. The lines of a part are grouped by collection in memory, and appended to the files of their
+// collections once the part is done, so that each collection's file can be read on its own
+func (s *mutationDiffStore) dedup(kind string) error {
+	if !s.dirty[kind] {
+		return nil
+	}
+
+	err := os.RemoveAll(s.dedupDirName(kind))
+	if err == nil {
+		err = os.MkdirAll(s.dedupDirName(kind), 0755)
+	}
+	if err != nil {
+		return err
+	}
+	var count int
+	colIds := make(map[uint32]bool)
+	err = s.forEachPart(kind, func(partFileName string) error {
+		keys := make(map[string]bool)
+		linesByColId := make(map[uint32][]byte)
+		err := forEachStoredLine(partFileName, func(line []byte) error {
+			keyEnd := storedLineKeyEnd(line)
+			if keyEnd < 0 {
+				return fmt.Errorf("invalid line %q", line)
+			}
+			if keys[string(line[:keyEnd])] {
+				return nil
+			}
+			keys[string(line[:keyEnd])] = true
+			colId, err := strconv.ParseUint(string(line[:bytes.IndexByte(line, ' ')]), 10, 32)
+			if err != nil {
+				return err
+			}
+			colIds[uint32(colId)] = true
+			count++
+			linesByColId[uint32(colId)] = append(linesByColId[uint32(colId)], line...)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for colId, lines := range linesByColId {
+			err = appendToFile(s.dedupFileName(kind, colId), lines)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.counts[kind] = count
+	s.colIds[kind] = nil
+	for colId := range colIds {
+		s.colIds[kind] = append(s.colIds[kind], colId)
+	}
+	sort.Slice(s.colIds[kind], func(i, j int) bool { return s.colIds[kind][i] < s.colIds[kind][j] })
+	delete(s.dirty, kind)
+	return nil
+}
+
+func appendToFile(fileName string, data []byte) error {
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, base.FileModeReadWrite)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Calls fn with each part of the file of the kind. The lines are split into parts by the hashes of their keys, so
+// that all the lines of a key are in the same part, in the order they were added, and only the keys of one part
+// need to be held in memory at a time. A file that fits in one part is its own part
+func (s *mutationDiffStore) forEachPart(kind string, fn func(partFileName string) error) error {
+	err := s.writers[kind].Flush()
+	if err != nil {
+		return err
+	}
+
+	numParts := int(s.sizes[kind]/s.dedupPartSize) + 1
+	partFileNames := []string{s.fileName(kind)}
+	if numParts > 1 {
+		partFileNames, err = s.splitIntoParts(kind, numParts)
+		defer func() {
+			for _, partFileName := range partFileNames {
+				os.Remove(partFileName)
+			}
+		}()
+		if err != nil {
+			return err
+		}
+	}
+	for _, partFileName := range partFileNames {
+		err = fn(partFileName)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splits the lines of the file of the kind into part files by the hashes of their keys, keeping their order
+func (s *mutationDiffStore) splitIntoParts(kind string, numParts int) ([]string, error) {
+	var partFileNames []string
+	var partFiles []*os.File
+	var partWriters []*bufio.Writer
+	defer func() {
+		for _, partFile := range partFiles {
+			partFile.Close()
+		}
+	}()
+	for i := 0; i < numParts; i++ {
+		partFileName := fmt.Sprintf("%v%v%v", s.fileName(kind), base.MutationDiffStorePartSuffix, i)
+		partFile, err := os.OpenFile(partFileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, base.FileModeReadWrite)
+		if err != nil {
+			return partFileNames, err
+		}
+		partFileNames = append(partFileNames, partFileName)
+		partFiles = append(partFiles, partFile)
+		partWriters = append(partWriters, bufio.NewWriterSize(partFile, base.MutationDiffStoreBufferSize))
+	}
+
+	err := forEachStoredLine(s.fileName(kind), func(line []byte) error {
+		keyEnd := storedLineKeyEnd(line)
+		if keyEnd < 0 {
+			return fmt.Errorf("invalid line %q", line)
+		}
+		hash := fnv.New32a()
+		hash.Write(line[:keyEnd])
+		_, err := partWriters[int(hash.Sum32()%uint32(numParts))].Write(line)
+		return err
+	})
+	if err != nil {
+		return partFileNames, err
+	}
+	for _, partWriter := range partWriters {
+		err = partWriter.Flush()
+		if err != nil {
+			return partFileNames, err
+		}
+	}
+	return partFileNames, nil
+}
+
+// calls fn with each line of the file, including its newline
+func forEachStoredLine(fileName string, fn func(line []byte) error) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReaderSize(file, base.MutationDiffStoreBufferSize)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		} else if err != nil && err != io.EOF {
+			return err
+		}
+		err = fn(line)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// calls fn with the first result of each key of the kind, as JSON
+func (s *mutationDiffStore) forEach(kind string, fn func(colId uint32, key string, result []byte) error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, exists := s.writers[kind]; !exists {
+		return nil
+	}
+	err := s.dedup(kind)
+	if err != nil {
+		return err
+	}
+	for _, colId := range s.colIds[kind] {
+		err = forEachStoredLine(s.dedupFileName(kind, colId), func(line []byte) error {
+			colId, key, result, err := parseStoredLine(line)
+			if err != nil {
+				return err
+			}
+			return fn(colId, key, result)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Calls fn with all the results of each key of the kind as JSON, in the order they were added, for the kinds that
+// keep more than one result per key. The results of one part of the file of the kind are held in memory at a time
+func (s *mutationDiffStore) forEachGroup(kind string, fn func(colId uint32, key string, results [][]byte) error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, exists := s.writers[kind]; !exists {
+		return nil
+	}
+	return s.forEachPart(kind, func(partFileName string) error {
+		var keyIds []string
+		lines := make(map[string][][]byte)
+		err := forEachStoredLine(partFileName, func(line []byte) error {
+			keyEnd := storedLineKeyEnd(line)
+			if keyEnd < 0 {
+				return fmt.Errorf("invalid line %q", line)
+			}
+			keyId := string(line[:keyEnd])
+			if _, exists := lines[keyId]; !exists {
+				keyIds = append(keyIds, keyId)
+			}
+			lines[keyId] = append(lines[keyId], line)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, keyId := range keyIds {
+			var colId uint32
+			var key string
+			results := make([][]byte, len(lines[keyId]))
+			for i, line := range lines[keyId] {
+				colId, key, results[i], err = parseStoredLine(line)
+				if err != nil {
+					return err
+				}
+			}
+			err = fn(colId, key, results)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// the keys of the results of the kind
+func (s *mutationDiffStore) diffKeys(kind string) (DiffKeysMap, error) {
+	diffKeys := make(DiffKeysMap)
+	err := s.forEach(kind, func(colId uint32, key string, result []byte) error {
+		diffKeys[colId] = append(diffKeys[colId], key)
+		return nil
+	})
+	return diffKeys, err
+}
+
+// the kinds that have results, in order
+func (s *mutationDiffStore) kinds() ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var kinds []string
+	for kind := range s.writers {
+		err := s.dedup(kind)
+		if err != nil {
+			return nil, err
+		}
+		if s.counts[kind] > 0 {
+			kinds = append(kinds, kind)
+		}
+	}
+	sort.Strings(kinds)
+	return kinds, nil
+}
+
+func (s *mutationDiffStore) totalCount() (int, error) {
+	kinds, err := s.kinds()
+	if err != nil {
+		return 0, err
+	}
+	var count int
+	for _, kind := range kinds {
+		kindCount, err := s.count(kind)
+		if err != nil {
+			return 0, err
+		}
+		count += kindCount
+	}
+	return count, nil
+}
+
+// the number of keys of the kind
+func (s *mutationDiffStore) count(kind string) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, exists := s.writers[kind]; !exists {
+		return 0, nil
+	}
+	err := s.dedup(kind)
+	return s.counts[kind], err
+}
+
+// Streams the results of the kind to w as a JSON object of the results of each collection by key, the same as
+// marshalling a map[uint32]map[string]result would. The dedup file of each collection is read once
+func (s *mutationDiffStore) writeJson(w io.Writer, kind string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, exists := s.writers[kind]; exists {
+		err := s.dedup(kind)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := io.WriteString(w, "{")
+	if err != nil {
+		return err
+	}
+	for i, colId := range s.colIds[kind] {
+		if i > 0 {
+			_, err = io.WriteString(w, ",")
+			if err != nil {
+				return err
+			}
+		}
+		_, err = fmt.Fprintf(w, "\"%v\":{", colId)
+		if err != nil {
+			return err
+		}
+		err = s.writeCollectionJson(w, kind, colId)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, "}")
+		if err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(w, "}")
+	return err
+}
+
+func (s *mutationDiffStore) writeCollectionJson(w io.Writer, kind string, colId uint32) error {
+	prefix := []byte(strconv.FormatUint(uint64(colId), 10) + " ")
+	var written bool
+	return forEachStoredLine(s.dedupFileName(kind, colId), func(line []byte) error {
+		if written {
+			_, err := io.WriteString(w, ",")
+			if err != nil {
+				return err
+			}
+		}
+		written = true
+		_, err := w.Write(bytes.TrimSuffix(line[len(prefix):], []byte("\n")))
+		return err
+	})
+}
@@ -0,0 +1,161 @@
+package differ
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"xdcrDiffer/base"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseStoredLine(t *testing.T) {
+	fmt.Println("============== Test case start: TestParseStoredLine =================")
+	assert := assert.New(t)
+	for _, key := range []string{"key", "key with spaces", `key "quoted" \ escaped`, "key:with:colons", ""} {
+		keyBytes, _ := json.Marshal(key)
+		colId, parsedKey, result, err := parseStoredLine([]byte(fmt.Sprintf("8 %s:{\"a\":\"b:c\"}\n", keyBytes)))
+		assert.Nil(err)
+		assert.Equal(uint32(8), colId)
+		assert.Equal(key, parsedKey)
+		assert.Equal(`{"a":"b:c"}`, string(result))
+	}
+
+	for _, line := range []string{"", "8", `8 key:1`, `8 "key`, `8 "key"1`, `x "key":1`} {
+		_, _, _, err := parseStoredLine([]byte(line))
+		assert.NotNil(err, line)
+	}
+}
+
+func TestMutationDiffStore(t *testing.T) {
+	fmt.Println("============== Test case start: TestMutationDiffStore =================")
+	// deduplicated in a single part, and in parts smaller than the file
+	for _, dedupPartSize := range []int64{base.MutationDiffStoreDedupPartSize, 16} {
+		t.Run(fmt.Sprintf("parts of %v bytes", dedupPartSize), func(t *testing.T) {
+			assert := assert.New(t)
+			dir, err := ioutil.TempDir("", "mutationDiffStoreTest")
+			assert.Nil(err)
+			defer os.RemoveAll(dir)
+
+			store := newMutationDiffStore(dir + base.FileDirDelimiter + base.MutationDiffStoreDir)
+			store.dedupPartSize = dedupPartSize
+			assert.Nil(store.reset())
+			defer store.close()
+
+			// a key that is added again keeps its first result, in the same collection only
+			assert.Nil(store.add(diffKindMismatchedFields, 0, "key_1", []string{"a"}))
+			assert.Nil(store.add(diffKindMismatchedFields, 0, `key "2"`, []string{"b"}))
+			assert.Nil(store.add(diffKindMismatchedFields, 0, "key_1", []string{"c"}))
+			assert.Nil(store.add(diffKindMismatchedFields, 8, "key_1", []string{"d"}))
+			assert.Nil(store.add(diffKindTargetMismatch, 8, "key_3", nil))
+			assert.Nil(store.flush())
+
+			count, err := store.count(diffKindMismatchedFields)
+			assert.Nil(err)
+			assert.Equal(3, count)
+			count, err = store.count(diffKindMismatch)
+			assert.Nil(err)
+			assert.Equal(0, count)
+			totalCount, err := store.totalCount()
+			assert.Nil(err)
+			assert.Equal(4, totalCount)
+			kinds, err := store.kinds()
+			assert.Nil(err)
+			assert.Equal([]string{diffKindMismatchedFields, diffKindTargetMismatch}, kinds)
+
+			diffKeys, err := store.diffKeys(diffKindMismatchedFields)
+			assert.Nil(err)
+			assert.ElementsMatch([]string{"key_1", `key "2"`}, diffKeys[0])
+			assert.Equal([]string{"key_1"}, diffKeys[8])
+
+			// the results are streamed as marshalling them as a map would
+			var buffer bytes.Buffer
+			assert.Nil(store.writeJson(&buffer, diffKindMismatchedFields))
+			var results map[uint32]map[string][]string
+			assert.Nil(json.Unmarshal(buffer.Bytes(), &results))
+			assert.Equal(map[uint32]map[string][]string{0: {"key_1": {"a"}, `key "2"`: {"b"}}, 8: {"key_1": {"d"}}}, results)
+			buffer.Reset()
+			assert.Nil(store.writeJson(&buffer, diffKindMismatch))
+			assert.Equal("{}", buffer.String())
+
+			// the keys added after a kind is read are deduplicated with the ones before them
+			assert.Nil(store.add(diffKindMismatchedFields, 8, "key_1", []string{"e"}))
+			assert.Nil(store.add(diffKindMismatchedFields, 8, "key_4", []string{"f"}))
+			count, err = store.count(diffKindMismatchedFields)
+			assert.Nil(err)
+			assert.Equal(4, count)
+			var fields [][]string
+			assert.Nil(store.forEach(diffKindMismatchedFields, func(colId uint32, key string, result []byte) error {
+				var resultFields []string
+				assert.Nil(json.Unmarshal(result, &resultFields))
+				fields = append(fields, resultFields)
+				return nil
+			}))
+			assert.ElementsMatch([][]string{{"a"}, {"b"}, {"d"}, {"f"}}, fields)
+
+			// the part files do not outlive the dedup
+			fileInfos, err := ioutil.ReadDir(store.dir)
+			assert.Nil(err)
+			var fileNames []string
+			for _, fileInfo := range fileInfos {
+				fileNames = append(fileNames, fileInfo.Name())
+			}
+			assert.ElementsMatch([]string{diffKindMismatchedFields, diffKindMismatchedFields + base.MutationDiffStoreDedupSuffix,
+				diffKindTargetMismatch, diffKindTargetMismatch + base.MutationDiffStoreDedupSuffix}, fileNames)
+			// with the deduplicated results of each collection in a file of its own
+			fileInfos, err = ioutil.ReadDir(store.dedupDirName(diffKindMismatchedFields))
+			assert.Nil(err)
+			fileNames = nil
+			for _, fileInfo := range fileInfos {
+				fileNames = append(fileNames, fileInfo.Name())
+			}
+			assert.ElementsMatch([]string{"0", "8"}, fileNames)
+
+			assert.Nil(store.reset())
+			totalCount, err = store.totalCount()
+			assert.Nil(err)
+			assert.Equal(0, totalCount)
+		})
+	}
+}
+
+func TestMutationDiffStoreConcurrentAdds(t *testing.T) {
+	fmt.Println("============== Test case start: TestMutationDiffStoreConcurrentAdds =================")
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "mutationDiffStoreTest")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	store := newMutationDiffStore(dir)
+	defer store.close()
+	// the workers add the same keys, and flush after each batch
+	waitGroup := &sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for j := 0; j < 100; j++ {
+				assert.Nil(store.add(diffKindMismatch, 0, fmt.Sprintf("key_%v", j), []string{"a"}))
+				if j%10 == 0 {
+					assert.Nil(store.flush())
+				}
+			}
+			assert.Nil(store.flush())
+		}()
+	}
+	waitGroup.Wait()
+
+	count, err := store.count(diffKindMismatch)
+	assert.Nil(err)
+	assert.Equal(100, count)
+	// the flushed sizes end with whole lines
+	data, err := ioutil.ReadFile(store.fileName(diffKindMismatch))
+	assert.Nil(err)
+	assert.Equal(int64(len(data)), store.fileSizes()[diffKindMismatch])
+	assert.Equal(400, bytes.Count(data, []byte("\n")))
+}
@@ -10,12 +10,14 @@
 package differ
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"math"
 	"os"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -56,16 +58,43 @@ type MutationDiffer struct {
 	sourceBucketAgent *GocbcoreAgent
 	targetBucketAgent *GocbcoreAgent
 
-	missingFromSource map[uint32]map[string]*GetResult
-	missingFromTarget map[uint32]map[string]*GetResult
-	srcDiff           map[uint32]map[string][]*GetResult
-	tgtDiff           map[uint32]map[string][]*GetResult
-	deletedFromSource map[uint32]map[string][]*GetResult
-	deletedFromTarget map[uint32]map[string][]*GetResult
+	// the differences found by the last fetch, which are kept on disk rather than in memory
+	diffStore             *mutationDiffStore
+	compareXattrs         bool
+	xattrKeysForNoCompare map[string]bool
+	// whether to canonicalize JSON bodies before comparing them
+	semanticJsonCompare bool
+	// JSON paths that are removed from bodies before comparing them, by the collections of each cluster
+	srcIgnoredJsonPaths *utils.IgnoredJsonPaths
+	tgtIgnoredJsonPaths *utils.IgnoredJsonPaths
+	// limits on the ops sent to each cluster, which are nil when they are not limited
+	srcRateLimiter *utils.RateLimiter
+	tgtRateLimiter *utils.RateLimiter
+	// differences that are expected given the settings of the replication, which are reported apart from the others.
+	// Unlike diffStore, it is not cleared by retries
+	explainedStore *mutationDiffStore
+	explainer      *DiffExplainer
 
 	keysWithError []*MutationDifferFetchEntry
 	stateLock     *sync.RWMutex
 
+	// the round of retries being run, its fetch list and the ranges of it that are done, which are checkpointed
+	checkpointParams *mutationDiffCheckpointParams
+	checkpointLock   *sync.Mutex
+	round            int
+	fetchList        MutationDiffFetchList
+	doneRanges       []fetchRange
+	// what each round observed of the keys that were retried, which is kept on disk and not cleared by retries,
+	// and the number of differences left after each round
+	historyStore    *mutationDiffStore
+	roundDiffCounts []int
+
+	// what the last fetch left, which is taken from the diff store at the end of Run before it is removed
+	srcDiffKeys DiffKeysMap
+	tgtDiffKeys DiffKeysMap
+	diffCounts  map[string]int
+	histogram   MismatchHistogram
+
 	numKeysProcessed  uint32
 	numKeysWithErrors uint32
 
@@ -101,6 +130,9 @@ func (r *GetResult) MarshalJSON() ([]byte, error) {
 	// GetMetaResult nil implies that the compareType is "body only"
 	if r.GetMetaResult == nil {
 		dataToBeEncoded[base.JsonBody] = r.value
+		if r.xattrs != nil {
+			dataToBeEncoded[base.JsonXattrs] = xattrsToJson(r.xattrs)
+		}
 		return json.Marshal(dataToBeEncoded)
 	}
 
@@ -110,6 +142,9 @@ func (r *GetResult) MarshalJSON() ([]byte, error) {
 	}
 
 	dataToBeEncoded[base.JsonMetadata] = r.GetMetaResult
+	if r.xattrs != nil {
+		dataToBeEncoded[base.JsonXattrs] = xattrsToJson(r.xattrs)
+	}
 	if r.HLV != nil {
 		dataToBeEncoded[xdcrCrMeta.XATTR_CVCAS_PATH] = r.GetCvCas()
 		dataToBeEncoded[xdcrCrMeta.XATTR_SRC_PATH] = r.GetCvSrc()
@@ -121,7 +156,16 @@ func (r *GetResult) MarshalJSON() ([]byte, error) {
 	return json.Marshal(dataToBeEncoded)
 }
 
-func NewMutationDiffer(sourceClusterUUID, sourceBucketName, sourceBucketUUID string, sourceRef *metadata.RemoteClusterReference, targetClusterUUID, targetBucketName, targetBucketUUID string, targetRef *metadata.RemoteClusterReference, fileDifferDir string, mutationDifferFileDir string, numberOfWorkers int, batchSize int, timeout int, maxNumOfSendBatchRetry int, sendBatchRetryInterval time.Duration, sendBatchMaxBackoff time.Duration, compareType string, logger *xdcrLog.CommonLogger, colIdsMap map[uint32][]uint32, srcCapability metadata.Capability, tgtCapability metadata.Capability, xdcrUtils xdcrUtils.UtilsIface, retries int, retriesWaitSecs int, duplMapping DuplicatedHintMap) *MutationDiffer {
+// xattrs are JSON values, which are output as they are rather than as bytes
+func xattrsToJson(xattrs map[string][]byte) map[string]json.RawMessage {
+	jsonXattrs := make(map[string]json.RawMessage, len(xattrs))
+	for key, value := range xattrs {
+		jsonXattrs[key] = value
+	}
+	return jsonXattrs
+}
+
+func NewMutationDiffer(sourceClusterUUID, sourceBucketName, sourceBucketUUID string, sourceRef *metadata.RemoteClusterReference, targetClusterUUID, targetBucketName, targetBucketUUID string, targetRef *metadata.RemoteClusterReference, fileDifferDir string, mutationDifferFileDir string, numberOfWorkers int, batchSize int, timeout int, maxNumOfSendBatchRetry int, sendBatchRetryInterval time.Duration, sendBatchMaxBackoff time.Duration, compareType string, logger *xdcrLog.CommonLogger, colIdsMap map[uint32][]uint32, srcCapability metadata.Capability, tgtCapability metadata.Capability, xdcrUtils xdcrUtils.UtilsIface, retries int, retriesWaitSecs int, duplMapping DuplicatedHintMap, explainer *DiffExplainer, compareXattrs bool, xattrKeysForNoCompare map[string]bool, semanticJsonCompare bool, srcIgnoredJsonPaths, tgtIgnoredJsonPaths *utils.IgnoredJsonPaths, srcOpsPerSec, tgtOpsPerSec uint64, adaptiveRateLimit bool) *MutationDiffer {
 	// this indicates that mutation differ is expected to read srcDiff fetchList generated by file differ,
 	inputDiffKeysFileName := fileDifferDir + base.FileDirDelimiter + base.DiffKeysFileName
 	if len(colIdsMap) == 0 {
@@ -143,14 +187,20 @@ func NewMutationDiffer(sourceClusterUUID, sourceBucketName, sourceBucketUUID str
 		numberOfWorkers:        numberOfWorkers,
 		batchSize:              batchSize,
 		timeout:                timeout,
-		missingFromSource:      make(map[uint32]map[string]*GetResult),
-		missingFromTarget:      make(map[uint32]map[string]*GetResult),
-		srcDiff:                make(map[uint32]map[string][]*GetResult),
-		tgtDiff:                make(map[uint32]map[string][]*GetResult),
-		deletedFromSource:      make(map[uint32]map[string][]*GetResult),
-		deletedFromTarget:      make(map[uint32]map[string][]*GetResult),
+		diffStore:              newMutationDiffStore(mutationDifferFileDir + base.FileDirDelimiter + base.MutationDiffStoreDir),
+		compareXattrs:          compareXattrs,
+		xattrKeysForNoCompare:  xattrKeysForNoCompare,
+		semanticJsonCompare:    semanticJsonCompare,
+		srcIgnoredJsonPaths:    srcIgnoredJsonPaths,
+		tgtIgnoredJsonPaths:    tgtIgnoredJsonPaths,
+		srcRateLimiter:         utils.NewRateLimiter(srcOpsPerSec, adaptiveRateLimit),
+		tgtRateLimiter:         utils.NewRateLimiter(tgtOpsPerSec, adaptiveRateLimit),
+		historyStore:           newMutationDiffStore(mutationDifferFileDir + base.FileDirDelimiter + base.MutationDiffHistoryStoreDir),
+		explainedStore:         newMutationDiffStore(mutationDifferFileDir + base.FileDirDelimiter + base.MutationDiffExplainedStoreDir),
+		explainer:              explainer,
 		keysWithError:          MutationDiffFetchList{},
 		stateLock:              &sync.RWMutex{},
+		checkpointLock:         &sync.Mutex{},
 		maxNumOfSendBatchRetry: maxNumOfSendBatchRetry,
 		sendBatchRetryInterval: sendBatchRetryInterval,
 		sendBatchMaxBackoff:    sendBatchMaxBackoff,
@@ -176,12 +226,6 @@ func (d *MutationDiffer) Run() error {
 	}
 	d.migrationHintMap = migrationHintMap
 
-	srcPovFetchList, srcPovFetchIdx := srcDiffKeys.ToFetchEntries(d.colIdsMap, migrationHintMap)
-	tgtPovFetchList, tgtPovFetchIdx := tgtDiffKeys.ToFetchEntries(d.reverseTgtColIdsMap, nil)
-	combinedFetchList := dedupFetchLists(srcPovFetchList, srcPovFetchIdx, tgtPovFetchList, tgtPovFetchIdx)
-
-	d.logger.Infof("Mutation srcDiff to work on %v srcPovFetchList with diffs.\n", len(combinedFetchList))
-
 	err = d.initialize()
 	if err != nil {
 		d.logger.Errorf("Error initializing: %v\n", err)
@@ -190,34 +234,396 @@ func (d *MutationDiffer) Run() error {
 
 	d.logger.Infof("Mutation differ initialized\n")
 
-	d.fetchAndDiff(combinedFetchList)
+	d.checkpointParams = &mutationDiffCheckpointParams{
+		DiffKeysFingerprint:  fingerprintDiffKeys(srcDiffKeys, tgtDiffKeys, migrationHintMap),
+		CompareType:          d.compareType,
+		CollectionMapping:    d.colIdsMap,
+		CompareXattrs:        d.compareXattrs,
+		SemanticJsonCompare:  d.semanticJsonCompare,
+		IgnoredJsonPathRules: d.srcIgnoredJsonPaths.Rules(),
+	}
+	resumed, err := d.resumeFromCheckpoint()
+	if err != nil {
+		return err
+	}
+	if !resumed {
+		srcPovFetchList, srcPovFetchIdx := srcDiffKeys.ToFetchEntries(d.colIdsMap, migrationHintMap)
+		tgtPovFetchList, tgtPovFetchIdx := tgtDiffKeys.ToFetchEntries(d.reverseTgtColIdsMap, nil)
+		combinedFetchList := dedupFetchLists(srcPovFetchList, srcPovFetchIdx, tgtPovFetchList, tgtPovFetchIdx)
+
+		d.logger.Infof("Mutation srcDiff to work on %v srcPovFetchList with diffs.\n", len(combinedFetchList))
+
+		err = d.explainedStore.reset()
+		if err == nil {
+			err = d.historyStore.reset()
+		}
+		if err != nil {
+			return err
+		}
+		err = d.startRound(0, combinedFetchList)
+		if err != nil {
+			return err
+		}
+	}
+
+	d.fetchAndDiff()
 
-	// Retry multiple times if asked to, in order to minimize in flight differences
-	for i := 0; d.containsDiff() && i < d.conflictRetries; i++ {
+	// Retry multiple times if asked to, in order to minimize in flight differences. The waits between retries back
+	// off exponentially, and the retries stop early once one of them no longer resolves any of the differences
+	for i := d.round; i < d.conflictRetries; i++ {
+		containsDiff, err := d.containsDiff()
+		if err != nil {
+			return err
+		}
+		if !containsDiff {
+			break
+		}
 		if i > 0 {
-			d.logger.Infof("Waiting %v seconds before retrying...", d.retriesWaitSec)
-			time.Sleep(time.Duration(d.retriesWaitSec) * time.Second)
-		}
-		srcDiffKeys = d.getDiffKeysFromSourceGocbResult()
-		tgtDiffKeys = d.getDiffKeysFromTargetGocbResult()
-		srcPovFetchList, srcPovFetchIdx = srcDiffKeys.ToFetchEntries(d.colIdsMap, migrationHintMap)
-		tgtPovFetchList, tgtPovFetchIdx = tgtDiffKeys.ToFetchEntries(d.reverseTgtColIdsMap, nil)
-		combinedFetchList = dedupFetchLists(srcPovFetchList, srcPovFetchIdx, tgtPovFetchList, tgtPovFetchIdx)
+			if !d.diffsShrunk(i) {
+				d.logger.Infof("Stopping retries after %v out of %v times since the last retry left %v diffs unresolved\n",
+					i, d.conflictRetries, d.roundDiffCounts[i])
+				break
+			}
+			waitSecs := d.retryWaitSecs(i)
+			d.logger.Infof("Waiting %v seconds before retrying...", waitSecs)
+			time.Sleep(time.Duration(waitSecs) * time.Second)
+		}
+		srcDiffKeys, err = d.getDiffKeysFromSourceGocbResult()
+		if err != nil {
+			return err
+		}
+		tgtDiffKeys, err = d.getDiffKeysFromTargetGocbResult()
+		if err != nil {
+			return err
+		}
+		srcPovFetchList, srcPovFetchIdx := srcDiffKeys.ToFetchEntries(d.colIdsMap, migrationHintMap)
+		tgtPovFetchList, tgtPovFetchIdx := tgtDiffKeys.ToFetchEntries(d.reverseTgtColIdsMap, nil)
+		combinedFetchList := dedupFetchLists(srcPovFetchList, srcPovFetchIdx, tgtPovFetchList, tgtPovFetchIdx)
 		d.logger.Infof("With %v diffs, retrying %v out of %v times to resolve in-flight differences...",
 			len(combinedFetchList), i+1, d.conflictRetries)
-		d.fetchAndDiff(combinedFetchList)
+		err = d.startRound(i+1, combinedFetchList)
+		if err != nil {
+			return err
+		}
+		d.fetchAndDiff()
 	}
 
-	return d.writeDiff()
+	err = d.summarize()
+	if err != nil {
+		return err
+	}
+	err = d.writeDiff()
+	if err != nil {
+		return err
+	}
+	d.removeCheckpoint()
+	return nil
 }
 
-func (d *MutationDiffer) fetchAndDiff(combinedFetchList MutationDiffFetchList) {
-	// First clear the results that the differWorker will be working on
+// takes what the last fetch left from the diff store, which is reported once the store is removed
+func (d *MutationDiffer) summarize() error {
+	srcDiffKeys, err := d.getDiffKeysFromSourceGocbResult()
+	if err != nil {
+		return err
+	}
+	tgtDiffKeys, err := d.getDiffKeysFromTargetGocbResult()
+	if err != nil {
+		return err
+	}
+	diffCounts, err := d.countDiffs()
+	if err != nil {
+		return err
+	}
+	if d.conflictRetries > 0 {
+		classificationCounts, err := d.classifyRetryHistories()
+		if err != nil {
+			return err
+		}
+		for _, classification := range []string{base.RetryClassificationConverged, base.RetryClassificationActivelyChanging, base.RetryClassificationDiverged} {
+			diffCounts[classification] = classificationCounts[classification]
+		}
+	}
+	histogram, err := d.mismatchHistogram()
+	if err != nil {
+		return err
+	}
+
+	d.stateLock.Lock()
+	defer d.stateLock.Unlock()
+	d.srcDiffKeys, d.tgtDiffKeys, d.diffCounts, d.histogram = srcDiffKeys, tgtDiffKeys, diffCounts, histogram
+	return nil
+}
+
+// whether round has left fewer differences than the round before
+func (d *MutationDiffer) diffsShrunk(round int) bool {
+	d.stateLock.RLock()
+	defer d.stateLock.RUnlock()
+	if round >= len(d.roundDiffCounts) {
+		return true
+	}
+	return d.roundDiffCounts[round] < d.roundDiffCounts[round-1]
+}
+
+// the wait before the retry after round, which grows by base.MutationRetriesBackoffFactor with each retry up to
+// base.MutationRetriesMaxWaitSecs, unless the wait asked for is longer than that to begin with
+func (d *MutationDiffer) retryWaitSecs(round int) int {
+	waitSecs := d.retriesWaitSec
+	for i := 1; i < round && waitSecs < base.MutationRetriesMaxWaitSecs; i++ {
+		waitSecs *= base.MutationRetriesBackoffFactor
+	}
+	if waitSecs > base.MutationRetriesMaxWaitSecs && d.retriesWaitSec <= base.MutationRetriesMaxWaitSecs {
+		waitSecs = base.MutationRetriesMaxWaitSecs
+	}
+	return waitSecs
+}
+
+// the number of differences of the round, from the point of view of the source and of the target alike
+func (d *MutationDiffer) diffCount() (int, error) {
+	var count int
+	for _, kind := range []string{diffKindMissingFromSource, diffKindMissingFromTarget, diffKindMismatch,
+		diffKindDeletedFromSource, diffKindDeletedFromTarget} {
+		kindCount, err := d.diffStore.count(kind)
+		if err != nil {
+			return 0, err
+		}
+		count += kindCount
+	}
+	return count, nil
+}
+
+// Loads the checkpoint of a previous run of the same diff keys, if there is one, along with the results that it
+// had stored by then. Returns false when every key needs to be fetched
+func (d *MutationDiffer) resumeFromCheckpoint() (bool, error) {
+	checkpoint, fetchList, err := loadMutationDiffCheckpoint(d.mutationDifferFileDir, d.checkpointParams)
+	if err != nil {
+		return false, err
+	}
+	if checkpoint == nil {
+		d.logger.Infof("There is no checkpoint of the mutation differ for the same diff keys to resume from. All keys are fetched\n")
+		return false, nil
+	}
+	err = d.diffStore.load(checkpoint.DiffStoreSizes)
+	if err == nil {
+		err = d.explainedStore.load(checkpoint.ExplainedStoreSizes)
+	}
+	if err == nil {
+		err = d.historyStore.load(checkpoint.HistoryStoreSizes)
+	}
+	if err != nil {
+		d.logger.Warnf("Error loading the results of the mutation differ checkpoint. All keys are fetched. err=%v\n", err)
+		return false, nil
+	}
+
+	d.stateLock.Lock()
+	defer d.stateLock.Unlock()
+	d.round = checkpoint.Round
+	d.fetchList = fetchList
+	d.doneRanges = checkpoint.DoneRanges
+	d.keysWithError = checkpoint.KeysWithError
+	d.roundDiffCounts = checkpoint.RoundDiffCounts
+	atomic.StoreUint32(&d.numKeysWithErrors, uint32(len(d.keysWithError)))
+
+	var numKeysDone int
+	for _, doneRange := range d.doneRanges {
+		numKeysDone += doneRange.End - doneRange.Start
+	}
+	d.logger.Infof("Resuming the mutation differ from its checkpoint at round %v, with %v of %v keys of the round done\n",
+		d.round, numKeysDone, len(d.fetchList))
+	return true, nil
+}
+
+// clears the results of the previous round, and checkpoints the fetch list of the round before it is fetched
+func (d *MutationDiffer) startRound(round int, fetchList MutationDiffFetchList) error {
 	d.clearGoCbResults()
+
+	d.stateLock.Lock()
+	d.round = round
+	d.fetchList = fetchList
+	d.doneRanges = nil
+	d.stateLock.Unlock()
+
+	err := saveMutationDiffFetchList(d.mutationDifferFileDir, fetchList)
+	if err != nil {
+		return fmt.Errorf("Error saving mutation diff fetch list. err=%v", err)
+	}
+	return d.saveCheckpoint()
+}
+
+// The sizes of the stores are taken after the done ranges, since the results of a range are flushed before it is
+// done. A range whose results are flushed but is not done yet is fetched again on resume, and its results are
+// deduplicated with the ones already in the stores
+func (d *MutationDiffer) saveCheckpoint() error {
+	d.checkpointLock.Lock()
+	defer d.checkpointLock.Unlock()
+
+	d.stateLock.Lock()
+	d.doneRanges = mergeFetchRanges(d.doneRanges)
+	checkpoint := &mutationDiffCheckpoint{
+		Version:         base.MutationDiffCheckpointVersion,
+		Params:          d.checkpointParams,
+		Round:           d.round,
+		FetchListLen:    len(d.fetchList),
+		DoneRanges:      append([]fetchRange{}, d.doneRanges...),
+		KeysWithError:   append(MutationDiffFetchList{}, d.keysWithError...),
+		RoundDiffCounts: append([]int{}, d.roundDiffCounts...),
+	}
+	d.stateLock.Unlock()
+
+	checkpoint.DiffStoreSizes = d.diffStore.fileSizes()
+	checkpoint.ExplainedStoreSizes = d.explainedStore.fileSizes()
+	checkpoint.HistoryStoreSizes = d.historyStore.fileSizes()
+	return checkpoint.save(d.mutationDifferFileDir)
+}
+
+func (d *MutationDiffer) checkpointPeriodically(finCh chan bool) {
+	ticker := time.NewTicker(time.Duration(base.MutationDiffCheckpointInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := d.saveCheckpoint()
+			if err != nil {
+				d.logger.Warnf("Error saving mutation diff checkpoint. err=%v\n", err)
+			}
+		case <-finCh:
+			return
+		}
+	}
+}
+
+// the checkpoint and the stores are only removed once the diff has been written, so that a run that fails
+// before then can be resumed
+func (d *MutationDiffer) removeCheckpoint() {
+	err := removeMutationDiffCheckpoint(d.mutationDifferFileDir)
+	if err != nil {
+		d.logger.Warnf("Error removing mutation diff checkpoint. err=%v\n", err)
+	}
+	for _, store := range []*mutationDiffStore{d.diffStore, d.explainedStore, d.historyStore} {
+		err = store.remove()
+		if err != nil {
+			d.logger.Warnf("Error removing the mutation diff store %v. err=%v\n", store.dir, err)
+		}
+	}
+}
+
+// the keys that are still different after the last fetch, from the point of view of the source and of the target
+func (d *MutationDiffer) DiffKeys() (DiffKeysMap, DiffKeysMap) {
+	d.stateLock.RLock()
+	defer d.stateLock.RUnlock()
+	return d.srcDiffKeys, d.tgtDiffKeys
+}
+
+// the number of differences found by the last fetch, by the kind that the diff details report them as
+func (d *MutationDiffer) DiffCounts() map[string]int {
+	d.stateLock.RLock()
+	defer d.stateLock.RUnlock()
+	return d.diffCounts
+}
+
+func (d *MutationDiffer) countDiffs() (map[string]int, error) {
+	counts := make(map[string]int)
+	kinds := []string{diffKindMismatch, diffKindMissingFromSource, diffKindMissingFromTarget}
+	if d.compareType == base.MutationCompareTypeMetadata || d.compareType == base.MutationCompareTypeBodyAndMeta {
+		kinds = append(kinds, diffKindDeletedFromSource, diffKindDeletedFromTarget)
+	}
+	for _, kind := range kinds {
+		count, err := d.diffStore.count(kind)
+		if err != nil {
+			return nil, err
+		}
+		counts[kind] = count
+	}
+	explainedCount, err := d.explainedStore.totalCount()
+	if err != nil {
+		return nil, err
+	}
+	counts["Explained"] = explainedCount
+
+	d.stateLock.RLock()
+	defer d.stateLock.RUnlock()
+	counts["KeysWithError"] = len(d.keysWithError)
+	return counts, nil
+}
+
+// the number of docs found mismatched by each of the fields that differ between their source and target versions
+func (d *MutationDiffer) MismatchHistogram() MismatchHistogram {
+	d.stateLock.RLock()
+	defer d.stateLock.RUnlock()
+	histogram := make(MismatchHistogram)
+	histogram.Merge(d.histogram)
+	return histogram
+}
+
+// the histogram of the mismatched fields in the diff store
+func (d *MutationDiffer) mismatchHistogram() (MismatchHistogram, error) {
+	histogram := make(MismatchHistogram)
+	err := d.diffStore.forEach(diffKindMismatchedFields, func(colId uint32, key string, result []byte) error {
+		var fields []string
+		err := json.Unmarshal(result, &fields)
+		if err != nil {
+			return err
+		}
+		histogram.add(fields)
+		return nil
+	})
+	return histogram, err
+}
+
+// Classifies the history of each key that the history store has observations of, and adds it to the diff store
+// to be reported. Returns the number of keys of each classification
+func (d *MutationDiffer) classifyRetryHistories() (map[string]int, error) {
+	counts := make(map[string]int)
+	err := d.historyStore.forEachGroup(diffKindRetryObservation, func(colId uint32, key string, observations [][]byte) error {
+		history, err := newKeyRetryHistory(observations)
+		if err != nil {
+			return fmt.Errorf("error classifying the retry history of key %v. err=%v", key, err)
+		}
+		counts[history.Classification]++
+		return d.diffStore.add(diffKindRetryHistory, colId, key, history)
+	})
+	if err == nil {
+		err = d.diffStore.flush()
+	}
+	return counts, err
+}
+
+// closes the connections to the buckets, which are opened by Run
+func (d *MutationDiffer) Close() {
+	if d.sourceBucketAgent != nil {
+		err := d.sourceBucketAgent.Close()
+		if err != nil {
+			d.logger.Warnf("Error closing source bucket agent. err=%v\n", err)
+		}
+	}
+	if d.targetBucketAgent != nil {
+		err := d.targetBucketAgent.Close()
+		if err != nil {
+			d.logger.Warnf("Error closing target bucket agent. err=%v\n", err)
+		}
+	}
+	d.diffStore.close()
+	d.explainedStore.close()
+	d.historyStore.close()
+}
+
+// fetches and diffs the ranges of the fetch list of the round that are not done yet, checkpointing periodically
+func (d *MutationDiffer) fetchAndDiff() {
+	d.stateLock.RLock()
+	fetchList := d.fetchList
+	batches := pendingFetchBatches(len(fetchList), d.doneRanges, d.batchSize)
+	numKeysPending := 0
+	for _, b := range batches {
+		numKeysPending += b.End - b.Start
+	}
+	d.stateLock.RUnlock()
+
+	atomic.StoreUint32(&d.numKeysProcessed, uint32(len(fetchList)-numKeysPending))
 	finCh := make(chan bool)
 
-	go d.reportStatus(len(combinedFetchList), finCh)
-	loadDistribution := utils.BalanceLoad(d.numberOfWorkers, len(combinedFetchList))
+	go d.reportStatus(len(fetchList), finCh)
+	go d.checkpointPeriodically(finCh)
+	loadDistribution := utils.BalanceLoad(d.numberOfWorkers, len(batches))
 	waitGroup := &sync.WaitGroup{}
 	for i := 0; i < d.numberOfWorkers; i++ {
 		lowIndex := loadDistribution[i][0]
@@ -227,13 +633,26 @@ func (d *MutationDiffer) fetchAndDiff(combinedFetchList MutationDiffFetchList) {
 			continue
 		}
 		diffWorker := NewDifferWorker(d, d.sourceDcpAgent, d.targetDcpAgent, d.sourceBucketAgent, d.targetBucketAgent,
-			combinedFetchList[lowIndex:highIndex], waitGroup, d.colIdsMap, d.reverseTgtColIdsMap, d.migrationHintMap,
+			fetchList, batches[lowIndex:highIndex], waitGroup, d.colIdsMap, d.reverseTgtColIdsMap, d.migrationHintMap,
 			d.compareType, d.conflictRetries)
 		waitGroup.Add(1)
 		go diffWorker.run()
 	}
 	waitGroup.Wait()
 	close(finCh)
+
+	diffCount, err := d.diffCount()
+	if err != nil {
+		d.logger.Errorf("Error counting the diffs of the mutation diff store. err=%v\n", err)
+	}
+	d.stateLock.Lock()
+	d.roundDiffCounts = append(d.roundDiffCounts[:d.round], diffCount)
+	d.stateLock.Unlock()
+
+	err = d.saveCheckpoint()
+	if err != nil {
+		d.logger.Warnf("Error saving mutation diff checkpoint. err=%v\n", err)
+	}
 }
 
 func dedupFetchLists(srcPovList MutationDiffFetchList, srcIdx MutationDiffFetchListIdx, tgtPovList MutationDiffFetchList, tgtIdx MutationDiffFetchListIdx) MutationDiffFetchList {
@@ -346,6 +765,8 @@ func (d *MutationDiffer) reportStatus(totalKeys int, finCh chan bool) {
 			if numKeysWithErrors > 0 {
 				d.logger.Warnf("%v skipped %v fetchList because of errors\n", time.Now(), numKeysWithErrors)
 			}
+			d.reportSlowdown(base.SourceClusterName, d.srcRateLimiter)
+			d.reportSlowdown(base.TargetClusterName, d.tgtRateLimiter)
 			if numKeysProcessed == uint32(totalKeys) {
 				return
 			}
@@ -356,6 +777,18 @@ func (d *MutationDiffer) reportStatus(totalKeys int, finCh chan bool) {
 	}
 }
 
+// reports the rate that an adaptive limit has slowed the ops sent to a cluster down to
+func (d *MutationDiffer) reportSlowdown(clusterName string, rateLimiter *utils.RateLimiter) {
+	if rateLimiter == nil {
+		return
+	}
+	rate, opsPerSec := rateLimiter.Rate()
+	if rate < opsPerSec {
+		d.logger.Warnf("%v ops to %v cluster are slowed down to %.0f/sec out of %.0f/sec because of timeouts or temporary failures\n",
+			time.Now(), clusterName, rate, opsPerSec)
+	}
+}
+
 func (d *MutationDiffer) writeDiff() error {
 	err := d.writeKeysWithError()
 	if err != nil {
@@ -372,6 +805,11 @@ func (d *MutationDiffer) writeDiff() error {
 		d.logger.Errorf("Error writing srcDiff details. err=%v\n", err)
 	}
 
+	err = d.writeExplainedDiffs()
+	if err != nil {
+		d.logger.Errorf("Error writing explained diffs. err=%v\n", err)
+	}
+
 	err = d.writeMigrationDetails()
 	if err != nil {
 		d.logger.Errorf("Error writing migration details. err=%v\n", err)
@@ -379,12 +817,108 @@ func (d *MutationDiffer) writeDiff() error {
 	return err
 }
 
+// the diff details are streamed from the diff store one kind of difference at a time, in the same format as
+// marshalling all of them as a map would
 func (d *MutationDiffer) writeDiffDetails() error {
-	diffBytes, err := d.getDiffBytes()
+	kinds := []string{diffKindMismatch, diffKindMismatchHistogram, diffKindMismatchedFields, diffKindMissingFromSource, diffKindMissingFromTarget}
+	if d.compareXattrs {
+		kinds = append(kinds, diffKindMismatchedXattrs)
+	}
+	if d.compareType == base.MutationCompareTypeBodyOnly || d.compareType == base.MutationCompareTypeBodyAndMeta {
+		kinds = append(kinds, diffKindBodyDiffs)
+	}
+	if d.compareType == base.MutationCompareTypeMetadata || d.compareType == base.MutationCompareTypeBodyAndMeta {
+		kinds = append(kinds, diffKindDeletedFromSource, diffKindDeletedFromTarget)
+	}
+	if d.conflictRetries > 0 {
+		kinds = append(kinds, diffKindRetryHistory)
+	}
+	sort.Strings(kinds)
+
+	fullFileName := d.mutationDifferFileDir + base.FileDirDelimiter + base.MutationDiffFileName
+	diffFile, err := os.OpenFile(fullFileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, base.FileModeReadWrite)
+	if err != nil {
+		return err
+	}
+	defer diffFile.Close()
+
+	writer := bufio.NewWriterSize(diffFile, base.MutationDiffStoreBufferSize)
+	_, err = writer.WriteString("{")
+	if err != nil {
+		return err
+	}
+	for i, kind := range kinds {
+		if i > 0 {
+			_, err = writer.WriteString(",")
+			if err != nil {
+				return err
+			}
+		}
+		_, err = fmt.Fprintf(writer, "%q:", kind)
+		if err != nil {
+			return err
+		}
+		if kind == diffKindMismatchHistogram {
+			var kindBytes []byte
+			kindBytes, err = json.Marshal(d.MismatchHistogram())
+			if err != nil {
+				return err
+			}
+			_, err = writer.Write(kindBytes)
+		} else {
+			err = d.diffStore.writeJson(writer, kind)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err = writer.WriteString("}")
 	if err != nil {
 		return err
 	}
-	return d.writeDiffBytesToFile(diffBytes)
+	return writer.Flush()
+}
+
+// the explained diffs are streamed from their store in the same way as the diff details
+func (d *MutationDiffer) writeExplainedDiffs() error {
+	kinds, err := d.explainedStore.kinds()
+	if err != nil {
+		return err
+	}
+
+	fileName := d.mutationDifferFileDir + base.FileDirDelimiter + base.MutationDiffExplainedFileName
+	explainedFile, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, base.FileModeReadWrite)
+	if err != nil {
+		return err
+	}
+	defer explainedFile.Close()
+
+	writer := bufio.NewWriterSize(explainedFile, base.MutationDiffStoreBufferSize)
+	_, err = writer.WriteString("{")
+	if err != nil {
+		return err
+	}
+	for i, kind := range kinds {
+		if i > 0 {
+			_, err = writer.WriteString(",")
+			if err != nil {
+				return err
+			}
+		}
+		_, err = fmt.Fprintf(writer, "%q:", kind)
+		if err != nil {
+			return err
+		}
+		err = d.explainedStore.writeJson(writer, kind)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = writer.WriteString("}")
+	if err != nil {
+		return err
+	}
+	return writer.Flush()
 }
 
 func (d *MutationDiffer) writeCollectionMapping() error {
@@ -412,7 +946,7 @@ func (d *MutationDiffer) writeKeysWithError() error {
 	}
 
 	keysWithErrorFileName := d.mutationDifferFileDir + base.FileDirDelimiter + base.DiffErrorKeysFileName
-	keysWithErrorFile, err := os.OpenFile(keysWithErrorFileName, os.O_RDWR|os.O_CREATE, base.FileModeReadWrite)
+	keysWithErrorFile, err := os.OpenFile(keysWithErrorFileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, base.FileModeReadWrite)
 	if err != nil {
 		return err
 	}
@@ -423,35 +957,6 @@ func (d *MutationDiffer) writeKeysWithError() error {
 	return err
 }
 
-func (d *MutationDiffer) getDiffBytes() ([]byte, error) {
-	outputMap := map[string]interface{}{
-		"Mismatch":          d.srcDiff,
-		"MissingFromSource": d.missingFromSource,
-		"MissingFromTarget": d.missingFromTarget,
-	}
-	if d.compareType == base.MutationCompareTypeMetadata || d.compareType == base.MutationCompareTypeBodyAndMeta {
-		outputMap["DeletedFromSource"] = d.deletedFromSource
-		outputMap["DeletedFromTarget"] = d.deletedFromTarget
-	}
-	return json.Marshal(outputMap)
-}
-
-func (d *MutationDiffer) writeDiffBytesToFile(diffBytes []byte) error {
-	fileName := base.MutationDiffFileName
-	fullFileName := d.mutationDifferFileDir + base.FileDirDelimiter + fileName
-
-	diffFile, err := os.OpenFile(fullFileName, os.O_RDWR|os.O_CREATE, base.FileModeReadWrite)
-	if err != nil {
-		return err
-	}
-
-	defer diffFile.Close()
-
-	_, err = diffFile.Write(diffBytes)
-	return err
-
-}
-
 func (d *MutationDiffer) loadDiffKeys() (DiffKeysMap, DiffKeysMap, MigrationHintMap, error) {
 	srcDiffKeysBytes, err := ioutil.ReadFile(d.srcDiffKeysFileName)
 	if err != nil {
@@ -494,74 +999,118 @@ func (d *MutationDiffer) loadDiffKeys() (DiffKeysMap, DiffKeysMap, MigrationHint
 	return srcDiffKeys, tgtDiffKeys, migrationHintMap, nil
 }
 
-func (d *MutationDiffer) addDocDiff(missingFromSource, missingFromTarget map[uint32]map[string]*GetResult, srcDiff, tgtDiff, deletedFromSource, deletedFromTarget map[uint32]map[string][]*GetResult) {
-	d.stateLock.Lock()
-	defer d.stateLock.Unlock()
+// the differences found by a worker are appended to the diff store as soon as each of its batches is diffed, so
+// that only the differences of one batch per worker are held in memory at a time. The range of the batch is done
+// once its differences are stored. The stores have locks of their own, so that the workers append to them without
+// holding the state lock
+func (d *MutationDiffer) addDocDiff(missingFromSource, missingFromTarget map[uint32]map[string]*GetResult, srcDiff, tgtDiff, deletedFromSource, deletedFromTarget map[uint32]map[string][]*GetResult, mismatchedFields map[uint32]map[string][]string, mismatchedXattrs map[uint32]map[string]*XattrDiff, bodyDiffs map[uint32]map[string][]*BodyChange, explained ExplainedDiffs, keysWithError MutationDiffFetchList, doneRange fetchRange, histories retryHistories) {
+	for colId, historiesPerCol := range histories {
+		for key, rounds := range historiesPerCol {
+			for _, observation := range rounds {
+				err := d.historyStore.add(diffKindRetryObservation, colId, key, observation)
+				if err != nil {
+					d.logger.Errorf("Error adding the retry observation of key %v to the mutation diff store. err=%v\n", key, err)
+				}
+			}
+		}
+	}
+	for kind, explainedPerKind := range explained {
+		for colId, explainedPerCol := range explainedPerKind {
+			for key, explainedDiff := range explainedPerCol {
+				err := d.explainedStore.add(kind, colId, key, explainedDiff)
+				if err != nil {
+					d.logger.Errorf("Error adding explained %v of key %v to the mutation diff store. err=%v\n", kind, key, err)
+				}
+			}
+		}
+	}
 
-	for colId, missingFromSourcePerCol := range missingFromSource {
-		if _, exists := d.missingFromSource[colId]; !exists {
-			d.missingFromSource[colId] = make(map[string]*GetResult)
+	for colId, mismatchedFieldsPerCol := range mismatchedFields {
+		for key, fields := range mismatchedFieldsPerCol {
+			d.addToDiffStore(diffKindMismatchedFields, colId, key, fields)
+		}
+	}
+	for colId, mismatchedXattrsPerCol := range mismatchedXattrs {
+		for key, xattrDiff := range mismatchedXattrsPerCol {
+			d.addToDiffStore(diffKindMismatchedXattrs, colId, key, xattrDiff)
 		}
+	}
+	for colId, bodyDiffsPerCol := range bodyDiffs {
+		for key, changes := range bodyDiffsPerCol {
+			d.addToDiffStore(diffKindBodyDiffs, colId, key, changes)
+		}
+	}
+	for colId, missingFromSourcePerCol := range missingFromSource {
 		for key, result := range missingFromSourcePerCol {
-			d.missingFromSource[colId][key] = result
+			d.addToDiffStore(diffKindMissingFromSource, colId, key, result)
 		}
 	}
-
 	for colId, missingFromTargetPerCol := range missingFromTarget {
-		if _, exists := d.missingFromTarget[colId]; !exists {
-			d.missingFromTarget[colId] = make(map[string]*GetResult)
-		}
 		for key, result := range missingFromTargetPerCol {
-			d.missingFromTarget[colId][key] = result
+			d.addToDiffStore(diffKindMissingFromTarget, colId, key, result)
 		}
 	}
-
 	for colId, srcDiffPerCol := range srcDiff {
-		if _, exists := d.srcDiff[colId]; !exists {
-			d.srcDiff[colId] = make(map[string][]*GetResult)
-		}
 		for key, results := range srcDiffPerCol {
-			d.srcDiff[colId][key] = results
+			d.addToDiffStore(diffKindMismatch, colId, key, results)
 		}
 	}
-
+	// the mismatches from the point of view of the target are not reported, and so only their keys are kept
 	for colId, tgtDiffPerCol := range tgtDiff {
-		if _, exists := d.tgtDiff[colId]; !exists {
-			d.tgtDiff[colId] = make(map[string][]*GetResult)
-		}
-		for key, results := range tgtDiffPerCol {
-			d.tgtDiff[colId][key] = results
+		for key := range tgtDiffPerCol {
+			d.addToDiffStore(diffKindTargetMismatch, colId, key, nil)
 		}
 	}
-
 	for colId, deleteFromSourcePerCol := range deletedFromSource {
-		if _, exists := d.deletedFromSource[colId]; !exists {
-			d.deletedFromSource[colId] = make(map[string][]*GetResult)
-		}
 		for key, results := range deleteFromSourcePerCol {
-			d.deletedFromSource[colId][key] = results
+			d.addToDiffStore(diffKindDeletedFromSource, colId, key, results)
 		}
 	}
 	for colId, deleteFromTargetPerCol := range deletedFromTarget {
-		if _, exists := d.deletedFromTarget[colId]; !exists {
-			d.deletedFromTarget[colId] = make(map[string][]*GetResult)
-		}
 		for key, results := range deleteFromTargetPerCol {
-			d.deletedFromTarget[colId][key] = results
+			d.addToDiffStore(diffKindDeletedFromTarget, colId, key, results)
 		}
 	}
+
+	err := d.diffStore.flush()
+	if err == nil {
+		err = d.explainedStore.flush()
+	}
+	if err == nil {
+		err = d.historyStore.flush()
+	}
+
+	d.stateLock.Lock()
+	defer d.stateLock.Unlock()
+	d.keysWithError = append(d.keysWithError, keysWithError...)
+	atomic.AddUint32(&d.numKeysWithErrors, uint32(len(keysWithError)))
+	if err != nil {
+		d.logger.Errorf("Error flushing the mutation diff store. err=%v\n", err)
+		return
+	}
+	d.doneRanges = append(d.doneRanges, doneRange)
 }
 
-func (d *MutationDiffer) addKeysWithError(keysWithError MutationDiffFetchList) {
+func (d *MutationDiffer) addToDiffStore(kind string, colId uint32, key string, result interface{}) {
+	err := d.diffStore.add(kind, colId, key, result)
+	if err != nil {
+		d.logger.Errorf("Error adding %v of key %v to the mutation diff store. err=%v\n", kind, key, err)
+	}
+}
+
+func (d *MutationDiffer) addKeysWithError(keysWithError MutationDiffFetchList, doneRange fetchRange) {
 	d.stateLock.Lock()
 	defer d.stateLock.Unlock()
 	d.keysWithError = append(d.keysWithError, keysWithError...)
 	atomic.AddUint32(&d.numKeysWithErrors, uint32(len(keysWithError)))
+	d.doneRanges = append(d.doneRanges, doneRange)
 }
 
 type DifferWorker struct {
-	differ            *MutationDiffer
-	fetchList         MutationDiffFetchList
+	differ    *MutationDiffer
+	fetchList MutationDiffFetchList
+	// the ranges of fetchList that the worker fetches and diffs, one batch at a time
+	batches           []fetchRange
 	sourceBucketAgent *GocbcoreAgent
 	targetBucketAgent *GocbcoreAgent
 	sourceDcpAgent    *gocbcore.DCPAgent
@@ -579,13 +1128,14 @@ type DifferWorker struct {
 }
 
 func NewDifferWorker(differ *MutationDiffer, sourceDCPAgent, targetDCPAgent *gocbcore.DCPAgent, sourceBucketAgent,
-	targetBucketAgent *GocbcoreAgent, fetchList MutationDiffFetchList, waitGroup *sync.WaitGroup, colIds,
+	targetBucketAgent *GocbcoreAgent, fetchList MutationDiffFetchList, batches []fetchRange, waitGroup *sync.WaitGroup, colIds,
 	reverseColIds map[uint32][]uint32, migrationHintMap MigrationHintMap, compareType string, retries int) *DifferWorker {
 	return &DifferWorker{
 		differ:            differ,
 		sourceBucketAgent: sourceBucketAgent,
 		targetBucketAgent: targetBucketAgent,
 		fetchList:         fetchList,
+		batches:           batches,
 		waitGroup:         waitGroup,
 		sourceResults:     make(map[uint32]map[string]*GetResult),
 		targetResults:     make(map[uint32]map[string]*GetResult),
@@ -625,30 +1175,17 @@ func compileReverseMap(srcToTgts map[uint32][]uint32) map[uint32][]uint32 {
 
 func (dw *DifferWorker) run() {
 	defer dw.waitGroup.Done()
-	dw.getResults()
-	dw.diff()
-}
-
-func (dw *DifferWorker) getResults() {
-	index := 0
-	for {
-		if index >= len(dw.fetchList) {
-			break
+	for _, batchRange := range dw.batches {
+		dw.sourceResults = make(map[uint32]map[string]*GetResult)
+		dw.targetResults = make(map[uint32]map[string]*GetResult)
+		if dw.sendBatchWithRetry(batchRange.Start, batchRange.End) {
+			dw.diff(batchRange)
 		}
-
-		if index+dw.differ.batchSize < len(dw.fetchList) {
-			dw.sendBatchWithRetry(index, index+dw.differ.batchSize)
-			index += dw.differ.batchSize
-			continue
-		}
-
-		dw.sendBatchWithRetry(index, len(dw.fetchList))
-		break
 	}
-
 }
 
-func (dw *DifferWorker) sendBatchWithRetry(startIndex, endIndex int) {
+// returns false if the batch is skipped because of errors
+func (dw *DifferWorker) sendBatchWithRetry(startIndex, endIndex int) bool {
 	sendBatchFunc := func() error {
 		batch := NewBatch(dw, startIndex, endIndex)
 		err := batch.send()
@@ -659,14 +1196,17 @@ func (dw *DifferWorker) sendBatchWithRetry(startIndex, endIndex int) {
 		return nil
 	}
 
+	// fetchList with error are also counted toward keysProcessed
+	defer atomic.AddUint32(&dw.differ.numKeysProcessed, uint32(endIndex-startIndex))
+
 	opErr := utils.ExponentialBackoffExecutor("sendBatchWithRetry", dw.differ.sendBatchRetryInterval, dw.differ.maxNumOfSendBatchRetry,
 		base.SendBatchBackoffFactor, dw.differ.sendBatchMaxBackoff, sendBatchFunc)
 	if opErr != nil {
 		dw.logger.Warnf("Skipped check on %v fetchList because of err=%v.\n", endIndex-startIndex, opErr)
-		dw.differ.addKeysWithError(dw.fetchList[startIndex:endIndex])
+		dw.differ.addKeysWithError(dw.fetchList[startIndex:endIndex], fetchRange{Start: startIndex, End: endIndex})
+		return false
 	}
-	// fetchList with error are also counted toward keysProcessed
-	atomic.AddUint32(&dw.differ.numKeysProcessed, uint32(endIndex-startIndex))
+	return true
 }
 
 // merge results obtained by batch into dw
@@ -691,13 +1231,28 @@ func (dw *DifferWorker) mergeResults(b *batch) {
 	}
 }
 
-func (dw *DifferWorker) diff() {
+func (dw *DifferWorker) diff(batchRange fetchRange) {
 	missingFromSource := make(map[uint32]map[string]*GetResult)
 	missingFromTarget := make(map[uint32]map[string]*GetResult)
 	srcDiff := make(map[uint32]map[string][]*GetResult)
 	tgtDiff := make(map[uint32]map[string][]*GetResult)
 	deletedFromSource := make(map[uint32]map[string][]*GetResult)
 	deletedFromTarget := make(map[uint32]map[string][]*GetResult)
+	mismatchedFields := make(map[uint32]map[string][]string)
+	mismatchedXattrs := make(map[uint32]map[string]*XattrDiff)
+	bodyDiffs := make(map[uint32]map[string][]*BodyChange)
+	explained := make(ExplainedDiffs)
+	explainer := dw.differ.explainer
+	var keysWithError MutationDiffFetchList
+	// what each key looked like is only kept when the keys that differ are retried. Keys that are the same are
+	// only of interest in the retries, where they are the ones that converged
+	histories := make(retryHistories)
+	round := dw.differ.round
+	observe := func(colId uint32, key, outcome string, sourceResult, targetResult *GetResult) {
+		if dw.differ.conflictRetries > 0 && (round > 0 || isDiffOutcome(outcome)) {
+			histories.add(colId, key, newRetryObservation(round, outcome, sourceResult, targetResult))
+		}
+	}
 
 	migrationMode := len(dw.migrationHintMap) > 0
 
@@ -732,6 +1287,11 @@ func (dw *DifferWorker) diff() {
 			} else {
 				tgtColIds = dw.colIds[srcColId]
 			}
+			// a doc whose xattrs could not be fetched cannot be diffed, and is reported as a key with an error
+			if xattrsFetchFailed(sourceResult) || dw.targetXattrsFetchFailed(tgtColIds, key) {
+				keysWithError = append(keysWithError, &MutationDifferFetchEntry{SrcColId: srcColId, TgtColIds: tgtColIds, Key: key})
+				continue
+			}
 
 			for _, tgtColId := range tgtColIds {
 				var srcerr error
@@ -748,32 +1308,64 @@ func (dw *DifferWorker) diff() {
 					tgterr = targetResult.metaErr
 				}
 				if isKeyNotFoundError(srcerr) && !isKeyNotFoundError(tgterr) {
+					if explainedBy := explainer.explainTargetOnly(key, targetResult); len(explainedBy) > 0 {
+						explained.add("MissingFromSource", srcColId, key, explainedBy, targetResult)
+						observe(srcColId, key, base.RetryOutcomeExplained, sourceResult, targetResult)
+						continue
+					}
 					if _, exists := missingFromSource[srcColId]; !exists {
 						missingFromSource[srcColId] = make(map[string]*GetResult)
 					}
 					missingFromSource[srcColId][key] = targetResult
+					observe(srcColId, key, diffKindMissingFromSource, sourceResult, targetResult)
 					continue
 				}
 				if !isKeyNotFoundError(srcerr) && isKeyNotFoundError(tgterr) {
+					if explainedBy := explainer.explainMissingFromTarget(key, sourceResult); len(explainedBy) > 0 {
+						explained.add("MissingFromTarget", tgtColId, key, explainedBy, sourceResult)
+						observe(srcColId, key, base.RetryOutcomeExplained, sourceResult, targetResult)
+						continue
+					}
 					if _, exists := missingFromTarget[tgtColId]; !exists {
 						missingFromTarget[tgtColId] = make(map[string]*GetResult)
 					}
 					missingFromTarget[tgtColId][key] = sourceResult
+					observe(srcColId, key, diffKindMissingFromTarget, sourceResult, targetResult)
 					continue
 				}
+				xattrDiff := diffXattrDigests(sourceResult.xattrs, targetResult.xattrs)
 				if bodyOnly {
-					if !areGetResultsBodyTheSame(sourceResult, targetResult) {
+					bodySame := areGetResultsBodyTheSame(sourceResult, targetResult)
+					if !bodySame || xattrDiff != nil {
+						if explainedBy := explainer.explainMismatch(key, sourceResult, targetResult); len(explainedBy) > 0 {
+							explained.add("Mismatch", srcColId, key, explainedBy, sourceResult, targetResult)
+							observe(srcColId, key, base.RetryOutcomeExplained, sourceResult, targetResult)
+							continue
+						}
 						if _, exists := srcDiff[srcColId]; !exists {
 							srcDiff[srcColId] = make(map[string][]*GetResult)
 						}
 						srcDiff[srcColId][key] = append(srcDiff[srcColId][key], []*GetResult{sourceResult, targetResult}...)
+						observe(srcColId, key, diffKindMismatch, sourceResult, targetResult)
+						var fields []string
+						if !bodySame {
+							fields = append(fields, base.DiffFieldBody)
+							addBodyDiff(bodyDiffs, srcColId, key, sourceResult, targetResult)
+						}
+						if xattrDiff != nil {
+							fields = append(fields, base.DiffFieldXattrs)
+							addMismatchedXattrs(mismatchedXattrs, srcColId, key, xattrDiff)
+						}
+						addMismatchedFields(mismatchedFields, srcColId, key, fields)
 						if _, exists := tgtDiff[tgtColId]; !exists {
 							tgtDiff[tgtColId] = make(map[string][]*GetResult)
 						}
 						tgtDiff[tgtColId][key] = append(tgtDiff[tgtColId][key], []*GetResult{targetResult, sourceResult}...)
+					} else {
+						observe(srcColId, key, base.RetryOutcomeConverged, sourceResult, targetResult)
 					}
 				} else {
-					metaSame, err := areGetResultsTheSame(sourceResult, targetResult, srcUUID, tgtUUID, includeBody)
+					metaSame, fields, err := areGetResultsTheSame(sourceResult, targetResult, srcUUID, tgtUUID, includeBody, xattrDiff != nil)
 					if err != nil {
 						atomic.AddUint32(&dw.differ.numKeysWithErrors, 1)
 						dw.logger.Errorf(err.Error())
@@ -781,27 +1373,54 @@ func (dw *DifferWorker) diff() {
 					}
 					if !metaSame {
 						if isDeleted(sourceResult.GetMetaResult) {
+							if explainedBy := explainer.explainDeletedFromSource(key, targetResult); len(explainedBy) > 0 {
+								explained.add("DeletedFromSource", srcColId, key, explainedBy, sourceResult, targetResult)
+								observe(srcColId, key, base.RetryOutcomeExplained, sourceResult, targetResult)
+								continue
+							}
 							if _, exists := deletedFromSource[srcColId]; !exists {
 								deletedFromSource[srcColId] = make(map[string][]*GetResult)
 							}
 							deletedFromSource[srcColId][key] = append(deletedFromSource[srcColId][key], []*GetResult{sourceResult, targetResult}...)
+							observe(srcColId, key, diffKindDeletedFromSource, sourceResult, targetResult)
 							continue
 						}
 						if isDeleted(targetResult.GetMetaResult) {
+							if explainedBy := explainer.explainTargetOnly(key, targetResult); len(explainedBy) > 0 {
+								explained.add("DeletedFromTarget", srcColId, key, explainedBy, sourceResult, targetResult)
+								observe(srcColId, key, base.RetryOutcomeExplained, sourceResult, targetResult)
+								continue
+							}
 							if _, exists := deletedFromTarget[srcColId]; !exists {
 								deletedFromTarget[srcColId] = make(map[string][]*GetResult)
 							}
 							deletedFromTarget[srcColId][key] = append(deletedFromSource[srcColId][key], []*GetResult{sourceResult, targetResult}...)
+							observe(srcColId, key, diffKindDeletedFromTarget, sourceResult, targetResult)
+							continue
+						}
+						if explainedBy := explainer.explainMismatch(key, sourceResult, targetResult); len(explainedBy) > 0 {
+							explained.add("Mismatch", srcColId, key, explainedBy, sourceResult, targetResult)
+							observe(srcColId, key, base.RetryOutcomeExplained, sourceResult, targetResult)
 							continue
 						}
 						if _, exists := srcDiff[srcColId]; !exists {
 							srcDiff[srcColId] = make(map[string][]*GetResult)
 						}
 						srcDiff[srcColId][key] = append(srcDiff[srcColId][key], []*GetResult{sourceResult, targetResult}...)
+						observe(srcColId, key, diffKindMismatch, sourceResult, targetResult)
+						addMismatchedFields(mismatchedFields, srcColId, key, fields)
+						if xattrDiff != nil {
+							addMismatchedXattrs(mismatchedXattrs, srcColId, key, xattrDiff)
+						}
+						if includeBody && !areGetResultsBodyTheSame(sourceResult, targetResult) {
+							addBodyDiff(bodyDiffs, srcColId, key, sourceResult, targetResult)
+						}
 						if _, exists := tgtDiff[tgtColId]; !exists {
 							tgtDiff[tgtColId] = make(map[string][]*GetResult)
 						}
 						tgtDiff[tgtColId][key] = append(tgtDiff[tgtColId][key], []*GetResult{targetResult, sourceResult}...)
+					} else {
+						observe(srcColId, key, base.RetryOutcomeConverged, sourceResult, targetResult)
 					}
 				}
 			}
@@ -830,10 +1449,52 @@ func (dw *DifferWorker) diff() {
 					missingFromTarget[tgtColId] = make(map[string]*GetResult)
 				}
 				missingFromTarget[tgtColId][key] = targetResult
+				if len(srcColIds) > 0 {
+					observe(srcColIds[0], key, diffKindMissingFromTarget, nil, targetResult)
+				}
+			}
+		}
+	}
+	dw.differ.addDocDiff(missingFromSource, missingFromTarget, srcDiff, tgtDiff, deletedFromSource, deletedFromTarget, mismatchedFields, mismatchedXattrs, bodyDiffs, explained, keysWithError, batchRange, histories)
+}
+
+// the values that differ between the bodies of the results, when both are JSON
+func addBodyDiff(bodyDiffs map[uint32]map[string][]*BodyChange, srcColId uint32, key string, sourceResult, targetResult *GetResult) {
+	changes := diffJsonBodies(sourceResult.comparableValue(), targetResult.comparableValue())
+	if len(changes) == 0 {
+		return
+	}
+	if _, exists := bodyDiffs[srcColId]; !exists {
+		bodyDiffs[srcColId] = make(map[string][]*BodyChange)
+	}
+	bodyDiffs[srcColId][key] = changes
+}
+
+// a doc that is mismatched in more than one target collection keeps the xattrs that differ in the last one
+func addMismatchedXattrs(mismatchedXattrs map[uint32]map[string]*XattrDiff, srcColId uint32, key string, xattrDiff *XattrDiff) {
+	if _, exists := mismatchedXattrs[srcColId]; !exists {
+		mismatchedXattrs[srcColId] = make(map[string]*XattrDiff)
+	}
+	mismatchedXattrs[srcColId][key] = xattrDiff
+}
+
+// a doc that is mismatched in more than one target collection has the fields of each added together
+func addMismatchedFields(mismatchedFields map[uint32]map[string][]string, srcColId uint32, key string, fields []string) {
+	if _, exists := mismatchedFields[srcColId]; !exists {
+		mismatchedFields[srcColId] = make(map[string][]string)
+	}
+	for _, field := range fields {
+		var found bool
+		for _, existingField := range mismatchedFields[srcColId][key] {
+			if existingField == field {
+				found = true
+				break
 			}
 		}
+		if !found {
+			mismatchedFields[srcColId][key] = append(mismatchedFields[srcColId][key], field)
+		}
 	}
-	dw.differ.addDocDiff(missingFromSource, missingFromTarget, srcDiff, tgtDiff, deletedFromSource, deletedFromTarget)
 }
 
 type batch struct {
@@ -917,6 +1578,8 @@ func (b *batch) get(key string, isSource bool, compareType string, colId uint32)
 			getResult.bodyErr = err
 		} else {
 			getResult.value = result.Value
+			getResult.cas = uint64(result.Cas)
+			getResult.comparedValue = b.dw.differ.comparableBody(result, isSource, colId)
 		}
 		b.waitGroup.Done()
 	}
@@ -964,6 +1627,40 @@ func (b *batch) get(key string, isSource bool, compareType string, colId uint32)
 		b.waitGroup.Done()
 	}
 
+	getXattrsCallbackFunc := func(xattrs map[string][]byte, err error) {
+		b.resultsLock.RLock()
+		var resultsMap map[string]*GetResult
+		if isSource {
+			resultsMap = b.sourceResults[colId]
+		} else {
+			resultsMap = b.targetResults[colId]
+		}
+		getResult := resultsMap[key]
+		b.resultsLock.RUnlock()
+
+		getResult.lock.Lock()
+		defer getResult.lock.Unlock()
+		if err != nil {
+			getResult.xattrsErr = err
+			if !isKeyNotFoundError(err) {
+				b.dw.logger.Debugf("Getting xattrs errored for doc %v. err:%v\n", key, err)
+			}
+		} else {
+			if b.dw.differ.explainer.needsDocXattrs() {
+				getResult.docXattrs = xattrs
+			}
+			if b.dw.differ.compareXattrs {
+				getResult.xattrs = make(map[string][]byte, len(xattrs))
+				for xattrKey, value := range xattrs {
+					if !b.dw.differ.xattrKeysForNoCompare[xattrKey] {
+						getResult.xattrs[xattrKey] = value
+					}
+				}
+			}
+		}
+		b.waitGroup.Done()
+	}
+
 	var err error
 	var err1 error
 	var err2 error
@@ -973,13 +1670,15 @@ func (b *batch) get(key string, isSource bool, compareType string, colId uint32)
 	} else {
 		gocbAgent = b.dw.targetBucketAgent
 	}
-	if compareType == base.MutationCompareTypeBodyOnly {
+	if compareType == base.MutationCompareTypeBodyOnly || (compareType == base.MutationCompareTypeMetadata && isSource && b.dw.differ.explainer.needsSourceBody()) {
+		// the filter is evaluated against the body of the source doc
 		b.waitGroup.Add(1)
 		err = gocbAgent.Get(key, getCallbackFunc, colId)
 		if err != nil {
 			b.dw.logger.Errorf("GetError for bucket %v on key %v. err: %v\n", gocbAgent.GocbcoreAgentCommon.BucketName, key, err)
 		}
-	} else if compareType == base.MutationCompareTypeMetadata {
+	}
+	if compareType == base.MutationCompareTypeMetadata {
 		b.waitGroup.Add(2)
 		err = gocbAgent.GetMeta(key, getMetaCallbackFunc, colId)
 		if err != nil {
@@ -1004,6 +1703,27 @@ func (b *batch) get(key string, isSource bool, compareType string, colId uint32)
 			b.dw.logger.Errorf("GetHlvError for bucket %v on key %v. err: %v\n", gocbAgent.GocbcoreAgentCommon.BucketName, key, err2)
 		}
 	}
+	if b.dw.differ.compareXattrs || b.dw.differ.explainer.needsDocXattrs() {
+		b.waitGroup.Add(1)
+		err = gocbAgent.GetXattrs(key, getXattrsCallbackFunc, colId)
+		if err != nil {
+			b.dw.logger.Errorf("GetXattrsError for bucket %v on key %v. err: %v\n", gocbAgent.GocbcoreAgentCommon.BucketName, key, err)
+		}
+	}
+}
+
+// a doc that is missing has no xattrs to fetch
+func xattrsFetchFailed(result *GetResult) bool {
+	return result.xattrsErr != nil && !isKeyNotFoundError(result.xattrsErr)
+}
+
+func (dw *DifferWorker) targetXattrsFetchFailed(tgtColIds []uint32, key string) bool {
+	for _, tgtColId := range tgtColIds {
+		if targetResult := dw.targetResults[tgtColId][key]; targetResult != nil && xattrsFetchFailed(targetResult) {
+			return true
+		}
+	}
+	return false
 }
 
 func isKeyNotFoundError(err error) bool {
@@ -1011,15 +1731,17 @@ func isKeyNotFoundError(err error) bool {
 }
 
 func areGetResultsBodyTheSame(result1, result2 *GetResult) bool {
+	value1 := result1.comparableValue()
+	value2 := result2.comparableValue()
 
-	if result1.value == nil {
-		return result2.value == nil
+	if value1 == nil {
+		return value2 == nil
 	}
-	if result2.value == nil {
+	if value2 == nil {
 		return false
 	}
 
-	return reflect.DeepEqual(result1.value, result2.value)
+	return reflect.DeepEqual(value1, value2)
 }
 
 // This function is used to docMeta for metadata comparison
@@ -1030,31 +1752,33 @@ func NewDocMeta(result *GetResult) *xdcrBase.DocumentMetadata {
 
 }
 
-func areGetResultsTheSame(result1, result2 *GetResult, sourceUUID, targetUUID hlv.DocumentSourceId, includeBody bool) (bool, error) {
+// Besides whether the results are the same, returns the fields that differ between them when both are docs that
+// have not been deleted. xattrsDiffer tells whether their xattrs have been found different by key
+func areGetResultsTheSame(result1, result2 *GetResult, sourceUUID, targetUUID hlv.DocumentSourceId, includeBody bool, xattrsDiffer bool) (bool, []string, error) {
 	if result1.GetMetaResult == nil && result2.GetMetaResult == nil {
-		return true, nil
+		return true, nil, nil
 	} else if result1.GetMetaResult == nil {
 		if isDeleted(result2.GetMetaResult) {
-			return true, nil
+			return true, nil, nil
 		} else {
-			return false, nil
+			return false, nil, nil
 		}
 	} else if result2.GetMetaResult == nil {
 		if isDeleted(result1.GetMetaResult) {
-			return true, nil
+			return true, nil, nil
 		} else {
-			return false, nil
+			return false, nil, nil
 		}
 	} else if isDeleted(result1.GetMetaResult) && isDeleted(result2.GetMetaResult) {
-		return true, nil
+		return true, nil, nil
 	} else if isDeleted(result1.GetMetaResult) && !isDeleted(result2.GetMetaResult) {
-		return false, nil
+		return false, nil, nil
 	} else if !isDeleted(result1.GetMetaResult) && isDeleted(result2.GetMetaResult) {
-		return false, nil
+		return false, nil, nil
 	} else {
 		// this parsingError is set if importCas and pRev is present, and there is an error while converting them to uint64
 		if result1.parsingErr != nil || result2.parsingErr != nil {
-			return false, fmt.Errorf("cannot compare metadata for document with key %v due to parsing error either at the source or at target. SourceErr: %v TargetError: %v", result1.key, result1.parsingErr, result2.parsingErr)
+			return false, nil, fmt.Errorf("cannot compare metadata for document with key %v due to parsing error either at the source or at target. SourceErr: %v TargetError: %v", result1.key, result1.parsingErr, result2.parsingErr)
 		}
 		sourceCrMeta := &xdcrCrMeta.CRMetadata{}
 		targetCrMeta := &xdcrCrMeta.CRMetadata{}
@@ -1064,7 +1788,7 @@ func areGetResultsTheSame(result1, result2 *GetResult, sourceUUID, targetUUID hl
 		if result1.hlvBytes != nil && len(result1.hlvBytes) != 0 {
 			err := UpdateCrMeta(sourceCrMeta, sourceUUID, result1.hlvBytes, result1.pRev)
 			if err != nil {
-				return false, fmt.Errorf("cannot compare metadata for document with key %v due to HLV parsing error either at source. SourceErr: %v ", result1.key, err)
+				return false, nil, fmt.Errorf("cannot compare metadata for document with key %v due to HLV parsing error either at source. SourceErr: %v ", result1.key, err)
 			}
 		}
 
@@ -1073,17 +1797,21 @@ func areGetResultsTheSame(result1, result2 *GetResult, sourceUUID, targetUUID hl
 		if result2.hlvBytes != nil && len(result2.hlvBytes) != 0 {
 			err := UpdateCrMeta(targetCrMeta, targetUUID, result2.hlvBytes, result2.pRev)
 			if err != nil {
-				return false, fmt.Errorf("cannot compare metadata for document with key %v due to HLV parsing error either at target. TargetErr: %v ", result2.key, err)
+				return false, nil, fmt.Errorf("cannot compare metadata for document with key %v due to HLV parsing error either at target. TargetErr: %v ", result2.key, err)
 			}
 		}
 
 		err := SetHlv(sourceCrMeta, targetCrMeta, sourceUUID, targetUUID)
 		result1.HLV = sourceCrMeta.GetHLV()
 		result2.HLV = targetCrMeta.GetHLV()
+		fields := diffMetaFields(sourceCrMeta.GetDocumentMetadata(), targetCrMeta.GetDocumentMetadata(), result1.HLV, result2.HLV, xattrsDiffer)
+		if includeBody && !areGetResultsBodyTheSame(result1, result2) {
+			fields = append([]string{base.DiffFieldBody}, fields...)
+		}
 		if err != nil {
 			// An err is populated only if implict construction of HLVs are not possible --> this implies that there is a diff
 			// return false and ignore the error.
-			return false, nil
+			return false, withHLVIfNoFields(fields), nil
 		}
 		metaSame, err1 := sourceCrMeta.Diff(targetCrMeta, xdcrBase.GetHLVPruneFunction(uint64(result1.Cas), sourcePruningWindow.get()), xdcrBase.GetHLVPruneFunction(uint64(result2.Cas), targetPruningWindow.get()))
 		if err1 != nil {
@@ -1096,9 +1824,12 @@ func areGetResultsTheSame(result1, result2 *GetResult, sourceUUID, targetUUID hl
 		}
 		if includeBody {
 			bodySame := areGetResultsBodyTheSame(result1, result2)
-			return (metaSame && bodySame), nil
+			metaSame = metaSame && bodySame
 		}
-		return metaSame, nil
+		if metaSame && !xattrsDiffer {
+			return true, nil, nil
+		}
+		return false, withHLVIfNoFields(fields), nil
 	}
 }
 
@@ -1154,9 +1885,43 @@ type GetResult struct {
 	*gocbcore.GetMetaResult
 	hlvBytes []byte
 	*hlv.HLV
+	// the xattrs that are compared, by key, which are only fetched when comparing xattrs
+	xattrs    map[string][]byte
+	xattrsErr error
+	// all the xattrs of the doc, which are only fetched when the explainer needs them
+	docXattrs map[string][]byte
+	// value as it is compared, when JSON bodies are compared semantically or have paths that are ignored
+	comparedValue []byte
+	// cas of the body, which identifies its version when metadata is not fetched
+	cas  uint64
 	lock sync.RWMutex
 }
 
+// the JSON body of a result without the JSON paths that are ignored, and canonicalized when JSON bodies are
+// compared semantically. Returns nil when the body is compared as it is, including when it turns out not to be JSON
+func (d *MutationDiffer) comparableBody(result *gocbcore.GetResult, isSource bool, colId uint32) []byte {
+	ignoredJsonPaths := d.tgtIgnoredJsonPaths.ForCollection(colId)
+	if isSource {
+		ignoredJsonPaths = d.srcIgnoredJsonPaths.ForCollection(colId)
+	}
+	if (!d.semanticJsonCompare && len(ignoredJsonPaths) == 0) || result.Datatype&base.JSONDataType == 0 {
+		return nil
+	}
+	comparableBody, err := utils.ComparableJsonBody(result.Value, ignoredJsonPaths, d.semanticJsonCompare)
+	if err != nil {
+		return nil
+	}
+	return comparableBody
+}
+
+// the body as it is compared
+func (r *GetResult) comparableValue() []byte {
+	if r.comparedValue != nil {
+		return r.comparedValue
+	}
+	return r.value
+}
+
 func (d *MutationDiffer) initialize() error {
 	var err error
 	err = d.openBucket(d.sourceBucketName, d.sourceReference, true)
@@ -1255,7 +2020,11 @@ func (d *MutationDiffer) openBucket(bucketName string, reference *metadata.Remot
 		connStr = fmt.Sprintf("%v%v", base.CouchbasePrefix, connStr)
 	}
 
-	agent, err := NewGocbcoreAgent(name, []string{connStr}, bucketName, auth, d.batchSize, capability, reference)
+	rateLimiter := d.tgtRateLimiter
+	if source {
+		rateLimiter = d.srcRateLimiter
+	}
+	agent, err := NewGocbcoreAgent(name, []string{connStr}, bucketName, auth, d.batchSize, capability, reference, rateLimiter)
 
 	if source {
 		d.sourceBucketAgent = agent
@@ -1318,99 +2087,42 @@ func (d *MutationDiffer) initializeKVVBMap(source bool) error {
 	return err
 }
 
-func resultMapContainsAtLeastOne(generic interface{}) bool {
-	switch generic.(type) {
-	case map[uint32]map[string]*GetResult:
-		uintMap := generic.(map[uint32]map[string]*GetResult)
-		for _, vMap := range uintMap {
-			if len(vMap) > 0 {
-				return true
-			}
+func (d *MutationDiffer) containsDiff() (bool, error) {
+	for _, kind := range []string{diffKindMissingFromSource, diffKindMissingFromTarget, diffKindMismatch,
+		diffKindTargetMismatch, diffKindDeletedFromSource, diffKindDeletedFromTarget} {
+		count, err := d.diffStore.count(kind)
+		if err != nil || count > 0 {
+			return count > 0, err
 		}
-	case map[uint32]map[string][]*GetResult:
-		uintMap := generic.(map[uint32]map[string][]*GetResult)
-		for _, vMap := range uintMap {
-			if len(vMap) > 0 {
-				return true
-			}
-		}
-	default:
-		panic(fmt.Sprintf("Invalid type %v", reflect.TypeOf(generic)))
 	}
-	return false
+	return false, nil
 }
 
-func (d *MutationDiffer) containsDiff() bool {
-	d.stateLock.RLock()
-	defer d.stateLock.RUnlock()
+func (d *MutationDiffer) getDiffKeysFromSourceGocbResult() (DiffKeysMap, error) {
+	return d.getDiffKeys(diffKindMissingFromSource, diffKindMismatch, diffKindDeletedFromSource)
+}
 
-	return resultMapContainsAtLeastOne(d.missingFromSource) || resultMapContainsAtLeastOne(d.missingFromTarget) ||
-		resultMapContainsAtLeastOne(d.srcDiff) || resultMapContainsAtLeastOne(d.tgtDiff) ||
-		resultMapContainsAtLeastOne(d.deletedFromSource) || resultMapContainsAtLeastOne(d.deletedFromTarget)
+func (d *MutationDiffer) getDiffKeysFromTargetGocbResult() (DiffKeysMap, error) {
+	return d.getDiffKeys(diffKindMissingFromTarget, diffKindTargetMismatch, diffKindDeletedFromTarget)
 }
 
-func resultMapToDiffKeysMap(generic interface{}) DiffKeysMap {
+func (d *MutationDiffer) getDiffKeys(kinds ...string) (DiffKeysMap, error) {
 	resultMap := make(DiffKeysMap)
-
-	switch generic.(type) {
-	case map[uint32]map[string]*GetResult:
-		uintMap := generic.(map[uint32]map[string]*GetResult)
-		for colId, strMap := range uintMap {
-			if _, exists := resultMap[colId]; !exists {
-				resultMap[colId] = []string{}
-			}
-			for key, _ := range strMap {
-				resultMap[colId] = append(resultMap[colId], key)
-			}
-		}
-	case map[uint32]map[string][]*GetResult:
-		uintMap := generic.(map[uint32]map[string][]*GetResult)
-		for colId, strMap := range uintMap {
-			if _, exists := resultMap[colId]; !exists {
-				resultMap[colId] = []string{}
-			}
-			for key, _ := range strMap {
-				resultMap[colId] = append(resultMap[colId], key)
-			}
+	for _, kind := range kinds {
+		diffKeys, err := d.diffStore.diffKeys(kind)
+		if err != nil {
+			return nil, err
 		}
-	default:
-		panic(fmt.Sprintf("Invalid type %v", reflect.TypeOf(generic)))
+		resultMap.Merge(diffKeys)
 	}
-	return resultMap
-}
-
-func (d *MutationDiffer) getDiffKeysFromSourceGocbResult() DiffKeysMap {
-	d.stateLock.RLock()
-	defer d.stateLock.RUnlock()
-
-	resultMap := make(DiffKeysMap)
-	resultMap.Merge(resultMapToDiffKeysMap(d.missingFromSource))
-	resultMap.Merge(resultMapToDiffKeysMap(d.srcDiff))
-	resultMap.Merge(resultMapToDiffKeysMap(d.deletedFromSource))
-	return resultMap
-}
-
-func (d *MutationDiffer) getDiffKeysFromTargetGocbResult() DiffKeysMap {
-	d.stateLock.RLock()
-	defer d.stateLock.RUnlock()
-
-	resultMap := make(DiffKeysMap)
-	resultMap.Merge(resultMapToDiffKeysMap(d.missingFromTarget))
-	resultMap.Merge(resultMapToDiffKeysMap(d.tgtDiff))
-	resultMap.Merge(resultMapToDiffKeysMap(d.deletedFromTarget))
-	return resultMap
+	return resultMap, nil
 }
 
 func (d *MutationDiffer) clearGoCbResults() {
-	d.stateLock.Lock()
-	defer d.stateLock.Unlock()
-
-	d.missingFromSource = make(map[uint32]map[string]*GetResult)
-	d.missingFromTarget = make(map[uint32]map[string]*GetResult)
-	d.srcDiff = make(map[uint32]map[string][]*GetResult)
-	d.tgtDiff = make(map[uint32]map[string][]*GetResult)
-	d.deletedFromSource = make(map[uint32]map[string][]*GetResult)
-	d.deletedFromTarget = make(map[uint32]map[string][]*GetResult)
+	err := d.diffStore.reset()
+	if err != nil {
+		d.logger.Errorf("Error resetting the mutation diff store. err=%v\n", err)
+	}
 }
 
 func (d *MutationDiffer) writeMigrationDetails() error {
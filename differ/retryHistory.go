@@ -0,0 +1,109 @@
+package differ
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"xdcrDiffer/base"
+)
+
+// What a round of the mutation differ observed of a key that was different, either in the first round or in any of
+// the retries after it. Seqnos are only known when metadata is compared
+type RetryObservation struct {
+	Round       int
+	SourceCas   uint64 `json:",omitempty"`
+	SourceSeqno uint64 `json:",omitempty"`
+	TargetCas   uint64 `json:",omitempty"`
+	TargetSeqno uint64 `json:",omitempty"`
+	// the kind that the key was found to be as of the round, or Converged once it is the same on both sides
+	Outcome string
+}
+
+// The observations of a key over the rounds, classified by how they ended
+type KeyRetryHistory struct {
+	Classification string
+	Rounds         []*RetryObservation
+}
+
+// observations by source collection ID and key, of the keys of a batch until they are added to the history store
+type retryHistories map[uint32]map[string][]*RetryObservation
+
+func (h retryHistories) add(colId uint32, key string, observation *RetryObservation) {
+	if _, exists := h[colId]; !exists {
+		h[colId] = make(map[string][]*RetryObservation)
+	}
+	h[colId][key] = addRetryObservation(h[colId][key], observation)
+}
+
+// a key compared against more than one target collection keeps a difference that any comparison of the round found
+func addRetryObservation(rounds []*RetryObservation, observation *RetryObservation) []*RetryObservation {
+	if len(rounds) > 0 && rounds[len(rounds)-1].Round == observation.Round {
+		if isDiffOutcome(observation.Outcome) || !isDiffOutcome(rounds[len(rounds)-1].Outcome) {
+			rounds[len(rounds)-1] = observation
+		}
+		return rounds
+	}
+	return append(rounds, observation)
+}
+
+func isDiffOutcome(outcome string) bool {
+	return outcome != base.RetryOutcomeConverged && outcome != base.RetryOutcomeExplained
+}
+
+// the history of a key from the observations that the history store has of it, in the order they were added. A
+// round that was fetched again after a restart has observations of its own for the key, which are merged the same
+// way as the ones of its target collections
+func newKeyRetryHistory(observations [][]byte) (*KeyRetryHistory, error) {
+	var rounds []*RetryObservation
+	for _, observationBytes := range observations {
+		observation := &RetryObservation{}
+		err := json.Unmarshal(observationBytes, observation)
+		if err != nil {
+			return nil, err
+		}
+		rounds = addRetryObservation(rounds, observation)
+	}
+	if len(rounds) == 0 {
+		return nil, fmt.Errorf("no observations")
+	}
+	return &KeyRetryHistory{Classification: classifyRetryRounds(rounds), Rounds: rounds}, nil
+}
+
+// A key that is still different after its last round is actively changing if either side of it moved on between
+// its last two rounds, since it is likely to be in flight rather than diverged. One that moved earlier on and then
+// stayed different has diverged
+func classifyRetryRounds(rounds []*RetryObservation) string {
+	last := rounds[len(rounds)-1]
+	// a key that turned out to be explained is not a difference any more either
+	if !isDiffOutcome(last.Outcome) {
+		return base.RetryClassificationConverged
+	}
+	if len(rounds) < 2 {
+		return base.RetryClassificationDiverged
+	}
+	previous := rounds[len(rounds)-2]
+	if last.SourceCas != previous.SourceCas || last.TargetCas != previous.TargetCas ||
+		last.SourceSeqno != previous.SourceSeqno || last.TargetSeqno != previous.TargetSeqno {
+		return base.RetryClassificationActivelyChanging
+	}
+	return base.RetryClassificationDiverged
+}
+
+func newRetryObservation(round int, outcome string, sourceResult, targetResult *GetResult) *RetryObservation {
+	observation := &RetryObservation{Round: round, Outcome: outcome}
+	if sourceResult != nil {
+		observation.SourceCas, observation.SourceSeqno = sourceResult.casAndSeqno()
+	}
+	if targetResult != nil {
+		observation.TargetCas, observation.TargetSeqno = targetResult.casAndSeqno()
+	}
+	return observation
+}
+
+// the seqno is only known when metadata is fetched. Both are 0 when the doc is not found
+func (r *GetResult) casAndSeqno() (uint64, uint64) {
+	if r.GetMetaResult != nil {
+		return uint64(r.GetMetaResult.Cas), uint64(r.GetMetaResult.SeqNo)
+	}
+	return r.cas, 0
+}
@@ -0,0 +1,141 @@
+package differ
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"xdcrDiffer/base"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func genObservation(round int, sourceCas, targetCas uint64, outcome string) *RetryObservation {
+	return &RetryObservation{Round: round, SourceCas: sourceCas, TargetCas: targetCas, Outcome: outcome}
+}
+
+func TestRetryHistoriesAdd(t *testing.T) {
+	fmt.Println("============== Test case start: TestRetryHistoriesAdd =================")
+	assert := assert.New(t)
+	histories := make(retryHistories)
+	histories.add(0, "key", genObservation(0, 1, 2, diffKindMismatch))
+	// a key compared against more than one target collection keeps a difference that any of them found
+	histories.add(0, "key", genObservation(0, 1, 1, base.RetryOutcomeConverged))
+	assert.Equal([]*RetryObservation{genObservation(0, 1, 2, diffKindMismatch)}, histories[0]["key"])
+	histories.add(0, "key", genObservation(1, 1, 1, base.RetryOutcomeConverged))
+	histories.add(0, "key", genObservation(1, 3, 2, diffKindMismatch))
+	assert.Equal([]*RetryObservation{genObservation(0, 1, 2, diffKindMismatch), genObservation(1, 3, 2, diffKindMismatch)},
+		histories[0]["key"])
+	histories.add(8, "key", genObservation(0, 1, 1, base.RetryOutcomeConverged))
+	assert.Len(histories[8]["key"], 1)
+}
+
+func TestClassifyRetryRounds(t *testing.T) {
+	fmt.Println("============== Test case start: TestClassifyRetryRounds =================")
+	tests := []struct {
+		name           string
+		rounds         []*RetryObservation
+		classification string
+	}{
+		{"converged", []*RetryObservation{genObservation(0, 1, 2, diffKindMismatch), genObservation(1, 1, 1, base.RetryOutcomeConverged)},
+			base.RetryClassificationConverged},
+		{"explained", []*RetryObservation{genObservation(0, 1, 2, diffKindMismatch), genObservation(1, 1, 2, base.RetryOutcomeExplained)},
+			base.RetryClassificationConverged},
+		{"not retried", []*RetryObservation{genObservation(0, 1, 2, diffKindMismatch)}, base.RetryClassificationDiverged},
+		{"never changed", []*RetryObservation{genObservation(0, 1, 2, diffKindMismatch), genObservation(1, 1, 2, diffKindMismatch),
+			genObservation(2, 1, 2, diffKindMismatch)}, base.RetryClassificationDiverged},
+		{"changed in the last round", []*RetryObservation{genObservation(0, 1, 2, diffKindMismatch), genObservation(1, 1, 2, diffKindMismatch),
+			genObservation(2, 3, 2, diffKindMismatch)}, base.RetryClassificationActivelyChanging},
+		// the last two rounds saw the same versions, but the ones before them did not
+		{"changed in an earlier round", []*RetryObservation{genObservation(0, 1, 2, diffKindMismatch), genObservation(1, 1, 4, diffKindMismatch),
+			genObservation(2, 1, 4, diffKindMismatch)}, base.RetryClassificationDiverged},
+		{"moved once, then stuck", []*RetryObservation{genObservation(0, 1, 2, diffKindMismatch), genObservation(1, 3, 2, diffKindMismatch),
+			genObservation(2, 3, 2, diffKindMismatch), genObservation(3, 3, 2, diffKindMismatch)}, base.RetryClassificationDiverged},
+		{"seqno changed", []*RetryObservation{genObservation(0, 1, 2, diffKindMismatch),
+			{Round: 1, SourceCas: 1, TargetCas: 2, SourceSeqno: 5, Outcome: diffKindMismatch}}, base.RetryClassificationActivelyChanging},
+		{"missing, then found", []*RetryObservation{genObservation(0, 1, 0, diffKindMissingFromTarget), genObservation(1, 1, 2, diffKindMismatch)},
+			base.RetryClassificationActivelyChanging},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.classification, classifyRetryRounds(test.rounds))
+		})
+	}
+}
+
+func TestNewKeyRetryHistory(t *testing.T) {
+	fmt.Println("============== Test case start: TestNewKeyRetryHistory =================")
+	assert := assert.New(t)
+	var observations [][]byte
+	// round 1 was fetched again after a restart
+	for _, observation := range []*RetryObservation{genObservation(0, 1, 2, diffKindMismatch), genObservation(1, 1, 2, diffKindMismatch),
+		genObservation(1, 1, 2, diffKindMismatch), genObservation(2, 1, 2, diffKindMismatch)} {
+		observationBytes, err := json.Marshal(observation)
+		assert.Nil(err)
+		observations = append(observations, observationBytes)
+	}
+	history, err := newKeyRetryHistory(observations)
+	assert.Nil(err)
+	assert.Equal(base.RetryClassificationDiverged, history.Classification)
+	assert.Len(history.Rounds, 3)
+
+	_, err = newKeyRetryHistory(nil)
+	assert.NotNil(err)
+	_, err = newKeyRetryHistory([][]byte{[]byte("{")})
+	assert.NotNil(err)
+}
+
+func TestMutationDifferRetryHistories(t *testing.T) {
+	fmt.Println("============== Test case start: TestMutationDifferRetryHistories =================")
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "retryHistoryTest")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	params := &mutationDiffCheckpointParams{DiffKeysFingerprint: "fingerprint"}
+	fetchList := MutationDiffFetchList{{Key: "key_1"}, {Key: "key_2"}}
+
+	d := newCheckpointedMutationDiffer(dir, params)
+	d.conflictRetries = 2
+	assert.Nil(d.historyStore.reset())
+	assert.Nil(d.startRound(0, fetchList))
+	d.addDocDiff(nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, fetchRange{0, 2}, retryHistories{
+		0: {"key_1": {genObservation(0, 1, 2, diffKindMismatch)}, "key_2": {genObservation(0, 1, 2, diffKindMismatch)}}})
+	// the observations outlive the round that they are of
+	assert.Nil(d.startRound(1, fetchList))
+	d.addDocDiff(nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, fetchRange{0, 1}, retryHistories{
+		0: {"key_1": {genObservation(1, 1, 1, base.RetryOutcomeConverged)}}})
+	assert.Nil(d.saveCheckpoint())
+
+	// round 1 of key_2 is observed after the checkpoint, and is observed again after the restart
+	d.addDocDiff(nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, fetchRange{1, 2}, retryHistories{
+		0: {"key_2": {genObservation(1, 1, 4, diffKindMismatch)}}})
+	d.Close()
+	d = newCheckpointedMutationDiffer(dir, params)
+	defer d.Close()
+	d.conflictRetries = 2
+	resumed, err := d.resumeFromCheckpoint()
+	assert.Nil(err)
+	assert.True(resumed)
+	d.addDocDiff(nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, fetchRange{1, 2}, retryHistories{
+		0: {"key_2": {genObservation(1, 1, 2, diffKindMismatch)}}})
+	// grouped by key in parts smaller than the file
+	d.historyStore.dedupPartSize = 16
+
+	counts, err := d.classifyRetryHistories()
+	assert.Nil(err)
+	assert.Equal(map[string]int{base.RetryClassificationConverged: 1, base.RetryClassificationDiverged: 1}, counts)
+
+	var buffer bytes.Buffer
+	assert.Nil(d.diffStore.writeJson(&buffer, diffKindRetryHistory))
+	var histories map[uint32]map[string]*KeyRetryHistory
+	assert.Nil(json.Unmarshal(buffer.Bytes(), &histories))
+	assert.Equal(map[uint32]map[string]*KeyRetryHistory{0: {
+		"key_1": {Classification: base.RetryClassificationConverged,
+			Rounds: []*RetryObservation{genObservation(0, 1, 2, diffKindMismatch), genObservation(1, 1, 1, base.RetryOutcomeConverged)}},
+		"key_2": {Classification: base.RetryClassificationDiverged,
+			Rounds: []*RetryObservation{genObservation(0, 1, 2, diffKindMismatch), genObservation(1, 1, 2, diffKindMismatch)}},
+	}}, histories)
+}
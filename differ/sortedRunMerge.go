@@ -0,0 +1,226 @@
+package differ
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"io"
+
+	"xdcrDiffer/base"
+	fdp "xdcrDiffer/fileDescriptorPool"
+	"xdcrDiffer/storage"
+	"xdcrDiffer/utils"
+
+	hlv "github.com/couchbase/goxdcr/hlv"
+	xdcrLog "github.com/couchbase/goxdcr/log"
+)
+
+// a run of records in a bin file, which is length bytes of frames from start onwards
+type runRange struct {
+	start  utils.BinFilePosition
+	length int64
+}
+
+// Captured files consist of runs of records that are sorted and deduplicated, one per buffer flush.
+// A run ends wherever a record does not sort after the one before it.
+// Finds where the records of each collection are in each run, along with the codec of the file
+func scanSortedRuns(fileName string, storage storage.Storage, logger *xdcrLog.CommonLogger) (map[uint32][]*runRange, uint16, error) {
+	file, err := storage.Open(fileName)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	reader, err := utils.NewBinFileReader(fileName, bufio.NewReaderSize(file, base.ExternalSortIOBufferSize).Read, logger)
+	if err != nil {
+		return nil, 0, err
+	}
+	colIdRuns := make(map[uint32][]*runRange)
+	var prev *utils.SortableRecord
+	var curRange *runRange
+	var curRangeStreamOffset int64
+	for {
+		data, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, 0, err
+		}
+		record, err := utils.NewSortableRecord(data)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if prev == nil || !prev.Less(record) || prev.SameKey(record) || prev.ColId != record.ColId {
+			curRange = &runRange{start: reader.RecordPosition()}
+			curRangeStreamOffset = reader.RecordStreamOffset()
+			colIdRuns[record.ColId] = append(colIdRuns[record.ColId], curRange)
+		}
+		// a run spans any corrupt records within it, which are skipped again as the run is merged
+		curRange.length = reader.StreamOffset() - curRangeStreamOffset
+		prev = record
+	}
+	return colIdRuns, reader.Codec(), nil
+}
+
+// Merges sorted runs, such as those of a collection, into a single stream of entries in key order,
+// keeping only the newest entry of each key
+type runMergeIterator struct {
+	// the files that the runs are read from
+	files       []storage.File
+	mergeHeap   runCursorHeap
+	actorId     hlv.DocumentSourceId
+	iterErr     error
+	itemCount   int
+	exhausted   bool
+	onExhausted func(itemCount int)
+}
+
+func newRunMergeIterator(fileName string, storage storage.Storage, codec uint16, runs []*runRange, actorId hlv.DocumentSourceId, logger *xdcrLog.CommonLogger, onExhausted func(itemCount int)) *runMergeIterator {
+	it := &runMergeIterator{
+		actorId:     actorId,
+		onExhausted: onExhausted,
+	}
+	if len(runs) == 0 {
+		return it
+	}
+
+	file, err := storage.Open(fileName)
+	if err != nil {
+		it.iterErr = err
+		it.exhausted = true
+		return it
+	}
+	it.files = append(it.files, file)
+
+	it.mergeHeap, it.iterErr = appendSortedRunCursors(nil, file, fileName, codec, runs, logger)
+	if it.iterErr != nil {
+		it.exhausted = true
+		return it
+	}
+	heap.Init(&it.mergeHeap)
+	return it
+}
+
+// Appends a cursor for each of the runs of the file to the heap, which is left for the caller to init.
+// Only the runs that have records are appended
+func appendSortedRunCursors(mergeHeap runCursorHeap, file storage.File, fileName string, codec uint16, runs []*runRange, logger *xdcrLog.CommonLogger) (runCursorHeap, error) {
+	for _, run := range runs {
+		var readOp fdp.FileOp
+		if codec == base.BinFileCodecNone {
+			// runs can be as small as a single record, so the read buffer should not be larger than the run
+			bufferSize := base.SortedRunReadBufferSize
+			if run.length < int64(bufferSize) {
+				bufferSize = int(run.length)
+			}
+			readOp = bufio.NewReaderSize(io.NewSectionReader(file, run.start.BlockOffset, run.length), bufferSize).Read
+		} else {
+			// whole blocks are read at a time, which the reader holds on to as they are decompressed
+			readOp = io.NewSectionReader(file, run.start.BlockOffset, file.Size()-run.start.BlockOffset).Read
+		}
+		cursor := &runCursor{
+			nextOp: utils.NewBinFileSectionReader(fileName, readOp, codec, run.start, run.length, logger).Next,
+		}
+		err := cursor.advance()
+		if err != nil {
+			return mergeHeap, err
+		}
+		if cursor.current != nil {
+			mergeHeap = append(mergeHeap, cursor)
+		}
+	}
+	return mergeHeap, nil
+}
+
+// Returns the newest record of the next key, after moving all cursors past that key
+func (it *runMergeIterator) nextRecord() *utils.SortableRecord {
+	if it.exhausted {
+		return nil
+	}
+	if it.mergeHeap.Len() == 0 {
+		it.exhausted = true
+		if it.onExhausted != nil {
+			it.onExhausted(it.itemCount)
+		}
+		return nil
+	}
+
+	record := it.mergeHeap[0].current
+	for it.mergeHeap.Len() > 0 && it.mergeHeap[0].current.SameKey(record) {
+		cursor := it.mergeHeap[0]
+		err := cursor.advance()
+		if err != nil {
+			it.iterErr = err
+			it.exhausted = true
+			return nil
+		}
+		if cursor.current == nil {
+			heap.Pop(&it.mergeHeap)
+		} else {
+			heap.Fix(&it.mergeHeap, 0)
+		}
+	}
+	it.itemCount++
+	return record
+}
+
+func (it *runMergeIterator) next() *oneEntry {
+	record := it.nextRecord()
+	if record == nil {
+		return nil
+	}
+	entry, err := getOneEntry(readFullOp(bytes.NewReader(record.Data)), it.actorId)
+	if err != nil {
+		it.iterErr = err
+		it.exhausted = true
+		return nil
+	}
+	return entry
+}
+
+func (it *runMergeIterator) err() error {
+	return it.iterErr
+}
+
+func (it *runMergeIterator) close() {
+	for _, file := range it.files {
+		file.Close()
+	}
+}
+
+// Loads the file by locating its sorted runs, which are merged as the entries are iterated
+func (attr *FileAttributes) loadSortedRuns() error {
+	if attr.closeOp != nil {
+		// the runs are read through their own handles
+		defer attr.closeOp()
+	}
+
+	var err error
+	attr.colIdItemCounts = make(map[uint32]int)
+	attr.colIdRuns, attr.binFileCodec, err = scanSortedRuns(attr.name, attr.storage, attr.logger)
+	return err
+}
+
+func (attr *FileAttributes) newRunMergeIterator(colId uint32) *runMergeIterator {
+	return newRunMergeIterator(attr.name, attr.storage, attr.binFileCodec, attr.colIdRuns[colId], attr.actorId, attr.logger, func(itemCount int) {
+		attr.colIdItemCounts[colId] = itemCount
+	})
+}
+
+// Counts the distinct keys of the collections that have not been iterated through in full
+func (attr *FileAttributes) getSortedRunsItemCount() int {
+	var itemCount int
+	for colId := range attr.colIdRuns {
+		if _, counted := attr.colIdItemCounts[colId]; !counted {
+			it := attr.newRunMergeIterator(colId)
+			for it.nextRecord() != nil {
+			}
+			it.close()
+			if it.err() != nil {
+				attr.colIdItemCounts[colId] = it.itemCount
+			}
+		}
+		itemCount += attr.colIdItemCounts[colId]
+	}
+	return itemCount
+}
@@ -0,0 +1,101 @@
+package differ
+
+import (
+	"fmt"
+	"testing"
+
+	"xdcrDiffer/base"
+	"xdcrDiffer/storage"
+	"xdcrDiffer/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// returns the frames of a run of the given keys of each of colIds, sorted and deduplicated like a buffer flush
+func genSortedRun(t *testing.T, keys []int, seqno uint64, colIds ...uint32) []byte {
+	var records []byte
+	for _, colId := range colIds {
+		for _, i := range keys {
+			records = append(records, genRecord(fmt.Sprintf("key_%03d", i), seqno, colId)...)
+		}
+	}
+	frames, err := utils.SortDedupAndFrameRecords(records)
+	assert.Nil(t, err)
+	return frames
+}
+
+func TestSortedRunMerge(t *testing.T) {
+	fmt.Println("============== Test case start: TestSortedRunMerge =================")
+	for _, codec := range []uint16{base.BinFileCodecNone, base.BinFileCodecSnappy} {
+		t.Run(base.BinFileCodecNames[codec], func(t *testing.T) {
+			assert := assert.New(t)
+			storage := storage.NewMemoryStorage()
+
+			// three flushes of overlapping keys, where the later flushes have the newer versions
+			data := utils.AppendBinFileHeader(nil, codec)
+			var err error
+			for flush, keys := range [][]int{{5, 1, 3, 7}, {2, 3, 4}, {7, 0, 8}} {
+				data, err = utils.AppendFramesToBinFile(data, genSortedRun(t, keys, uint64(flush+1), 0, 8), codec)
+				assert.Nil(err)
+			}
+			assert.Nil(storage.WriteFile("/bin", data))
+
+			colIdRuns, scannedCodec, err := scanSortedRuns("/bin", storage, logger)
+			assert.Nil(err)
+			assert.Equal(codec, scannedCodec)
+			assert.Equal(2, len(colIdRuns))
+			assert.Equal(3, len(colIdRuns[0]))
+			assert.Equal(3, len(colIdRuns[8]))
+
+			expectedSeqnos := map[string]uint64{"key_000": 3, "key_001": 1, "key_002": 2, "key_003": 2, "key_004": 2, "key_005": 1, "key_007": 3, "key_008": 3}
+			for _, colId := range []uint32{0, 8} {
+				var itemCount int
+				it := newRunMergeIterator("/bin", storage, codec, colIdRuns[colId], "", logger, func(count int) { itemCount = count })
+				var keys []string
+				for entry := it.next(); entry != nil; entry = it.next() {
+					assert.Equal(colId, entry.ColId)
+					assert.Equal(expectedSeqnos[entry.Key], entry.Seqno)
+					keys = append(keys, entry.Key)
+				}
+				assert.Nil(it.err())
+				it.close()
+				assert.Equal([]string{"key_000", "key_001", "key_002", "key_003", "key_004", "key_005", "key_007", "key_008"}, keys)
+				assert.Equal(8, itemCount)
+			}
+
+			attr := NewFileAttribute("/bin")
+			attr.storage = storage
+			attr.sortedRuns = true
+			assert.Nil(attr.LoadFileIntoBuffer())
+			assert.Equal(16, attr.getItemCount())
+		})
+	}
+	fmt.Println("============== Test case end: TestSortedRunMerge =================")
+}
+
+func TestSortedRunMergeSkipsCorruptRecords(t *testing.T) {
+	assert := assert.New(t)
+	storage := storage.NewMemoryStorage()
+
+	data := utils.AppendBinFileHeader(nil, base.BinFileCodecNone)
+	data = append(data, genSortedRun(t, []int{0, 1, 2, 3}, 1, 0)...)
+	corruptRecordStart := len(data)
+	data = append(data, genSortedRun(t, []int{4, 5, 6}, 2, 0)...)
+	// flip a byte in the value of the first record of the second run
+	data[corruptRecordStart+base.RecordFrameHeaderLen+base.KeyLenVariable] ^= 0xff
+	assert.Nil(storage.WriteFile("/bin", data))
+
+	colIdRuns, _, err := scanSortedRuns("/bin", storage, logger)
+	assert.Nil(err)
+	// the corrupt record is skipped, so the rest of its run still sorts after the first run
+	assert.Equal(1, len(colIdRuns[0]))
+
+	it := newRunMergeIterator("/bin", storage, base.BinFileCodecNone, colIdRuns[0], "", logger, nil)
+	var keys []string
+	for entry := it.next(); entry != nil; entry = it.next() {
+		keys = append(keys, entry.Key)
+	}
+	assert.Nil(it.err())
+	it.close()
+	assert.Equal([]string{"key_000", "key_001", "key_002", "key_003", "key_005", "key_006"}, keys)
+}
@@ -0,0 +1,38 @@
+package differ
+
+import (
+	"bytes"
+	"sort"
+)
+
+// The xattrs, by key, that differ between the source and target versions of a doc
+type XattrDiff struct {
+	Different         []string `json:",omitempty"`
+	MissingFromSource []string `json:",omitempty"`
+	MissingFromTarget []string `json:",omitempty"`
+}
+
+// diffs the xattrs of the source and target versions of a doc, which are either the xattrs themselves or their
+// digests, by key. Returns nil if they are the same
+func diffXattrDigests(source, target map[string][]byte) *XattrDiff {
+	diff := &XattrDiff{}
+	for key, sourceValue := range source {
+		if targetValue, exists := target[key]; !exists {
+			diff.MissingFromTarget = append(diff.MissingFromTarget, key)
+		} else if !bytes.Equal(sourceValue, targetValue) {
+			diff.Different = append(diff.Different, key)
+		}
+	}
+	for key := range target {
+		if _, exists := source[key]; !exists {
+			diff.MissingFromSource = append(diff.MissingFromSource, key)
+		}
+	}
+	if len(diff.Different) == 0 && len(diff.MissingFromSource) == 0 && len(diff.MissingFromTarget) == 0 {
+		return nil
+	}
+	sort.Strings(diff.Different)
+	sort.Strings(diff.MissingFromSource)
+	sort.Strings(diff.MissingFromTarget)
+	return diff
+}
@@ -0,0 +1,52 @@
+package differ
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/couchbase/gocbcore/v10"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffXattrDigests(t *testing.T) {
+	fmt.Println("============== Test case start: TestDiffXattrDigests =================")
+	tests := []struct {
+		name   string
+		source map[string][]byte
+		target map[string][]byte
+		diff   *XattrDiff
+	}{
+		{"both empty", nil, map[string][]byte{}, nil},
+		{"same", map[string][]byte{"a": []byte("1"), "b": []byte("2")}, map[string][]byte{"b": []byte("2"), "a": []byte("1")}, nil},
+		{"different", map[string][]byte{"a": []byte("1"), "b": []byte("2"), "c": []byte("3")},
+			map[string][]byte{"a": []byte("1"), "b": []byte("3"), "c": []byte("4")}, &XattrDiff{Different: []string{"b", "c"}}},
+		{"missing from target", map[string][]byte{"b": []byte("2"), "a": []byte("1")}, nil,
+			&XattrDiff{MissingFromTarget: []string{"a", "b"}}},
+		{"missing from source", map[string][]byte{}, map[string][]byte{"a": []byte("1")},
+			&XattrDiff{MissingFromSource: []string{"a"}}},
+		{"all kinds", map[string][]byte{"a": []byte("1"), "b": []byte("2")}, map[string][]byte{"b": []byte("3"), "c": []byte("1")},
+			&XattrDiff{Different: []string{"b"}, MissingFromSource: []string{"c"}, MissingFromTarget: []string{"a"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.diff, diffXattrDigests(test.source, test.target))
+		})
+	}
+}
+
+func TestXattrsFetchFailed(t *testing.T) {
+	fmt.Println("============== Test case start: TestXattrsFetchFailed =================")
+	assert := assert.New(t)
+	assert.False(xattrsFetchFailed(&GetResult{}))
+	// a doc that is missing has no xattrs
+	assert.False(xattrsFetchFailed(&GetResult{xattrsErr: gocbcore.ErrDocumentNotFound}))
+	assert.True(xattrsFetchFailed(&GetResult{xattrsErr: gocbcore.ErrTimeout}))
+
+	dw := &DifferWorker{targetResults: map[uint32]map[string]*GetResult{
+		8: {"key": &GetResult{key: "key"}},
+		9: {"key": &GetResult{key: "key", xattrsErr: gocbcore.ErrTimeout}},
+	}}
+	assert.False(dw.targetXattrsFetchFailed([]uint32{8}, "key"))
+	assert.True(dw.targetXattrsFetchFailed([]uint32{8, 9}, "key"))
+	assert.False(dw.targetXattrsFetchFailed([]uint32{10}, "key"))
+}
@@ -11,13 +11,14 @@ package fileDescriptorPool
 
 import (
 	"fmt"
-	"os"
+	"io"
 	"sync"
+	"xdcrDiffer/storage"
 )
 
 /**
  * A portable file descriptor pool that allows the caller to run file ops without worrying about
- * going over the max number of open files
+ * going over the max number of open files, which are opened through the storage that the pool is on
  */
 type FdPoolIface interface {
 	RegisterFileHandle(fileName string) (FileOp, FileOp, error) // Read, Write, err
@@ -36,19 +37,23 @@ const (
 type FileOp func([]byte) (int, error)
 
 type FdPool struct {
-	mtx    sync.Mutex
-	curFds uint64
-	fdMap  map[string]*internalFd
+	mtx     sync.Mutex
+	curFds  uint64
+	fdMap   map[string]*internalFd
+	storage storage.Storage
 
 	fdsInUseChan chan (*internalFd)
 	fdNeedsOpen  chan bool
+	// held while descriptors are taken for files that are opened outside of the pool
+	acquireMtx sync.Mutex
 }
 
 type internalFd struct {
 	fileName   string
-	fileHandle *os.File
+	fileHandle io.ReadWriteCloser
 	state      State
 	mtx        sync.Mutex
+	storage    storage.Storage
 
 	// Channels to file descriptor pool to request open or ask someone to give up their open fds
 	requestOpenChan *(chan (*internalFd))
@@ -59,8 +64,13 @@ type internalFd struct {
 }
 
 func NewFileDescriptorPool(maxFds int) *FdPool {
+	return NewFileDescriptorPoolWithStorage(maxFds, storage.NewLocalStorage())
+}
+
+func NewFileDescriptorPoolWithStorage(maxFds int, storage storage.Storage) *FdPool {
 	pool := &FdPool{
 		fdMap:        make(map[string]*internalFd),
+		storage:      storage,
 		fdsInUseChan: make(chan *internalFd, maxFds),
 		fdNeedsOpen:  make(chan bool),
 	}
@@ -97,6 +107,37 @@ func (fdp *FdPool) RegisterReadOnlyFileHandle(fileName string) (FileOp, error) {
 	return ifd.Read, nil
 }
 
+// Takes up n of the descriptors of the pool, or all of them if there are fewer, for files that are opened outside of
+// it, asking the open handles to give theirs up while the pool is full. Returns the number of descriptors taken,
+// which are given back by ReleaseFds
+func (fdp *FdPool) AcquireFds(n int) int {
+	if n > cap(fdp.fdsInUseChan) {
+		n = cap(fdp.fdsInUseChan)
+	}
+	// the descriptors of a caller are all taken before the next caller's, so that callers cannot each hold a part of
+	// what they need while waiting for the rest
+	fdp.acquireMtx.Lock()
+	defer fdp.acquireMtx.Unlock()
+	for acquired := 0; acquired < n; {
+		select {
+		case fdp.fdsInUseChan <- nil:
+			acquired++
+		case fdp.fdNeedsOpen <- true:
+			// an open handle is giving up its descriptor, which is taken on the next try
+		}
+	}
+	return n
+}
+
+func (fdp *FdPool) ReleaseFds(n int) {
+	for i := 0; i < n; i++ {
+		select {
+		case <-fdp.fdsInUseChan:
+		default:
+		}
+	}
+}
+
 func (fdp *FdPool) registerInternalNoLock(fileName string) (*internalFd, error) {
 	if _, ok := fdp.fdMap[fileName]; ok {
 		return nil, fmt.Errorf("FileName %v is already registered", fileName)
@@ -108,6 +149,7 @@ func (fdp *FdPool) registerInternalNoLock(fileName string) (*internalFd, error)
 		requestOpenChan: &(fdp.fdsInUseChan),
 		requestRelease:  &(fdp.fdNeedsOpen),
 		exitChan:        make(chan bool, 1),
+		storage:         fdp.storage,
 	}
 	fdp.fdMap[fileName] = ifd
 
@@ -166,8 +208,12 @@ func (fd *internalFd) readWriteOpInternal(input []byte, read bool) (bytes int, e
 				return
 			}
 		default:
-			*fd.requestRelease <- true // This will notify and block until someone frees up
-			*fd.requestOpenChan <- fd
+			// Ask an open fd to free up, unless one is given back meanwhile by the files opened outside of the pool
+			select {
+			case *fd.requestRelease <- true:
+				*fd.requestOpenChan <- fd
+			case *fd.requestOpenChan <- fd:
+			}
 			if read {
 				bytes, err = fd.openAndRead(input)
 			} else {
@@ -198,9 +244,17 @@ func (fd *internalFd) Write(input []byte) (bytesWritten int, err error) {
 // Mtx needs to be held
 func (fd *internalFd) open(readonly bool) (err error) {
 	if readonly {
-		fd.fileHandle, err = os.OpenFile(fd.fileName, os.O_RDONLY, 0444)
+		var file storage.File
+		file, err = fd.storage.Open(fd.fileName)
+		if err == nil {
+			fd.fileHandle = &readOnlyHandle{file}
+		}
 	} else {
-		fd.fileHandle, err = os.OpenFile(fd.fileName, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+		var appender io.WriteCloser
+		appender, err = fd.storage.OpenForAppend(fd.fileName)
+		if err == nil {
+			fd.fileHandle = &appendOnlyHandle{appender}
+		}
 	}
 	if err != nil {
 		return
@@ -271,3 +325,19 @@ func (fd *internalFd) waitForClose() {
 		}
 	}
 }
+
+type readOnlyHandle struct {
+	io.ReadCloser
+}
+
+func (h *readOnlyHandle) Write([]byte) (int, error) {
+	return 0, fmt.Errorf("File is opened read only")
+}
+
+type appendOnlyHandle struct {
+	io.WriteCloser
+}
+
+func (h *appendOnlyHandle) Read([]byte) (int, error) {
+	return 0, fmt.Errorf("File is opened for append only")
+}
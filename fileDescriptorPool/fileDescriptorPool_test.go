@@ -2,8 +2,10 @@ package fileDescriptorPool
 
 import (
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestFD(t *testing.T) {
@@ -51,3 +53,37 @@ func TestFD(t *testing.T) {
 	fdp.DeRegisterFileHandle(testFile2)
 	//	fmt.Printf("Done\n ")
 }
+
+func TestAcquireFds(t *testing.T) {
+	assert := assert.New(t)
+	fdp := NewFileDescriptorPool(2)
+
+	testFile := "/tmp/poolAcquireTest"
+	defer os.Remove(testFile)
+	testBytes := []byte("TestString")
+	assert.Nil(ioutil.WriteFile(testFile, testBytes, 0666))
+
+	readCb, err := fdp.RegisterReadOnlyFileHandle(testFile)
+	assert.Nil(err)
+	assert.Equal(1, len(fdp.fdsInUseChan))
+
+	// no more than the pool has, which the open handle gives its fd up for
+	assert.Equal(2, fdp.AcquireFds(3))
+	assert.Equal(2, len(fdp.fdsInUseChan))
+
+	// the handle waits for the fds to be given back
+	readCh := make(chan int)
+	go func() {
+		read, _ := readCb(make([]byte, len(testBytes)))
+		readCh <- read
+	}()
+	select {
+	case <-readCh:
+		assert.Fail("read while the pool was full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	fdp.ReleaseFds(2)
+	assert.Equal(len(testBytes), <-readCh)
+
+	fdp.DeRegisterFileHandle(testFile)
+}
@@ -16,9 +16,13 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -28,6 +32,7 @@ import (
 	"xdcrDiffer/differ"
 	fdp "xdcrDiffer/fileDescriptorPool"
 	"xdcrDiffer/filterPool"
+	"xdcrDiffer/storage"
 	"xdcrDiffer/utils"
 
 	"github.com/couchbase/gocb/v2"
@@ -47,6 +52,10 @@ import (
 var done = make(chan bool)
 
 var options struct {
+	// base.SubcommandCapture, base.SubcommandDiff, or empty to capture and diff in the same run
+	subcommand string
+	// the cluster that the capture subcommand captures
+	captureCluster                    string
 	sourceUrl                         string
 	sourceUsername                    string
 	sourcePassword                    string
@@ -66,10 +75,25 @@ var options struct {
 	numberOfWorkersForMutationDiffer  uint64
 	numberOfBins                      uint64
 	numberOfFileDesc                  uint64
+	numberOfKeyHashPartitions         uint64
+	fileDifferMemoryBudgetMB          uint64
+	binFileCompression                string
+	storage                           string
+	s3Endpoint                        string
+	s3Bucket                          string
+	s3Region                          string
 	// the duration that the tools should be run, in minutes
 	completeByDuration uint64
 	// whether tool should complete after processing all mutations at tool start time
 	completeBySeqno bool
+	// whether to wait for the replication to drain before taking the source seqnos to complete by,
+	// and again before taking the target seqnos, instead of waiting for delayBetweenSourceAndTarget.
+	// This is best effort, since the target seqnos are not derived from what the replication has checkpointed
+	consistentCut bool
+	// number of changes left to replicate at or below which the replication is considered drained
+	changesLeftThreshold uint64
+	// how long to wait for the replication to drain before taking the seqnos anyway, in seconds
+	consistentCutTimeout uint64
 	// directory for checkpoint files
 	checkpointFileDir string
 	// name of source cluster checkpoint file to load from when tool starts
@@ -81,18 +105,45 @@ var options struct {
 	// name of new checkpoint file to write to when tool shuts down
 	// if not specified, tool will not save checkpoint files
 	newCheckpointFileName string
+	// whether to resume from the checkpoints of the previous run, appending to its bin files,
+	// and re-diff only the bins whose files have changed
+	incremental bool
+	// whether to keep capturing past completeBySeqno and diff what has been captured every daemonWindowInterval,
+	// keeping track of how long each inconsistency found has lasted
+	daemon bool
+	// interval between the diffs of continuous verification, in seconds
+	daemonWindowInterval uint64
+	// how long an inconsistency needs to last to be reported by continuous verification, in seconds
+	inconsistencyGracePeriod uint64
+	// directory for the inconsistencies tracked by continuous verification
+	inconsistencyDir string
 	// directory for storing diffs generated by file differ
 	fileDifferDir string
 	// output directory for mutation differ
 	mutationDifferDir string
+	// file that the summary of the diff, along with the stats of the replication, is written to,
+	// which is in fileDifferDir unless given
+	diffSummaryFile string
 	// size of batch used by mutation differ
 	mutationDifferBatchSize uint64
 	// timeout, in seconds, used by mutation differ
 	mutationDifferTimeout uint64
+	// max ops per second that mutation differ sends to each cluster, where 0 means no limit
+	mutationDifferSourceOpsPerSec uint64
+	mutationDifferTargetOpsPerSec uint64
+	// whether mutation differ slows down below the limits when ops time out or fail temporarily
+	mutationDifferAdaptiveRateLimit bool
 	// size of source dcp handler channel
 	sourceDcpHandlerChanSize uint64
 	// size of target dcp handler channel
 	targetDcpHandlerChanSize uint64
+	// max bytes and mutations per second that the dcp streams of each cluster are captured at, where 0 means no limit
+	sourceDcpBytesPerSec     uint64
+	sourceDcpMutationsPerSec uint64
+	targetDcpBytesPerSec     uint64
+	targetDcpMutationsPerSec uint64
+	// file of capture limits that is checked for changes while capturing, which override the limits above
+	captureLimitsFile string
 	// timeout for bucket for stats collection, in seconds
 	bucketOpTimeout uint64
 	// max number of retry for get stats
@@ -136,9 +187,21 @@ var options struct {
 	setupTimeout int
 	//string denoting the xattrs that shouldn't be compared
 	fileContaingXattrKeysForNoComapre string
+	// whether to compare xattrs by key, to report which of them differ
+	compareXattrs bool
+	// whether to compare JSON bodies by their canonical form
+	semanticJsonCompare bool
+	// file containing the rules of the JSON paths of bodies that shouldn't be compared
+	fileContainingIgnoredJsonPaths string
 }
 
 func argParse() {
+	args := os.Args[1:]
+	if len(args) > 0 && (args[0] == base.SubcommandCapture || args[0] == base.SubcommandDiff) {
+		options.subcommand = args[0]
+		args = args[1:]
+	}
+
 	flag.StringVar(&options.sourceUrl, "sourceUrl", "",
 		"url for source cluster")
 	flag.StringVar(&options.sourceUsername, "sourceUsername", "",
@@ -177,10 +240,31 @@ func argParse() {
 		"number of buckets per vbucket")
 	flag.Uint64Var(&options.numberOfFileDesc, "numberOfFileDesc", 500,
 		"number of file descriptors")
+	flag.Uint64Var(&options.numberOfKeyHashPartitions, "numberOfKeyHashPartitions", 0,
+		"number of key hash partitions to diff files by, instead of by vbucket. When 0 and source and target buckets have different numbers of vbuckets, the larger number of vbuckets times numberOfBins is used")
+	flag.Uint64Var(&options.fileDifferMemoryBudgetMB, "fileDifferMemoryBudgetMB", 0,
+		"memory budget, in MB, of the file differ, which is shared evenly by its workers. When non-zero, files are sorted on disk instead of being loaded into memory as a whole, and the diff details are spilled to disk")
+	flag.StringVar(&options.binFileCompression, "binFileCompression", base.BinFileCodecNames[base.BinFileCodecNone],
+		fmt.Sprintf("codec that the captured bin files are compressed with, which is one of %v", base.BinFileCodecNames))
+	flag.StringVar(&options.storage, "storage", base.StorageTypeLocal,
+		fmt.Sprintf("where the bin files are captured to and diffed from, which is one of %v. With %v, sourceFileDir and targetFileDir are paths within s3Bucket, and the credentials are taken from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY",
+			base.StorageTypes, base.StorageTypeS3))
+	flag.StringVar(&options.s3Endpoint, "s3Endpoint", "",
+		"url of the S3 compatible object store, e.g. http://127.0.0.1:9000 for a local MinIO")
+	flag.StringVar(&options.s3Bucket, "s3Bucket", "",
+		"bucket of the S3 compatible object store that the bin files are kept in")
+	flag.StringVar(&options.s3Region, "s3Region", "us-east-1",
+		"region of the S3 compatible object store")
 	flag.Uint64Var(&options.completeByDuration, "completeByDuration", 0,
 		"duration that the tool should run")
 	flag.BoolVar(&options.completeBySeqno, "completeBySeqno", true,
 		"whether tool should automatically complete (after processing all mutations at start time)")
+	flag.BoolVar(&options.consistentCut, "consistentCut", false,
+		"whether to complete the source at the seqnos of the latest XDCR checkpoint of each vbucket, and the target at the target seqnos that the checkpoint recorded for them, so that mutations still being replicated do not show up as differences. Waits for the changes left to replicate to drain to changesLeftThreshold first, so that the checkpoints are close to the high seqnos. Requires completeBySeqno, and a replication that has checkpointed every vbucket with mutations")
+	flag.Uint64Var(&options.changesLeftThreshold, "changesLeftThreshold", 0,
+		"number of changes left to replicate at or below which consistentCut considers the replication drained")
+	flag.Uint64Var(&options.consistentCutTimeout, "consistentCutTimeout", base.ConsistentCutTimeout,
+		"how long consistentCut waits for the replication to drain before taking the seqnos anyway, in seconds")
 	flag.StringVar(&options.checkpointFileDir, "checkpointFileDir", base.CheckpointFileDir,
 		"directory for checkpoint files")
 	flag.StringVar(&options.oldSourceCheckpointFileName, "oldSourceCheckpointFileName", "",
@@ -189,18 +273,47 @@ func argParse() {
 		"old target checkpoint file to load from when tool starts")
 	flag.StringVar(&options.newCheckpointFileName, "newCheckpointFileName", "",
 		"new checkpoint file to write to when tool shuts down")
+	flag.BoolVar(&options.incremental, "incremental", false,
+		"whether to capture only the mutations since the checkpoints saved to newCheckpointFileName by the previous run, appending them to its bin files, and to re-diff only the bins whose files have changed since the previous diff in fileDifferDir")
+	flag.BoolVar(&options.daemon, "daemon", false,
+		"whether to keep the dcp streams open past completeBySeqno and, every daemonWindowInterval, diff what has been captured so far, reporting the inconsistencies that have lasted longer than inconsistencyGracePeriod into inconsistencyDir")
+	flag.Uint64Var(&options.daemonWindowInterval, "daemonWindowInterval", base.DaemonWindowInterval,
+		"interval between the diffs of the daemon, in seconds")
+	flag.Uint64Var(&options.inconsistencyGracePeriod, "inconsistencyGracePeriod", base.InconsistencyGracePeriod,
+		"how long an inconsistency needs to last for the daemon to report it, in seconds")
+	flag.StringVar(&options.inconsistencyDir, "inconsistencyDir", base.InconsistencyDir,
+		"directory for the inconsistencies tracked by the daemon")
 	flag.StringVar(&options.fileDifferDir, "fileDifferDir", base.FileDifferDir,
 		" directory for storing diffs generated by file differ")
 	flag.StringVar(&options.mutationDifferDir, "mutationDifferDir", base.MutationDifferDir,
 		" output directory for mutation differ")
+	flag.StringVar(&options.diffSummaryFile, "diffSummaryFile", "",
+		"file that the summary of the diff, along with the stats of the replication at the start and the end of the run, is written to. Defaults to "+base.DiffSummaryFileName+" in fileDifferDir")
 	flag.Uint64Var(&options.mutationDifferBatchSize, "mutationDifferBatchSize", 100,
 		"size of batch used by mutation differ")
 	flag.Uint64Var(&options.mutationDifferTimeout, "mutationDifferTimeout", 30,
 		"timeout, in seconds, used by mutation differ")
+	flag.Uint64Var(&options.mutationDifferSourceOpsPerSec, "mutationDifferSourceOpsPerSec", 0,
+		"max ops per second that mutation differ sends to the source cluster. 0 means no limit")
+	flag.Uint64Var(&options.mutationDifferTargetOpsPerSec, "mutationDifferTargetOpsPerSec", 0,
+		"max ops per second that mutation differ sends to the target cluster. 0 means no limit")
+	flag.BoolVar(&options.mutationDifferAdaptiveRateLimit, "mutationDifferAdaptiveRateLimit", false,
+		"whether mutation differ slows down below the ops per second limits when ops time out or fail temporarily, until they succeed again")
 	flag.Uint64Var(&options.sourceDcpHandlerChanSize, "sourceDcpHandlerChanSize", base.DcpHandlerChanSize,
 		"size of source dcp handler channel")
 	flag.Uint64Var(&options.targetDcpHandlerChanSize, "targetDcpHandlerChanSize", base.DcpHandlerChanSize,
 		"size of target dcp handler channel")
+	flag.Uint64Var(&options.sourceDcpBytesPerSec, "sourceDcpBytesPerSec", 0,
+		"max bytes per second that the dcp streams of the source cluster are captured at. 0 means no limit")
+	flag.Uint64Var(&options.sourceDcpMutationsPerSec, "sourceDcpMutationsPerSec", 0,
+		"max mutations per second that the dcp streams of the source cluster are captured at. 0 means no limit")
+	flag.Uint64Var(&options.targetDcpBytesPerSec, "targetDcpBytesPerSec", 0,
+		"max bytes per second that the dcp streams of the target cluster are captured at. 0 means no limit")
+	flag.Uint64Var(&options.targetDcpMutationsPerSec, "targetDcpMutationsPerSec", 0,
+		"max mutations per second that the dcp streams of the target cluster are captured at. 0 means no limit")
+	flag.StringVar(&options.captureLimitsFile, "captureLimitsFile", "",
+		fmt.Sprintf("Path to a JSON file of capture limits by cluster, e.g. {\"%v\": {\"bytesPerSec\": 10485760, \"mutationsPerSec\": 5000}}, which is checked for changes every %v seconds while capturing. Limits in the file override the limits given by flags",
+			base.SourceClusterName, base.CaptureLimitsFileCheckInterval))
 	flag.Uint64Var(&options.bucketOpTimeout, "bucketOpTimeout", base.BucketOpTimeout,
 		" timeout for bucket for stats collection, in seconds")
 	flag.Uint64Var(&options.maxNumOfGetStatsRetry, "maxNumOfGetStatsRetry", base.MaxNumOfGetStatsRetry,
@@ -243,7 +356,17 @@ func argParse() {
 		"Common setup timeout duration in seconds")
 	flag.StringVar(&options.fileContaingXattrKeysForNoComapre, "fileContaingXattrKeysForNoComapre", "",
 		"Path to the file containing the Xattr keys for NoCompare ")
-	flag.Parse()
+	flag.BoolVar(&options.compareXattrs, "compareXattrs", false,
+		"whether to compare the xattrs of docs by key, which reports the xattrs that differ. Needs to be set when capturing as well as when diffing")
+	flag.BoolVar(&options.semanticJsonCompare, "semanticJsonCompare", false,
+		"whether to compare JSON bodies by their canonical form, ignoring key order, whitespace, number formatting and string escapes. Needs to be set when capturing as well as when diffing")
+	flag.StringVar(&options.fileContainingIgnoredJsonPaths, "fileContainingIgnoredJsonPaths", "",
+		"Path to the file containing the JSON paths of bodies that are not compared, one [<scope>.<collection>:]<JSON pointer> per line")
+	flag.StringVar(&options.captureCluster, "captureCluster", "",
+		fmt.Sprintf("cluster that the %v subcommand captures into a capture archive, which is either %v, into sourceFileDir, or %v, into targetFileDir",
+			base.SubcommandCapture, base.SourceClusterName, base.TargetClusterName))
+	flag.Usage = usage
+	flag.CommandLine.Parse(args)
 }
 
 func validateCompareType(method string) {
@@ -256,8 +379,108 @@ func validateCompareType(method string) {
 	os.Exit(1)
 }
 
+func validateBinFileCompression(name string) uint16 {
+	codec, err := utils.GetBinFileCodec(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	return codec
+}
+
+// The previous run saved its checkpoints to newCheckpointFileName, which this run resumes from unless
+// told otherwise. Either cluster starts from 0 if it has no such checkpoint
+func setupIncrementalCheckpoints() {
+	if !options.incremental {
+		return
+	}
+	if options.newCheckpointFileName == "" {
+		fmt.Fprintf(os.Stderr, "newCheckpointFileName is required for incremental runs to resume from\n")
+		os.Exit(1)
+	}
+	if options.oldSourceCheckpointFileName == "" && checkpointExists(base.SourceClusterName, options.newCheckpointFileName) {
+		options.oldSourceCheckpointFileName = options.newCheckpointFileName
+	}
+	if options.oldTargetCheckpointFileName == "" && checkpointExists(base.TargetClusterName, options.newCheckpointFileName) {
+		options.oldTargetCheckpointFileName = options.newCheckpointFileName
+	}
+}
+
+func validateDaemon() {
+	if !options.daemon {
+		return
+	}
+	if options.subcommand != "" {
+		fmt.Fprintf(os.Stderr, "daemon cannot be run with the %v subcommand\n", options.subcommand)
+		os.Exit(1)
+	}
+	if !options.runDataGeneration || !options.runFileDiffer {
+		fmt.Fprintf(os.Stderr, "daemon requires both runDataGeneration and runFileDiffer\n")
+		os.Exit(1)
+	}
+	if options.daemonWindowInterval == 0 {
+		fmt.Fprintf(os.Stderr, "daemonWindowInterval needs to be greater than 0\n")
+		os.Exit(1)
+	}
+}
+
+func validateConsistentCut() {
+	if !options.consistentCut {
+		return
+	}
+	if !options.completeBySeqno || options.daemon {
+		fmt.Fprintf(os.Stderr, "consistentCut requires completeBySeqno, and cannot be run as a daemon\n")
+		os.Exit(1)
+	}
+	if options.subcommand != "" {
+		fmt.Fprintf(os.Stderr, "consistentCut cannot be run with the %v subcommand, since it needs to capture both clusters\n", options.subcommand)
+		os.Exit(1)
+	}
+	if len(options.targetUsername) > 0 {
+		fmt.Fprintf(os.Stderr, "consistentCut cannot be run in legacy mode, since it needs the XDCR checkpoints from the metadata store\n")
+		os.Exit(1)
+	}
+}
+
+func checkpointExists(clusterName, checkpointFileName string) bool {
+	_, err := os.Stat(utils.GetCheckpointFileName(options.checkpointFileDir, clusterName, checkpointFileName))
+	return err == nil
+}
+
+func newStorage(storageType string) storage.Storage {
+	switch storageType {
+	case base.StorageTypeLocal:
+		return storage.NewLocalStorage()
+	case base.StorageTypeS3:
+		s3Storage, err := storage.NewS3Storage(options.s3Endpoint, options.s3Bucket, options.s3Region,
+			os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		return s3Storage
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid storage %v. It needs to be one of %v\n", storageType, base.StorageTypes)
+		os.Exit(1)
+	}
+	return nil
+}
+
+func validateCaptureCluster(clusterName string) {
+	if options.subcommand != base.SubcommandCapture {
+		return
+	}
+	if clusterName != base.SourceClusterName && clusterName != base.TargetClusterName {
+		fmt.Fprintf(os.Stderr, "Invalid captureCluster '%v'. It needs to be either %v or %v\n", clusterName, base.SourceClusterName, base.TargetClusterName)
+		os.Exit(1)
+	}
+}
+
 func usage() {
-	fmt.Fprintf(os.Stderr, "Usage : %s [OPTIONS] \n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage : %s [%v | %v] [OPTIONS] \n", os.Args[0], base.SubcommandCapture, base.SubcommandDiff)
+	fmt.Fprintf(os.Stderr, "  %v - captures the cluster specified by captureCluster into a capture archive\n", base.SubcommandCapture)
+	fmt.Fprintf(os.Stderr, "  %v - diffs the capture archives in sourceFileDir and targetFileDir without access to the clusters\n", base.SubcommandDiff)
+	fmt.Fprintf(os.Stderr, "Without a subcommand, both clusters are captured and diffed in the same run\n")
 	flag.PrintDefaults()
 }
 
@@ -297,6 +520,13 @@ type xdcrDiffTool struct {
 	tgtCapabilities  metadata.Capability
 	srcClusterCompat int
 
+	srcNumberOfVbuckets int
+	tgtNumberOfVbuckets int
+	// codec that the bin files written by the tool are compressed with
+	binFileCodec uint16
+	// where the bin files are captured to and diffed from
+	binFileStorage storage.Storage
+
 	srcBucketManifest *metadata.CollectionsManifest
 	tgtBucketManifest *metadata.CollectionsManifest
 
@@ -321,12 +551,141 @@ type xdcrDiffTool struct {
 
 	sourceDcpDriver *dcp.DcpDriver
 	targetDcpDriver *dcp.DcpDriver
+	// for a consistent cut, the target seqnos that the replication checkpointed for the seqnos that the source is cut at
+	cutTargetSeqnos map[uint16]uint64
+	// the capture window that the daemon is capturing into
+	captureWindow int
+
+	// the capture archives being diffed, which are only set by the diff subcommand
+	sourceArchive *utils.CaptureArchive
+	targetArchive *utils.CaptureArchive
 
 	curState difftoolState
 
 	legacyMode bool
 	//Xattr Keys to be excluded for comparison
 	xattrKeysForNoCompare map[string]bool
+	// JSON paths of bodies to be excluded for comparison
+	ignoredJsonPathRules []*utils.IgnoredJsonPathRule
+
+	// summary of the diff being run, which is nil for the runs that do not diff
+	summary *diffSummary
+}
+
+// Summarizes the diff of a run, next to the stats of the replication at the start and the end of the run,
+// which can explain the differences found, such as those that were filtered or were still being replicated
+type diffSummary struct {
+	StartTime time.Time
+	EndTime   time.Time
+
+	SourceItemCount     int64
+	TargetItemCount     int64
+	SourceFilteredCount int64
+	TargetFilteredCount int64
+	// keys found different by the file differ, from the point of view of the source and of the target
+	FileDiffSourceKeys int
+	FileDiffTargetKeys int
+	// mismatched docs by the fields that differ between their source and target versions
+	FileDiffMismatchHistogram differ.MismatchHistogram
+	// differences still found by the mutation differ, by kind
+	MutationDiffCounts            map[string]int           `json:",omitempty"`
+	MutationDiffMismatchHistogram differ.MismatchHistogram `json:",omitempty"`
+
+	ReplicationStatsAtStart map[string]uint64 `json:",omitempty"`
+	ReplicationStatsAtEnd   map[string]uint64 `json:",omitempty"`
+	// how much each stat has changed over the run
+	ReplicationStatsDelta map[string]int64 `json:",omitempty"`
+}
+
+func newDiffSummary() *diffSummary {
+	return &diffSummary{StartTime: time.Now()}
+}
+
+func (s *diffSummary) setReplicationStatsAtEnd(stats map[string]uint64) {
+	s.ReplicationStatsAtEnd = stats
+	s.ReplicationStatsDelta = make(map[string]int64)
+	for name, end := range stats {
+		if start, exists := s.ReplicationStatsAtStart[name]; exists {
+			s.ReplicationStatsDelta[name] = int64(end) - int64(start)
+		}
+	}
+}
+
+func getDiffSummaryFileName() string {
+	if options.diffSummaryFile != "" {
+		return options.diffSummaryFile
+	}
+	return options.fileDifferDir + base.FileDirDelimiter + base.DiffSummaryFileName
+}
+
+func (s *diffSummary) write(fileName string, logger *xdcrLog.CommonLogger) error {
+	s.EndTime = time.Now()
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	logger.Infof("Diff summary: %s\n", data)
+	// fileDifferDir does not exist when the file differ has been skipped
+	err = os.MkdirAll(filepath.Dir(fileName), 0777)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fileName, data, base.FileModeReadWrite)
+}
+
+// Loads the rules of the JSON paths that are not compared, one per line. Blank lines and lines starting with # are skipped
+func loadIgnoredJsonPathRules(fileName string) ([]*utils.IgnoredJsonPathRule, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var rules []*utils.IgnoredJsonPathRule
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := utils.ParseIgnoredJsonPathRule(line)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Resolves the JSON paths that are not compared to the collections of the source by name, and to the collections of
+// the target through the collection mapping of the replication, so that the paths of a rule apply to the same docs
+// on both clusters. Without the manifest of the source, which is only retrieved when both clusters support
+// collections, only the default collection can be resolved
+func (difftool *xdcrDiffTool) resolveIgnoredJsonPaths() (*utils.IgnoredJsonPaths, *utils.IgnoredJsonPaths) {
+	if len(difftool.ignoredJsonPathRules) == 0 {
+		return nil, nil
+	}
+	manifest := difftool.srcBucketManifest
+	getCollectionId := func(scope, collection string) (uint32, error) {
+		if manifest != nil {
+			return manifest.GetCollectionId(scope, collection)
+		}
+		if scope == xdcrBase.DefaultScopeCollectionName && collection == xdcrBase.DefaultScopeCollectionName {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("no manifest")
+	}
+	srcIgnoredJsonPaths, unresolved := utils.NewIgnoredJsonPaths(difftool.ignoredJsonPathRules, getCollectionId)
+	for _, namespace := range unresolved {
+		difftool.logger.Warnf("Ignoring the JSON paths of %v, which is not a collection of the source bucket\n", namespace)
+	}
+	return srcIgnoredJsonPaths, srcIgnoredJsonPaths.MapCollections(difftool.srcToTgtColIdsMap)
+}
+
+// the settings that the files of this run are captured with
+func (difftool *xdcrDiffTool) captureSettings() *utils.CaptureSettings {
+	if difftool.sourceArchive != nil {
+		// the files can only be diffed the way they were captured
+		return difftool.sourceArchive.CaptureSettings
+	}
+	return utils.NewCaptureSettings(options.compareXattrs, options.semanticJsonCompare, difftool.xattrKeysForNoCompare, difftool.ignoredJsonPathRules)
 }
 
 func staticHostAddr() string {
@@ -354,6 +713,13 @@ func NewDiffTool(legacyMode bool) (*xdcrDiffTool, error) {
 			difftool.xattrKeysForNoCompare[fileScanner.Text()] = true
 		}
 	}
+	if options.fileContainingIgnoredJsonPaths != "" {
+		difftool.ignoredJsonPathRules, err = loadIgnoredJsonPathRules(options.fileContainingIgnoredJsonPaths)
+		if err != nil {
+			fmt.Printf("Error in reading the file %v. err=%v\n", options.fileContainingIgnoredJsonPaths, err)
+			return nil, err
+		}
+	}
 	// HLV and ImportCas needs to be stripped from the Xattrs
 	difftool.xattrKeysForNoCompare[xdcrBase.XATTR_HLV] = true
 	difftool.xattrKeysForNoCompare[xdcrBase.XATTR_MOU] = true
@@ -463,6 +829,69 @@ func NewDiffTool(legacyMode bool) (*xdcrDiffTool, error) {
 	return difftool, err
 }
 
+// Sets up the tool to diff the capture archives in sourceFileDir and targetFileDir, without access to the clusters
+func NewOfflineDiffTool(binFileStorage storage.Storage) (*xdcrDiffTool, error) {
+	var err error
+	difftool := &xdcrDiffTool{
+		utils:          xdcrUtils.NewUtilities(),
+		binFileStorage: binFileStorage,
+	}
+	difftool.logger = xdcrLog.NewLogger("xdcrDiffTool", xdcrLog.DefaultLoggerContext)
+	if options.debugMode {
+		xdcrLog.DefaultLoggerContext.SetLogLevel(xdcrLog.LogLevelDebug)
+	}
+
+	difftool.sourceArchive, err = utils.ReadCaptureArchive(binFileStorage, options.sourceFileDir, base.SourceClusterName)
+	if err != nil {
+		return nil, err
+	}
+	difftool.targetArchive, err = utils.ReadCaptureArchive(binFileStorage, options.targetFileDir, base.TargetClusterName)
+	if err != nil {
+		return nil, err
+	}
+	if difftool.sourceArchive.NumberOfBins != difftool.targetArchive.NumberOfBins {
+		return nil, fmt.Errorf("source cluster was captured into %v bins per vbucket while target cluster was captured into %v bins per vbucket",
+			difftool.sourceArchive.NumberOfBins, difftool.targetArchive.NumberOfBins)
+	}
+	if diffs := difftool.sourceArchive.CaptureSettings.Diff(difftool.targetArchive.CaptureSettings); len(diffs) > 0 {
+		return nil, fmt.Errorf("source and target clusters were captured with different %v", strings.Join(diffs, ", "))
+	}
+	difftool.logger.Infof("Diffing source bucket %v captured at %v with target bucket %v captured at %v\n",
+		difftool.sourceArchive.BucketName, difftool.sourceArchive.CaptureTime, difftool.targetArchive.BucketName, difftool.targetArchive.CaptureTime)
+
+	// the files can only be diffed the way they were captured
+	options.numberOfBins = uint64(difftool.sourceArchive.NumberOfBins)
+	difftool.binFileCodec, err = utils.GetBinFileCodec(difftool.sourceArchive.BinFileCompression)
+	if err != nil {
+		return nil, err
+	}
+	difftool.srcNumberOfVbuckets = difftool.sourceArchive.NumberOfVbuckets
+	difftool.tgtNumberOfVbuckets = difftool.targetArchive.NumberOfVbuckets
+	difftool.srcToTgtColIdsMap = difftool.sourceArchive.CollectionMapping
+	difftool.colFilterOrderedKeys = difftool.sourceArchive.ColFilterStrings
+	difftool.colFilterOrderedTargetColId = difftool.sourceArchive.ColFilterTgtIds
+
+	difftool.selfRef, err = metadata.NewRemoteClusterReference(difftool.sourceArchive.ClusterUUID, base.SelfReferenceName, "", "", "",
+		"", false, "", nil, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	difftool.specifiedRef, err = metadata.NewRemoteClusterReference(difftool.targetArchive.ClusterUUID, options.remoteClusterName, "", "", "",
+		"", false, "", nil, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	difftool.specifiedSpec, err = metadata.NewReplicationSpecification(difftool.sourceArchive.BucketName, difftool.sourceArchive.BucketUUID,
+		difftool.targetArchive.ClusterUUID, difftool.targetArchive.BucketName, difftool.targetArchive.BucketUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	go difftool.monitorInterruptSignal()
+
+	return difftool, nil
+}
+
 func setupSecuritySvcMock(securitySvc *service_def_mock.SecuritySvc) {
 	securitySvc.On("IsClusterEncryptionLevelStrict").Return(false)
 }
@@ -621,11 +1050,24 @@ func main() {
 	base.SetupTimeoutSeconds = options.setupTimeout
 
 	validateCompareType(options.compareType)
+	validateCaptureCluster(options.captureCluster)
+	validateDaemon()
+	validateConsistentCut()
+	binFileCodec := validateBinFileCompression(options.binFileCompression)
+	binFileStorage := newStorage(options.storage)
+
+	if options.subcommand != base.SubcommandDiff {
+		setupIncrementalCheckpoints()
+	}
 
 	fmt.Printf("differ is run with options: %+v\n", options)
+	if options.subcommand == base.SubcommandDiff {
+		runOfflineDiff(binFileStorage)
+		return
+	}
 	legacyMode := len(options.targetUsername) > 0
 
-	if err := setupDirectories(); err != nil {
+	if err := setupDirectories(binFileStorage); err != nil {
 		fmt.Printf("Unable to set up directory structure: %v\n", err)
 		os.Exit(1)
 	}
@@ -635,6 +1077,8 @@ func main() {
 		fmt.Printf("Error creating difftool: %v\n", err)
 		os.Exit(1)
 	}
+	difftool.binFileCodec = binFileCodec
+	difftool.binFileStorage = binFileStorage
 
 	if options.enforceTLS {
 		// For using certificates, the source cluster must be on a loopback device since we will be retrieving the
@@ -656,6 +1100,25 @@ func main() {
 			os.Exit(1)
 		}
 	}
+	if err := difftool.retrieveNumberOfVbuckets(); err != nil {
+		fmt.Printf("Error retrieving number of vbuckets. err=%v\n", err)
+		os.Exit(1)
+	}
+
+	if options.daemon {
+		err := difftool.runDaemon()
+		if err != nil {
+			fmt.Printf("Error running daemon. err=%v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if options.subcommand != base.SubcommandCapture {
+		difftool.summary = newDiffSummary()
+		difftool.summary.ReplicationStatsAtStart = difftool.getReplicationStats()
+	}
+
 	if options.runDataGeneration {
 		err := difftool.generateDataFiles()
 		if err != nil {
@@ -666,6 +1129,15 @@ func main() {
 		fmt.Printf("Skipping  generating data files since it has been disabled\n")
 	}
 
+	if options.subcommand == base.SubcommandCapture {
+		err := difftool.writeCaptureArchive()
+		if err != nil {
+			fmt.Printf("Error writing capture archive. err=%v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if options.runFileDiffer {
 		err := difftool.diffDataFiles()
 		if err != nil {
@@ -681,6 +1153,36 @@ func main() {
 	} else {
 		fmt.Printf("Skipping mutation diff since it has been disabled\n")
 	}
+
+	difftool.summary.setReplicationStatsAtEnd(difftool.getReplicationStats())
+	err = difftool.summary.write(getDiffSummaryFileName(), difftool.logger)
+	if err != nil {
+		fmt.Printf("Error writing diff summary. err=%v\n", err)
+		os.Exit(1)
+	}
+}
+
+// diffs the capture archives in sourceFileDir and targetFileDir
+func runOfflineDiff(binFileStorage storage.Storage) {
+	difftool, err := NewOfflineDiffTool(binFileStorage)
+	if err != nil {
+		fmt.Printf("Error creating difftool: %v\n", err)
+		os.Exit(1)
+	}
+
+	difftool.summary = newDiffSummary()
+	err = difftool.diffDataFiles()
+	if err != nil {
+		fmt.Printf("Error running file difftool. err=%v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Skipping mutation diff since the %v subcommand does not access the clusters\n", base.SubcommandDiff)
+
+	err = difftool.summary.write(getDiffSummaryFileName(), difftool.logger)
+	if err != nil {
+		fmt.Printf("Error writing diff summary. err=%v\n", err)
+		os.Exit(1)
+	}
 }
 
 func isURLLoopBack(url string) bool {
@@ -689,12 +1191,12 @@ func isURLLoopBack(url string) bool {
 	return IPLoopbackCheck.IsLoopback() || hostNameIsLocalHost
 }
 
-func setupDirectories() error {
-	err := os.MkdirAll(options.sourceFileDir, 0777)
+func setupDirectories(binFileStorage storage.Storage) error {
+	err := binFileStorage.MkdirAll(options.sourceFileDir)
 	if err != nil {
 		fmt.Printf("Error mkdir sourceFileDir: %v\n", err)
 	}
-	err = os.MkdirAll(options.targetFileDir, 0777)
+	err = binFileStorage.MkdirAll(options.targetFileDir)
 	if err != nil {
 		fmt.Printf("Error mkdir targetFileDir: %v\n", err)
 	}
@@ -741,59 +1243,331 @@ func (difftool *xdcrDiffTool) generateDataFiles() error {
 
 	errChan := make(chan error, 1)
 	waitGroup := &sync.WaitGroup{}
+	delayDurationBetweenSourceAndTarget, err := difftool.startDcpDrivers(errChan, waitGroup, options.completeBySeqno)
+	if err != nil {
+		return err
+	}
+
+	if options.completeBySeqno {
+		err = difftool.waitForCompletion(difftool.sourceDcpDriver, difftool.targetDcpDriver, errChan, waitGroup)
+	} else {
+		err = difftool.waitForDuration(difftool.sourceDcpDriver, difftool.targetDcpDriver, errChan, options.completeByDuration, delayDurationBetweenSourceAndTarget)
+	}
+	if err != nil {
+		return err
+	}
+
+	// the bin files may be diffed by another process, e.g. from a capture archive
+	err = difftool.binFileStorage.Sync()
+	if err != nil {
+		return fmt.Errorf("Error syncing bin files to %v. err=%v", difftool.binFileStorage, err)
+	}
+	return nil
+}
+
+// starts the dcp drivers of the clusters captured by this run
+// returns the delay between starting the source and the target
+func (difftool *xdcrDiffTool) startDcpDrivers(errChan chan error, waitGroup *sync.WaitGroup, completeBySeqno bool) (time.Duration, error) {
+	if options.consistentCut {
+		err := difftool.waitForReplicationToDrain("before taking the source seqnos")
+		if err != nil {
+			return 0, err
+		}
+	}
 
 	var fileDescPool fdp.FdPoolIface
 	if options.numberOfFileDesc > 0 {
-		fileDescPool = fdp.NewFileDescriptorPool(int(options.numberOfFileDesc))
+		fileDescPool = fdp.NewFileDescriptorPoolWithStorage(int(options.numberOfFileDesc), difftool.binFileStorage)
 	}
 
 	if err := difftool.createFilter(); err != nil {
 		difftool.logger.Errorf("Error creating filter: %v", err.Error())
 		os.Exit(1)
 	}
+	srcIgnoredJsonPaths, tgtIgnoredJsonPaths := difftool.resolveIgnoredJsonPaths()
+	var srcEndSeqnoCut, tgtEndSeqnoCut dcp.EndSeqnoCut
+	if options.consistentCut {
+		srcEndSeqnoCut, tgtEndSeqnoCut = difftool.cutSourceAtCheckpoints, difftool.cutTargetAtCheckpoints
+	}
+
+	if capturesCluster(base.SourceClusterName) {
+		difftool.sourceDcpDriver = startDcpDriver(difftool.logger, base.SourceClusterName, options.sourceUrl, difftool.specifiedSpec.SourceBucketName,
+			difftool.srcNumberOfVbuckets, difftool.selfRef, difftool.getCaptureFileDir(options.sourceFileDir), options.checkpointFileDir,
+			options.oldSourceCheckpointFileName, options.newCheckpointFileName, options.numberOfSourceDcpClients,
+			options.numberOfWorkersPerSourceDcpClient, options.numberOfBins, options.sourceDcpHandlerChanSize,
+			options.bucketOpTimeout, options.maxNumOfGetStatsRetry, options.getStatsRetryInterval,
+			options.getStatsMaxBackoff, options.checkpointInterval, errChan, waitGroup, completeBySeqno, fileDescPool, difftool.filter,
+			difftool.srcCapabilities, difftool.srcCollectionIds, difftool.colFilterOrderedKeys, difftool.utils, options.bucketBufferCapacity, difftool.binFileCodec, difftool.binFileStorage,
+			difftool.migrationMapping, difftool.specifiedSpec.Settings.GetMobileCompatible(), difftool.specifiedSpec.Settings.GetExpDelMode(), difftool.xattrKeysForNoCompare, options.compareXattrs, options.semanticJsonCompare,
+			srcIgnoredJsonPaths,
+			dcp.CaptureLimits{BytesPerSec: options.sourceDcpBytesPerSec, MutationsPerSec: options.sourceDcpMutationsPerSec}, srcEndSeqnoCut)
+	}
+
+	// there is nothing to wait for when only one of the clusters is captured
+	var delayDurationBetweenSourceAndTarget time.Duration
+	if options.consistentCut {
+		// the target is cut at the target seqnos of the checkpoints that the source has been cut at
+		err := difftool.waitForSourceSeqnos(errChan)
+		if err != nil {
+			difftool.stopDcpDriver(difftool.sourceDcpDriver)
+			return 0, err
+		}
+	} else if options.subcommand != base.SubcommandCapture {
+		delayDurationBetweenSourceAndTarget = time.Duration(options.delayBetweenSourceAndTarget) * time.Second
+		difftool.logger.Infof("Waiting for %v before starting target dcp clients\n", delayDurationBetweenSourceAndTarget)
+		time.Sleep(delayDurationBetweenSourceAndTarget)
+	}
 
-	difftool.sourceDcpDriver = startDcpDriver(difftool.logger, base.SourceClusterName, options.sourceUrl, difftool.specifiedSpec.SourceBucketName,
-		difftool.selfRef, options.sourceFileDir, options.checkpointFileDir,
-		options.oldSourceCheckpointFileName, options.newCheckpointFileName, options.numberOfSourceDcpClients,
-		options.numberOfWorkersPerSourceDcpClient, options.numberOfBins, options.sourceDcpHandlerChanSize,
-		options.bucketOpTimeout, options.maxNumOfGetStatsRetry, options.getStatsRetryInterval,
-		options.getStatsMaxBackoff, options.checkpointInterval, errChan, waitGroup, options.completeBySeqno, fileDescPool, difftool.filter,
-		difftool.srcCapabilities, difftool.srcCollectionIds, difftool.colFilterOrderedKeys, difftool.utils, options.bucketBufferCapacity,
-		difftool.migrationMapping, difftool.specifiedSpec.Settings.GetMobileCompatible(), difftool.specifiedSpec.Settings.GetExpDelMode(), difftool.xattrKeysForNoCompare)
-
-	delayDurationBetweenSourceAndTarget := time.Duration(options.delayBetweenSourceAndTarget) * time.Second
-	difftool.logger.Infof("Waiting for %v before starting target dcp clients\n", delayDurationBetweenSourceAndTarget)
-	time.Sleep(delayDurationBetweenSourceAndTarget)
+	if capturesCluster(base.TargetClusterName) {
+		difftool.logger.Infof("Starting target dcp clients\n")
+		difftool.targetDcpDriver = startDcpDriver(difftool.logger, base.TargetClusterName, difftool.specifiedRef.HostName_,
+			difftool.specifiedSpec.TargetBucketName, difftool.tgtNumberOfVbuckets, difftool.specifiedRef,
+			difftool.getCaptureFileDir(options.targetFileDir), options.checkpointFileDir, options.oldTargetCheckpointFileName, options.newCheckpointFileName,
+			options.numberOfTargetDcpClients, options.numberOfWorkersPerTargetDcpClient, options.numberOfBins, options.targetDcpHandlerChanSize,
+			options.bucketOpTimeout, options.maxNumOfGetStatsRetry, options.getStatsRetryInterval, options.getStatsMaxBackoff,
+			options.checkpointInterval, errChan, waitGroup, completeBySeqno, fileDescPool, difftool.filter,
+			difftool.tgtCapabilities, difftool.tgtCollectionIds, difftool.colFilterOrderedKeys, difftool.utils, options.bucketBufferCapacity, difftool.binFileCodec, difftool.binFileStorage,
+			difftool.migrationMapping, difftool.specifiedSpec.Settings.GetMobileCompatible(), difftool.specifiedSpec.Settings.GetExpDelMode(), difftool.xattrKeysForNoCompare, options.compareXattrs, options.semanticJsonCompare,
+			tgtIgnoredJsonPaths,
+			dcp.CaptureLimits{BytesPerSec: options.targetDcpBytesPerSec, MutationsPerSec: options.targetDcpMutationsPerSec}, tgtEndSeqnoCut)
+	}
 
-	difftool.logger.Infof("Starting target dcp clients\n")
-	difftool.targetDcpDriver = startDcpDriver(difftool.logger, base.TargetClusterName, difftool.specifiedRef.HostName_,
-		difftool.specifiedSpec.TargetBucketName, difftool.specifiedRef,
-		options.targetFileDir, options.checkpointFileDir, options.oldTargetCheckpointFileName, options.newCheckpointFileName,
-		options.numberOfTargetDcpClients, options.numberOfWorkersPerTargetDcpClient, options.numberOfBins, options.targetDcpHandlerChanSize,
-		options.bucketOpTimeout, options.maxNumOfGetStatsRetry, options.getStatsRetryInterval, options.getStatsMaxBackoff,
-		options.checkpointInterval, errChan, waitGroup, options.completeBySeqno, fileDescPool, difftool.filter,
-		difftool.tgtCapabilities, difftool.tgtCollectionIds, difftool.colFilterOrderedKeys, difftool.utils, options.bucketBufferCapacity,
-		difftool.migrationMapping, difftool.specifiedSpec.Settings.GetMobileCompatible(), difftool.specifiedSpec.Settings.GetExpDelMode(), difftool.xattrKeysForNoCompare)
+	if options.captureLimitsFile != "" {
+		// the waitGroup is done once both drivers have stopped, which stops the watch with them
+		stopCh := make(chan bool)
+		go utils.WaitForWaitGroup(waitGroup, stopCh)
+		go difftool.watchCaptureLimitsFile(options.captureLimitsFile, stopCh)
+	}
 
 	difftool.curState.mtx.Lock()
 	difftool.curState.state = StateDcpStarted
 	difftool.curState.mtx.Unlock()
 
-	var err error
-	if options.completeBySeqno {
-		err = difftool.waitForCompletion(difftool.sourceDcpDriver, difftool.targetDcpDriver, errChan, waitGroup)
+	return delayDurationBetweenSourceAndTarget, nil
+}
+
+// Polls the changes left to replicate until they are at or below changesLeftThreshold, or until consistentCutTimeout,
+// after which the cut is taken anyway. The cut itself comes from the checkpoints, so draining only keeps it from
+// leaving out more of the source than it needs to
+func (difftool *xdcrDiffTool) waitForReplicationToDrain(stage string) error {
+	timeout := time.Duration(options.consistentCutTimeout) * time.Second
+	difftool.logger.Infof("Waiting up to %v for the changes left to replicate to drain to %v %v\n", timeout, options.changesLeftThreshold, stage)
+
+	ticker := time.NewTicker(time.Duration(base.ChangesLeftPollInterval) * time.Second)
+	defer ticker.Stop()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		changesLeft, err := difftool.getReplicationStat(base.XdcrChangesLeftStatName)
+		if err != nil {
+			return fmt.Errorf("Error getting changes left to replicate. err=%v", err)
+		}
+		if changesLeft <= options.changesLeftThreshold {
+			difftool.logger.Infof("Replication has drained to %v changes left %v\n", changesLeft, stage)
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-timer.C:
+			difftool.logger.Warnf("Replication still has %v changes left after %v. Proceeding %v, so the cut may leave out more of the source\n",
+				changesLeft, timeout, stage)
+			return nil
+		}
+	}
+}
+
+// the latest value of a stat of the replication being diffed, summed over the nodes of the source cluster
+func (difftool *xdcrDiffTool) getReplicationStat(statName string) (uint64, error) {
+	params := url.Values{}
+	params.Set("sourceBucketName", difftool.specifiedSpec.SourceBucketName)
+	params.Set("targetClusterUUID", difftool.specifiedRef.Uuid_)
+	params.Set("targetBucketName", difftool.specifiedSpec.TargetBucketName)
+	params.Set("pipelineType", base.XdcrPipelineTypeMain)
+	params.Set("nodesAggregation", "sum")
+	path := base.StatsRangePath + statName + "?" + params.Encode()
+
+	var statsRange map[string]interface{}
+	err, statusCode := difftool.utils.QueryRestApi(options.sourceUrl, path, false, xdcrBase.MethodGet, "", nil, 0, &statsRange, difftool.logger)
+	if err != nil || statusCode != http.StatusOK {
+		return 0, fmt.Errorf("Failed on calling %v, err=%v, statusCode=%v", path, err, statusCode)
+	}
+	return utils.GetLatestStatFromStatsRange(statName, statsRange)
+}
+
+// the stats of the replication that the diff summary reports. Those that cannot be retrieved, such as
+// from clusters whose version does not serve them, are left out
+func (difftool *xdcrDiffTool) getReplicationStats() map[string]uint64 {
+	stats := make(map[string]uint64)
+	for name, statName := range base.XdcrSummaryStats {
+		value, err := difftool.getReplicationStat(statName)
+		if err != nil {
+			difftool.logger.Warnf("Unable to get %v of the replication for the diff summary. err=%v\n", name, err)
+			continue
+		}
+		stats[name] = value
+	}
+	return stats
+}
+
+// Cuts each vbucket of the source at the seqno of its latest XDCR checkpoint at or below its high seqno, and keeps the
+// target seqno that the checkpoint recorded for cutTargetAtCheckpoints. The checkpoint has to be of the current vbuuid,
+// since the seqnos of an older one may have been rolled back
+func (difftool *xdcrDiffTool) cutSourceAtCheckpoints(vbuuids, highSeqnos map[uint16]uint64) (map[uint16]uint64, error) {
+	if difftool.srcNumberOfVbuckets != difftool.tgtNumberOfVbuckets {
+		return nil, fmt.Errorf("consistentCut needs the source and target buckets to have the same number of vbuckets. source=%v target=%v",
+			difftool.srcNumberOfVbuckets, difftool.tgtNumberOfVbuckets)
+	}
+	checkpointsSvc, err := metadata_svc.NewCheckpointsService(difftool.metadataSvc, difftool.logger.LoggerContext(), difftool.utils, difftool.replicationSpecSvc)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating checkpoints service. err=%v", err)
+	}
+	checkpointsDocs, err := checkpointsSvc.CheckpointsDocs(difftool.specifiedSpec.Id, false)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting checkpoints of replication %v. err=%v", difftool.specifiedSpec.Id, err)
+	}
+
+	cutSeqnos := make(map[uint16]uint64)
+	difftool.cutTargetSeqnos = make(map[uint16]uint64)
+	var seqnosLeftOut uint64
+	for vbno, highSeqno := range highSeqnos {
+		// nothing can be in flight from a vbucket without mutations, so the target is not cut for it
+		if highSeqno == 0 {
+			cutSeqnos[vbno] = 0
+			continue
+		}
+		record := getCheckpointToCutAt(checkpointsDocs[vbno], vbuuids[vbno], highSeqno)
+		if record == nil {
+			return nil, fmt.Errorf("Replication %v has no checkpoint of vbucket %v at or below its high seqno %v since it last failed over. Wait for the replication to checkpoint and retry",
+				difftool.specifiedSpec.Id, vbno, highSeqno)
+		}
+		cutSeqnos[vbno] = record.Seqno
+		difftool.cutTargetSeqnos[vbno] = record.Target_Seqno
+		seqnosLeftOut += highSeqno - record.Seqno
+	}
+	difftool.logger.Infof("Cut the source at the XDCR checkpoints, which leaves out %v seqnos past them\n", seqnosLeftOut)
+	return cutSeqnos, nil
+}
+
+// the latest checkpoint record of vbuuid at or below highSeqno, or nil if there is none
+func getCheckpointToCutAt(doc *metadata.CheckpointsDoc, vbuuid, highSeqno uint64) *metadata.CheckpointRecord {
+	if doc == nil {
+		return nil
+	}
+	var latest *metadata.CheckpointRecord
+	for _, record := range doc.Checkpoint_records {
+		if record == nil || record.Failover_uuid != vbuuid || record.Seqno > highSeqno {
+			continue
+		}
+		if latest == nil || record.Seqno > latest.Seqno {
+			latest = record
+		}
+	}
+	return latest
+}
+
+// Cuts each vbucket of the target at the target seqno that the checkpoint that the source was cut at recorded. Those
+// of vbuckets that the source has no mutations in are left at their high seqnos
+func (difftool *xdcrDiffTool) cutTargetAtCheckpoints(vbuuids, highSeqnos map[uint16]uint64) (map[uint16]uint64, error) {
+	cutSeqnos := make(map[uint16]uint64)
+	for vbno, highSeqno := range highSeqnos {
+		cutSeqno, exists := difftool.cutTargetSeqnos[vbno]
+		if !exists {
+			cutSeqnos[vbno] = highSeqno
+			continue
+		}
+		if cutSeqno > highSeqno {
+			return nil, fmt.Errorf("Target vbucket %v has a high seqno of %v, which is below the target seqno %v of the checkpoint that the source was cut at. The target may have been rolled back",
+				vbno, highSeqno, cutSeqno)
+		}
+		cutSeqnos[vbno] = cutSeqno
+	}
+	return cutSeqnos, nil
+}
+
+// waits for the source dcp driver to take the seqnos that it completes by
+func (difftool *xdcrDiffTool) waitForSourceSeqnos(errChan chan error) error {
+	select {
+	case <-difftool.sourceDcpDriver.EndSeqnosTaken():
+		return nil
+	case err := <-errChan:
+		// put back for waitForCompletion to see
+		utils.AddToErrorChan(errChan, err)
+		return err
+	}
+}
+
+// Describes the cluster that has been captured into its file dir, together with what is needed to diff it
+// without access to the clusters
+func (difftool *xdcrDiffTool) writeCaptureArchive() error {
+	archive := &utils.CaptureArchive{
+		ClusterName:        options.captureCluster,
+		NumberOfBins:       int(options.numberOfBins),
+		BinFileCompression: base.BinFileCodecNames[difftool.binFileCodec],
+		CollectionMapping:  difftool.srcToTgtColIdsMap,
+		ColFilterStrings:   difftool.colFilterOrderedKeys,
+		ColFilterTgtIds:    difftool.colFilterOrderedTargetColId,
+		CaptureSettings:    difftool.captureSettings(),
+		CaptureTime:        time.Now(),
+	}
+	var dcpDriver *dcp.DcpDriver
+	var fileDir string
+	isSource := options.captureCluster == base.SourceClusterName
+	if isSource {
+		dcpDriver, fileDir = difftool.sourceDcpDriver, options.sourceFileDir
+		archive.ClusterUUID = difftool.selfRef.Uuid_
+		archive.BucketName = difftool.specifiedSpec.SourceBucketName
+		archive.BucketUUID = difftool.specifiedSpec.SourceBucketUUID
+		archive.NumberOfVbuckets = difftool.srcNumberOfVbuckets
 	} else {
-		err = difftool.waitForDuration(difftool.sourceDcpDriver, difftool.targetDcpDriver, errChan, options.completeByDuration, delayDurationBetweenSourceAndTarget)
+		dcpDriver, fileDir = difftool.targetDcpDriver, options.targetFileDir
+		archive.ClusterUUID = difftool.specifiedRef.Uuid_
+		archive.BucketName = difftool.specifiedSpec.TargetBucketName
+		archive.BucketUUID = difftool.specifiedSpec.TargetBucketUUID
+		archive.NumberOfVbuckets = difftool.tgtNumberOfVbuckets
+	}
+	if dcpDriver == nil {
+		return fmt.Errorf("%v cluster has not been captured since data generation has been disabled", options.captureCluster)
 	}
+	archive.FilteredCount = dcpDriver.FilteredCount()
 
-	return err
+	// in legacy mode, there is no bucketTopologySvc to fetch the pruning window from
+	if difftool.bucketTopologySvc != nil {
+		pruningWindow, err := differ.GetVersionPruningWindow(difftool.bucketTopologySvc, difftool.specifiedSpec, isSource)
+		if err != nil {
+			return err
+		}
+		archive.VersionPruningWindowHrs = int(pruningWindow / time.Hour)
+	}
+
+	if checkpointFileName := dcpDriver.CheckpointFileName(); checkpointFileName != "" {
+		checkpoint, err := ioutil.ReadFile(checkpointFileName)
+		if err != nil {
+			return fmt.Errorf("Error reading checkpoint %v. err=%v", checkpointFileName, err)
+		}
+		err = difftool.binFileStorage.WriteFile(utils.GetCaptureCheckpointFileName(fileDir), checkpoint)
+		if err != nil {
+			return err
+		}
+		archive.HasCheckpoint = true
+	} else {
+		difftool.logger.Warnf("Capture archive %v has no checkpoint since newCheckpointFileName is not specified\n", fileDir)
+	}
+
+	err := utils.WriteCaptureArchive(difftool.binFileStorage, fileDir, archive)
+	if err != nil {
+		return err
+	}
+	difftool.logger.Infof("Captured %v cluster into capture archive %v in %v\n", options.captureCluster, fileDir, difftool.binFileStorage)
+	return nil
 }
 
 func (difftool *xdcrDiffTool) diffDataFiles() error {
 	difftool.logger.Infof("DiffDataFiles routine started\n")
 	defer difftool.logger.Infof("DiffDataFiles routine completed\n")
 
-	err := os.RemoveAll(options.fileDifferDir)
+	err := removeFileDifferResults()
 	if err != nil {
 		difftool.logger.Errorf("Error removing fileDifferDir: %v\n", err)
 	}
@@ -802,52 +1576,134 @@ func (difftool *xdcrDiffTool) diffDataFiles() error {
 		return fmt.Errorf("Error mkdir fileDifferDir: %v\n", err)
 	}
 
+	numberOfKeyHashPartitions := int(options.numberOfKeyHashPartitions)
+	if numberOfKeyHashPartitions == 0 && difftool.srcNumberOfVbuckets != difftool.tgtNumberOfVbuckets {
+		numberOfKeyHashPartitions = difftool.srcNumberOfVbuckets
+		if difftool.tgtNumberOfVbuckets > numberOfKeyHashPartitions {
+			numberOfKeyHashPartitions = difftool.tgtNumberOfVbuckets
+		}
+		numberOfKeyHashPartitions *= int(options.numberOfBins)
+		difftool.logger.Infof("Source bucket has %v vbuckets while target bucket has %v vbuckets. Diffing files by %v key hash partitions\n",
+			difftool.srcNumberOfVbuckets, difftool.tgtNumberOfVbuckets, numberOfKeyHashPartitions)
+	}
+	diffUnit := "vb"
+	if numberOfKeyHashPartitions > 0 {
+		diffUnit = "key hash partition"
+	}
+
 	difftoolDriver := differ.NewDifferDriver(options.sourceFileDir, options.targetFileDir, options.fileDifferDir,
 		base.DiffKeysFileName, int(options.numberOfWorkersForFileDiffer), int(options.numberOfBins),
-		int(options.numberOfFileDesc), difftool.srcToTgtColIdsMap, difftool.colFilterOrderedKeys, difftool.colFilterOrderedTargetColId, difftool.selfRef.Uuid_, difftool.specifiedRef.Uuid_, difftool.specifiedSpec.SourceBucketUUID, difftool.specifiedSpec.TargetBucketUUID, difftool.bucketTopologySvc, difftool.specifiedSpec, difftool.logger)
+		difftool.srcNumberOfVbuckets, difftool.tgtNumberOfVbuckets, numberOfKeyHashPartitions,
+		int(options.numberOfFileDesc), int(options.fileDifferMemoryBudgetMB)*1024*1024, diffsIncrementally(), difftool.binFileCodec, difftool.binFileStorage, difftool.srcToTgtColIdsMap, difftool.colFilterOrderedKeys, difftool.colFilterOrderedTargetColId, difftool.selfRef.Uuid_, difftool.specifiedRef.Uuid_, difftool.specifiedSpec.SourceBucketUUID, difftool.specifiedSpec.TargetBucketUUID, difftool.bucketTopologySvc, difftool.specifiedSpec, difftool.logger)
+	difftoolDriver.SetCompareSettings(options.compareType, difftool.captureSettings())
+	if difftool.sourceArchive != nil {
+		difftoolDriver.SetPruningWindows(time.Duration(difftool.sourceArchive.VersionPruningWindowHrs)*time.Hour,
+			time.Duration(difftool.targetArchive.VersionPruningWindowHrs)*time.Hour)
+	}
 	err = difftoolDriver.Run()
 	if err != nil {
 		difftool.logger.Errorf("Error from diffDataFiles = %v\n", err)
 	}
+	srcFilteredCount, tgtFilteredCount := difftool.filteredCounts()
 	difftoolDriver.MapLock.RLock()
 	if difftool.colFilterOrderedKeys == nil {
-		difftool.logger.Infof("Source vb to item count map: %v", difftoolDriver.SrcVbItemCntMap)
+		difftool.logger.Infof("Source %v to item count map: %v", diffUnit, difftoolDriver.SrcVbItemCntMap)
 	}
-	difftool.logger.Infof("Target vb to item count map: %v", difftoolDriver.TgtVbItemCntMap)
+	difftool.logger.Infof("Target %v to item count map: %v", diffUnit, difftoolDriver.TgtVbItemCntMap)
 	difftoolDriver.MapLock.RUnlock()
 	if difftool.colFilterOrderedKeys == nil {
-		difftool.logger.Infof("Source bucket item count including tombstones is %v (excluding %v filtered mutations)", difftoolDriver.SourceItemCount, difftool.sourceDcpDriver.FilteredCount())
+		difftool.logger.Infof("Source bucket item count including tombstones is %v (excluding %v filtered mutations)", difftoolDriver.SourceItemCount, srcFilteredCount)
 	} else {
 		difftool.logger.Infof("Replication is in migration mode from the source bucket")
 	}
-	difftool.logger.Infof("Target bucket item count including tombstones is %v (excluding %v filtered mutations)", difftoolDriver.TargetItemCount, difftool.targetDcpDriver.FilteredCount())
+	difftool.logger.Infof("Target bucket item count including tombstones is %v (excluding %v filtered mutations)", difftoolDriver.TargetItemCount, tgtFilteredCount)
 	if difftool.colFilterOrderedKeys == nil && difftoolDriver.SourceItemCount != difftoolDriver.TargetItemCount {
-		difftool.logger.Infof("Here are the vbuckets with different item counts:")
+		difftool.logger.Infof("Here are the %vs with different item counts:", diffUnit)
 		for vb, c1 := range difftoolDriver.SrcVbItemCntMap {
 			c2 := difftoolDriver.TgtVbItemCntMap[vb]
 			if c1 != c2 {
-				difftool.logger.Infof("vb:%v source count %v, target count %v", vb, c1, c2)
+				difftool.logger.Infof("%v:%v source count %v, target count %v", diffUnit, vb, c1, c2)
 			}
 		}
 	}
 	difftool.duplicatedMapping = difftoolDriver.DuplicatedHint
+
+	if difftool.summary != nil {
+		difftool.summary.SourceItemCount = difftoolDriver.SourceItemCount
+		difftool.summary.TargetItemCount = difftoolDriver.TargetItemCount
+		difftool.summary.SourceFilteredCount = srcFilteredCount
+		difftool.summary.TargetFilteredCount = tgtFilteredCount
+		difftool.summary.FileDiffSourceKeys, difftool.summary.FileDiffTargetKeys = difftoolDriver.DiffKeyCounts()
+		difftool.summary.FileDiffMismatchHistogram = difftoolDriver.MismatchHistogram()
+	}
 	return err
 }
 
-func (difftool *xdcrDiffTool) runMutationDiffer() {
+// the daemon re-diffs only the bins whose files have changed since its previous window
+func diffsIncrementally() bool {
+	return options.incremental || options.daemon
+}
+
+// removes the results of the previous diff, except for the state that an incremental diff resumes from
+func removeFileDifferResults() error {
+	if !diffsIncrementally() {
+		return os.RemoveAll(options.fileDifferDir)
+	}
+	fileInfos, err := ioutil.ReadDir(options.fileDifferDir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, fileInfo := range fileInfos {
+		if fileInfo.Name() == base.DiffStateFileName || fileInfo.Name() == base.DiffDetailsBinDir {
+			continue
+		}
+		err = os.RemoveAll(options.fileDifferDir + base.FileDirDelimiter + fileInfo.Name())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the mutations filtered out of the files being diffed, which were counted when they were captured
+func (difftool *xdcrDiffTool) filteredCounts() (int64, int64) {
+	if difftool.sourceArchive != nil {
+		return difftool.sourceArchive.FilteredCount, difftool.targetArchive.FilteredCount
+	}
+	return difftool.sourceDcpDriver.FilteredCount(), difftool.targetDcpDriver.FilteredCount()
+}
+
+// returns the keys that are still different after the mutation differ, from the point of view of the source and of the target
+func (difftool *xdcrDiffTool) runMutationDiffer() (differ.DiffKeysMap, differ.DiffKeysMap, error) {
 	difftool.logger.Infof("runMutationDiffer started with compareBody=%v\n", options.compareType)
 	defer difftool.logger.Infof("runMutationDiffer completed\n")
 
-	err := os.RemoveAll(options.mutationDifferDir)
-	if err != nil {
-		difftool.logger.Errorf("Error removing mutationDifferDir: %v\n", err)
+	if options.mutationDifferAdaptiveRateLimit && options.mutationDifferSourceOpsPerSec == 0 && options.mutationDifferTargetOpsPerSec == 0 {
+		difftool.logger.Warnf("mutationDifferAdaptiveRateLimit has no effect unless mutationDifferSourceOpsPerSec or mutationDifferTargetOpsPerSec is set\n")
+	}
+
+	// a run that did not complete leaves its checkpoint behind, which the mutation differ resumes from
+	var err error
+	if !differ.MutationDiffCheckpointExists(options.mutationDifferDir) {
+		err = os.RemoveAll(options.mutationDifferDir)
+		if err != nil {
+			difftool.logger.Errorf("Error removing mutationDifferDir: %v\n", err)
+		}
 	}
 	err = os.MkdirAll(options.mutationDifferDir, 0777)
 	if err != nil {
 		err = fmt.Errorf("Error mkdir mutationDifferDir: %v\n", err)
-		return
+		return nil, nil, err
 	}
 
+	srcIgnoredJsonPaths, tgtIgnoredJsonPaths := difftool.resolveIgnoredJsonPaths()
+	explainer, err := difftool.newDiffExplainer()
+	if err != nil {
+		err = fmt.Errorf("Error creating the filter to explain differences with: %v\n", err)
+		return nil, nil, err
+	}
 	mutationDiffer := differ.NewMutationDiffer(difftool.selfRef.Uuid_, difftool.specifiedSpec.SourceBucketName, difftool.specifiedSpec.SourceBucketUUID,
 		difftool.selfRef, difftool.specifiedRef.Uuid_, difftool.specifiedSpec.TargetBucketName, difftool.specifiedSpec.TargetBucketUUID, difftool.specifiedRef,
 		options.fileDifferDir, options.mutationDifferDir, int(options.numberOfWorkersForMutationDiffer),
@@ -855,26 +1711,92 @@ func (difftool *xdcrDiffTool) runMutationDiffer() {
 		time.Duration(options.sendBatchRetryInterval)*time.Millisecond,
 		time.Duration(options.sendBatchMaxBackoff)*time.Second, options.compareType, difftool.logger, difftool.srcToTgtColIdsMap,
 		difftool.srcCapabilities, difftool.tgtCapabilities, difftool.utils, options.mutationDifferRetries,
-		options.mutationDifferRetriesWaitSecs, difftool.duplicatedMapping)
+		options.mutationDifferRetriesWaitSecs, difftool.duplicatedMapping, explainer,
+		options.compareXattrs, difftool.xattrKeysForNoCompare, options.semanticJsonCompare,
+		srcIgnoredJsonPaths, tgtIgnoredJsonPaths,
+		options.mutationDifferSourceOpsPerSec, options.mutationDifferTargetOpsPerSec, options.mutationDifferAdaptiveRateLimit)
+	defer mutationDiffer.Close()
 	err = mutationDiffer.Run()
 	if err != nil {
 		difftool.logger.Errorf("Error from runMutationDiffer = %v\n", err)
+		return nil, nil, err
+	}
+	if difftool.summary != nil {
+		difftool.summary.MutationDiffCounts = mutationDiffer.DiffCounts()
+		difftool.summary.MutationDiffMismatchHistogram = mutationDiffer.MismatchHistogram()
+	}
+	srcDiffKeys, tgtDiffKeys := mutationDiffer.DiffKeys()
+	return srcDiffKeys, tgtDiffKeys, nil
+}
+
+// explains the differences that the settings of the replication cause on purpose, evaluating the filter of the
+// replication against the docs when it has a filter expression
+func (difftool *xdcrDiffTool) newDiffExplainer() (*differ.DiffExplainer, error) {
+	var filter xdcrParts.Filter
+	if filterExpression, _ := difftool.specifiedSpec.Settings.Values[metadata.FilterExpressionKey].(string); len(filterExpression) > 0 {
+		if difftool.filter == nil {
+			if err := difftool.createFilter(); err != nil {
+				return nil, err
+			}
+		}
+		filter = difftool.filter
 	}
+	return differ.NewDiffExplainer(filter, difftool.specifiedSpec.Settings.GetExpDelMode(),
+		difftool.specifiedSpec.Settings.GetMobileCompatible()), nil
+}
+
+// whether the cluster is captured by this run
+func capturesCluster(clusterName string) bool {
+	return options.subcommand != base.SubcommandCapture || options.captureCluster == clusterName
 }
 
-func startDcpDriver(logger *xdcrLog.CommonLogger, name, url, bucketName string, ref *metadata.RemoteClusterReference, fileDir, checkpointFileDir, oldCheckpointFileName, newCheckpointFileName string, numberOfDcpClients, numberOfWorkersPerDcpClient, numberOfBins, dcpHandlerChanSize, bucketOpTimeout, maxNumOfGetStatsRetry, getStatsRetryInterval, getStatsMaxBackoff, checkpointInterval uint64, errChan chan error, waitGroup *sync.WaitGroup, completeBySeqno bool, fdPool fdp.FdPoolIface, filter xdcrParts.Filter, capabilities metadata.Capability, collectionIDs []uint32, colMigrationFilters []string, utils xdcrUtils.UtilsIface, bucketBufferCap int, migrationMapping metadata.CollectionNamespaceMapping, mobileCompat int, expDelMode xdcrBase.FilterExpDelType, xattrKeysForNoCompare map[string]bool) *dcp.DcpDriver {
+func startDcpDriver(logger *xdcrLog.CommonLogger, name, url, bucketName string, numberOfVbuckets int, ref *metadata.RemoteClusterReference, fileDir, checkpointFileDir, oldCheckpointFileName, newCheckpointFileName string, numberOfDcpClients, numberOfWorkersPerDcpClient, numberOfBins, dcpHandlerChanSize, bucketOpTimeout, maxNumOfGetStatsRetry, getStatsRetryInterval, getStatsMaxBackoff, checkpointInterval uint64, errChan chan error, waitGroup *sync.WaitGroup, completeBySeqno bool, fdPool fdp.FdPoolIface, filter xdcrParts.Filter, capabilities metadata.Capability, collectionIDs []uint32, colMigrationFilters []string, utils xdcrUtils.UtilsIface, bucketBufferCap int, binFileCodec uint16, binFileStorage storage.Storage, migrationMapping metadata.CollectionNamespaceMapping, mobileCompat int, expDelMode xdcrBase.FilterExpDelType, xattrKeysForNoCompare map[string]bool, compareXattrs bool, semanticJsonCompare bool, ignoredJsonPaths *utils.IgnoredJsonPaths, captureLimits dcp.CaptureLimits, endSeqnoCut dcp.EndSeqnoCut) *dcp.DcpDriver {
 	waitGroup.Add(1)
 	dcpDriver := dcp.NewDcpDriver(logger, name, url, bucketName, ref, fileDir, checkpointFileDir, oldCheckpointFileName,
-		newCheckpointFileName, int(numberOfDcpClients), int(numberOfWorkersPerDcpClient), int(numberOfBins),
+		newCheckpointFileName, int(numberOfDcpClients), int(numberOfWorkersPerDcpClient), int(numberOfBins), numberOfVbuckets,
 		int(dcpHandlerChanSize), time.Duration(bucketOpTimeout)*time.Second, int(maxNumOfGetStatsRetry),
 		time.Duration(getStatsRetryInterval)*time.Second, time.Duration(getStatsMaxBackoff)*time.Second,
 		int(checkpointInterval), errChan, waitGroup, completeBySeqno, fdPool, filter, capabilities, collectionIDs, colMigrationFilters,
-		utils, bucketBufferCap, migrationMapping, mobileCompat, expDelMode, xattrKeysForNoCompare)
+		utils, bucketBufferCap, binFileCodec, binFileStorage, migrationMapping, mobileCompat, expDelMode, xattrKeysForNoCompare, compareXattrs, semanticJsonCompare, ignoredJsonPaths,
+		captureLimits)
+	dcpDriver.SetEndSeqnoCut(endSeqnoCut)
 	// dcp driver startup may take some time. Do it asynchronously
 	go startDcpDriverAysnc(dcpDriver, errChan, logger)
 	return dcpDriver
 }
 
+// Applies the limits in the capture limits file to the dcp drivers whenever the file changes, until stopCh is closed.
+// A file that cannot be read or parsed leaves the limits as they are
+func (difftool *xdcrDiffTool) watchCaptureLimitsFile(fileName string, stopCh chan bool) {
+	ticker := time.NewTicker(time.Duration(base.CaptureLimitsFileCheckInterval) * time.Second)
+	defer ticker.Stop()
+
+	var lastModTime time.Time
+	for {
+		fileInfo, err := os.Stat(fileName)
+		if err == nil && !fileInfo.ModTime().Equal(lastModTime) {
+			lastModTime = fileInfo.ModTime()
+			limitsByCluster, err := dcp.LoadCaptureLimits(fileName)
+			if err != nil {
+				difftool.logger.Warnf("Error loading capture limits from %v. Keeping the current limits. err=%v\n", fileName, err)
+			} else {
+				for name, dcpDriver := range map[string]*dcp.DcpDriver{base.SourceClusterName: difftool.sourceDcpDriver, base.TargetClusterName: difftool.targetDcpDriver} {
+					if limits, exists := limitsByCluster[name]; exists && dcpDriver != nil {
+						dcpDriver.SetCaptureLimits(*limits)
+					}
+				}
+			}
+		} else if err != nil && !os.IsNotExist(err) {
+			difftool.logger.Warnf("Error checking capture limits file %v. err=%v\n", fileName, err)
+		}
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
 func startDcpDriverAysnc(dcpDriver *dcp.DcpDriver, errChan chan error, logger *xdcrLog.CommonLogger) {
 	err := dcpDriver.Start()
 	if err != nil {
@@ -890,14 +1812,8 @@ func (difftool *xdcrDiffTool) waitForCompletion(sourceDcpDriver, targetDcpDriver
 	select {
 	case err := <-errChan:
 		difftool.logger.Errorf("Stop diff generation due to error from dcp client %v\n", err)
-		err1 := sourceDcpDriver.Stop()
-		if err1 != nil {
-			difftool.logger.Errorf("Error stopping source dcp client. err=%v\n", err1)
-		}
-		err1 = targetDcpDriver.Stop()
-		if err1 != nil {
-			difftool.logger.Errorf("Error stopping target dcp client. err=%v\n", err1)
-		}
+		difftool.stopDcpDriver(sourceDcpDriver)
+		difftool.stopDcpDriver(targetDcpDriver)
 		return err
 	case <-doneChan:
 		difftool.logger.Infof("Source cluster and target cluster have completed\n")
@@ -917,21 +1833,193 @@ func (difftool *xdcrDiffTool) waitForDuration(sourceDcpDriver, targetDcpDriver *
 		difftool.logger.Infof("Stop diff generation after specified processing duration\n")
 	}
 
-	err1 := sourceDcpDriver.Stop()
-	if err1 != nil {
-		difftool.logger.Errorf("Error stopping source dcp client. err=%v\n", err1)
-	}
+	difftool.stopDcpDriver(sourceDcpDriver)
 
 	time.Sleep(delayDurationBetweenSourceAndTarget)
 
-	err1 = targetDcpDriver.Stop()
-	if err1 != nil {
-		difftool.logger.Errorf("Error stopping target dcp client. err=%v\n", err1)
-	}
+	difftool.stopDcpDriver(targetDcpDriver)
 
 	return err
 }
 
+// Keeps the dcp streams of both clusters open and, every window interval, diffs what has been captured so far,
+// keeping track of how long each inconsistency found has lasted. Runs until the dcp drivers are stopped
+func (difftool *xdcrDiffTool) runDaemon() error {
+	tracker, err := differ.NewInconsistencyTracker(options.inconsistencyDir, time.Duration(options.inconsistencyGracePeriod)*time.Second)
+	if err != nil {
+		return err
+	}
+	if tracker.Len() > 0 {
+		difftool.logger.Infof("Resuming tracking of %v inconsistencies from %v\n", tracker.Len(), options.inconsistencyDir)
+	}
+
+	// what a previous run captured into its last windows, up to where its checkpoints resume from
+	for window := 0; window < base.DaemonCaptureWindowDirs; window++ {
+		err = difftool.mergeCaptureWindow(window, nil, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	errChan := make(chan error, 1)
+	waitGroup := &sync.WaitGroup{}
+	_, err = difftool.startDcpDrivers(errChan, waitGroup, false)
+	if err != nil {
+		return err
+	}
+	// what the windows being captured hold is picked up by the next run
+	defer func() {
+		if err := difftool.binFileStorage.Sync(); err != nil {
+			difftool.logger.Errorf("Error syncing bin files to %v. err=%v\n", difftool.binFileStorage, err)
+		}
+	}()
+
+	doneChan := make(chan bool, 1)
+	go utils.WaitForWaitGroup(waitGroup, doneChan)
+
+	ticker := time.NewTicker(time.Duration(options.daemonWindowInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case err := <-errChan:
+			difftool.logger.Errorf("Stop daemon due to error from dcp client %v\n", err)
+			difftool.stopDcpDriver(difftool.sourceDcpDriver)
+			difftool.stopDcpDriver(difftool.targetDcpDriver)
+			return err
+		case <-doneChan:
+			difftool.logger.Infof("Source cluster and target cluster have stopped. Stop daemon\n")
+			return nil
+		case <-ticker.C:
+			err := difftool.verifyWindow(tracker)
+			if err != nil {
+				difftool.logger.Errorf("Error verifying capture window. err=%v\n", err)
+			}
+		}
+	}
+}
+
+// Rotates the capture to the next window, and diffs what has been captured up to the end of the window being sealed
+// while the next one is captured, and then updates the inconsistencies being tracked with those that are still found
+func (difftool *xdcrDiffTool) verifyWindow(tracker *differ.InconsistencyTracker) error {
+	window := difftool.captureWindow
+	difftool.logger.Infof("Verifying capture window %v\n", window)
+
+	err := difftool.rotateCaptureWindow(window + 1)
+	if err != nil {
+		return err
+	}
+	err = difftool.mergeCaptureWindow(window, difftool.sourceDcpDriver, difftool.targetDcpDriver)
+	if err != nil {
+		return err
+	}
+	err = difftool.diffDataFiles()
+	if err != nil {
+		return err
+	}
+
+	var srcDiffKeys, tgtDiffKeys differ.DiffKeysMap
+	if options.runMutationDiffer {
+		// the documents are fetched from the clusters as they are now, which leaves out what has converged since the window ended
+		srcDiffKeys, tgtDiffKeys, err = difftool.runMutationDiffer()
+	} else {
+		srcDiffKeys, tgtDiffKeys, err = differ.LoadDiffKeys(options.fileDifferDir)
+	}
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	newCnt, resolvedCnt := tracker.Update(srcDiffKeys, tgtDiffKeys, now)
+	err = tracker.Save(now)
+	if err != nil {
+		return err
+	}
+	difftool.logger.Infof("Capture window %v has %v inconsistencies, of which %v are new. %v have been resolved since the previous window\n",
+		window, tracker.Len(), newCnt, resolvedCnt)
+	if persistent := tracker.Persistent(now); len(persistent) > 0 {
+		difftool.logger.Warnf("%v inconsistencies have lasted longer than %v, the oldest since %v. See %v\n", len(persistent),
+			time.Duration(options.inconsistencyGracePeriod)*time.Second, persistent[0].FirstSeen,
+			options.inconsistencyDir+base.FileDirDelimiter+base.PersistentInconsistenciesFileName)
+	}
+	return nil
+}
+
+// the daemon captures each window into its own directory under fileDir, alternating between base.DaemonCaptureWindowDirs of them,
+// and merges the window into the bin files of fileDir once it is sealed
+func getCaptureWindowDir(fileDir string, window int) string {
+	return fmt.Sprintf("%v%v%v%v%v", fileDir, base.FileDirDelimiter, base.DaemonCaptureWindowDirPrefix, base.FileNameDelimiter, window%base.DaemonCaptureWindowDirs)
+}
+
+// the directory that the dcp drivers capture into, which is that of the current capture window for the daemon
+func (difftool *xdcrDiffTool) getCaptureFileDir(fileDir string) string {
+	if !options.daemon {
+		return fileDir
+	}
+	return getCaptureWindowDir(fileDir, difftool.captureWindow)
+}
+
+// seals the window being captured into by both clusters, and captures the next one into its own directory
+func (difftool *xdcrDiffTool) rotateCaptureWindow(window int) error {
+	err := difftool.sourceDcpDriver.RotateCaptureWindow(window, getCaptureWindowDir(options.sourceFileDir, window))
+	if err != nil {
+		return err
+	}
+	err = difftool.targetDcpDriver.RotateCaptureWindow(window, getCaptureWindowDir(options.targetFileDir, window))
+	if err != nil {
+		return err
+	}
+	difftool.captureWindow = window
+	return nil
+}
+
+// Merges the sealed window into the bin files that are diffed, once they have been rolled back by the rollbacks that
+// the dcp drivers have had since the previous window was merged. The dcp drivers are nil when the capture has not started
+func (difftool *xdcrDiffTool) mergeCaptureWindow(window int, sourceDcpDriver, targetDcpDriver *dcp.DcpDriver) error {
+	for _, cluster := range []struct {
+		dcpDriver        *dcp.DcpDriver
+		fileDir          string
+		numberOfVbuckets int
+	}{
+		{sourceDcpDriver, options.sourceFileDir, difftool.srcNumberOfVbuckets},
+		{targetDcpDriver, options.targetFileDir, difftool.tgtNumberOfVbuckets},
+	} {
+		windowDir := getCaptureWindowDir(cluster.fileDir, window)
+		if cluster.dcpDriver != nil {
+			for _, rollback := range cluster.dcpDriver.TakeRollbacks() {
+				_, err := dcp.RollbackBinFiles(cluster.fileDir, rollback.Vbno, int(options.numberOfBins), rollback.Seqno, difftool.binFileStorage, difftool.logger)
+				if err != nil {
+					return err
+				}
+				// a rollback during the sealed window has already been applied to its files, unlike one during the next window
+				if rollback.Window > window {
+					_, err = dcp.RollbackBinFiles(windowDir, rollback.Vbno, int(options.numberOfBins), rollback.Seqno, difftool.binFileStorage, difftool.logger)
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+		mergedCnt, err := differ.MergeCaptureWindow(windowDir, cluster.fileDir, cluster.numberOfVbuckets, int(options.numberOfBins), difftool.binFileStorage, difftool.logger)
+		if err != nil {
+			return fmt.Errorf("error merging capture window %v into %v. err=%v", windowDir, cluster.fileDir, err)
+		}
+		difftool.logger.Infof("Merged %v bin files of capture window %v into %v\n", mergedCnt, window, cluster.fileDir)
+	}
+	return nil
+}
+
+// the dcp driver is nil when only the other cluster is being captured
+func (difftool *xdcrDiffTool) stopDcpDriver(dcpDriver *dcp.DcpDriver) {
+	if dcpDriver == nil {
+		return
+	}
+	err := dcpDriver.Stop()
+	if err != nil {
+		difftool.logger.Errorf("Error stopping %v dcp client. err=%v\n", dcpDriver.Name, err)
+	}
+}
+
 func (difftool *xdcrDiffTool) retrieveReplicationSpecInfo() error {
 	// CBAUTH has already been setup
 	var err error
@@ -995,6 +2083,40 @@ func (difftool *xdcrDiffTool) populateTemporarySpecAndRef() error {
 	return err
 }
 
+// only the clusters that are captured are contacted, so that a capture of one cluster does not need the other to be reachable
+func (difftool *xdcrDiffTool) retrieveNumberOfVbuckets() error {
+	var err error
+	if capturesCluster(base.SourceClusterName) {
+		difftool.srcNumberOfVbuckets, err = difftool.getNumberOfVbuckets(difftool.selfRef, difftool.specifiedSpec.SourceBucketName)
+		if err != nil {
+			return fmt.Errorf("retrieveNumberOfVbuckets(%v) - %v", difftool.specifiedSpec.SourceBucketName, err)
+		}
+		difftool.logger.Infof("Source bucket has %v vbuckets\n", difftool.srcNumberOfVbuckets)
+	}
+	if capturesCluster(base.TargetClusterName) {
+		difftool.tgtNumberOfVbuckets, err = difftool.getNumberOfVbuckets(difftool.specifiedRef, difftool.specifiedSpec.TargetBucketName)
+		if err != nil {
+			return fmt.Errorf("retrieveNumberOfVbuckets(%v) - %v", difftool.specifiedSpec.TargetBucketName, err)
+		}
+		difftool.logger.Infof("Target bucket has %v vbuckets\n", difftool.tgtNumberOfVbuckets)
+	}
+	return nil
+}
+
+func (difftool *xdcrDiffTool) getNumberOfVbuckets(ref *metadata.RemoteClusterReference, bucketName string) (int, error) {
+	connStr, err := ref.MyConnectionStr()
+	if err != nil {
+		return 0, err
+	}
+	bucketInfo, _, _, _, _, _, err := difftool.utils.BucketValidationInfo(connStr, bucketName, ref.UserName(), ref.Password(),
+		ref.HttpAuthMech(), ref.Certificates(), ref.SANInCertificate(), ref.ClientCertificate(), ref.ClientKey(),
+		difftool.logger)
+	if err != nil {
+		return 0, err
+	}
+	return utils.GetNumberOfVbucketsFromBucketInfo(bucketName, bucketInfo)
+}
+
 func (difftool *xdcrDiffTool) monitorInterruptSignal() {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
@@ -1006,8 +2128,8 @@ func (difftool *xdcrDiffTool) monitorInterruptSignal() {
 				os.Exit(0)
 			case StateDcpStarted:
 				difftool.logger.Warnf("Received interrupt. Closing DCP drivers")
-				difftool.sourceDcpDriver.Stop()
-				difftool.targetDcpDriver.Stop()
+				difftool.stopDcpDriver(difftool.sourceDcpDriver)
+				difftool.stopDcpDriver(difftool.targetDcpDriver)
 				difftool.curState.state = StateFinal
 			case StateFinal:
 				os.Exit(0)
@@ -1204,13 +2326,13 @@ func (difftool *xdcrDiffTool) outputManifestsToFiles(err error) error {
 		return err
 	}
 
-	err = ioutil.WriteFile(utils.GetManifestFileName(options.sourceFileDir), srcManJson, 0644)
+	err = difftool.binFileStorage.WriteFile(utils.GetManifestFileName(options.sourceFileDir), srcManJson)
 	if err != nil {
 		difftool.logger.Errorf("SrcManifestWrite - %v\n", err)
 		return err
 	}
 
-	err = ioutil.WriteFile(utils.GetManifestFileName(options.targetFileDir), tgtManJson, 0644)
+	err = difftool.binFileStorage.WriteFile(utils.GetManifestFileName(options.targetFileDir), tgtManJson)
 	if err != nil {
 		difftool.logger.Errorf("TgtManifestWrite - %v\n", err)
 		return err
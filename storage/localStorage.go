@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+
+	"xdcrDiffer/base"
+)
+
+// Keeps the files on the local file system
+type localStorage struct{}
+
+func NewLocalStorage() Storage {
+	return &localStorage{}
+}
+
+func (s *localStorage) OpenForAppend(name string) (io.WriteCloser, error) {
+	return os.OpenFile(name, os.O_APPEND|os.O_WRONLY|os.O_CREATE, base.FileModeReadWrite)
+}
+
+func (s *localStorage) Open(name string) (File, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &localFile{File: file, size: fileInfo.Size()}, nil
+}
+
+func (s *localStorage) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(name)
+}
+
+// truncates and rewrites the same file rather than replacing it, so that the handles opened for append
+// keep pointing at it
+func (s *localStorage) WriteFile(name string, data []byte) error {
+	return ioutil.WriteFile(name, data, base.FileModeReadWrite)
+}
+
+func (s *localStorage) Size(name string) (int64, error) {
+	fileInfo, err := os.Stat(name)
+	if err != nil {
+		return 0, err
+	}
+	return fileInfo.Size(), nil
+}
+
+func (s *localStorage) MkdirAll(dir string) error {
+	return os.MkdirAll(dir, 0777)
+}
+
+func (s *localStorage) RemoveAll(name string) error {
+	return os.RemoveAll(name)
+}
+
+// appends are written to the files right away
+func (s *localStorage) Sync() error {
+	return nil
+}
+
+func (s *localStorage) String() string {
+	return "local file system"
+}
+
+type localFile struct {
+	*os.File
+	size int64
+}
+
+func (f *localFile) Size() int64 {
+	return f.size
+}
@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Keeps the files in memory, which lets tests capture and diff files without touching the disk.
+// The files are lost when the process exits, so it is not one of the storage choices of the tool
+type memoryStorage struct {
+	mtx   sync.RWMutex
+	files map[string][]byte
+}
+
+func NewMemoryStorage() Storage {
+	return &memoryStorage{
+		files: make(map[string][]byte),
+	}
+}
+
+func (s *memoryStorage) OpenForAppend(name string) (io.WriteCloser, error) {
+	name = path.Clean(name)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if _, exists := s.files[name]; !exists {
+		s.files[name] = []byte{}
+	}
+	return &memoryAppender{storage: s, name: name}, nil
+}
+
+// the file is a snapshot of what has been written so far, which later appends leave untouched
+func (s *memoryStorage) Open(name string) (File, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	data, exists := s.files[path.Clean(name)]
+	if !exists {
+		return nil, notExistError("open", name)
+	}
+	return &memoryFile{Reader: bytes.NewReader(data[:len(data):len(data)])}, nil
+}
+
+func (s *memoryStorage) ReadFile(name string) ([]byte, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	data, exists := s.files[path.Clean(name)]
+	if !exists {
+		return nil, notExistError("open", name)
+	}
+	return append([]byte(nil), data...), nil
+}
+
+func (s *memoryStorage) WriteFile(name string, data []byte) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.files[path.Clean(name)] = append([]byte(nil), data...)
+	return nil
+}
+
+func (s *memoryStorage) Size(name string) (int64, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	data, exists := s.files[path.Clean(name)]
+	if !exists {
+		return 0, notExistError("stat", name)
+	}
+	return int64(len(data)), nil
+}
+
+// directories only exist as the paths of the files within them
+func (s *memoryStorage) MkdirAll(dir string) error {
+	return nil
+}
+
+func (s *memoryStorage) RemoveAll(name string) error {
+	name = path.Clean(name)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for fileName := range s.files {
+		if fileName == name || strings.HasPrefix(fileName, name+"/") {
+			delete(s.files, fileName)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStorage) Sync() error {
+	return nil
+}
+
+func (s *memoryStorage) String() string {
+	return "memory"
+}
+
+type memoryAppender struct {
+	storage *memoryStorage
+	name    string
+}
+
+func (a *memoryAppender) Write(p []byte) (int, error) {
+	a.storage.mtx.Lock()
+	defer a.storage.mtx.Unlock()
+	a.storage.files[a.name] = append(a.storage.files[a.name], p...)
+	return len(p), nil
+}
+
+func (a *memoryAppender) Close() error {
+	return nil
+}
+
+type memoryFile struct {
+	*bytes.Reader
+}
+
+func (f *memoryFile) Close() error {
+	return nil
+}
@@ -0,0 +1,740 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"xdcrDiffer/base"
+)
+
+const partSeqnoLen = 10
+
+// Keeps the files in a bucket of an S3 compatible object store, such as MinIO, so that files can be
+// captured on one machine and diffed on another.
+// Objects cannot be appended to, so a file is made of parts, which are objects named after the file and
+// the sequence number of the part, e.g. source/diffTool_0_0/0000000003. The file is its parts in order.
+// The appends to a file are held in a local file until there are segmentSize bytes of them, or until the
+// file is read or synced, and are then uploaded as the next part, so that a file has few parts to list
+type s3Storage struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+
+	segmentSize    int64
+	uploadPartSize int64
+	// the appends held for each file by its key, which are kept once created so that appenders can hold on to them
+	staged    map[string]*s3StagedAppends
+	stagedMtx sync.Mutex
+}
+
+// endpoint is the url of the object store, e.g. http://127.0.0.1:9000, whose buckets are addressed by path
+func NewS3Storage(endpoint, bucket, region, accessKey, secretKey string) (Storage, error) {
+	endpointUrl, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid S3 endpoint %v: %v", endpoint, err)
+	}
+	if endpointUrl.Scheme != "http" && endpointUrl.Scheme != "https" || endpointUrl.Host == "" {
+		return nil, fmt.Errorf("Invalid S3 endpoint %v: it needs to be an http or https url", endpoint)
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("No S3 bucket specified")
+	}
+	return &s3Storage{
+		endpoint:  endpointUrl,
+		bucket:    bucket,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: base.S3RequestTimeout},
+
+		segmentSize:    base.S3AppendSegmentSize,
+		uploadPartSize: base.S3UploadPartSize,
+		staged:         make(map[string]*s3StagedAppends),
+	}, nil
+}
+
+// a part of a file, which starts offset bytes into the file
+type s3Part struct {
+	key    string
+	seqno  uint64
+	offset int64
+	size   int64
+}
+
+func getObjectKey(name string) (string, error) {
+	key := strings.TrimPrefix(path.Clean(name), "/")
+	if key == "." || key == "" {
+		return "", fmt.Errorf("Invalid file name %v", name)
+	}
+	return key, nil
+}
+
+func getPartKey(key string, seqno uint64) string {
+	return fmt.Sprintf("%v/%0*d", key, partSeqnoLen, seqno)
+}
+
+func (s *s3Storage) OpenForAppend(name string) (io.WriteCloser, error) {
+	key, err := getObjectKey(name)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Appender{storage: s, key: key}, nil
+}
+
+// the appends held for the file are uploaded first, so that they can be read
+func (s *s3Storage) Open(name string) (File, error) {
+	key, err := getObjectKey(name)
+	if err != nil {
+		return nil, err
+	}
+	err = s.uploadStaged(key)
+	if err != nil {
+		return nil, err
+	}
+	parts, err := s.listParts(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) == 0 {
+		return nil, notExistError("open", name)
+	}
+	lastPart := parts[len(parts)-1]
+	return &s3File{storage: s, parts: parts, size: lastPart.offset + lastPart.size}, nil
+}
+
+func (s *s3Storage) ReadFile(name string) ([]byte, error) {
+	file, err := s.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ioutil.ReadAll(file)
+}
+
+// overwrites the last part of the file and then removes the other parts and the appends held for it, so that
+// the appends that follow still come after the new content
+func (s *s3Storage) WriteFile(name string, data []byte) error {
+	key, err := getObjectKey(name)
+	if err != nil {
+		return err
+	}
+	if staged := s.getStaged(key, false /*create*/); staged != nil {
+		staged.mtx.Lock()
+		defer staged.mtx.Unlock()
+		err = staged.discard()
+		if err != nil {
+			return err
+		}
+	}
+	parts, err := s.listParts(key)
+	if err != nil {
+		return err
+	}
+	var seqno uint64
+	if len(parts) > 0 {
+		seqno = parts[len(parts)-1].seqno
+		parts = parts[:len(parts)-1]
+	}
+	err = s.putObject(getPartKey(key, seqno), data)
+	if err != nil {
+		return err
+	}
+	for _, part := range parts {
+		err = s.deleteObject(part.key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// includes the appends held for the file
+func (s *s3Storage) Size(name string) (int64, error) {
+	key, err := getObjectKey(name)
+	if err != nil {
+		return 0, err
+	}
+	var stagedSize int64
+	if staged := s.getStaged(key, false /*create*/); staged != nil {
+		staged.mtx.Lock()
+		defer staged.mtx.Unlock()
+		stagedSize = staged.size
+	}
+	parts, err := s.listParts(key)
+	if err != nil {
+		return 0, err
+	}
+	if len(parts) == 0 {
+		if stagedSize > 0 {
+			return stagedSize, nil
+		}
+		return 0, notExistError("stat", name)
+	}
+	lastPart := parts[len(parts)-1]
+	return lastPart.offset + lastPart.size + stagedSize, nil
+}
+
+// directories only exist as the prefixes of the objects within them
+func (s *s3Storage) MkdirAll(dir string) error {
+	return nil
+}
+
+func (s *s3Storage) RemoveAll(name string) error {
+	key, err := getObjectKey(name)
+	if err != nil {
+		return err
+	}
+	for stagedKey, staged := range s.getAllStaged() {
+		if stagedKey != key && !strings.HasPrefix(stagedKey, key+"/") {
+			continue
+		}
+		staged.mtx.Lock()
+		err = staged.discard()
+		staged.mtx.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	// both the parts of a file and the files within a directory are under the prefix
+	objects, err := s.listObjects(key+"/", "")
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		err = s.deleteObject(object.Key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploads the appends held for every file
+func (s *s3Storage) Sync() error {
+	for key := range s.getAllStaged() {
+		err := s.uploadStaged(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *s3Storage) String() string {
+	return fmt.Sprintf("bucket %v of %v", s.bucket, s.endpoint)
+}
+
+// returns the appends held for the file, or nil if there are none and they are not to be created
+func (s *s3Storage) getStaged(key string, create bool) *s3StagedAppends {
+	s.stagedMtx.Lock()
+	defer s.stagedMtx.Unlock()
+	staged, exists := s.staged[key]
+	if !exists && create {
+		staged = &s3StagedAppends{}
+		s.staged[key] = staged
+	}
+	return staged
+}
+
+func (s *s3Storage) getAllStaged() map[string]*s3StagedAppends {
+	s.stagedMtx.Lock()
+	defer s.stagedMtx.Unlock()
+	allStaged := make(map[string]*s3StagedAppends, len(s.staged))
+	for key, staged := range s.staged {
+		allStaged[key] = staged
+	}
+	return allStaged
+}
+
+func (s *s3Storage) uploadStaged(key string) error {
+	staged := s.getStaged(key, false /*create*/)
+	if staged == nil {
+		return nil
+	}
+	staged.mtx.Lock()
+	defer staged.mtx.Unlock()
+	return s.uploadStagedLocked(key, staged)
+}
+
+// uploads the appends held for the file as its next part, and lets go of them. Needs the lock of staged to be held
+func (s *s3Storage) uploadStagedLocked(key string, staged *s3StagedAppends) error {
+	if staged.size == 0 {
+		return nil
+	}
+	parts, err := s.listParts(key)
+	if err != nil {
+		return err
+	}
+	var seqno uint64
+	if len(parts) > 0 {
+		seqno = parts[len(parts)-1].seqno + 1
+	}
+
+	file, err := os.Open(staged.fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	err = s.uploadObject(getPartKey(key, seqno), file, staged.size)
+	if err != nil {
+		return err
+	}
+	return staged.discard()
+}
+
+// returns the parts of the file in order, with their offsets into the file
+func (s *s3Storage) listParts(key string) ([]*s3Part, error) {
+	objects, err := s.listObjects(key+"/", "/")
+	if err != nil {
+		return nil, err
+	}
+	var parts []*s3Part
+	for _, object := range objects {
+		seqnoStr := strings.TrimPrefix(object.Key, key+"/")
+		if len(seqnoStr) != partSeqnoLen {
+			continue
+		}
+		seqno, err := strconv.ParseUint(seqnoStr, 10, 64)
+		if err != nil {
+			continue
+		}
+		parts = append(parts, &s3Part{key: object.Key, seqno: seqno, size: object.Size})
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].seqno < parts[j].seqno
+	})
+	var offset int64
+	for _, part := range parts {
+		part.offset = offset
+		offset += part.size
+	}
+	return parts, nil
+}
+
+type s3Object struct {
+	Key  string
+	Size int64
+}
+
+type s3ListBucketResult struct {
+	Contents              []s3Object
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *s3Storage) listObjects(prefix, delimiter string) ([]s3Object, error) {
+	var objects []s3Object
+	var continuationToken string
+	for {
+		query := map[string]string{
+			"list-type": "2",
+			"prefix":    prefix,
+		}
+		if delimiter != "" {
+			query["delimiter"] = delimiter
+		}
+		if continuationToken != "" {
+			query["continuation-token"] = continuationToken
+		}
+		body, _, err := s.doRequest(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListBucketResult
+		err = xml.Unmarshal(body, &result)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse the objects listed under %v: %v", prefix, err)
+		}
+		objects = append(objects, result.Contents...)
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		continuationToken = result.NextContinuationToken
+	}
+}
+
+func (s *s3Storage) putObject(key string, data []byte) error {
+	_, _, err := s.doRequest(http.MethodPut, key, nil, nil, data)
+	return err
+}
+
+func (s *s3Storage) deleteObject(key string) error {
+	_, _, err := s.doRequest(http.MethodDelete, key, nil, nil, nil)
+	return err
+}
+
+type s3InitiateMultipartUploadResult struct {
+	UploadId string
+}
+
+type s3CompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+// uploads size bytes read from reader as the object, in a multipart upload when there are more of them than fit in
+// one upload part, so that only an upload part is held in memory at a time
+func (s *s3Storage) uploadObject(key string, reader io.Reader, size int64) error {
+	if size <= s.uploadPartSize {
+		data := make([]byte, size)
+		_, err := io.ReadFull(reader, data)
+		if err != nil {
+			return err
+		}
+		return s.putObject(key, data)
+	}
+
+	body, _, err := s.doRequest(http.MethodPost, key, map[string]string{"uploads": ""}, nil, nil)
+	if err != nil {
+		return err
+	}
+	var initiateResult s3InitiateMultipartUploadResult
+	err = xml.Unmarshal(body, &initiateResult)
+	if err != nil || initiateResult.UploadId == "" {
+		return fmt.Errorf("Unable to parse the multipart upload initiated for %v: %v", key, err)
+	}
+	uploadQuery := map[string]string{"uploadId": initiateResult.UploadId}
+
+	err = s.uploadParts(key, initiateResult.UploadId, reader, size)
+	if err != nil {
+		// the parts uploaded so far are kept by the object store until the upload is aborted
+		_, _, abortErr := s.doRequest(http.MethodDelete, key, uploadQuery, nil, nil)
+		if abortErr != nil {
+			return fmt.Errorf("%v, and the upload could not be aborted: %v", err, abortErr)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *s3Storage) uploadParts(key, uploadId string, reader io.Reader, size int64) error {
+	var complete s3CompleteMultipartUpload
+	data := make([]byte, s.uploadPartSize)
+	for partNumber := 1; size > 0; partNumber++ {
+		partSize := s.uploadPartSize
+		if size < partSize {
+			partSize = size
+		}
+		_, err := io.ReadFull(reader, data[:partSize])
+		if err != nil {
+			return err
+		}
+		query := map[string]string{"partNumber": strconv.Itoa(partNumber), "uploadId": uploadId}
+		_, respHeader, err := s.doRequest(http.MethodPut, key, query, nil, data[:partSize])
+		if err != nil {
+			return err
+		}
+		complete.Parts = append(complete.Parts, s3CompletedPart{PartNumber: partNumber, ETag: respHeader.Get("ETag")})
+		size -= partSize
+	}
+
+	completeBody, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	_, _, err = s.doRequest(http.MethodPost, key, map[string]string{"uploadId": uploadId}, nil, completeBody)
+	return err
+}
+
+// returns the bytes of the object from start to end inclusive
+func (s *s3Storage) getObjectRange(key string, start, end int64) ([]byte, error) {
+	header := map[string]string{"Range": fmt.Sprintf("bytes=%v-%v", start, end)}
+	data, _, err := s.doRequest(http.MethodGet, key, nil, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != end-start+1 {
+		return nil, fmt.Errorf("Unable to read %v, expected %v bytes, bytes read: %v", key, end-start+1, len(data))
+	}
+	return data, nil
+}
+
+// returns the body and the header of the response, or an error satisfying os.IsNotExist if the object does not exist
+func (s *s3Storage) doRequest(method, key string, query, header map[string]string, body []byte) ([]byte, http.Header, error) {
+	requestUrl := fmt.Sprintf("%v://%v/%v", s.endpoint.Scheme, s.endpoint.Host, uriEncode(s.bucket, false))
+	if key != "" {
+		requestUrl += "/" + uriEncode(key, false)
+	}
+	if len(query) > 0 {
+		requestUrl += "?" + canonicalQueryString(query)
+	}
+	req, err := http.NewRequest(method, requestUrl, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	payloadHash := sha256.Sum256(body)
+	signV4(req, hex.EncodeToString(payloadHash[:]), s.accessKey, s.secretKey, s.region, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound && key != "" {
+		return nil, nil, notExistError(strings.ToLower(method), key)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, nil, fmt.Errorf("%v of %v in bucket %v returned %v: %s", method, key, s.bucket, resp.Status, respBody)
+	}
+	return respBody, resp.Header, nil
+}
+
+// signs the request with AWS signature version 4, as S3 compatible object stores expect
+func signV4(req *http.Request, payloadHash, accessKey, secretKey, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") || name == "range" || name == "content-type" {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery,
+		canonicalHeaders.String(), signedHeaders, payloadHash}, "\n")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := fmt.Sprintf("%v/%v/s3/aws4_request", date, region)
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(canonicalRequestHash[:])}, "\n")
+
+	signingKey := hmacSha256([]byte("AWS4"+secretKey), date)
+	signingKey = hmacSha256(signingKey, region)
+	signingKey = hmacSha256(signingKey, "s3")
+	signingKey = hmacSha256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// percent-encodes everything but the unreserved characters, and the slashes if they are kept
+func uriEncode(s string, encodeSlash bool) string {
+	var encoded strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !encodeSlash {
+			encoded.WriteByte(c)
+		} else {
+			encoded.WriteString(fmt.Sprintf("%%%02X", c))
+		}
+	}
+	return encoded.String()
+}
+
+func canonicalQueryString(query map[string]string) string {
+	var names []string
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var params []string
+	for _, name := range names {
+		params = append(params, uriEncode(name, true)+"="+uriEncode(query[name], true))
+	}
+	return strings.Join(params, "&")
+}
+
+// Appends to a file by holding the appends until they are uploaded as a part of it. The file is created by the first append
+type s3Appender struct {
+	storage *s3Storage
+	key     string
+}
+
+func (a *s3Appender) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	staged := a.storage.getStaged(a.key, true /*create*/)
+	staged.mtx.Lock()
+	defer staged.mtx.Unlock()
+	err := staged.append(p)
+	if err != nil {
+		return 0, err
+	}
+	if staged.size >= a.storage.segmentSize {
+		err = a.storage.uploadStagedLocked(a.key, staged)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// the appends stay held, since files can be opened for append many times when there are fewer file descriptors than files
+func (a *s3Appender) Close() error {
+	return nil
+}
+
+// The appends to a file that have not been uploaded yet, which are kept in a local file that is only opened
+// while being appended to, so that they take up neither memory nor file descriptors
+type s3StagedAppends struct {
+	fileName string
+	size     int64
+	mtx      sync.Mutex
+}
+
+// Needs the lock to be held
+func (s *s3StagedAppends) append(p []byte) error {
+	var file *os.File
+	var err error
+	if s.fileName == "" {
+		file, err = ioutil.TempFile("", "xdcrDiffer_s3_")
+		if err == nil {
+			s.fileName = file.Name()
+		}
+	} else {
+		file, err = os.OpenFile(s.fileName, os.O_APPEND|os.O_WRONLY, base.FileModeReadWrite)
+	}
+	if err != nil {
+		return err
+	}
+	n, err := file.Write(p)
+	s.size += int64(n)
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// Needs the lock to be held
+func (s *s3StagedAppends) discard() error {
+	if s.fileName == "" {
+		return nil
+	}
+	err := os.Remove(s.fileName)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.fileName = ""
+	s.size = 0
+	return nil
+}
+
+// Reads the parts of a file as they were when it was opened
+type s3File struct {
+	storage *s3Storage
+	parts   []*s3Part
+	size    int64
+	// where Read is at, and what has been read ahead from there
+	offset    int64
+	readAhead []byte
+}
+
+func (f *s3File) Size() int64 {
+	return f.size
+}
+
+// returns the part that the offset is in
+func (f *s3File) findPart(offset int64) *s3Part {
+	i := sort.Search(len(f.parts), func(i int) bool {
+		return f.parts[i].offset+f.parts[i].size > offset
+	})
+	return f.parts[i]
+}
+
+func (f *s3File) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if len(f.readAhead) == 0 {
+		if f.offset >= f.size {
+			return 0, io.EOF
+		}
+		// reads ahead up to the end of the part
+		part := f.findPart(f.offset)
+		start := f.offset - part.offset
+		end := part.size - 1
+		if end-start+1 > base.S3ReadAheadSize {
+			end = start + base.S3ReadAheadSize - 1
+		}
+		var err error
+		f.readAhead, err = f.storage.getObjectRange(part.key, start, end)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, f.readAhead)
+	f.readAhead = f.readAhead[n:]
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *s3File) ReadAt(p []byte, off int64) (int, error) {
+	var n int
+	for n < len(p) && off+int64(n) < f.size {
+		offset := off + int64(n)
+		part := f.findPart(offset)
+		end := part.offset + part.size
+		if end > off+int64(len(p)) {
+			end = off + int64(len(p))
+		}
+		data, err := f.storage.getObjectRange(part.key, offset-part.offset, end-part.offset-1)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], data)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *s3File) Close() error {
+	return nil
+}
@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"io"
+	"os"
+)
+
+// Where the bin files are kept. Files are named by paths, as built by utils.GetFileName,
+// so that the tool does not need to know whether they are local or in shared storage.
+// Errors for files that do not exist satisfy os.IsNotExist
+type Storage interface {
+	// opens the file for appending to, creating it if it does not exist
+	OpenForAppend(name string) (io.WriteCloser, error)
+	// opens the file for reading from the start
+	Open(name string) (File, error)
+	ReadFile(name string) ([]byte, error)
+	// replaces the content of the file, creating it if it does not exist
+	WriteFile(name string, data []byte) error
+	Size(name string) (int64, error)
+	MkdirAll(dir string) error
+	// removes the file, or the directory and everything within it
+	RemoveAll(name string) error
+	// writes out the appends that are held back, so that another process can read them
+	Sync() error
+	// describes where the files are kept, for logging
+	String() string
+}
+
+// A file opened for reading
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Closer
+	// the size of the file when it was opened
+	Size() int64
+}
+
+func notExistError(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+}
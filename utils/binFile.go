@@ -0,0 +1,508 @@
+package utils
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"xdcrDiffer/base"
+
+	xdcrLog "github.com/couchbase/goxdcr/log"
+	"github.com/golang/snappy"
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+func GetBinFileCodec(name string) (uint16, error) {
+	for codec, codecName := range base.BinFileCodecNames {
+		if name == codecName {
+			return uint16(codec), nil
+		}
+	}
+	return 0, fmt.Errorf("Invalid bin file compression '%v'. Accepted values are %v", name, base.BinFileCodecNames)
+}
+
+// Appends the header that every bin file starts with
+func AppendBinFileHeader(data []byte, codec uint16) []byte {
+	header := make([]byte, base.BinFileHeaderLen)
+	binary.BigEndian.PutUint32(header[0:4], base.BinFileMagic)
+	binary.BigEndian.PutUint16(header[4:6], base.BinFileFormatVersion)
+	binary.BigEndian.PutUint16(header[6:8], codec)
+	return append(data, header...)
+}
+
+// Returns the codec of the bin file.
+// Bins written in another format, including those written before the format was versioned, cannot be read
+func CheckBinFileHeader(fileName string, header []byte) (uint16, error) {
+	if len(header) < base.BinFileHeaderLen {
+		return 0, fmt.Errorf("%w %v: truncated within its header, which has %v of %v bytes", base.ErrorIncompatibleBinFile, fileName, len(header), base.BinFileHeaderLen)
+	}
+	magic := binary.BigEndian.Uint32(header[0:4])
+	if magic != base.BinFileMagic {
+		return 0, fmt.Errorf("%w %v: magic %x is not %x, so it is not a bin file or was written before the format was versioned", base.ErrorIncompatibleBinFile, fileName, magic, base.BinFileMagic)
+	}
+	version := binary.BigEndian.Uint16(header[4:6])
+	if version != base.BinFileFormatVersion {
+		return 0, fmt.Errorf("%w %v: written in format version %v, which is incompatible with format version %v", base.ErrorIncompatibleBinFile, fileName, version, base.BinFileFormatVersion)
+	}
+	codec := binary.BigEndian.Uint16(header[6:8])
+	if int(codec) >= len(base.BinFileCodecNames) {
+		return 0, fmt.Errorf("%w %v: compressed with unknown codec %v", base.ErrorIncompatibleBinFile, fileName, codec)
+	}
+	return codec, nil
+}
+
+// Appends record in a frame of its length and checksum
+func AppendRecordFrame(data, record []byte) []byte {
+	frameHeader := make([]byte, base.RecordFrameHeaderLen)
+	binary.BigEndian.PutUint32(frameHeader[0:4], uint32(len(record)))
+	binary.BigEndian.PutUint32(frameHeader[4:8], crc32.Checksum(record, crc32cTable))
+	data = append(data, frameHeader...)
+	return append(data, record...)
+}
+
+// Appends the framed records in frames the way that they are written to a bin file of codec,
+// which is as they are if the file is not compressed, or else in compressed blocks of whole frames
+func AppendFramesToBinFile(data, frames []byte, codec uint16) ([]byte, error) {
+	if codec == base.BinFileCodecNone {
+		return append(data, frames...), nil
+	}
+
+	for start := 0; start < len(frames); {
+		end := start
+		for end < len(frames) {
+			frameLen := base.RecordFrameHeaderLen + int(binary.BigEndian.Uint32(frames[end:end+4]))
+			if end > start && end-start+frameLen > base.BinFileBlockSize {
+				break
+			}
+			end += frameLen
+		}
+
+		compressed, err := compressBlock(codec, frames[start:end])
+		if err != nil {
+			return nil, err
+		}
+		blockHeader := make([]byte, base.BlockFrameHeaderLen)
+		binary.BigEndian.PutUint32(blockHeader[0:4], uint32(len(compressed)))
+		binary.BigEndian.PutUint32(blockHeader[4:8], crc32.Checksum(compressed, crc32cTable))
+		data = append(data, blockHeader...)
+		data = append(data, compressed...)
+		start = end
+	}
+	return data, nil
+}
+
+func compressBlock(codec uint16, block []byte) ([]byte, error) {
+	switch codec {
+	case base.BinFileCodecSnappy:
+		return snappy.Encode(nil, block), nil
+	default:
+		return nil, fmt.Errorf("unknown codec %v", codec)
+	}
+}
+
+func decompressBlock(codec uint16, compressed []byte) ([]byte, error) {
+	switch codec {
+	case base.BinFileCodecSnappy:
+		return snappy.Decode(nil, compressed)
+	default:
+		return nil, fmt.Errorf("unknown codec %v", codec)
+	}
+}
+
+// Where a frame is in a bin file, which is at BlockOffset if the file is not compressed,
+// or else OffsetInBlock bytes into the decompressed block at BlockOffset
+type BinFilePosition struct {
+	BlockOffset   int64
+	OffsetInBlock int64
+}
+
+// Reads the records framed in a bin file, decompressing them as they are read if the file is compressed.
+// Corrupt records and blocks are reported along with the file and offset of their frames, and skipped.
+// When the file is not compressed, the file is scanned past a corrupt frame for the next frame whose length and
+// checksum both check out, so that only the corrupt frame is skipped. In a compressed file, the frames after a
+// truncated frame, or one whose length is corrupt, cannot be located, so the rest of the block that it is in is skipped
+type BinFileReader struct {
+	fileName string
+	readOp   func([]byte) (int, error)
+	codec    uint16
+	logger   *xdcrLog.CommonLogger
+	// offset in the file of what readOp reads next
+	offset int64
+
+	// the current decompressed block, when the file is compressed
+	block       []byte
+	blockOffset int64
+	blockPos    int
+	skipInBlock int
+
+	// how much of the frames has been read, and how much is to be read if limit is not negative
+	streamOffset int64
+	limit        int64
+
+	// bytes that were read ahead while scanning for an intact frame, which are read before the rest of the file
+	pending []byte
+
+	recordPos          BinFilePosition
+	recordStreamOffset int64
+	frameHeader        []byte
+	blockHeader        []byte
+	corruptCnt         int
+	done               bool
+}
+
+// Reads the header of the bin file through readOp, after which its records can be read.
+// An empty file has neither a header nor records
+func NewBinFileReader(fileName string, readOp func([]byte) (int, error), logger *xdcrLog.CommonLogger) (*BinFileReader, error) {
+	r := newBinFileReader(fileName, readOp, base.BinFileCodecNone, 0, -1, logger)
+	header := make([]byte, base.BinFileHeaderLen)
+	bytesRead, err := r.readFromFile(header)
+	if err == io.EOF {
+		r.done = true
+		return r, nil
+	} else if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("error reading the header of %v. err=%v", fileName, err)
+	}
+	r.codec, err = CheckBinFileHeader(fileName, header[:bytesRead])
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reads length bytes of the frames from start onwards, in a bin file of codec whose header has already been read.
+// readOp reads the file from start.BlockOffset
+func NewBinFileSectionReader(fileName string, readOp func([]byte) (int, error), codec uint16, start BinFilePosition, length int64, logger *xdcrLog.CommonLogger) *BinFileReader {
+	r := newBinFileReader(fileName, readOp, codec, start.BlockOffset, length, logger)
+	r.skipInBlock = int(start.OffsetInBlock)
+	return r
+}
+
+func newBinFileReader(fileName string, readOp func([]byte) (int, error), codec uint16, offset, limit int64, logger *xdcrLog.CommonLogger) *BinFileReader {
+	return &BinFileReader{
+		fileName:    fileName,
+		readOp:      readOp,
+		codec:       codec,
+		logger:      logger,
+		offset:      offset,
+		limit:       limit,
+		frameHeader: make([]byte, base.RecordFrameHeaderLen),
+		blockHeader: make([]byte, base.BlockFrameHeaderLen),
+	}
+}
+
+// Returns the next serialized mutation that is intact, or io.EOF if there are no more
+func (r *BinFileReader) Next() ([]byte, error) {
+	for !r.done {
+		if r.limit >= 0 && r.streamOffset >= r.limit {
+			r.done = true
+			break
+		}
+		if r.codec != base.BinFileCodecNone && r.blockPos == len(r.block) {
+			err := r.nextBlock()
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		pos := r.position()
+		streamOffset := r.streamOffset
+		bytesRead, err := r.readFrames(r.frameHeader)
+		if err == io.EOF {
+			r.done = true
+			break
+		} else if err == io.ErrUnexpectedEOF {
+			err = r.skipCorrupt(pos, streamOffset, r.frameHeader[:bytesRead], "the frame is truncated")
+			if err != nil {
+				return nil, err
+			}
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("error reading %v at offset %v. err=%v", r.fileName, r.offset, err)
+		}
+
+		recordLen := binary.BigEndian.Uint32(r.frameHeader[0:4])
+		checksum := binary.BigEndian.Uint32(r.frameHeader[4:8])
+		if recordLen == 0 || recordLen > base.MaxRecordLen {
+			err = r.skipCorrupt(pos, streamOffset, r.frameHeader, fmt.Sprintf("the record length %v is corrupt", recordLen))
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		record := make([]byte, recordLen)
+		bytesRead, err = r.readFrames(record)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = r.skipCorrupt(pos, streamOffset, append(append([]byte{}, r.frameHeader...), record[:bytesRead]...), "the record is truncated")
+			if err != nil {
+				return nil, err
+			}
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("error reading %v at offset %v. err=%v", r.fileName, r.offset, err)
+		}
+
+		if crc32.Checksum(record, crc32cTable) != checksum {
+			if r.codec != base.BinFileCodecNone {
+				r.reportCorrupt(pos, "the record does not match its checksum")
+				continue
+			}
+			// the length that the record was read by may be what is corrupt
+			err = r.skipCorrupt(pos, streamOffset, append(append([]byte{}, r.frameHeader...), record...), "the record does not match its checksum")
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		parsedLen, _, _, _, err := ParseSerializedMutation(record)
+		if err != nil || parsedLen != len(record) {
+			r.reportCorrupt(pos, "the record is not a serialized mutation")
+			continue
+		}
+		r.recordPos = pos
+		r.recordStreamOffset = streamOffset
+		return record, nil
+	}
+	return nil, io.EOF
+}
+
+// position of the frame of the record last returned by Next
+func (r *BinFileReader) RecordPosition() BinFilePosition {
+	return r.recordPos
+}
+
+// how much of the frames had been read before the frame of the record last returned by Next
+func (r *BinFileReader) RecordStreamOffset() int64 {
+	return r.recordStreamOffset
+}
+
+// how much of the frames has been read
+func (r *BinFileReader) StreamOffset() int64 {
+	return r.streamOffset
+}
+
+func (r *BinFileReader) Codec() uint16 {
+	return r.codec
+}
+
+// number of corrupt records and blocks that have been skipped
+func (r *BinFileReader) CorruptCount() int {
+	return r.corruptCnt
+}
+
+func (r *BinFileReader) position() BinFilePosition {
+	if r.codec == base.BinFileCodecNone {
+		return BinFilePosition{BlockOffset: r.offset}
+	}
+	return BinFilePosition{BlockOffset: r.blockOffset, OffsetInBlock: int64(r.blockPos)}
+}
+
+// reads from the current block if the file is compressed, or else from the file itself
+func (r *BinFileReader) readFrames(buf []byte) (int, error) {
+	if r.codec == base.BinFileCodecNone {
+		bytesRead, err := r.readFromFile(buf)
+		r.streamOffset += int64(bytesRead)
+		return bytesRead, err
+	}
+
+	bytesRead := copy(buf, r.block[r.blockPos:])
+	r.blockPos += bytesRead
+	r.streamOffset += int64(bytesRead)
+	if bytesRead == 0 {
+		return 0, io.EOF
+	} else if bytesRead < len(buf) {
+		return bytesRead, io.ErrUnexpectedEOF
+	}
+	return bytesRead, nil
+}
+
+// loads the next block that is intact, or sets done if there are no more
+func (r *BinFileReader) nextBlock() error {
+	for {
+		blockOffset := r.offset
+		_, err := r.readFromFile(r.blockHeader)
+		if err == io.EOF {
+			r.done = true
+			return nil
+		} else if err == io.ErrUnexpectedEOF {
+			r.reportCorruptBlock(blockOffset, "the block is truncated")
+			r.done = true
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("error reading %v at offset %v. err=%v", r.fileName, blockOffset, err)
+		}
+
+		blockLen := binary.BigEndian.Uint32(r.blockHeader[0:4])
+		checksum := binary.BigEndian.Uint32(r.blockHeader[4:8])
+		if blockLen == 0 || blockLen > base.MaxRecordLen {
+			r.reportCorruptBlock(blockOffset, fmt.Sprintf("the block length %v is corrupt, so the rest of the file is skipped", blockLen))
+			r.done = true
+			return nil
+		}
+
+		compressed := make([]byte, blockLen)
+		_, err = r.readFromFile(compressed)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			r.reportCorruptBlock(blockOffset, "the block is truncated")
+			r.done = true
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("error reading %v at offset %v. err=%v", r.fileName, blockOffset, err)
+		}
+
+		if crc32.Checksum(compressed, crc32cTable) != checksum {
+			r.reportCorruptBlock(blockOffset, "the block does not match its checksum")
+			continue
+		}
+		block, err := decompressBlock(r.codec, compressed)
+		if err != nil {
+			r.reportCorruptBlock(blockOffset, fmt.Sprintf("the block cannot be decompressed. err=%v", err))
+			continue
+		}
+
+		r.block = block
+		r.blockOffset = blockOffset
+		r.blockPos = 0
+		if r.skipInBlock > 0 {
+			// the first block of a section is read from where the section starts
+			r.blockPos = r.skipInBlock
+			if r.blockPos > len(r.block) {
+				r.blockPos = len(r.block)
+			}
+			r.skipInBlock = 0
+		}
+		return nil
+	}
+}
+
+// Skips the corrupt frame at pos, of which consumed has been read so far, along with the rest of its block if
+// the file is compressed
+func (r *BinFileReader) skipCorrupt(pos BinFilePosition, streamOffset int64, consumed []byte, reason string) error {
+	if r.codec == base.BinFileCodecNone {
+		r.reportCorrupt(pos, reason+", so the file is scanned for the next intact record")
+		return r.scanForFrame(pos.BlockOffset, streamOffset, consumed)
+	}
+	r.reportCorrupt(pos, reason+", so the rest of the block is skipped")
+	r.streamOffset += int64(len(r.block) - r.blockPos)
+	r.blockPos = len(r.block)
+	return nil
+}
+
+// Scans an uncompressed file from the byte after the corrupt frame at offset for the next frame whose length and
+// checksum check out and that holds a serialized mutation, which is where the reader picks up again.
+// What has been read of the file from the corrupt frame on is given by consumed
+func (r *BinFileReader) scanForFrame(offset, streamOffset int64, consumed []byte) error {
+	corruptOffset := offset
+	data := append([]byte{}, consumed...)
+	var eof bool
+	// reads ahead until data has n bytes, or the file runs out
+	fill := func(n int) error {
+		for len(data) < n && !eof {
+			chunkLen := n - len(data)
+			if chunkLen < base.BinFileBlockSize {
+				chunkLen = base.BinFileBlockSize
+			}
+			chunk := make([]byte, chunkLen)
+			bytesRead, err := r.readFromFile(chunk)
+			data = append(data, chunk[:bytesRead]...)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return fmt.Errorf("error reading %v at offset %v. err=%v", r.fileName, r.offset, err)
+			}
+		}
+		return nil
+	}
+
+	for i := 1; ; i++ {
+		if i >= base.BinFileBlockSize {
+			// what has been scanned past is not kept
+			data = data[i:]
+			offset += int64(i)
+			streamOffset += int64(i)
+			i = 0
+		}
+		if r.limit >= 0 && streamOffset+int64(i) >= r.limit {
+			break
+		}
+		err := fill(i + base.RecordFrameHeaderLen)
+		if err != nil {
+			return err
+		}
+		if len(data) < i+base.RecordFrameHeaderLen {
+			break
+		}
+
+		recordLen := int(binary.BigEndian.Uint32(data[i : i+4]))
+		if recordLen == 0 || recordLen > base.MaxRecordLen {
+			continue
+		}
+		recordStart := i + base.RecordFrameHeaderLen
+		err = fill(recordStart + recordLen)
+		if err != nil {
+			return err
+		}
+		if len(data) < recordStart+recordLen {
+			continue
+		}
+		record := data[recordStart : recordStart+recordLen]
+		if crc32.Checksum(record, crc32cTable) != binary.BigEndian.Uint32(data[i+4:i+8]) {
+			continue
+		}
+		if parsedLen, _, _, _, err := ParseSerializedMutation(record); err != nil || parsedLen != recordLen {
+			continue
+		}
+
+		r.logger.Infof("Found an intact record in %v at offset %v after skipping %v bytes\n", r.fileName, offset+int64(i), offset+int64(i)-corruptOffset)
+		// the bytes read ahead of the frame that was found are read again, before what was left of the earlier ones
+		r.pending = append(append([]byte{}, data[i:]...), r.pending...)
+		r.offset = offset + int64(i)
+		r.streamOffset = streamOffset + int64(i)
+		return nil
+	}
+	r.done = true
+	return nil
+}
+
+func (r *BinFileReader) reportCorrupt(pos BinFilePosition, reason string) {
+	r.corruptCnt++
+	if r.codec == base.BinFileCodecNone {
+		r.logger.Errorf("Skipping corrupt record in %v at offset %v: %v\n", r.fileName, pos.BlockOffset, reason)
+	} else {
+		r.logger.Errorf("Skipping corrupt record in %v at offset %v of the block at offset %v: %v\n", r.fileName, pos.OffsetInBlock, pos.BlockOffset, reason)
+	}
+}
+
+func (r *BinFileReader) reportCorruptBlock(blockOffset int64, reason string) {
+	r.corruptCnt++
+	r.logger.Errorf("Skipping corrupt block in %v at offset %v: %v\n", r.fileName, blockOffset, reason)
+}
+
+// readOp may return fewer bytes than asked for, before it runs into the end of the file
+func (r *BinFileReader) readFromFile(buf []byte) (int, error) {
+	var bytesRead int
+	if len(r.pending) > 0 {
+		bytesRead = copy(buf, r.pending)
+		r.pending = r.pending[bytesRead:]
+		r.offset += int64(bytesRead)
+	}
+	for bytesRead < len(buf) {
+		n, err := r.readOp(buf[bytesRead:])
+		bytesRead += n
+		r.offset += int64(n)
+		if err == io.EOF {
+			if bytesRead == 0 {
+				return 0, io.EOF
+			} else if bytesRead < len(buf) {
+				return bytesRead, io.ErrUnexpectedEOF
+			}
+			break
+		} else if err != nil {
+			return bytesRead, err
+		}
+	}
+	return bytesRead, nil
+}
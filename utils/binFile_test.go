@@ -0,0 +1,268 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"xdcrDiffer/base"
+
+	xdcrLog "github.com/couchbase/goxdcr/log"
+	"github.com/stretchr/testify/assert"
+)
+
+var logger = xdcrLog.NewLogger("utils_test", xdcrLog.DefaultLoggerContext)
+
+// serializes a mutation without hlv, filters or xattr digests, in the layout of Mutation.Serialize
+func genSerializedMutation(key string, seqno uint64, colId uint32) []byte {
+	data := make([]byte, base.KeyLenVariable+len(key)+52+8+64+4+base.MigrationFilterLen+base.XattrDigestCntLen)
+	binary.BigEndian.PutUint16(data[0:base.KeyLenVariable], uint16(len(key)))
+	pos := base.KeyLenVariable
+	pos += copy(data[pos:], key)
+	binary.BigEndian.PutUint64(data[pos:pos+8], seqno)
+	// revId, cas, flags, expiry, opCode, datatype, importCas, pRev, hlv size and hash are left as zeros
+	pos += 52 + 8 + 64
+	binary.BigEndian.PutUint32(data[pos:pos+4], colId)
+	return data
+}
+
+func genFrames(numberOfRecords int) ([]byte, [][]byte) {
+	var frames []byte
+	var records [][]byte
+	for i := 0; i < numberOfRecords; i++ {
+		record := genSerializedMutation(fmt.Sprintf("key_%05d", i), uint64(i+1), 0)
+		frames = AppendRecordFrame(frames, record)
+		records = append(records, record)
+	}
+	return frames, records
+}
+
+func genBinFileData(t *testing.T, frames []byte, codec uint16) []byte {
+	data, err := AppendFramesToBinFile(AppendBinFileHeader(nil, codec), frames, codec)
+	assert.Nil(t, err)
+	return data
+}
+
+// reads all the records that are intact, and the number of corrupt records and blocks skipped
+func readAllRecords(t *testing.T, data []byte) ([][]byte, int) {
+	reader, err := NewBinFileReader("test", bytes.NewReader(data).Read, logger)
+	assert.Nil(t, err)
+	var records [][]byte
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return records, reader.CorruptCount()
+		}
+		assert.Nil(t, err)
+		records = append(records, record)
+	}
+}
+
+func TestBinFileHeader(t *testing.T) {
+	assert := assert.New(t)
+	for codec := range base.BinFileCodecNames {
+		checkedCodec, err := CheckBinFileHeader("test", AppendBinFileHeader(nil, uint16(codec)))
+		assert.Nil(err)
+		assert.Equal(uint16(codec), checkedCodec)
+	}
+
+	header := AppendBinFileHeader(nil, base.BinFileCodecNone)
+	badMagic := append([]byte{}, header...)
+	badMagic[0] ^= 0xff
+	badVersion := append([]byte{}, header...)
+	binary.BigEndian.PutUint16(badVersion[4:6], base.BinFileFormatVersion-1)
+	badCodec := AppendBinFileHeader(nil, uint16(len(base.BinFileCodecNames)))
+	for _, badHeader := range [][]byte{badMagic, badVersion, badCodec, header[:base.BinFileHeaderLen-1]} {
+		_, err := CheckBinFileHeader("test", badHeader)
+		assert.True(errors.Is(err, base.ErrorIncompatibleBinFile))
+		_, err = NewBinFileReader("test", bytes.NewReader(badHeader).Read, logger)
+		assert.True(errors.Is(err, base.ErrorIncompatibleBinFile))
+	}
+
+	// an empty file has no header and no records
+	records, corruptCnt := readAllRecords(t, nil)
+	assert.Equal(0, len(records))
+	assert.Equal(0, corruptCnt)
+}
+
+func TestBinFileRecords(t *testing.T) {
+	frames, expected := genFrames(1000)
+	for codec, codecName := range base.BinFileCodecNames {
+		t.Run(codecName, func(t *testing.T) {
+			assert := assert.New(t)
+			data := genBinFileData(t, frames, uint16(codec))
+			if uint16(codec) != base.BinFileCodecNone {
+				assert.True(len(data) < len(frames))
+			}
+
+			records, corruptCnt := readAllRecords(t, data)
+			assert.Equal(expected, records)
+			assert.Equal(0, corruptCnt)
+		})
+	}
+}
+
+func TestBinFileSectionReader(t *testing.T) {
+	frames, expected := genFrames(1000)
+	for codec, codecName := range base.BinFileCodecNames {
+		t.Run(codecName, func(t *testing.T) {
+			assert := assert.New(t)
+			data := genBinFileData(t, frames, uint16(codec))
+
+			// note where records 300 to 599 are
+			reader, err := NewBinFileReader("test", bytes.NewReader(data).Read, logger)
+			assert.Nil(err)
+			var start BinFilePosition
+			var startStreamOffset, length int64
+			for i := 0; i < 600; i++ {
+				_, err = reader.Next()
+				assert.Nil(err)
+				if i == 300 {
+					start = reader.RecordPosition()
+					startStreamOffset = reader.RecordStreamOffset()
+				}
+			}
+			length = reader.StreamOffset() - startStreamOffset
+
+			section := NewBinFileSectionReader("test", bytes.NewReader(data[start.BlockOffset:]).Read, uint16(codec), start, length, logger)
+			var records [][]byte
+			for {
+				record, err := section.Next()
+				if err == io.EOF {
+					break
+				}
+				assert.Nil(err)
+				records = append(records, record)
+			}
+			assert.Equal(expected[300:600], records)
+		})
+	}
+}
+
+func TestBinFileCorruption(t *testing.T) {
+	frames, expected := genFrames(1000)
+	frameLen := base.RecordFrameHeaderLen + len(expected[0])
+	uncompressed := func(t *testing.T) []byte {
+		return genBinFileData(t, frames, base.BinFileCodecNone)
+	}
+	compressed := func(t *testing.T) []byte {
+		return genBinFileData(t, frames, base.BinFileCodecSnappy)
+	}
+	// offset of the frame of record i in an uncompressed file
+	frameOffset := func(i int) int {
+		return base.BinFileHeaderLen + i*frameLen
+	}
+
+	tests := []struct {
+		name       string
+		genData    func(t *testing.T) []byte
+		corrupt    func(data []byte) []byte
+		expected   [][]byte
+		corruptCnt int
+	}{
+		{
+			name:    "checksum mismatch skips the record",
+			genData: uncompressed,
+			corrupt: func(data []byte) []byte {
+				data[frameOffset(10)+base.RecordFrameHeaderLen+5] ^= 0xff
+				return data
+			},
+			expected:   append(append([][]byte{}, expected[:10]...), expected[11:]...),
+			corruptCnt: 1,
+		},
+		{
+			name:    "corrupt length skips the record",
+			genData: uncompressed,
+			corrupt: func(data []byte) []byte {
+				binary.BigEndian.PutUint32(data[frameOffset(20):], base.MaxRecordLen+1)
+				return data
+			},
+			expected:   append(append([][]byte{}, expected[:20]...), expected[21:]...),
+			corruptCnt: 1,
+		},
+		{
+			name:    "length that is off skips the record",
+			genData: uncompressed,
+			corrupt: func(data []byte) []byte {
+				data[frameOffset(30)+3] ^= 0x01
+				return data
+			},
+			expected:   append(append([][]byte{}, expected[:30]...), expected[31:]...),
+			corruptCnt: 1,
+		},
+		{
+			name:    "length past the end of the file skips the record",
+			genData: uncompressed,
+			corrupt: func(data []byte) []byte {
+				binary.BigEndian.PutUint32(data[frameOffset(40):], base.MaxRecordLen)
+				return data
+			},
+			expected:   append(append([][]byte{}, expected[:40]...), expected[41:]...),
+			corruptCnt: 1,
+		},
+		{
+			name:    "garbage between records is skipped",
+			genData: uncompressed,
+			corrupt: func(data []byte) []byte {
+				garbage := bytes.Repeat([]byte{0xab}, 3*base.BinFileBlockSize)
+				return append(append(append([]byte{}, data[:frameOffset(50)]...), garbage...), data[frameOffset(50):]...)
+			},
+			expected:   expected,
+			corruptCnt: 1,
+		},
+		{
+			// which are scanned past at once
+			name:    "corrupt records one after the other",
+			genData: uncompressed,
+			corrupt: func(data []byte) []byte {
+				binary.BigEndian.PutUint32(data[frameOffset(60):], 0)
+				data[frameOffset(61)+base.RecordFrameHeaderLen+5] ^= 0xff
+				binary.BigEndian.PutUint32(data[frameOffset(62):], base.MaxRecordLen+1)
+				return data
+			},
+			expected:   append(append([][]byte{}, expected[:60]...), expected[63:]...),
+			corruptCnt: 1,
+		},
+		{
+			name:    "truncated write skips the last record",
+			genData: uncompressed,
+			corrupt: func(data []byte) []byte {
+				return data[:len(data)-3]
+			},
+			expected:   expected[:999],
+			corruptCnt: 1,
+		},
+		{
+			name:    "corrupt block skips the block",
+			genData: compressed,
+			corrupt: func(data []byte) []byte {
+				// the first byte of the compressed data of the first block
+				data[base.BinFileHeaderLen+base.BlockFrameHeaderLen] ^= 0xff
+				return data
+			},
+			expected:   expected[base.BinFileBlockSize/frameLen:],
+			corruptCnt: 1,
+		},
+		{
+			name:    "truncated block skips the rest of the file",
+			genData: compressed,
+			corrupt: func(data []byte) []byte {
+				return data[:len(data)-3]
+			},
+			expected:   expected[:1000-1000%(base.BinFileBlockSize/frameLen)],
+			corruptCnt: 1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+			records, corruptCnt := readAllRecords(t, test.corrupt(test.genData(t)))
+			assert.Equal(len(test.expected), len(records))
+			assert.Equal(test.expected, records)
+			assert.Equal(test.corruptCnt, corruptCnt)
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"xdcrDiffer/base"
+	"xdcrDiffer/storage"
+)
+
+// Describes the capture of one cluster, so that its bin files can be diffed without access to either cluster
+type CaptureArchive struct {
+	Version int
+	// base.SourceClusterName or base.TargetClusterName
+	ClusterName        string
+	ClusterUUID        string
+	BucketName         string
+	BucketUUID         string
+	NumberOfVbuckets   int
+	NumberOfBins       int
+	BinFileCompression string
+	// version pruning window of the bucket, which decides whether differing HLVs are a real diff
+	VersionPruningWindowHrs int
+	// mutations that the replication filters out, which were not captured
+	FilteredCount int64
+	// the collection mapping of the replication, compiled from its spec and the manifests of both buckets
+	CollectionMapping map[uint32][]uint32
+	ColFilterStrings  []string
+	ColFilterTgtIds   []uint32
+	// what was hashed into the bin files, which the archives of both clusters need to agree on
+	CaptureSettings *CaptureSettings
+	// whether the checkpoint that the capture ended at is in the archive
+	HasCheckpoint bool
+	CaptureTime   time.Time
+}
+
+func WriteCaptureArchive(storage storage.Storage, fileDir string, archive *CaptureArchive) error {
+	archive.Version = base.CaptureArchiveVersion
+	data, err := json.Marshal(archive)
+	if err != nil {
+		return err
+	}
+	return storage.WriteFile(GetCaptureArchiveFileName(fileDir), data)
+}
+
+// Reads the descriptor of the archive in fileDir, which needs to be a capture of the named cluster
+func ReadCaptureArchive(storage storage.Storage, fileDir, clusterName string) (*CaptureArchive, error) {
+	fileName := GetCaptureArchiveFileName(fileDir)
+	data, err := storage.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("%v in %v is not a capture archive. err=%v", fileDir, storage, err)
+	}
+	archive := &CaptureArchive{}
+	err = json.Unmarshal(data, archive)
+	if err != nil {
+		return nil, fmt.Errorf("Error unmarshalling capture archive %v. err=%v", fileName, err)
+	}
+	if archive.Version != base.CaptureArchiveVersion {
+		return nil, fmt.Errorf("capture archive %v has version %v, which is incompatible with version %v", fileName, archive.Version, base.CaptureArchiveVersion)
+	}
+	if archive.ClusterName != clusterName {
+		return nil, fmt.Errorf("capture archive %v is a capture of the %v cluster instead of the %v cluster", fileName, archive.ClusterName, clusterName)
+	}
+	return archive, nil
+}
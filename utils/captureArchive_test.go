@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"xdcrDiffer/base"
+	"xdcrDiffer/storage"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCaptureArchive(t *testing.T) {
+	assert := assert.New(t)
+	storage := storage.NewMemoryStorage()
+
+	archive := &CaptureArchive{
+		ClusterName:             base.SourceClusterName,
+		ClusterUUID:             "clusterUUID",
+		BucketName:              "bucket",
+		BucketUUID:              "bucketUUID",
+		NumberOfVbuckets:        128,
+		NumberOfBins:            5,
+		BinFileCompression:      base.BinFileCodecNames[base.BinFileCodecSnappy],
+		VersionPruningWindowHrs: 720,
+		FilteredCount:           3,
+		CollectionMapping:       map[uint32][]uint32{8: {9, 10}},
+		ColFilterStrings:        []string{"type=\"a\""},
+		ColFilterTgtIds:         []uint32{9},
+		CaptureSettings:         NewCaptureSettings(true, true, map[string]bool{"_sync": true}, []*IgnoredJsonPathRule{{Path: []string{"updatedAt"}}}),
+		HasCheckpoint:           true,
+		CaptureTime:             time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	assert.Nil(WriteCaptureArchive(storage, "/source", archive))
+	assert.Equal(base.CaptureArchiveVersion, archive.Version)
+
+	readArchive, err := ReadCaptureArchive(storage, "/source", base.SourceClusterName)
+	assert.Nil(err)
+	assert.Equal(archive, readArchive)
+
+	// the archive of the source cannot be diffed as the target
+	_, err = ReadCaptureArchive(storage, "/source", base.TargetClusterName)
+	assert.NotNil(err)
+
+	// nor can a dir that is not an archive, or an archive of another version
+	_, err = ReadCaptureArchive(storage, "/target", base.TargetClusterName)
+	assert.NotNil(err)
+	archive.Version = base.CaptureArchiveVersion + 1
+	data, err := json.Marshal(archive)
+	assert.Nil(err)
+	assert.Nil(storage.WriteFile(GetCaptureArchiveFileName("/target"), data))
+	_, err = ReadCaptureArchive(storage, "/target", base.SourceClusterName)
+	assert.NotNil(err)
+}
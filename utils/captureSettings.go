@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"reflect"
+	"sort"
+)
+
+// The settings that decide what is hashed into the bin files as they are captured. The bins of both clusters
+// need to have been captured with the same settings to be diffed against each other, and the results of a diff
+// can only be reused for bins captured with the same settings
+type CaptureSettings struct {
+	CompareXattrs       bool
+	SemanticJsonCompare bool
+	// sorted
+	XattrKeysForNoCompare []string
+	// the rules as they were given, before they were resolved to the collections of either cluster
+	IgnoredJsonPathRules []*IgnoredJsonPathRule
+}
+
+func NewCaptureSettings(compareXattrs, semanticJsonCompare bool, xattrKeysForNoCompare map[string]bool, ignoredJsonPathRules []*IgnoredJsonPathRule) *CaptureSettings {
+	settings := &CaptureSettings{
+		CompareXattrs:        compareXattrs,
+		SemanticJsonCompare:  semanticJsonCompare,
+		IgnoredJsonPathRules: ignoredJsonPathRules,
+	}
+	for key := range xattrKeysForNoCompare {
+		settings.XattrKeysForNoCompare = append(settings.XattrKeysForNoCompare, key)
+	}
+	sort.Strings(settings.XattrKeysForNoCompare)
+	return settings
+}
+
+// the names of the settings that differ between s and other
+func (s *CaptureSettings) Diff(other *CaptureSettings) []string {
+	if s == nil {
+		s = &CaptureSettings{}
+	}
+	if other == nil {
+		other = &CaptureSettings{}
+	}
+	var diffs []string
+	if s.CompareXattrs != other.CompareXattrs {
+		diffs = append(diffs, "compareXattrs")
+	}
+	if s.SemanticJsonCompare != other.SemanticJsonCompare {
+		diffs = append(diffs, "semanticJsonCompare")
+	}
+	if len(s.XattrKeysForNoCompare)+len(other.XattrKeysForNoCompare) > 0 && !reflect.DeepEqual(s.XattrKeysForNoCompare, other.XattrKeysForNoCompare) {
+		diffs = append(diffs, "xattrKeysForNoCompare")
+	}
+	if len(s.IgnoredJsonPathRules)+len(other.IgnoredJsonPathRules) > 0 && !reflect.DeepEqual(s.IgnoredJsonPathRules, other.IgnoredJsonPathRules) {
+		diffs = append(diffs, "ignoredJsonPaths")
+	}
+	return diffs
+}
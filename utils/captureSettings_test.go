@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCaptureSettingsDiff(t *testing.T) {
+	assert := assert.New(t)
+	genSettings := func() *CaptureSettings {
+		return NewCaptureSettings(true, false, map[string]bool{"_sync": true, "_mou": true}, nil)
+	}
+	assert.Equal([]string{"_mou", "_sync"}, genSettings().XattrKeysForNoCompare)
+	assert.Nil(genSettings().Diff(genSettings()))
+
+	tests := []struct {
+		name   string
+		change func(settings *CaptureSettings)
+		diffs  []string
+	}{
+		{"compare xattrs", func(settings *CaptureSettings) { settings.CompareXattrs = false }, []string{"compareXattrs"}},
+		{"semantic json compare", func(settings *CaptureSettings) { settings.SemanticJsonCompare = true }, []string{"semanticJsonCompare"}},
+		{"xattr keys for no compare", func(settings *CaptureSettings) { settings.XattrKeysForNoCompare = []string{"_sync"} },
+			[]string{"xattrKeysForNoCompare"}},
+		{"ignored json paths", func(settings *CaptureSettings) {
+			settings.IgnoredJsonPathRules = []*IgnoredJsonPathRule{{Path: []string{"updatedAt"}}}
+		}, []string{"ignoredJsonPaths"}},
+		{"several", func(settings *CaptureSettings) { settings.CompareXattrs, settings.SemanticJsonCompare = false, true },
+			[]string{"compareXattrs", "semanticJsonCompare"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			settings := genSettings()
+			test.change(settings)
+			assert.Equal(test.diffs, genSettings().Diff(settings))
+			assert.Equal(test.diffs, settings.Diff(genSettings()))
+		})
+	}
+
+	// an archive without settings was captured with none of them
+	var noSettings *CaptureSettings
+	assert.Nil(noSettings.Diff(NewCaptureSettings(false, false, nil, nil)))
+	assert.Equal([]string{"compareXattrs", "xattrKeysForNoCompare"}, noSettings.Diff(genSettings()))
+}
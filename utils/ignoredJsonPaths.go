@@ -0,0 +1,202 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"xdcrDiffer/base"
+)
+
+// A JSON path of bodies that is not compared, either in all collections or in the collection of Namespace
+type IgnoredJsonPathRule struct {
+	// scope and collection names separated by a dot, or empty for all collections
+	Namespace string
+	// the reference tokens of the JSON pointer to the path, where base.JsonPathWildcard matches any key or index
+	Path []string
+}
+
+// Parses a rule of the form [<scope>.<collection>:]<JSON pointer>, such as "/lastSyncedAt" or
+// "inventory.items:/counters/views"
+func ParseIgnoredJsonPathRule(line string) (*IgnoredJsonPathRule, error) {
+	rule := &IgnoredJsonPathRule{}
+	pointer := line
+	if !strings.HasPrefix(line, "/") {
+		sepIdx := strings.Index(line, base.IgnoredJsonPathNamespaceDelimiter)
+		if sepIdx < 0 {
+			return nil, fmt.Errorf("invalid rule %q: the JSON path needs to be a JSON pointer starting with /", line)
+		}
+		rule.Namespace = line[:sepIdx]
+		pointer = line[sepIdx+len(base.IgnoredJsonPathNamespaceDelimiter):]
+		if len(strings.Split(rule.Namespace, ".")) != 2 {
+			return nil, fmt.Errorf("invalid rule %q: the collection needs to be given as <scope>.<collection>", line)
+		}
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid rule %q: the JSON path needs to be a JSON pointer starting with /", line)
+	}
+	for _, token := range strings.Split(pointer[1:], "/") {
+		rule.Path = append(rule.Path, strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1))
+	}
+	return rule, nil
+}
+
+// The JSON paths of bodies that are not compared, by the ID of the collection that they apply to on one cluster.
+// A nil IgnoredJsonPaths ignores nothing
+type IgnoredJsonPaths struct {
+	allCollections [][]string
+	byCollectionId map[uint32][][]string
+	// the rules that have been resolved
+	rules []*IgnoredJsonPathRule
+}
+
+// Resolves the collections of the rules by getCollectionId. Returns the namespaces that could not be resolved,
+// whose rules are left out
+func NewIgnoredJsonPaths(rules []*IgnoredJsonPathRule, getCollectionId func(scope, collection string) (uint32, error)) (*IgnoredJsonPaths, []string) {
+	paths := &IgnoredJsonPaths{
+		byCollectionId: make(map[uint32][][]string),
+	}
+	var unresolved []string
+	for _, rule := range rules {
+		if rule.Namespace == "" {
+			paths.allCollections = append(paths.allCollections, rule.Path)
+			paths.rules = append(paths.rules, rule)
+			continue
+		}
+		names := strings.SplitN(rule.Namespace, ".", 2)
+		colId, err := getCollectionId(names[0], names[1])
+		if err != nil {
+			unresolved = append(unresolved, rule.Namespace)
+			continue
+		}
+		paths.byCollectionId[colId] = append(paths.byCollectionId[colId], rule.Path)
+		paths.rules = append(paths.rules, rule)
+	}
+	return paths, unresolved
+}
+
+// The same paths, applied to the collections of the other cluster that colIdsMap maps the collections of p to, such
+// as the target collections that the source collections are replicated to. Without a collection mapping, only the
+// default collection is diffed and the collections map to themselves
+func (p *IgnoredJsonPaths) MapCollections(colIdsMap map[uint32][]uint32) *IgnoredJsonPaths {
+	if p == nil {
+		return nil
+	}
+	mapped := &IgnoredJsonPaths{
+		allCollections: p.allCollections,
+		byCollectionId: make(map[uint32][][]string),
+		rules:          p.rules,
+	}
+	for colId, paths := range p.byCollectionId {
+		mappedColIds := colIdsMap[colId]
+		if len(colIdsMap) == 0 {
+			mappedColIds = []uint32{colId}
+		}
+		for _, mappedColId := range mappedColIds {
+			mapped.byCollectionId[mappedColId] = append(mapped.byCollectionId[mappedColId], paths...)
+		}
+	}
+	return mapped
+}
+
+// the rules that the paths have been resolved from, which is nil when there are none
+func (p *IgnoredJsonPaths) Rules() []*IgnoredJsonPathRule {
+	if p == nil {
+		return nil
+	}
+	return p.rules
+}
+
+// the paths that are not compared in the collection
+func (p *IgnoredJsonPaths) ForCollection(colId uint32) [][]string {
+	if p == nil {
+		return nil
+	}
+	if len(p.byCollectionId[colId]) == 0 {
+		return p.allCollections
+	}
+	paths := make([][]string, 0, len(p.allCollections)+len(p.byCollectionId[colId]))
+	paths = append(paths, p.allCollections...)
+	return append(paths, p.byCollectionId[colId]...)
+}
+
+// Removes the values at the paths from a JSON body. The body is serialized again even if none of the paths are
+// found in it, so that it compares the same as the bodies that the paths have been removed from
+func StripJsonPaths(body []byte, paths [][]string) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value interface{}
+	err := decoder.Decode(&value)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		value = stripJsonPath(value, path)
+	}
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	err = encoder.Encode(value)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buffer.Bytes(), []byte("\n")), nil
+}
+
+func stripJsonPath(value interface{}, path []string) interface{} {
+	if len(path) == 0 {
+		return value
+	}
+	token := path[0]
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, elem := range v {
+			if token != base.JsonPathWildcard && key != token {
+				continue
+			}
+			if len(path) == 1 {
+				delete(v, key)
+			} else {
+				v[key] = stripJsonPath(elem, path[1:])
+			}
+		}
+		return v
+	case []interface{}:
+		if token == base.JsonPathWildcard {
+			if len(path) == 1 {
+				return []interface{}{}
+			}
+			for i, elem := range v {
+				v[i] = stripJsonPath(elem, path[1:])
+			}
+			return v
+		}
+		i, err := strconv.Atoi(token)
+		if err != nil || i < 0 || i >= len(v) {
+			return v
+		}
+		if len(path) == 1 {
+			return append(v[:i], v[i+1:]...)
+		}
+		v[i] = stripJsonPath(v[i], path[1:])
+		return v
+	}
+	return value
+}
+
+// A JSON body as it is compared, with the ignored paths removed from it and then canonicalized if asked to
+func ComparableJsonBody(body []byte, ignoredPaths [][]string, canonicalize bool) ([]byte, error) {
+	var err error
+	if len(ignoredPaths) > 0 {
+		body, err = StripJsonPaths(body, ignoredPaths)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if canonicalize {
+		return CanonicalizeJson(body)
+	}
+	return body, nil
+}
@@ -0,0 +1,114 @@
+package utils
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseIgnoredJsonPathRule(t *testing.T) {
+	tests := []struct {
+		line string
+		rule *IgnoredJsonPathRule
+	}{
+		{"/lastSyncedAt", &IgnoredJsonPathRule{Path: []string{"lastSyncedAt"}}},
+		{"inventory.items:/counters/views", &IgnoredJsonPathRule{Namespace: "inventory.items", Path: []string{"counters", "views"}}},
+		{"/history/*/ts", &IgnoredJsonPathRule{Path: []string{"history", "*", "ts"}}},
+		// escaped tokens, and a colon in a path that has no namespace
+		{"/a~1b/c~0d/e:f", &IgnoredJsonPathRule{Path: []string{"a/b", "c~d", "e:f"}}},
+		{"/", &IgnoredJsonPathRule{Path: []string{""}}},
+	}
+	for _, test := range tests {
+		t.Run(test.line, func(t *testing.T) {
+			rule, err := ParseIgnoredJsonPathRule(test.line)
+			assert.Nil(t, err)
+			assert.Equal(t, test.rule, rule)
+		})
+	}
+
+	for _, line := range []string{"lastSyncedAt", "items:/a", "inventory.items.x:/a", "inventory.items:a", ""} {
+		_, err := ParseIgnoredJsonPathRule(line)
+		assert.NotNil(t, err, line)
+	}
+}
+
+func TestIgnoredJsonPathsCollections(t *testing.T) {
+	assert := assert.New(t)
+	rules := []*IgnoredJsonPathRule{
+		{Path: []string{"a"}},
+		{Namespace: "inventory.items", Path: []string{"b"}},
+		{Namespace: "inventory.orders", Path: []string{"c"}},
+		{Namespace: "inventory.missing", Path: []string{"d"}},
+	}
+	colIds := map[string]uint32{"inventory.items": 8, "inventory.orders": 9}
+	paths, unresolved := NewIgnoredJsonPaths(rules, func(scope, collection string) (uint32, error) {
+		colId, exists := colIds[scope+"."+collection]
+		if !exists {
+			return 0, fmt.Errorf("not found")
+		}
+		return colId, nil
+	})
+	assert.Equal([]string{"inventory.missing"}, unresolved)
+	assert.Equal(rules[:3], paths.Rules())
+	assert.Equal([][]string{{"a"}}, paths.ForCollection(0))
+	assert.Equal([][]string{{"a"}, {"b"}}, paths.ForCollection(8))
+	assert.Equal([][]string{{"a"}, {"c"}}, paths.ForCollection(9))
+
+	// on the target, the paths apply to the collections that the source collections are replicated to
+	mapped := paths.MapCollections(map[uint32][]uint32{8: {20}, 9: {20, 21}, 10: {8}})
+	assert.Equal(paths.Rules(), mapped.Rules())
+	assert.Equal([][]string{{"a"}}, mapped.ForCollection(8))
+	assert.Equal([][]string{{"a"}, {"c"}}, mapped.ForCollection(21))
+	assert.ElementsMatch([][]string{{"a"}, {"b"}, {"c"}}, mapped.ForCollection(20))
+
+	// without a collection mapping, the collections map to themselves
+	assert.Equal([][]string{{"a"}, {"b"}}, paths.MapCollections(nil).ForCollection(8))
+
+	var noPaths *IgnoredJsonPaths
+	assert.Nil(noPaths.ForCollection(0))
+	assert.Nil(noPaths.MapCollections(nil))
+	assert.Nil(noPaths.Rules())
+}
+
+func TestStripJsonPaths(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		paths    [][]string
+		stripped string
+	}{
+		{"top level key", `{"a":1,"b":2}`, [][]string{{"a"}}, `{"b":2}`},
+		{"nested key", `{"a":{"b":1,"c":2}}`, [][]string{{"a", "b"}}, `{"a":{"c":2}}`},
+		{"missing path", `{"a":1}`, [][]string{{"x", "y"}}, `{"a":1}`},
+		{"path through a scalar", `{"a":1}`, [][]string{{"a", "b"}}, `{"a":1}`},
+		{"array index", `{"a":[1,2,3]}`, [][]string{{"a", "1"}}, `{"a":[1,3]}`},
+		{"array index out of range", `{"a":[1]}`, [][]string{{"a", "5"}, {"a", "-1"}, {"a", "x"}}, `{"a":[1]}`},
+		{"wildcard key", `{"a":{"x":{"ts":1,"v":1},"y":{"ts":2,"v":2}}}`, [][]string{{"a", "*", "ts"}}, `{"a":{"x":{"v":1},"y":{"v":2}}}`},
+		{"wildcard index", `{"h":[{"ts":1,"v":1},{"ts":2}]}`, [][]string{{"h", "*", "ts"}}, `{"h":[{"v":1},{}]}`},
+		{"wildcard last", `{"h":[1,2],"o":{"a":1}}`, [][]string{{"h", "*"}, {"o", "*"}}, `{"h":[],"o":{}}`},
+		{"several paths", `{"a":1,"b":2,"c":3}`, [][]string{{"a"}, {"c"}}, `{"b":2}`},
+		// the body is serialized again even when nothing is stripped, with its numbers as written
+		{"serialized again", `{ "b": 1.0, "a": "<&>" }`, [][]string{{"x"}}, `{"a":"<&>","b":1.0}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stripped, err := StripJsonPaths([]byte(test.body), test.paths)
+			assert.Nil(t, err)
+			assert.Equal(t, test.stripped, string(stripped))
+		})
+	}
+
+	_, err := StripJsonPaths([]byte(`{"a":`), [][]string{{"a"}})
+	assert.NotNil(t, err)
+
+	// bodies that differ only by the ignored paths compare the same
+	body1, err := ComparableJsonBody([]byte(`{"a":1,"ts":1}`), [][]string{{"ts"}}, false)
+	assert.Nil(t, err)
+	body2, err := ComparableJsonBody([]byte(`{"ts":2, "a":1}`), [][]string{{"ts"}}, false)
+	assert.Nil(t, err)
+	assert.Equal(t, body1, body2)
+	body3, err := ComparableJsonBody([]byte(`{"ts":2, "a":1.0}`), [][]string{{"ts"}}, true)
+	assert.Nil(t, err)
+	assert.Equal(t, body1, body3)
+}
@@ -0,0 +1,175 @@
+package utils
+
+import (
+	"sync"
+	"time"
+
+	"xdcrDiffer/base"
+)
+
+// The time that a RateLimiter goes by, which tests replace to control it
+type Clock interface {
+	Now() time.Time
+	// a channel that is sent the time once d has passed, and a func that stops it
+	NewTimer(d time.Duration) (<-chan time.Time, func() bool)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	timer := time.NewTimer(d)
+	return timer.C, timer.Stop
+}
+
+// A token bucket that limits ops to a rate per second, with bursts of up to base.RateLimiterBurstSecs worth of
+// them. When adaptive, the rate is cut down whenever ops are failing because the server is overloaded, and then
+// brought back up to the limit as they succeed again. A nil RateLimiter does not limit
+type RateLimiter struct {
+	// the rate asked for, which an adaptive limiter never goes above
+	opsPerSec float64
+	adaptive  bool
+
+	rate         float64
+	tokens       float64
+	lastRefill   time.Time
+	lastAdjusted time.Time
+	clock        Clock
+	mtx          sync.Mutex
+}
+
+// returns nil if opsPerSec is 0, in which case ops are not limited
+func NewRateLimiter(opsPerSec uint64, adaptive bool) *RateLimiter {
+	if opsPerSec == 0 {
+		return nil
+	}
+	return &RateLimiter{
+		opsPerSec:  float64(opsPerSec),
+		adaptive:   adaptive,
+		rate:       float64(opsPerSec),
+		tokens:     burstOf(float64(opsPerSec)),
+		lastRefill: time.Now(),
+		clock:      systemClock{},
+	}
+}
+
+// replaces the clock that the limiter goes by, which starts it over with a full burst as of the clock's time
+func (r *RateLimiter) SetClock(clock Clock) {
+	if r == nil {
+		return
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.clock = clock
+	r.tokens = burstOf(r.rate)
+	r.lastRefill = clock.Now()
+	r.lastAdjusted = time.Time{}
+}
+
+// Starts the limiter off with the tokens that the limiter it replaces has left, up to its own burst, so that a
+// change of limits neither hands out a fresh burst nor forgives the ops that the old limiter is still paying off
+func (r *RateLimiter) CarryOver(previous *RateLimiter) {
+	if r == nil || previous == nil {
+		return
+	}
+	previous.mtx.Lock()
+	previous.refill(previous.clock.Now())
+	tokens := previous.tokens
+	previous.mtx.Unlock()
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if burst := burstOf(r.rate); tokens > burst {
+		tokens = burst
+	}
+	r.tokens = tokens
+	r.lastRefill = r.clock.Now()
+}
+
+// adds the tokens made up for since the last refill, up to the burst. Needs the lock to be held
+func (r *RateLimiter) refill(now time.Time) {
+	r.tokens += now.Sub(r.lastRefill).Seconds() * r.rate
+	if burst := burstOf(r.rate); r.tokens > burst {
+		r.tokens = burst
+	}
+	r.lastRefill = now
+}
+
+func burstOf(rate float64) float64 {
+	burst := rate * base.RateLimiterBurstSecs
+	if burst < 1 {
+		return 1
+	}
+	return burst
+}
+
+// Blocks until an op can be sent. The token of the op is taken right away, so that the ops waiting are let through
+// in the order that they arrived
+func (r *RateLimiter) Wait() {
+	r.WaitN(1, nil)
+}
+
+// Blocks until n tokens' worth of ops can be sent, or until cancelCh is closed. An n larger than the burst is let
+// through once the tokens it is short of have been made up for
+func (r *RateLimiter) WaitN(n uint64, cancelCh <-chan bool) {
+	if r == nil {
+		return
+	}
+	r.mtx.Lock()
+	r.refill(r.clock.Now())
+	r.tokens -= float64(n)
+	var wait time.Duration
+	if r.tokens < 0 {
+		wait = time.Duration(-r.tokens / r.rate * float64(time.Second))
+	}
+	clock := r.clock
+	r.mtx.Unlock()
+
+	if wait > 0 {
+		timerCh, stopTimer := clock.NewTimer(wait)
+		defer stopTimer()
+		select {
+		case <-timerCh:
+		case <-cancelCh:
+		}
+	}
+}
+
+// Tells an adaptive limiter how an op went. The rate is halved when the op was overloaded, and raised by a fraction
+// of the limit when it was not, at most once per base.RateLimiterAdjustInterval either way
+func (r *RateLimiter) Observe(overloaded bool) {
+	if r == nil || !r.adaptive {
+		return
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if !overloaded && r.rate >= r.opsPerSec {
+		return
+	}
+	now := r.clock.Now()
+	if now.Sub(r.lastAdjusted) < base.RateLimiterAdjustInterval {
+		return
+	}
+	r.lastAdjusted = now
+	if overloaded {
+		r.rate *= base.RateLimiterSlowdownFactor
+		if minRate := r.opsPerSec * base.RateLimiterMinFraction; r.rate < minRate {
+			r.rate = minRate
+		}
+	} else {
+		r.rate += r.opsPerSec * base.RateLimiterRecoveryFraction
+		if r.rate > r.opsPerSec {
+			r.rate = r.opsPerSec
+		}
+	}
+}
+
+// the current rate and the rate asked for, in ops per second
+func (r *RateLimiter) Rate() (float64, float64) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.rate, r.opsPerSec
+}
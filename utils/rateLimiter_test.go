@@ -0,0 +1,260 @@
+package utils
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// a clock whose time only moves when it is advanced, firing the timers that are due by then
+type fakeClock struct {
+	now    time.Time
+	timers []*fakeTimer
+	mtx    sync.Mutex
+}
+
+type fakeTimer struct {
+	deadline time.Time
+	wait     time.Duration
+	ch       chan time.Time
+	stopped  bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	timer := &fakeTimer{deadline: c.now.Add(d), wait: d, ch: make(chan time.Time, 1)}
+	c.timers = append(c.timers, timer)
+	return timer.ch, func() bool {
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+		timer.stopped = true
+		return true
+	}
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.now = c.now.Add(d)
+	for _, timer := range c.timers {
+		if !timer.stopped && !timer.deadline.After(c.now) {
+			timer.stopped = true
+			timer.ch <- c.now
+		}
+	}
+}
+
+// the waits of the timers that have been started, which are the waits of the calls that were held back
+func (c *fakeClock) waits() []time.Duration {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	var waits []time.Duration
+	for _, timer := range c.timers {
+		waits = append(waits, timer.wait)
+	}
+	return waits
+}
+
+// waits for n tokens in the background, returning a channel that is closed once the wait is over
+func waitInBackground(r *RateLimiter, n uint64, cancelCh <-chan bool) chan bool {
+	doneCh := make(chan bool)
+	go func() {
+		r.WaitN(n, cancelCh)
+		close(doneCh)
+	}()
+	return doneCh
+}
+
+func waitForTimers(t *testing.T, clock *fakeClock, n int) {
+	for i := 0; i < 1000 && len(clock.waits()) < n; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Len(t, clock.waits(), n)
+}
+
+func TestRateLimiterTokenBucket(t *testing.T) {
+	assert := assert.New(t)
+	clock := newFakeClock()
+	limiter := NewRateLimiter(100, false)
+	limiter.SetClock(clock)
+
+	// a burst of a tenth of a second goes through without waiting
+	for i := 0; i < 10; i++ {
+		limiter.Wait()
+	}
+	assert.Empty(clock.waits())
+
+	// the next op waits for its token
+	doneCh := waitInBackground(limiter, 1, nil)
+	waitForTimers(t, clock, 1)
+	assert.Equal(10*time.Millisecond, clock.waits()[0])
+	clock.Advance(9 * time.Millisecond)
+	select {
+	case <-doneCh:
+		assert.Fail("waited less than the token takes")
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.Advance(time.Millisecond)
+	<-doneCh
+
+	// the tokens refill at the rate, up to the burst
+	clock.Advance(time.Hour)
+	limiter.WaitN(10, nil)
+	assert.Len(clock.waits(), 1)
+	doneCh = waitInBackground(limiter, 5, nil)
+	waitForTimers(t, clock, 2)
+	assert.Equal(50*time.Millisecond, clock.waits()[1])
+	clock.Advance(50 * time.Millisecond)
+	<-doneCh
+
+	// n larger than the burst is let through once the tokens it is short of have been made up for
+	clock.Advance(time.Hour)
+	doneCh = waitInBackground(limiter, 30, nil)
+	waitForTimers(t, clock, 3)
+	assert.Equal(200*time.Millisecond, clock.waits()[2])
+	clock.Advance(200 * time.Millisecond)
+	<-doneCh
+}
+
+func TestRateLimiterWaitNCancelled(t *testing.T) {
+	assert := assert.New(t)
+	clock := newFakeClock()
+	limiter := NewRateLimiter(10, false)
+	limiter.SetClock(clock)
+
+	limiter.Wait()
+	cancelCh := make(chan bool)
+	doneCh := waitInBackground(limiter, 1, cancelCh)
+	waitForTimers(t, clock, 1)
+	assert.Equal(100*time.Millisecond, clock.waits()[0])
+	close(cancelCh)
+	<-doneCh
+
+	// the tokens of a wait that is cancelled are still taken
+	doneCh = waitInBackground(limiter, 1, nil)
+	waitForTimers(t, clock, 2)
+	assert.Equal(200*time.Millisecond, clock.waits()[1])
+	clock.Advance(200 * time.Millisecond)
+	<-doneCh
+}
+
+func TestRateLimiterAdaptive(t *testing.T) {
+	assert := assert.New(t)
+	clock := newFakeClock()
+	limiter := NewRateLimiter(1000, true)
+	limiter.SetClock(clock)
+	rate := func() float64 {
+		rate, _ := limiter.Rate()
+		return rate
+	}
+
+	// halved when overloaded, at most once per interval
+	limiter.Observe(true)
+	assert.Equal(500.0, rate())
+	limiter.Observe(true)
+	assert.Equal(500.0, rate())
+	clock.Advance(time.Second)
+	limiter.Observe(true)
+	assert.Equal(250.0, rate())
+
+	// down to 5% of the limit at the least
+	for i := 0; i < 10; i++ {
+		clock.Advance(time.Second)
+		limiter.Observe(true)
+	}
+	assert.Equal(50.0, rate())
+
+	// ops wait by the lowered rate
+	limiter.WaitN(5, nil)
+	doneCh := waitInBackground(limiter, 1, nil)
+	waitForTimers(t, clock, 1)
+	assert.Equal(20*time.Millisecond, clock.waits()[0])
+	clock.Advance(20 * time.Millisecond)
+	<-doneCh
+
+	// recovers by 5% of the limit per second while ops succeed, up to the limit
+	clock.Advance(time.Second)
+	limiter.Observe(false)
+	assert.Equal(100.0, rate())
+	limiter.Observe(false)
+	assert.Equal(100.0, rate())
+	for i := 0; i < 30; i++ {
+		clock.Advance(time.Second)
+		limiter.Observe(false)
+	}
+	assert.Equal(1000.0, rate())
+	_, opsPerSec := limiter.Rate()
+	assert.Equal(1000.0, opsPerSec)
+}
+
+func TestRateLimiterNotLimited(t *testing.T) {
+	assert := assert.New(t)
+	// not adaptive, the rate stays at the limit
+	limiter := NewRateLimiter(100, false)
+	limiter.SetClock(newFakeClock())
+	limiter.Observe(true)
+	rate, _ := limiter.Rate()
+	assert.Equal(100.0, rate)
+
+	// no limit at all
+	limiter = NewRateLimiter(0, true)
+	assert.Nil(limiter)
+	limiter.SetClock(newFakeClock())
+	limiter.WaitN(1000000, nil)
+	limiter.Observe(true)
+}
+
+func TestRateLimiterCarryOver(t *testing.T) {
+	assert := assert.New(t)
+	clock := newFakeClock()
+	previous := NewRateLimiter(100, false)
+	previous.SetClock(clock)
+
+	// the new limiter pays off the ops that the previous one let through ahead of time
+	previous.WaitN(10, nil)
+	cancelCh := make(chan bool)
+	close(cancelCh)
+	// the tokens of the cancelled wait are still taken
+	previous.WaitN(20, cancelCh)
+	clock.Advance(100 * time.Millisecond)
+	limiter := NewRateLimiter(10, false)
+	limiter.SetClock(clock)
+	limiter.CarryOver(previous)
+	doneCh := waitInBackground(limiter, 1, nil)
+	waitForTimers(t, clock, 2)
+	assert.Equal(1100*time.Millisecond, clock.waits()[1])
+	clock.Advance(1100 * time.Millisecond)
+	<-doneCh
+
+	// the tokens carried over are capped at the burst of the new limiter
+	clock.Advance(time.Hour)
+	limiter = NewRateLimiter(10, false)
+	limiter.SetClock(clock)
+	limiter.CarryOver(previous)
+	limiter.Wait()
+	doneCh = waitInBackground(limiter, 1, nil)
+	waitForTimers(t, clock, 3)
+	assert.Equal(100*time.Millisecond, clock.waits()[2])
+	clock.Advance(100 * time.Millisecond)
+	<-doneCh
+
+	// nothing to carry over from no limit, or to no limit
+	limiter = NewRateLimiter(10, false)
+	limiter.CarryOver(nil)
+	var noLimit *RateLimiter
+	noLimit.CarryOver(limiter)
+	noLimit.WaitN(1000, nil)
+}
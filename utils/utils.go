@@ -11,12 +11,16 @@ package utils
 
 import (
 	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	xdcrBase "github.com/couchbase/goxdcr/base"
 	xdcrUtils "github.com/couchbase/goxdcr/utils"
 	"hash/crc32"
+	"io"
 	"io/ioutil"
 	"math"
+	"math/big"
 	mrand "math/rand"
 	"sort"
 	"strconv"
@@ -39,12 +43,29 @@ func GetFileName(fileDir string, vbno uint16, bucketIndex int) string {
 }
 
 func GetManifestFileName(fileDir string) string {
+	return getPrefixedFileName(fileDir, base.ManifestFileName)
+}
+
+func GetCaptureArchiveFileName(fileDir string) string {
+	return getPrefixedFileName(fileDir, base.CaptureArchiveFileName)
+}
+
+func GetCaptureCheckpointFileName(fileDir string) string {
+	return getPrefixedFileName(fileDir, base.CaptureCheckpointFileName)
+}
+
+// checkpoint files of both clusters are kept in the same dir, named after the cluster
+func GetCheckpointFileName(checkpointFileDir, clusterName, fileName string) string {
+	return checkpointFileDir + base.FileDirDelimiter + clusterName + base.FileNameDelimiter + fileName
+}
+
+func getPrefixedFileName(fileDir, name string) string {
 	var buffer bytes.Buffer
 	buffer.WriteString(fileDir)
 	buffer.WriteString(base.FileDirDelimiter)
 	buffer.WriteString(base.FileNamePrefix)
 	buffer.WriteString(base.FileNameDelimiter)
-	buffer.WriteString(fmt.Sprintf("%v", base.ManifestFileName))
+	buffer.WriteString(name)
 	return buffer.String()
 }
 
@@ -54,6 +75,112 @@ func GetBucketIndexFromKey(key []byte, numberOfBins int) int {
 	return int(math.Mod(float64(crc), float64(numberOfBins)))
 }
 
+// parses the length, key, seqno and collection id of the serialized mutation at the start of data
+// see Mutation.Serialize for the layout
+func ParseSerializedMutation(data []byte) (recordLen int, key []byte, seqno uint64, colId uint32, err error) {
+	if len(data) < base.KeyLenVariable {
+		return 0, nil, 0, 0, fmt.Errorf("truncated record of %v bytes", len(data))
+	}
+	keyLen := int(binary.BigEndian.Uint16(data[0:base.KeyLenVariable]))
+	seqnoPos := base.KeyLenVariable + keyLen
+	// seqno, revId, cas, flags, expiry, opCode, datatype, importCas and pRev precede the hlv size
+	hlvLenPos := seqnoPos + 52
+	if len(data) < hlvLenPos+8 {
+		return 0, nil, 0, 0, fmt.Errorf("truncated record of %v bytes", len(data))
+	}
+	hlvLen := binary.BigEndian.Uint64(data[hlvLenPos : hlvLenPos+8])
+	// hash and collectionId follow the hlv
+	filterLenPos := hlvLenPos + 8 + int(hlvLen) + 68
+	if len(data) < filterLenPos+base.MigrationFilterLen {
+		return 0, nil, 0, 0, fmt.Errorf("truncated record of %v bytes", len(data))
+	}
+	filterCnt := int(binary.BigEndian.Uint16(data[filterLenPos : filterLenPos+base.MigrationFilterLen]))
+	xattrDigestCntPos := filterLenPos + base.MigrationFilterLen + filterCnt*2
+	if len(data) < xattrDigestCntPos+base.XattrDigestCntLen {
+		return 0, nil, 0, 0, fmt.Errorf("truncated record of %v bytes", len(data))
+	}
+	xattrDigestCnt := int(binary.BigEndian.Uint16(data[xattrDigestCntPos : xattrDigestCntPos+base.XattrDigestCntLen]))
+	recordLen = xattrDigestCntPos + base.XattrDigestCntLen
+	for i := 0; i < xattrDigestCnt; i++ {
+		if len(data) < recordLen+base.XattrKeyLenVariable {
+			return 0, nil, 0, 0, fmt.Errorf("truncated record of %v bytes", len(data))
+		}
+		xattrKeyLen := int(binary.BigEndian.Uint16(data[recordLen : recordLen+base.XattrKeyLenVariable]))
+		recordLen += base.XattrKeyLenVariable + xattrKeyLen + base.XattrDigestLen
+	}
+	if len(data) < recordLen {
+		return 0, nil, 0, 0, fmt.Errorf("truncated record of %v bytes", len(data))
+	}
+	key = data[base.KeyLenVariable:seqnoPos]
+	seqno = binary.BigEndian.Uint64(data[seqnoPos : seqnoPos+8])
+	colId = binary.BigEndian.Uint32(data[filterLenPos-4 : filterLenPos])
+	return recordLen, key, seqno, colId, nil
+}
+
+// A serialized record, along with the fields that records are sorted by
+type SortableRecord struct {
+	ColId uint32
+	Key   []byte
+	Seqno uint64
+	Data  []byte
+}
+
+func NewSortableRecord(data []byte) (*SortableRecord, error) {
+	recordLen, key, seqno, colId, err := ParseSerializedMutation(data)
+	if err != nil {
+		return nil, err
+	}
+	return &SortableRecord{
+		ColId: colId,
+		Key:   key,
+		Seqno: seqno,
+		Data:  data[:recordLen],
+	}, nil
+}
+
+// Records are ordered by collection id, then by key, then from the newest seqno to the oldest
+// so that the first record of a key is the one to keep when deduplicating
+func (r *SortableRecord) Less(other *SortableRecord) bool {
+	if r.ColId != other.ColId {
+		return r.ColId < other.ColId
+	}
+	if keyCompare := bytes.Compare(r.Key, other.Key); keyCompare != 0 {
+		return keyCompare < 0
+	}
+	return r.Seqno > other.Seqno
+}
+
+func (r *SortableRecord) SameKey(other *SortableRecord) bool {
+	return r.ColId == other.ColId && bytes.Equal(r.Key, other.Key)
+}
+
+// Sorts the serialized records in data, keeping only the newest record of each key
+// The sorted records are framed into a new buffer, ready to be appended to a bin file
+func SortDedupAndFrameRecords(data []byte) ([]byte, error) {
+	var records []*SortableRecord
+	for pos := 0; pos < len(data); {
+		record, err := NewSortableRecord(data[pos:])
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+		pos += len(record.Data)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Less(records[j])
+	})
+
+	sorted := make([]byte, 0, len(data)+len(records)*base.RecordFrameHeaderLen)
+	for i, record := range records {
+		if i > 0 && record.SameKey(records[i-1]) {
+			continue
+		}
+		sorted = AppendRecordFrame(sorted, record.Data)
+	}
+	return sorted, nil
+}
+
 // evenly distribute load across workers
 // assumes that num_of_worker <= num_of_load
 // returns load_distribution [][]int, where
@@ -92,9 +219,9 @@ func BalanceLoad(num_of_worker int, num_of_load int) [][]int {
 	return load_distribution
 }
 
-func ParseHighSeqnoStat(statsMap map[string]map[string]string, highSeqnoMap map[uint16]uint64, vbuuidMap map[uint16]uint64, getHighSeqno bool) error {
+func ParseHighSeqnoStat(statsMap map[string]map[string]string, highSeqnoMap map[uint16]uint64, vbuuidMap map[uint16]uint64, getHighSeqno bool, numberOfVbuckets int) error {
 	for _, statsMapPerServer := range statsMap {
-		for vbno := 0; vbno < base.NumberOfVbuckets; vbno++ {
+		for vbno := 0; vbno < numberOfVbuckets; vbno++ {
 			uuidKey := fmt.Sprintf(base.VbucketUuidStatsKey, vbno)
 			uuidStr, ok := statsMapPerServer[uuidKey]
 			if ok && uuidStr != "" {
@@ -123,13 +250,13 @@ func ParseHighSeqnoStat(statsMap map[string]map[string]string, highSeqnoMap map[
 		}
 	}
 
-	if len(vbuuidMap) != base.NumberOfVbuckets {
+	if len(vbuuidMap) != numberOfVbuckets {
 		err := fmt.Errorf("did not get all vb uuid. len(vbuuidMap) =%v\n", len(vbuuidMap))
 		fmt.Printf("%v\n", err)
 		return err
 	}
 
-	if getHighSeqno && len(highSeqnoMap) != base.NumberOfVbuckets {
+	if getHighSeqno && len(highSeqnoMap) != numberOfVbuckets {
 		err := fmt.Errorf("did not get all high seqnos. len(highSeqnoMap) =%v\n", len(highSeqnoMap))
 		fmt.Printf("%v\n", err)
 		return err
@@ -217,6 +344,72 @@ func GetBucketPasswordFromBucketInfo(bucketName string, bucketInfo map[string]in
 	return bucketPassword, nil
 }
 
+// the number of vbuckets of a bucket is the length of the vbucket map in its bucket config
+func GetNumberOfVbucketsFromBucketInfo(bucketName string, bucketInfo map[string]interface{}) (int, error) {
+	serverMapObj, ok := bucketInfo[base.VBucketServerMapKey]
+	if !ok {
+		return 0, fmt.Errorf("Error looking up vbucket server map of bucket %v", bucketName)
+	}
+	serverMap, ok := serverMapObj.(map[string]interface{})
+	if !ok {
+		return 0, fmt.Errorf("Vbucket server map of bucket %v is of wrong type", bucketName)
+	}
+	vbMapObj, ok := serverMap[base.VBucketMapKey]
+	if !ok {
+		return 0, fmt.Errorf("Error looking up vbucket map of bucket %v", bucketName)
+	}
+	vbMap, ok := vbMapObj.([]interface{})
+	if !ok {
+		return 0, fmt.Errorf("Vbucket map of bucket %v is of wrong type", bucketName)
+	}
+	if len(vbMap) == 0 {
+		return 0, fmt.Errorf("Vbucket map of bucket %v is empty", bucketName)
+	}
+	return len(vbMap), nil
+}
+
+// The latest value of a stat in the response of the stats range REST API, summed over the series returned, e.g. one per node
+// the response is of the form {"data":[{"metric":{...},"values":[[timestamp,"value"],...]},...],"errors":[...]}
+func GetLatestStatFromStatsRange(statName string, statsRange map[string]interface{}) (uint64, error) {
+	dataObj, ok := statsRange["data"]
+	if !ok {
+		return 0, fmt.Errorf("Error looking up data of stat %v", statName)
+	}
+	data, ok := dataObj.([]interface{})
+	if !ok {
+		return 0, fmt.Errorf("Data of stat %v is of wrong type", statName)
+	}
+	if len(data) == 0 {
+		return 0, fmt.Errorf("Stat %v has no data. errors=%v", statName, statsRange["errors"])
+	}
+
+	var sum uint64
+	for _, seriesObj := range data {
+		series, ok := seriesObj.(map[string]interface{})
+		if !ok {
+			return 0, fmt.Errorf("Series of stat %v is of wrong type", statName)
+		}
+		values, ok := series["values"].([]interface{})
+		if !ok || len(values) == 0 {
+			return 0, fmt.Errorf("Series %v of stat %v has no values", series["metric"], statName)
+		}
+		sample, ok := values[len(values)-1].([]interface{})
+		if !ok || len(sample) != 2 {
+			return 0, fmt.Errorf("Sample %v of stat %v is of wrong format", values[len(values)-1], statName)
+		}
+		valueStr, ok := sample[1].(string)
+		if !ok {
+			return 0, fmt.Errorf("Value %v of stat %v is of wrong type", sample[1], statName)
+		}
+		value, err := strconv.ParseFloat(valueStr, 64)
+		if err != nil {
+			return 0, fmt.Errorf("Error parsing value %v of stat %v. err=%v", valueStr, statName, err)
+		}
+		sum += uint64(value)
+	}
+	return sum, nil
+}
+
 // check if a cluster (with specified clusterCompatibility) is compatible with version
 func IsClusterCompatible(clusterCompatibility int, version []int) bool {
 	return clusterCompatibility >= EncodeVersionToEffectiveVersion(version)
@@ -310,3 +503,69 @@ func SearchUint8List(seqno_list []uint8, seqno uint8) (int, bool) {
 		return index, false
 	}
 }
+
+// Canonicalizes a JSON value, so that values that only differ by how they are serialized are the same: object keys
+// are sorted, whitespace is removed, numbers are written in their shortest form (1.0 becomes 1) and strings are
+// written with the same escapes
+func CanonicalizeJson(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	err := decoder.Decode(&value)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after the JSON value")
+	}
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	err = encoder.Encode(canonicalizeJsonNumbers(value))
+	if err != nil {
+		return nil, err
+	}
+	// the encoder ends each value with a newline
+	return bytes.TrimSuffix(buffer.Bytes(), []byte("\n")), nil
+}
+
+func canonicalizeJsonNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, elem := range v {
+			v[key] = canonicalizeJsonNumbers(elem)
+		}
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = canonicalizeJsonNumbers(elem)
+		}
+	case json.Number:
+		return canonicalJsonNumber(v)
+	}
+	return value
+}
+
+// integers are kept exact however large they are, whether they are written with a fraction or an exponent or not.
+// Other numbers are written in the shortest form that parses back to the same float64, and as integers when they
+// are whole
+func canonicalJsonNumber(number json.Number) json.Number {
+	if integer, ok := new(big.Int).SetString(string(number), 10); ok {
+		return json.Number(integer.String())
+	}
+	float, err := strconv.ParseFloat(string(number), 64)
+	if err != nil {
+		return number
+	}
+	if float == math.Trunc(float) {
+		if math.Abs(float) < 1<<53 {
+			return json.Number(strconv.FormatInt(int64(float), 10))
+		}
+		// past the precision of a float64, such as 1e20, which is bounded by the range of a float64
+		if rat, ok := new(big.Rat).SetString(string(number)); ok && rat.IsInt() {
+			return json.Number(rat.Num().String())
+		}
+		integer, _ := new(big.Float).SetFloat64(float).Int(nil)
+		return json.Number(integer.String())
+	}
+	return json.Number(strconv.FormatFloat(float, 'g', -1, 64))
+}
@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanonicalizeJson(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		canonical string
+	}{
+		{"sorted keys and no whitespace", `{ "b": 1, "a": [ 2, {"d": 3, "c": 4} ] }`, `{"a":[2,{"c":4,"d":3}],"b":1}`},
+		{"whole floats as integers", `[1.0, -2.50, 1e2, 0.0, -0.0]`, `[1,-2.5,100,0,0]`},
+		{"shortest floats", `[0.10, 1.5e-300, 1E-7, 3.14159265358979323846]`, `[0.1,1.5e-300,1e-07,3.141592653589793]`},
+		{"big integers are exact", `[12345678901234567890, -98765432109876543210123]`, `[12345678901234567890,-98765432109876543210123]`},
+		{"integers past float precision", `[9007199254740993, 9007199254740993.0, 90071992547409930e-1]`,
+			`[9007199254740993,9007199254740993,9007199254740993]`},
+		{"large whole floats", `[1e20, 1.0e25, -2E+21]`, `[100000000000000000000,10000000000000000000000000,-2000000000000000000000]`},
+		{"exponents up to the range of a float64", `[1.5e300]`, `[15` + strings.Repeat("0", 299) + `]`},
+		{"fractions past float precision", `[9007199254740993.5]`, `[9007199254740994]`},
+		{"out of the range of a float64", `[1e400]`, `[1e400]`},
+		{"strings with the same escapes", `["A<>&", "\/"]`, `["A<>&","/"]`},
+		{"trailing whitespace", "{\"a\":1}\n\t ", `{"a":1}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			canonical, err := CanonicalizeJson([]byte(test.data))
+			assert.Nil(t, err)
+			assert.Equal(t, test.canonical, string(canonical))
+		})
+	}
+
+	// numbers that are written differently but are the same are canonicalized the same
+	canonical1, err := CanonicalizeJson([]byte(`{"a":100,"b":0.5}`))
+	assert.Nil(t, err)
+	canonical2, err := CanonicalizeJson([]byte(`{"b":5e-1,"a":1.00e2}`))
+	assert.Nil(t, err)
+	assert.Equal(t, canonical1, canonical2)
+
+	for _, data := range []string{``, `{"a":`, `{"a":1}{"a":2}`, `[1]]`, `{"a":1} x`, "\x00\x01"} {
+		_, err := CanonicalizeJson([]byte(data))
+		assert.NotNil(t, err, data)
+	}
+}